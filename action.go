@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// --- Per-Request Expected Action ---
+// One plugin instance on a catch-all route may protect pages whose widgets
+// solve for different actions. A plugin running before this one names the
+// action(s) the request's token must have been solved for, either under
+// kong.ctx.shared.turnstile_expected_action (SharedExpectedActionKey), which
+// clients cannot reach, or, with expected_action_header set, in that request
+// header, e.g. written by request-transformer from the route. Several actions
+// are separated by commas.
+//
+// A client can send expected_action_header itself, so it is only trusted as
+// far as it narrows: with expected_actions configured, named actions outside
+// it are ignored with a warning, and when none remain expected_actions
+// applies. The header is removed before proxying. The actions of the request
+// are advertised in challenge requirements (see challenge.go).
+
+// SharedExpectedActionKey is where earlier plugins put the expected action.
+const SharedExpectedActionKey = "turnstile_expected_action"
+
+// readExpectedActions resolves the request's expected actions and removes
+// expected_action_header from the upstream request.
+func (r *requestState) readExpectedActions() {
+	settings := r.settings
+	override, source := "", ""
+	if shared, err := r.kong.Ctx.GetSharedString(SharedExpectedActionKey); err == nil && shared != "" {
+		override, source = shared, "kong.ctx.shared."+SharedExpectedActionKey
+	}
+	if header := settings.expectedActionHeader; header != "" {
+		if value, err := r.kong.Request.GetHeader(header); err == nil && value != "" && override == "" {
+			override, source = value, header
+		}
+		if err := r.kong.ServiceRequest.ClearHeader(header); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header, err))
+		}
+	}
+	r.actions = settings.expectedActions
+	if override == "" {
+		return
+	}
+
+	var actions []string
+	for _, action := range strings.Split(override, ",") {
+		action = strings.TrimSpace(action)
+		switch {
+		case action == "":
+		case len(settings.expectedActions) > 0 && !slices.Contains(settings.expectedActions, action):
+			r.log.Warn(fmt.Sprintf("Turnstile: ignoring action '%s' from %s, not in expected_actions", action, source))
+		default:
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) > 0 {
+		r.actions = actions
+	}
+}
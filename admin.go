@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// --- Admin Endpoint ---
+// An optional HTTP listener inside the plugin server for incident response.
+// It is configured for the whole process through the environment, since
+// plugin config is per instance:
+//
+//	TURNSTILE_ADMIN_LISTEN  address to listen on, e.g. 127.0.0.1:9180 (disabled when unset)
+//	TURNSTILE_ADMIN_TOKEN   bearer token every request must carry (required)
+//
+// Endpoints:
+//
+//	GET  /caches                                      statistics of every cache
+//	POST /caches/purge?cache=&token_hash=&ip=         purge entries; all parameters optional
+//	GET  /verify-pool                                 verification worker pool load, see verifypool.go
+//	GET  /probes                                      synthetic probe results, see probe.go
+//	GET  /route-modes, POST and DELETE                per-route mode overrides, see routemode.go
+//	GET  /emergency-bypass, POST and DELETE           time-boxed shadow mode for every route, see emergencybypass.go
+//	GET  /sinks                                       async sink queue fill and drops, see sinkqueue.go
+//	GET  /tenants                                     decisions and latency per tenant, see tenantmetrics.go
+//	GET  /support-bundle                              state for bug reports, see supportbundle.go
+//	GET  /version                                     version, build and capabilities, see version.go
+//	GET  /metrics                                     Prometheus metrics, see metrics.go
+const (
+	AdminListenEnv = "TURNSTILE_ADMIN_LISTEN"
+	AdminTokenEnv  = "TURNSTILE_ADMIN_TOKEN"
+)
+
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("/caches", handleCacheStats)
+	adminMux.HandleFunc("/caches/purge", handleCachePurge)
+}
+
+// startAdminServer starts the admin listener in the background if configured.
+func startAdminServer() {
+	addr := os.Getenv(AdminListenEnv)
+	if addr == "" {
+		return
+	}
+	token := os.Getenv(AdminTokenEnv)
+	if token == "" {
+		log.Printf("turnstile: %s is set but %s is empty, admin endpoint disabled", AdminListenEnv, AdminTokenEnv)
+		return
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           requireAdminToken(token, adminMux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			log.Printf("turnstile: admin endpoint on %s stopped: %v", addr, err)
+		}
+	}()
+}
+
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, allCacheStats())
+}
+
+// allCacheStats returns the statistics of every registered cache.
+func allCacheStats() map[string]cacheStats {
+	stats := make(map[string]cacheStats)
+	for _, name := range registeredCaches() {
+		if c, ok := lookupCache(name); ok {
+			stats[name] = c.Stats().withRatio()
+		}
+	}
+	return stats
+}
+
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	filter := cacheFilter{TokenHash: query.Get("token_hash"), IP: query.Get("ip")}
+
+	names := registeredCaches()
+	if name := query.Get("cache"); name != "" {
+		if _, ok := lookupCache(name); !ok {
+			writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "unknown cache " + name})
+			return
+		}
+		names = []string{name}
+	}
+
+	purged := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		c, _ := lookupCache(name)
+		if removed, ok := c.Purge(filter); ok {
+			purged[name] = removed
+		} else if filter.all() {
+			purged[name] = "not purgeable"
+		} else {
+			purged[name] = "filter not supported"
+		}
+	}
+	log.Printf("turnstile: admin purge (token_hash=%q ip=%q): %v", filter.TokenHash, filter.IP, purged)
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"purged": purged})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Analytics Export ---
+// With analytics_url set, every published decision is also sent to a bulk
+// HTTP ingestion endpoint for long-term abuse analytics: batches of NDJSON
+// records, gzip-compressed, with analytics_token as bearer token. A
+// ClickHouse URL such as
+//
+//	https://clickhouse:8443/?query=INSERT%20INTO%20turnstile_decisions%20FORMAT%20JSONEachRow
+//
+// ingests them directly. A record is the decision as published to
+// kong.ctx.shared (provider fields limited by exported_response_fields) plus
+// "time" and "ip_hash"; raw client addresses are not exported.
+//
+// Records are queued in memory, see sinkqueue.go. Batches the endpoint does
+// not accept, and records the queue discards under sink_overflow_policy,
+// are spilled to analytics_spill_dir (up to analyticsMaxSpillBytes) and
+// resent once the endpoint accepts batches again; without a spill
+// directory they are dropped. One exporter runs per URL and token.
+
+const (
+	analyticsQueueSize     = 10000
+	analyticsMaxSpillBytes = 256 * 1024 * 1024
+)
+
+// analyticsExporter batches records for one endpoint.
+type analyticsExporter struct {
+	url       string
+	token     string
+	client    *httpClient
+	batchSize int
+	interval  time.Duration
+	spillDir  string
+
+	queue *sinkQueue[[]byte] // Encoded records
+
+	spillMu      sync.Mutex
+	pendingSpill []byte // Records that did not fit the queue, written out by the loop
+
+	sent    atomic.Int64
+	spilled atomic.Int64
+	dropped atomic.Int64
+}
+
+// analyticsStats is reported per endpoint in support bundles.
+type analyticsStats struct {
+	Queued  int   `json:"queued"`
+	Sent    int64 `json:"sent"`
+	Spilled int64 `json:"spilled"`
+	Dropped int64 `json:"dropped"`
+}
+
+// analyticsExporters holds one exporter per endpoint URL and token.
+var analyticsExporters sync.Map // map[string]*analyticsExporter
+
+func compileAnalytics(conf *Config, clients map[string]*httpClient) (*analyticsExporter, error) {
+	client, err := resolveHTTPClient(clients, "analytics_http_client", conf.AnalyticsHTTPClient,
+		defaultHTTPClient("analytics", 30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	e := &analyticsExporter{
+		url:       conf.AnalyticsURL,
+		token:     conf.AnalyticsToken,
+		client:    client,
+		batchSize: DefaultAnalyticsBatch,
+		interval:  time.Duration(DefaultAnalyticsFlushSec) * time.Second,
+		spillDir:  conf.AnalyticsSpillDir,
+	}
+	e.queue = newSinkQueue("analytics:"+e.url, analyticsQueueSize, e.spillOverflow)
+	if conf.AnalyticsBatchSize > 0 {
+		e.batchSize = conf.AnalyticsBatchSize
+	}
+	if conf.AnalyticsFlushSeconds > 0 {
+		e.interval = time.Duration(conf.AnalyticsFlushSeconds) * time.Second
+	}
+	if e.spillDir != "" {
+		if err := os.MkdirAll(e.spillDir, 0o700); err != nil {
+			return nil, fmt.Errorf("analytics_spill_dir: %v", err)
+		}
+	}
+	actual, loaded := analyticsExporters.LoadOrStore(e.url+"\x00"+e.token, e)
+	if !loaded {
+		e.queue.register()
+		go e.loop()
+	}
+	return actual.(*analyticsExporter), nil
+}
+
+// exportDecision queues the published decision value for analytics.
+func (r *requestState) exportDecision(value map[string]interface{}) {
+	e := r.settings.analytics
+	if e == nil {
+		return
+	}
+	record := make(map[string]interface{}, len(value)+2)
+	for k, v := range value {
+		record[k] = v
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	if ip := r.clientIP(); ip != "" {
+		record["ip_hash"] = hashIP(ip)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	e.queue.put(append(line, '\n'), r.settings.sinkOverflow)
+}
+
+// spillOverflow keeps a record discarded by the queue for the spill
+// directory, which the loop writes to on its next flush.
+func (e *analyticsExporter) spillOverflow(line []byte) bool {
+	if e.spillDir == "" {
+		return false
+	}
+	e.spillMu.Lock()
+	e.pendingSpill = append(e.pendingSpill, line...)
+	e.spillMu.Unlock()
+	e.spilled.Add(1)
+	return true
+}
+
+func (e *analyticsExporter) loop() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var batch bytes.Buffer
+	records := 0
+	flush := func() {
+		if records > 0 {
+			if err := e.send(batch.Bytes()); err != nil {
+				log.Printf("turnstile: analytics export to %s failed: %v", e.url, err)
+				e.spill(batch.Bytes(), records)
+			} else {
+				e.sent.Add(int64(records))
+				e.resendSpilled()
+			}
+			batch.Reset()
+			records = 0
+		} else {
+			e.resendSpilled() // Catch up while idle
+		}
+		e.spillMu.Lock()
+		overflow := e.pendingSpill
+		e.pendingSpill = nil
+		e.spillMu.Unlock()
+		if len(overflow) > 0 {
+			e.writeSpill(overflow)
+		}
+	}
+	for {
+		select {
+		case line := <-e.queue.items:
+			batch.Write(line)
+			records++
+			if records >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send posts one batch of NDJSON records.
+func (e *analyticsExporter) send(ndjson []byte) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	_, _ = zw.Write(ndjson)
+	_ = zw.Close()
+	resp, err := e.client.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Content-Encoding", "gzip")
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, snippet)
+	}
+	return nil
+}
+
+// spill keeps a rejected batch for later, or drops it without a spill directory.
+func (e *analyticsExporter) spill(ndjson []byte, records int) {
+	if e.spillDir == "" {
+		e.dropped.Add(int64(records))
+		return
+	}
+	e.spilled.Add(int64(records))
+	e.writeSpill(ndjson)
+}
+
+// writeSpill stores records in a new spill file, unless the directory is full.
+func (e *analyticsExporter) writeSpill(ndjson []byte) {
+	_, size := e.spillFiles()
+	if size+int64(len(ndjson)) > analyticsMaxSpillBytes {
+		e.dropped.Add(int64(bytes.Count(ndjson, []byte("\n"))))
+		log.Printf("turnstile: analytics spill directory %s full, dropping records", e.spillDir)
+		return
+	}
+	name := filepath.Join(e.spillDir, fmt.Sprintf("batch-%d.ndjson", time.Now().UnixNano()))
+	if err := os.WriteFile(name, ndjson, 0o600); err != nil {
+		e.dropped.Add(int64(bytes.Count(ndjson, []byte("\n"))))
+		log.Printf("turnstile: could not spill analytics records: %v", err)
+	}
+}
+
+// spillFiles returns the spill files, oldest first, and their total size.
+func (e *analyticsExporter) spillFiles() ([]string, int64) {
+	matches, _ := filepath.Glob(filepath.Join(e.spillDir, "batch-*.ndjson"))
+	sort.Strings(matches) // Names carry fixed-width nanosecond timestamps
+	var size int64
+	for _, name := range matches {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return matches, size
+}
+
+// resendSpilled sends the oldest spill file, removing it once accepted.
+func (e *analyticsExporter) resendSpilled() {
+	if e.spillDir == "" {
+		return
+	}
+	files, _ := e.spillFiles()
+	if len(files) == 0 {
+		return
+	}
+	ndjson, err := os.ReadFile(files[0])
+	if err != nil {
+		return
+	}
+	if err := e.send(ndjson); err != nil {
+		return // Kept for the next successful flush
+	}
+	e.sent.Add(int64(bytes.Count(ndjson, []byte("\n"))))
+	_ = os.Remove(files[0])
+}
+
+func (e *analyticsExporter) stats() analyticsStats {
+	return analyticsStats{Queued: len(e.queue.items), Sent: e.sent.Load(), Spilled: e.spilled.Load(), Dropped: e.dropped.Load() + e.queue.dropped.Load()}
+}
+
+// allAnalyticsStats returns the statistics of every exporter by URL.
+func allAnalyticsStats() map[string]analyticsStats {
+	stats := make(map[string]analyticsStats)
+	analyticsExporters.Range(func(_, v interface{}) bool {
+		e := v.(*analyticsExporter)
+		stats[e.url] = e.stats()
+		return true
+	})
+	return stats
+}
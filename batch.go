@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --- Batch Verification ---
+
+// verifyBatch handles batch_mode 'per_item': the request body is a JSON array
+// and every item carries its own token under batch_token_field. The request
+// is only let through when every item's token verifies. Each item counts
+// against attempt_limit like a request of its own.
+func (r *requestState) verifyBatch(clientIP string) {
+	settings := r.settings
+	rawBody, release, err := readBody(r.kong.Request, settings.maxBodyBytes, settings.maxBufferedBody)
+	if r.rejectBodyError(err) {
+		return
+	}
+	if err != nil {
+		r.log.Err(fmt.Sprintf("Error reading batch request body: %v", err))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Could not read request body")
+		return
+	}
+	defer release()
+
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(rawBody, &items); err != nil {
+		r.log.Warn(fmt.Sprintf("Batch request body is not a JSON array of objects: %v", err))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Turnstile token missing")
+		return
+	}
+	if len(items) == 0 {
+		r.log.Warn("Batch request body is empty")
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Turnstile token missing")
+		return
+	}
+	if len(items) > settings.batchMaxItems {
+		r.log.Warn(fmt.Sprintf("Batch of %d items exceeds batch_max_items (%d)", len(items), settings.batchMaxItems))
+		r.reject(decision{status: http.StatusRequestEntityTooLarge, reason: ReasonBatchTooLarge}, "Too many items in batch")
+		return
+	}
+
+	tokens := make([]string, len(items))
+	for i, item := range items {
+		var token string
+		if raw, ok := item[settings.batchTokenField]; ok {
+			_ = json.Unmarshal(raw, &token) // Non-string values are treated as missing
+		}
+		if token == "" {
+			r.log.Warn(fmt.Sprintf("Turnstile token not found in batch item %d field '%s'", i, settings.batchTokenField))
+			r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Turnstile token missing")
+			return
+		}
+		if problem := r.malformedToken(settings.providers[0], token); problem != "" {
+			r.log.Warn(fmt.Sprintf("Turnstile token of batch item %d malformed: %s", i, problem))
+			r.reject(decision{status: http.StatusBadRequest, reason: ReasonMalformedToken, provider: settings.providers[0]}, "Turnstile token malformed")
+			return
+		}
+		tokens[i] = token
+	}
+
+	v := &verification{provider: settings.providers[0]}
+	if !r.transportStage(v) {
+		return
+	}
+	// Every item is an attempt, taken before any is verified
+	for range tokens {
+		if !r.attemptLimitStage(v) {
+			return
+		}
+	}
+
+	r.log.Info(fmt.Sprintf("Verifying %d batch tokens for IP: %s", len(tokens), clientIP))
+
+	// Items are queued at once and verified concurrently by the worker pool
+	p := settings.providers[0]
+	pending := make([]<-chan verifyResult, len(tokens))
+	spans := make([]*verifySpan, len(tokens))
+	for i, token := range tokens {
+		spans[i] = r.newVerifySpan()
+		pending[i] = verifyWorkers.startTraced(settings, p, token, clientIP, spans[i])
+	}
+	responses := make([]*VerificationResult, len(tokens))
+	errs := make([]*verifyError, len(tokens))
+	for i, result := range pending {
+		res := <-result
+		responses[i], errs[i] = res.resp, res.err
+		r.endVerifySpan(spans[i], p, tokens[i], res.resp, res.err)
+	}
+
+	for i := range tokens {
+		if errs[i] != nil && errs[i].retryAfter > 0 {
+			r.rateLimited(p, errs[i])
+			return
+		}
+		if errs[i] != nil {
+			r.providerFailed(p, errs[i], fmt.Sprintf("Batch item %d: %s", i, errs[i].msg))
+			return
+		}
+	}
+	for i, resp := range responses {
+		if !resp.Success {
+			p.stats.Rejected.Add(1)
+			r.log.Warn(fmt.Sprintf("Turnstile verification failed for batch item %d. Error codes: [%s]", i, r.exportedField("error_codes", strings.Join(resp.ErrorCodes, ", "))))
+			r.reject(decision{status: http.StatusForbidden, reason: providerRejection(resp), provider: p, response: resp}, "Verification failed")
+			return
+		}
+	}
+	for i, resp := range responses {
+		if !r.checkTokenAge(p, resp, fmt.Sprintf("token of batch item %d", i)) {
+			return
+		}
+	}
+	for i, resp := range responses {
+		if !r.checkScore(p, resp) || !r.checkExpectedFields(p, resp, fmt.Sprintf("token of batch item %d", i)) {
+			return
+		}
+	}
+	p.stats.Verified.Add(int64(len(responses)))
+	r.publish(decision{allowed: true, reason: ReasonVerified, provider: p})
+	r.log.Info(fmt.Sprintf("Turnstile verification successful for all %d batch items!", len(responses)))
+}
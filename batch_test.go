@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+func TestBatchItemsCountAsAttempts(t *testing.T) {
+	localBuckets.Purge(cacheFilter{})
+	t.Cleanup(func() { localBuckets.Purge(cacheFilter{}) })
+	srv := turnstiletest.NewServer(t)
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.BatchMode = "per_item"
+	conf.AttemptLimit = 3
+
+	env := turnstiletest.RunAccess(t, conf, test.Request{
+		Method:  "POST",
+		Url:     "http://example.com/batch",
+		Headers: http.Header{"Content-Type": {"application/json"}},
+		Body:    []byte(`[{"cf-turnstile-response":"a"},{"cf-turnstile-response":"b"},{"cf-turnstile-response":"c"},{"cf-turnstile-response":"d"}]`),
+	})
+
+	if env.ClientRes.Status != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d (body %q)", env.ClientRes.Status, http.StatusTooManyRequests, env.ClientRes.Body)
+	}
+	if got := decisionReason(t, env); got != string(ReasonAttemptLimited) {
+		t.Errorf("reason = %q, want %q", got, ReasonAttemptLimited)
+	}
+	if calls := len(srv.Calls()); calls != 0 {
+		t.Errorf("%d siteverify calls, want none", calls)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Request Bodies ---
+// Kong only reads the request body when a plugin asks for it, and nginx only
+// answers "Expect: 100-continue" at that point. Header-based extraction never
+// touches the body, so such clients are rejected before uploading anything.
+// When a body is needed, its declared size is checked against max_body_bytes
+// first, so oversized uploads are refused before a single body byte is sent.
+//
+// Every body read is also charged against max_buffered_body_bytes, shared by
+// all in-flight requests of the plugin server, until its token was extracted.
+// A flood of large bodies to protected routes is shed with 503 once the cap is
+// reached rather than growing the plugin server's heap without bound.
+
+// bufferedBodyBytes is the number of body bytes currently charged.
+var bufferedBodyBytes atomic.Int64
+
+// bodyTooLargeError means the declared body size exceeds max_body_bytes.
+type bodyTooLargeError struct {
+	size, limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body of %d bytes exceeds max_body_bytes (%d)", e.size, e.limit)
+}
+
+// bodyStreamedError means a body without declared length (chunked or
+// streamed) could not be buffered within max_body_bytes, either because it
+// was longer or because nginx had already spilled it to disk.
+type bodyStreamedError struct {
+	limit int64
+	err   error // Read error, nil when the body was merely too long
+}
+
+func (e *bodyStreamedError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("streamed request body could not be buffered: %v", e.err)
+	}
+	return fmt.Sprintf("streamed request body exceeds max_body_bytes (%d)", e.limit)
+}
+
+// bodyBufferFullError means buffering the body would exceed max_buffered_body_bytes.
+type bodyBufferFullError struct {
+	size, limit int64
+}
+
+func (e *bodyBufferFullError) Error() string {
+	return fmt.Sprintf("buffering %d more body bytes would exceed max_buffered_body_bytes (%d)", e.size, e.limit)
+}
+
+// reserveBodyBytes charges n bytes against maxBuffered.
+func reserveBodyBytes(n, maxBuffered int64) bool {
+	if bufferedBodyBytes.Add(n) > maxBuffered {
+		bufferedBodyBytes.Add(-n)
+		return false
+	}
+	return true
+}
+
+// readBody returns the request body after checking its declared size and
+// charging it against maxBuffered. The caller runs release once it no
+// longer needs the body; release is nil when an error is returned.
+func readBody(req requestSource, limit, maxBuffered int64) (body []byte, release func(), err error) {
+	// Chunked bodies declare no length up front and are charged the limit
+	reserved, streamed := limit, true
+	if length, err := req.GetHeader("Content-Length"); err == nil && length != "" {
+		size, err := strconv.ParseInt(strings.TrimSpace(length), 10, 64)
+		if err == nil && size > limit {
+			return nil, nil, &bodyTooLargeError{size, limit}
+		}
+		if err == nil {
+			reserved, streamed = size, false
+		}
+	}
+	if !reserveBodyBytes(reserved, maxBuffered) {
+		return nil, nil, &bodyBufferFullError{reserved, maxBuffered}
+	}
+	release = func() { bufferedBodyBytes.Add(-reserved) }
+
+	body, err = req.GetRawBody()
+	if err != nil {
+		release()
+		if streamed {
+			return nil, nil, &bodyStreamedError{limit, err}
+		}
+		return nil, nil, err
+	}
+	if int64(len(body)) > limit {
+		release()
+		if streamed {
+			return nil, nil, &bodyStreamedError{limit, nil}
+		}
+		return nil, nil, &bodyTooLargeError{int64(len(body)), limit}
+	}
+	return body, release, nil
+}
+
+// rejectBodyError answers the client when err is a size-related body error
+// and reports whether it did. Other errors are left to the caller.
+func (r *requestState) rejectBodyError(err error) bool {
+	switch err := err.(type) {
+	case *bodyTooLargeError:
+		r.log.Warn(fmt.Sprintf("Rejecting request before reading its body: %v", err))
+		r.reject(decision{status: http.StatusRequestEntityTooLarge, reason: ReasonBodyTooLarge}, "Request body too large")
+		return true
+	case *bodyStreamedError:
+		r.log.Warn(fmt.Sprintf("Rejecting request: %v", err))
+		r.reject(decision{status: http.StatusRequestEntityTooLarge, reason: ReasonBodyTooLarge}, "Request body too large")
+		return true
+	case *bodyBufferFullError:
+		r.log.Warn(fmt.Sprintf("Shedding request before reading its body: %v", err))
+		r.exit(decision{status: http.StatusServiceUnavailable, reason: ReasonOverloaded}, []byte("Service temporarily overloaded"),
+			map[string][]string{"Retry-After": {"1"}})
+		return true
+	}
+	return false
+}
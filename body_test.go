@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+// fakeRequest is a requestSource without a Kong connection.
+type fakeRequest struct {
+	headers map[string]string
+	query   string // Raw query string
+	body    []byte
+	bodyErr error
+}
+
+func (f *fakeRequest) GetHeader(k string) (string, error) { return f.headers[k], nil }
+func (f *fakeRequest) GetRawQuery() (string, error)       { return f.query, nil }
+func (f *fakeRequest) GetRawBody() ([]byte, error)        { return f.body, f.bodyErr }
+
+// decisionReason returns the reason of the decision published for env's request.
+func decisionReason(t *testing.T, env *test.TestEnv) string {
+	t.Helper()
+	d, ok := env.Ctx.Store[SharedDecisionKey].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no decision published, ctx.shared holds %v", env.Ctx.Store)
+	}
+	reason, _ := d["reason"].(string)
+	return reason
+}
+
+func TestReadBody(t *testing.T) {
+	spilled := errors.New("request body is buffered to a temporary file")
+	tests := []struct {
+		name    string
+		req     *fakeRequest
+		wantErr interface{}
+	}{
+		{"declared length within limit", &fakeRequest{headers: map[string]string{"Content-Length": "5"}, body: []byte("a=b&c")}, nil},
+		{"declared length over limit", &fakeRequest{headers: map[string]string{"Content-Length": "100"}}, &bodyTooLargeError{}},
+		{"chunked within limit", &fakeRequest{body: []byte("a=b")}, nil},
+		{"chunked over limit", &fakeRequest{body: []byte(strings.Repeat("x", 17))}, &bodyStreamedError{}},
+		{"chunked spilled to disk", &fakeRequest{bodyErr: spilled}, &bodyStreamedError{}},
+		{"declared length read error", &fakeRequest{headers: map[string]string{"Content-Length": "5"}, bodyErr: spilled}, spilled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, release, err := readBody(tt.req, 16, 1<<20)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("readBody() error = %v", err)
+				}
+				release()
+			case *bodyTooLargeError:
+				if _, ok := err.(*bodyTooLargeError); !ok {
+					t.Fatalf("readBody() error = %T %v, want *bodyTooLargeError", err, err)
+				}
+			case *bodyStreamedError:
+				if _, ok := err.(*bodyStreamedError); !ok {
+					t.Fatalf("readBody() error = %T %v, want *bodyStreamedError", err, err)
+				}
+			case error:
+				if err != want {
+					t.Fatalf("readBody() error = %v, want %v", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBodyReleasesReservationOnError(t *testing.T) {
+	req := &fakeRequest{body: []byte(strings.Repeat("x", 17))}
+	for i := 0; i < 3; i++ {
+		// A leaked reservation of 16 bytes would exhaust the 32 byte buffer cap
+		if _, _, err := readBody(req, 16, 32); err == nil {
+			t.Fatal("readBody() accepted a body over the limit")
+		} else if _, ok := err.(*bodyBufferFullError); ok {
+			t.Fatalf("attempt %d: reservation leaked: %v", i, err)
+		}
+	}
+}
+
+func TestWithoutBodySteps(t *testing.T) {
+	steps := []extractionStep{{location: "form", name: "a"}, {location: "header", name: "b"}, {location: "query", name: "c"}}
+	kept := withoutBodySteps(steps)
+	if len(kept) != 2 || kept[0].name != "b" || kept[1].name != "c" {
+		t.Errorf("withoutBodySteps() = %+v, want the header and query steps", kept)
+	}
+}
+
+func TestStreamedBodyPolicy(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+
+	tests := []struct {
+		policy       string
+		headerToken  string
+		wantRejected bool
+		wantStatus   int
+		wantReason   Reason
+	}{
+		{policy: "", wantRejected: true, wantStatus: http.StatusRequestEntityTooLarge, wantReason: ReasonBodyTooLarge},
+		{policy: "reject", wantRejected: true, wantStatus: http.StatusRequestEntityTooLarge, wantReason: ReasonBodyTooLarge},
+		{policy: "header", headerToken: "token", wantReason: ReasonVerified},
+		{policy: "header", wantRejected: true, wantStatus: http.StatusBadRequest, wantReason: ReasonMissingToken},
+		{policy: "skip", wantReason: ReasonStreamedBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.headerToken, func(t *testing.T) {
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			conf.MaxBodyBytes = 16
+			conf.StreamedBodyPolicy = tt.policy
+			conf.Extraction = &ExtractionConfig{Location: "form", Name: "cf-turnstile-response",
+				Fallbacks: []ExtractionStep{{Location: "header", Name: DefaultTokenHeader}}}
+
+			headers := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}} // No Content-Length: chunked
+			if tt.headerToken != "" {
+				headers.Set(DefaultTokenHeader, tt.headerToken)
+			}
+			env := turnstiletest.RunAccess(t, conf, test.Request{
+				Method:  "POST",
+				Url:     "http://example.com/upload",
+				Headers: headers,
+				Body:    []byte("file=" + strings.Repeat("x", 64)),
+			})
+
+			if got := turnstiletest.Rejected(env); got != tt.wantRejected {
+				t.Fatalf("rejected = %v, want %v (status %d)", got, tt.wantRejected, env.ClientRes.Status)
+			}
+			if tt.wantRejected && env.ClientRes.Status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", env.ClientRes.Status, tt.wantStatus)
+			}
+			if got := decisionReason(t, env); got != string(tt.wantReason) {
+				t.Errorf("reason = %q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
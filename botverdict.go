@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --- Bot Verdicts ---
+// A bot-detection plugin running before this one (Kong's bot-detection only
+// blocks, so typically a custom plugin or a pre-function wrapping it) can
+// hand its verdict on the request over in
+// kong.ctx.shared.turnstile_bot_verdict (SharedBotVerdictKey), a short
+// string such as "bot", "suspicious" or "human". bot_verdict_policies decides
+// what each verdict means here:
+//
+//	block      refuse the request with 403, reason bot_detected
+//	challenge  require a token verified for this request: flow tokens,
+//	           passes, receipts, session cookies, conditional request
+//	           relaxation, good IP reputation and cached verifications do not
+//	           let it through
+//	relax      let the request through without a token, reason
+//	           bypass_allowlist, except while the threat level is elevated
+//	verify     the usual handling
+//
+// Verdicts are compared lowercased. A request without a verdict, or with one
+// the policies do not name, is handled as usual. Clients cannot set the
+// shared context, so the verdict is trusted as given.
+
+// SharedBotVerdictKey is where earlier plugins put their bot verdict.
+const SharedBotVerdictKey = "turnstile_bot_verdict"
+
+// compileBotVerdictPolicies validates bot_verdict_policies, lowercasing
+// verdicts and actions.
+func compileBotVerdictPolicies(policies map[string]string) (map[string]string, error) {
+	compiled := make(map[string]string, len(policies))
+	for verdict, action := range policies {
+		action = strings.ToLower(action)
+		switch action {
+		case "block", "challenge", "relax", "verify":
+		default:
+			return nil, fmt.Errorf("invalid bot_verdict_policies.%s configured: '%s'. Use 'block', 'challenge', 'relax' or 'verify'", verdict, action)
+		}
+		compiled[strings.ToLower(verdict)] = action
+	}
+	return compiled, nil
+}
+
+// botVerdictStage applies bot_verdict_policies to the verdict of an earlier
+// plugin.
+func (r *requestState) botVerdictStage(*verification) bool {
+	if len(r.settings.botVerdictPolicies) == 0 {
+		return true
+	}
+	verdict, err := r.kong.Ctx.GetSharedString(SharedBotVerdictKey)
+	if err != nil || verdict == "" {
+		return true
+	}
+	verdict = strings.ToLower(verdict)
+	switch r.settings.botVerdictPolicies[verdict] {
+	case "block":
+		r.log.Warn(fmt.Sprintf("Turnstile: refusing request with bot verdict '%s'", verdict))
+		r.reject(decision{status: http.StatusForbidden, reason: ReasonBotDetected}, "Forbidden")
+		return false
+	case "challenge":
+		r.log.Info(fmt.Sprintf("Turnstile: bot verdict '%s' requires a freshly verified token", verdict))
+		r.forceChallenge = true
+	case "relax":
+		if r.threatElevated() {
+			r.log.Info(fmt.Sprintf("Turnstile: ignoring bot verdict '%s' under elevated threat level", verdict))
+			return true
+		}
+		r.log.Debug(fmt.Sprintf("Turnstile: request with bot verdict '%s' passed without verification", verdict))
+		r.spotCheck(SpotCheckBotVerdict)
+		r.publish(decision{allowed: true, reason: ReasonBypassAllowlist})
+		return false
+	}
+	return true
+}
+
+// challengeSkipped are the bypass stages a 'challenge' verdict skips.
+var challengeSkipped = map[string]bool{
+	"conditional_request": true,
+	"flow_token":          true,
+	"pass":                true,
+	"receipt":             true,
+	"session":             true,
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Circuit Breaker ---
+// Retries (see HTTPClientConfig) ride out a single blip; during an outage
+// they only multiply the calls to a failing endpoint. With
+// circuit_breaker_failures set, that many consecutive siteverify calls to one
+// verification URL without a usable answer (connection errors, timeouts,
+// non-200 answers other than 429, garbage) open the breaker: for
+// circuit_breaker_cooldown_seconds calls to that URL are not sent, and
+// requests needing one fail straight away under failure_mode, 'closed' with
+// 502 or 'open' with fail-open cause breaker_open. The first call after the
+// cool-down goes through; one more failure opens the breaker again, a usable
+// answer closes it. Answers rejecting a token are usable answers; 429s are
+// handled by the hold-back in ratelimit.go instead. Like hold-backs, breaker
+// state is kept per plugin server and shared by every route using the URL.
+
+const DefaultBreakerCooldownSeconds = 30
+
+// breakerState is the state of one verification URL's breaker.
+type breakerState struct {
+	failures  atomic.Int64 // Consecutive calls without a usable answer
+	openUntil atomic.Int64 // Unix nanoseconds
+}
+
+// breakers holds the breaker state by verification URL.
+var breakers sync.Map // map[string]*breakerState
+
+func breakerFor(verifyURL string) *breakerState {
+	state, _ := breakers.LoadOrStore(verifyURL, new(breakerState))
+	return state.(*breakerState)
+}
+
+// breakerRemaining returns how long calls to p are still short-circuited.
+func breakerRemaining(settings *compiledConfig, p *provider, now time.Time) time.Duration {
+	if settings.breakerFailures == 0 {
+		return 0
+	}
+	return time.Duration(breakerFor(p.verifyURL).openUntil.Load() - now.UnixNano())
+}
+
+func breakerOpenError(p *provider, wait time.Duration) *verifyError {
+	return &verifyError{status: http.StatusBadGateway, body: "Turnstile verification temporarily unavailable", breakerOpen: true,
+		msg: fmt.Sprintf("%s API circuit breaker open, calls short-circuited for another %s", p.name, wait.Round(time.Millisecond))}
+}
+
+// recordBreaker counts the outcome of a call to p and opens its breaker
+// after circuit_breaker_failures consecutive failures.
+func recordBreaker(settings *compiledConfig, p *provider, verr *verifyError) {
+	if settings.breakerFailures == 0 {
+		return
+	}
+	state := breakerFor(p.verifyURL)
+	switch {
+	case verr == nil:
+		state.failures.Store(0)
+		return
+	case verr.retryAfter > 0:
+		return // Rate limited, see ratelimit.go
+	}
+	p.stats.BreakerFailures.Add(1)
+	if failures := state.failures.Add(1); failures >= int64(settings.breakerFailures) {
+		state.openUntil.Store(clock.Now().Add(settings.breakerCooldown).UnixNano())
+		log.Printf("turnstile: circuit breaker for %s opened after %d consecutive failures, calls short-circuited for %s",
+			p.verifyURL, failures, settings.breakerCooldown)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	t.Cleanup(setClock(turnstiletest.NewClock(clockStart)))
+	settings := &compiledConfig{breakerFailures: 2, breakerCooldown: 30 * time.Second}
+	p := &provider{name: "turnstile", verifyURL: "https://breaker.invalid/" + t.Name(), stats: &providerStats{}}
+	failure := &verifyError{status: http.StatusBadGateway}
+
+	recordBreaker(settings, p, failure)
+	recordBreaker(settings, p, nil) // A usable answer resets the count
+	recordBreaker(settings, p, failure)
+	recordBreaker(settings, p, &verifyError{retryAfter: time.Second}) // 429s do not count
+	if wait := breakerRemaining(settings, p, clockStart); wait > 0 {
+		t.Fatalf("breaker open for %s after non-consecutive failures", wait)
+	}
+
+	recordBreaker(settings, p, failure)
+	if wait := breakerRemaining(settings, p, clockStart); wait != 30*time.Second {
+		t.Errorf("breaker open for %s, want 30s", wait)
+	}
+	if wait := breakerRemaining(settings, p, clockStart.Add(30*time.Second)); wait > 0 {
+		t.Errorf("breaker still open for %s after the cool-down", wait)
+	}
+	if wait := breakerRemaining(&compiledConfig{}, p, clockStart); wait != 0 {
+		t.Errorf("breaker open for %s with circuit_breaker_failures 0", wait)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Token Buckets ---
+// Features that limit how often something may happen (attempt limits,
+// verify quotas, penalty bans and the Cloudflare list feedback, see
+// limits.go and cflist.go) share one token bucket subsystem instead of
+// counting on their own. A bucket is keyed by feature and identifier (a
+// client IP, a provider account) and holds up to limit tokens, refilled
+// continuously at limit per window; every event takes one. A block keeps an
+// identifier out for a fixed time, e.g. an IP banned after draining its
+// failure bucket.
+//
+// rate_limit_strategy decides where buckets and blocks live:
+//
+//	local   in the plugin server's memory (default); limits apply per plugin server
+//	redis   in rate_limit_redis, shared by every plugin server using it:
+//	          turnstile:bucket:<feature>|<id>   hash of tokens and last update, updated by a script
+//	          turnstile:block:<feature>|<id>    set with the block's expiry
+//
+// Buckets expire once they would be full again, blocks when they end: local
+// buckets are dropped as they fill up, local blocks swept every
+// bucketSweepInterval, Redis keys carry a TTL. At most maxLocalBuckets local
+// buckets are tracked; a further identifier replaces the bucket closest to
+// full, which forgets the fewest events. When Redis fails to answer within
+// bucketRedisTimeout, the request falls back to the local buckets, and so do
+// all requests for bucketStoreBackoff after, but for one trying Redis again
+// per bucketStoreBackoff, so an outage costs no dial per request. The
+// failure is logged once until Redis answers again. Limits are
+// process-wide per key, so plugin instances configuring the same feature
+// share an IP's bucket, each taking with its own limit.
+// Local buckets appear as cache 'rate_limit_buckets' of the admin endpoint,
+// where purging an IP lifts its local blocks.
+
+const (
+	maxLocalBuckets     = 100000 // Bounds memory under a distributed attack
+	bucketSweepInterval = time.Minute
+	bucketRedisTimeout  = 100 * time.Millisecond // Bounds the wait of one request on Redis
+	bucketStoreBackoff  = 5 * time.Second        // Local buckets only, after the store failed
+)
+
+// bucketLimit allows limit events per window, with bursts of up to limit.
+// The zero value disables a feature.
+type bucketLimit struct {
+	limit  int
+	window time.Duration
+}
+
+func (l bucketLimit) enabled() bool { return l.limit > 0 && l.window > 0 }
+
+// refill returns the tokens added over d.
+func (l bucketLimit) refill(d time.Duration) float64 {
+	return float64(l.limit) * float64(max(d, 0)) / float64(l.window)
+}
+
+// until returns how long the bucket takes to refill the given tokens.
+func (l bucketLimit) until(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens * float64(l.window) / float64(l.limit)))
+}
+
+// bucketTake is the outcome of taking a token.
+type bucketTake struct {
+	wait      time.Duration // Zero when a token was taken, else until one is available
+	remaining int           // Whole tokens left
+}
+
+func (t bucketTake) allowed() bool { return t.wait == 0 }
+
+// exhausted reports whether this event took the last token or found none.
+func (t bucketTake) exhausted() bool { return t.wait > 0 || t.remaining == 0 }
+
+// bucketStore keeps buckets and blocks; see rate_limit_strategy.
+type bucketStore interface {
+	take(key string, limit bucketLimit, now time.Time) (bucketTake, error)
+	block(key string, d time.Duration, now time.Time) error
+	blockedFor(key string, now time.Time) (time.Duration, error)
+}
+
+// --- Local Strategy ---
+
+// tokenBucket is one local bucket.
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket is full again and can be dropped
+	index   int       // Position in memoryBuckets.byFull
+}
+
+// bucketHeap orders buckets by when they are full again, the soonest first.
+type bucketHeap []*tokenBucket
+
+func (h bucketHeap) Len() int           { return len(h) }
+func (h bucketHeap) Less(i, j int) bool { return h[i].full.Before(h[j].full) }
+
+func (h bucketHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *bucketHeap) Push(x any) {
+	b := x.(*tokenBucket)
+	b.index = len(*h)
+	*h = append(*h, b)
+}
+
+func (h *bucketHeap) Pop() any {
+	old := *h
+	b := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return b
+}
+
+// memoryBuckets is the local strategy.
+type memoryBuckets struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	byFull    bucketHeap
+	blocks    map[string]time.Time // Keyed like buckets, holding the end of the block
+	swept     time.Time
+	evictions int64
+}
+
+// localBuckets are the buckets of the plugin server.
+var localBuckets = newMemoryBuckets()
+
+func newMemoryBuckets() *memoryBuckets {
+	m := &memoryBuckets{buckets: make(map[string]*tokenBucket), blocks: make(map[string]time.Time)}
+	registerCache("rate_limit_buckets", m)
+	return m
+}
+
+func (m *memoryBuckets) take(key string, limit bucketLimit, now time.Time) (bucketTake, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxLocalBuckets {
+			m.remove(m.byFull[0]) // The bucket closest to full
+			m.evictions++
+		}
+		b = &tokenBucket{key: key, tokens: float64(limit.limit), updated: now, full: now}
+		m.buckets[key] = b
+		heap.Push(&m.byFull, b)
+	}
+	b.tokens = min(float64(limit.limit), b.tokens+limit.refill(now.Sub(b.updated)))
+	b.updated = now
+	var take bucketTake
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		take.wait = limit.until(1 - b.tokens)
+	}
+	take.remaining = int(b.tokens)
+	b.full = now.Add(limit.until(float64(limit.limit) - b.tokens))
+	heap.Fix(&m.byFull, b.index)
+	return take, nil
+}
+
+// remove drops bucket b; callers hold m.mu.
+func (m *memoryBuckets) remove(b *tokenBucket) {
+	delete(m.buckets, b.key)
+	heap.Remove(&m.byFull, b.index)
+}
+
+func (m *memoryBuckets) block(key string, d time.Duration, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocks[key] = now.Add(d)
+	return nil
+}
+
+func (m *memoryBuckets) blockedFor(key string, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return max(m.blocks[key].Sub(now), 0), nil
+}
+
+// sweep drops full buckets, and ended blocks at most every
+// bucketSweepInterval. Callers hold m.mu.
+func (m *memoryBuckets) sweep(now time.Time) {
+	for len(m.byFull) > 0 && !now.Before(m.byFull[0].full) {
+		m.remove(m.byFull[0])
+		m.evictions++
+	}
+	if now.Sub(m.swept) < bucketSweepInterval {
+		return
+	}
+	m.swept = now
+	for key, end := range m.blocks {
+		if !now.Before(end) {
+			delete(m.blocks, key)
+		}
+	}
+}
+
+func (m *memoryBuckets) Stats() cacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return cacheStats{Entries: len(m.buckets) + len(m.blocks), Evictions: m.evictions}
+}
+
+// Purge removes all buckets and blocks, or those of one IP.
+func (m *memoryBuckets) Purge(filter cacheFilter) (int, bool) {
+	if filter.TokenHash != "" {
+		return 0, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for key, b := range m.buckets {
+		if filter.IP == "" || strings.HasSuffix(key, "|"+filter.IP) {
+			m.remove(b)
+			removed++
+		}
+	}
+	for key := range m.blocks {
+		if filter.IP == "" || strings.HasSuffix(key, "|"+filter.IP) {
+			delete(m.blocks, key)
+			removed++
+		}
+	}
+	return removed, true
+}
+
+// --- Redis Strategy ---
+
+// bucketScript takes a token from the bucket in KEYS[1]; ARGV holds the
+// limit, the window and the current time, both in milliseconds. It returns
+// "<wait ms> <remaining tokens>".
+const bucketScript = `
+local limit, window, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(state[1]) or limit, tonumber(state[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - updated) * limit / window)
+local wait = 0
+if tokens >= 1 then tokens = tokens - 1 else wait = math.ceil((1 - tokens) * window / limit) end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((limit - tokens) * window / limit) + 1000)
+return string.format('%d %d', wait, math.floor(tokens))
+`
+
+// redisBuckets is the Redis strategy for one server.
+type redisBuckets struct {
+	client *redisClient
+}
+
+// redisBucketStores holds one store per server, password and database.
+var redisBucketStores sync.Map // map[*redisClient]*redisBuckets
+
+func getRedisBuckets(addr, password string, database int) *redisBuckets {
+	client := getRedisClient(addr, password, database)
+	store, _ := redisBucketStores.LoadOrStore(client, &redisBuckets{client: client})
+	return store.(*redisBuckets)
+}
+
+func (s *redisBuckets) take(key string, limit bucketLimit, now time.Time) (bucketTake, error) {
+	reply, _, err := s.command("EVAL", bucketScript, "1", "turnstile:bucket:"+key,
+		strconv.Itoa(limit.limit), strconv.FormatInt(limit.window.Milliseconds(), 10), strconv.FormatInt(now.UnixMilli(), 10))
+	if err != nil {
+		return bucketTake{}, err
+	}
+	var waitMs int64
+	var take bucketTake
+	if _, err := fmt.Sscan(reply, &waitMs, &take.remaining); err != nil {
+		return bucketTake{}, fmt.Errorf("unexpected script reply %q", reply)
+	}
+	take.wait = time.Duration(waitMs) * time.Millisecond
+	return take, nil
+}
+
+func (s *redisBuckets) block(key string, d time.Duration, _ time.Time) error {
+	_, _, err := s.command("SET", "turnstile:block:"+key, "1", "PX", strconv.FormatInt(max(d.Milliseconds(), 1), 10))
+	return err
+}
+
+func (s *redisBuckets) blockedFor(key string, _ time.Time) (time.Duration, error) {
+	reply, _, err := s.command("PTTL", "turnstile:block:"+key)
+	if err != nil {
+		return 0, err
+	}
+	ms, err := strconv.ParseInt(reply, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, err // -2 when there is no block
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// command runs one command within bucketRedisTimeout.
+func (s *redisBuckets) command(args ...string) (string, bool, error) {
+	return s.client.exec(bucketRedisTimeout, args)
+}
+
+// --- Rate Limiter ---
+
+// rateLimiter takes from the buckets of rate_limit_strategy, falling back
+// to the local ones while its store fails.
+type rateLimiter struct {
+	name    string // 'local', or the Redis address
+	store   bucketStore
+	failed  atomic.Bool  // Last call to store failed; logged once until it recovers
+	retryAt atomic.Int64 // Unix nanoseconds before which store is not tried, zero while it works
+}
+
+// localRateLimiter serves configurations with rate_limit_strategy 'local'.
+var localRateLimiter = &rateLimiter{name: "local", store: localBuckets}
+
+// rateLimiters holds one limiter per Redis store, so failures are logged once.
+var rateLimiters sync.Map // map[*redisBuckets]*rateLimiter
+
+func compileRateLimiter(conf *Config) (*rateLimiter, error) {
+	switch strings.ToLower(conf.RateLimitStrategy) {
+	case "", "local":
+		return localRateLimiter, nil
+	case "redis":
+		if _, _, err := net.SplitHostPort(conf.RateLimitRedis); err != nil {
+			return nil, fmt.Errorf("invalid rate_limit_redis '%s': %v. rate_limit_strategy 'redis' requires a 'host:port'", conf.RateLimitRedis, err)
+		}
+		store := getRedisBuckets(conf.RateLimitRedis, conf.RateLimitRedisPassword, conf.RateLimitRedisDatabase)
+		limiter, _ := rateLimiters.LoadOrStore(store, &rateLimiter{name: conf.RateLimitRedis, store: store})
+		return limiter.(*rateLimiter), nil
+	}
+	return nil, fmt.Errorf("invalid rate_limit_strategy configured: '%s'. Use 'local' or 'redis'", conf.RateLimitStrategy)
+}
+
+// take takes a token from the bucket of feature and id.
+func (l *rateLimiter) take(feature, id string, limit bucketLimit) bucketTake {
+	key, now := feature+"|"+id, clock.Now()
+	var take bucketTake
+	l.use(now, func(store bucketStore) (err error) {
+		take, err = store.take(key, limit, now)
+		return err
+	})
+	if take.allowed() {
+		countRateLimit(feature, "allowed")
+	} else {
+		countRateLimit(feature, "limited")
+	}
+	return take
+}
+
+// block keeps id out of feature for d.
+func (l *rateLimiter) block(feature, id string, d time.Duration) {
+	key, now := feature+"|"+id, clock.Now()
+	l.use(now, func(store bucketStore) error { return store.block(key, d, now) })
+	countRateLimit(feature, "blocked")
+}
+
+// blockedFor returns how long id is still blocked from feature.
+func (l *rateLimiter) blockedFor(feature, id string) time.Duration {
+	key, now := feature+"|"+id, clock.Now()
+	var remaining time.Duration
+	l.use(now, func(store bucketStore) (err error) {
+		remaining, err = store.blockedFor(key, now)
+		return err
+	})
+	return remaining
+}
+
+// use runs call on the store of rate_limit_strategy, or on the local
+// buckets when that fails or failed less than bucketStoreBackoff ago.
+// Failures and recoveries are logged once.
+func (l *rateLimiter) use(now time.Time, call func(store bucketStore) error) {
+	if l.store == localBuckets || !l.available(now) {
+		_ = call(localBuckets)
+		return
+	}
+	err := call(l.store)
+	switch {
+	case err != nil:
+		l.retryAt.Store(now.Add(bucketStoreBackoff).UnixNano())
+		if !l.failed.Swap(true) {
+			log.Printf("turnstile: rate limit buckets on %s unavailable, using local buckets: %v", l.name, err)
+		}
+		_ = call(localBuckets)
+	case l.failed.Swap(false):
+		l.retryAt.Store(0)
+		log.Printf("turnstile: rate limit buckets on %s available again", l.name)
+	}
+}
+
+// available reports whether the store may be tried: it worked last time,
+// or its backoff has passed and this call won the retry.
+func (l *rateLimiter) available(now time.Time) bool {
+	retryAt := l.retryAt.Load()
+	return retryAt == 0 || now.UnixNano() >= retryAt && l.retryAt.CompareAndSwap(retryAt, now.Add(bucketStoreBackoff).UnixNano())
+}
+
+// rateLimitCounts counts bucket outcomes by "<feature>\x00<outcome>".
+var rateLimitCounts sync.Map // map[string]*atomic.Int64
+
+func countRateLimit(feature, outcome string) {
+	counter, _ := rateLimitCounts.LoadOrStore(feature+"\x00"+outcome, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(1)
+}
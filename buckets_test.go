@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func TestMemoryBucketsEvictBucketClosestToFull(t *testing.T) {
+	m := &memoryBuckets{buckets: make(map[string]*tokenBucket), blocks: make(map[string]time.Time), swept: clockStart}
+	limit := bucketLimit{limit: 2, window: time.Minute}
+
+	take := func(key string, now time.Time) bucketTake {
+		t.Helper()
+		take, err := m.take(key, limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return take
+	}
+	take("victim", clockStart)
+	take("victim", clockStart)
+	for i := 1; i < maxLocalBuckets; i++ {
+		take(fmt.Sprint(i), clockStart.Add(time.Second))
+	}
+
+	if got := take("new", clockStart.Add(2*time.Second)); !got.allowed() {
+		t.Fatalf("new identifier limited: %+v", got)
+	}
+	if got := take("victim", clockStart.Add(2*time.Second)); got.allowed() {
+		t.Error("drained bucket was evicted instead of one closer to full")
+	}
+	if stats := m.Stats(); stats.Entries != maxLocalBuckets || stats.Evictions != 1 {
+		t.Errorf("stats = %+v, want %d entries and 1 eviction", stats, maxLocalBuckets)
+	}
+}
+
+func TestMemoryBucketsDropFullBuckets(t *testing.T) {
+	m := &memoryBuckets{buckets: make(map[string]*tokenBucket), blocks: make(map[string]time.Time), swept: clockStart}
+	limit := bucketLimit{limit: 10, window: 10 * time.Second}
+	for _, key := range []string{"a", "b"} {
+		if _, err := m.take(key, limit, clockStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.take("c", limit, clockStart.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.buckets) != 1 || len(m.byFull) != 1 || m.buckets["c"] == nil {
+		t.Errorf("buckets = %v, want only c", m.buckets)
+	}
+}
+
+// failingBuckets is a bucket store that is down, counting the calls to it.
+type failingBuckets struct{ calls int }
+
+func (f *failingBuckets) take(string, bucketLimit, time.Time) (bucketTake, error) {
+	f.calls++
+	return bucketTake{}, errors.New("connection refused")
+}
+
+func (f *failingBuckets) block(string, time.Duration, time.Time) error {
+	f.calls++
+	return errors.New("connection refused")
+}
+
+func (f *failingBuckets) blockedFor(string, time.Time) (time.Duration, error) {
+	f.calls++
+	return 0, errors.New("connection refused")
+}
+
+func TestRateLimiterBacksOffFailingStore(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+	store := &failingBuckets{}
+	l := &rateLimiter{name: "failing", store: store}
+	limit := bucketLimit{limit: 100, window: time.Minute}
+	id := "id-" + t.Name()
+
+	for i := 0; i < 5; i++ {
+		if take := l.take("test", id, limit); !take.allowed() {
+			t.Fatalf("take %d limited: %+v", i, take)
+		}
+	}
+	if store.calls != 1 {
+		t.Errorf("store called %d times during the backoff, want 1", store.calls)
+	}
+
+	clk.Advance(bucketStoreBackoff)
+	l.take("test", id, limit)
+	l.take("test", id, limit)
+	if store.calls != 2 {
+		t.Errorf("store called %d times after the backoff, want 2", store.calls)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// --- Cache Registry ---
+// Every in-memory cache of the plugin server registers here so the admin
+// endpoint can report statistics and purge entries during incidents.
+
+// cacheStats is a point-in-time view of a cache.
+type cacheStats struct {
+	Entries   int     `json:"entries"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+// withRatio fills in HitRatio from Hits and Misses.
+func (s cacheStats) withRatio() cacheStats {
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+// cacheFilter selects entries to purge. The zero value selects everything.
+type cacheFilter struct {
+	TokenHash string // Hex SHA-256 of a token
+	IP        string // Client IP the entry was created for
+}
+
+func (f cacheFilter) all() bool { return f.TokenHash == "" && f.IP == "" }
+
+// purgeableCache is implemented by every registered cache. Purge returns the
+// number of removed entries, or ok=false if the cache cannot apply filter.
+type purgeableCache interface {
+	Stats() cacheStats
+	Purge(filter cacheFilter) (removed int, ok bool)
+}
+
+var cacheRegistry = struct {
+	sync.RWMutex
+	caches map[string]purgeableCache
+}{caches: make(map[string]purgeableCache)}
+
+func registerCache(name string, c purgeableCache) {
+	cacheRegistry.Lock()
+	defer cacheRegistry.Unlock()
+	cacheRegistry.caches[name] = c
+}
+
+// registeredCaches returns the registered cache names, sorted.
+func registeredCaches() []string {
+	cacheRegistry.RLock()
+	defer cacheRegistry.RUnlock()
+	names := make([]string, 0, len(cacheRegistry.caches))
+	for name := range cacheRegistry.caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupCache(name string) (purgeableCache, bool) {
+	cacheRegistry.RLock()
+	defer cacheRegistry.RUnlock()
+	c, ok := cacheRegistry.caches[name]
+	return c, ok
+}
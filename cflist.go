@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Cloudflare IP List Feedback ---
+// IPs failing verification repeatedly are pushed to a Cloudflare IP List
+// (account-level "rules list", referenced from a WAF custom rule), so edge
+// blocking kicks in before their traffic reaches Kong. Failures are counted
+// per IP in a token bucket of block_threshold failures refilled over
+// block_window_seconds (see buckets.go); once an IP drains it, the IP is
+// pushed once, asynchronously, and not counted again until
+// block_window_seconds has passed since the push.
+
+const cloudflareListQueueSize = 256
+
+// cloudflareList is the compiled list integration of one configuration.
+type cloudflareList struct {
+	apiURL    string
+	apiToken  string
+	accountID string
+	listID    string
+	threshold int
+	window    time.Duration
+	client    *httpClient
+}
+
+type listPush struct {
+	list *cloudflareList
+	ip   string
+}
+
+// listPushes queues pushes to the Cloudflare API.
+var listPushes = newListPushes()
+
+func newListPushes() *sinkQueue[listPush] {
+	pushes := newSinkQueue[listPush]("cloudflare_list", cloudflareListQueueSize, nil)
+	pushes.register()
+	go pushLoop(pushes)
+	return pushes
+}
+
+func pushLoop(pushes *sinkQueue[listPush]) {
+	for push := range pushes.items {
+		if err := push.list.addIP(push.ip); err != nil {
+			log.Printf("turnstile: could not add %s to Cloudflare list %s: %v", push.ip, push.list.listID, err)
+		} else {
+			log.Printf("turnstile: added repeatedly failing IP %s to Cloudflare list %s", push.ip, push.list.listID)
+		}
+	}
+}
+
+// addIP appends ip to the list through the Cloudflare API.
+func (l *cloudflareList) addIP(ip string) error {
+	body, _ := json.Marshal([]map[string]string{{
+		"ip":      ip,
+		"comment": fmt.Sprintf("turnstile plugin: repeated verification failures (%s)", time.Now().UTC().Format(time.RFC3339)),
+	}})
+	endpoint := fmt.Sprintf("%s/accounts/%s/rules/lists/%s/items", strings.TrimRight(l.apiURL, "/"), l.accountID, l.listID)
+	resp, err := l.client.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+l.apiToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, snippet)
+	}
+	return nil
+}
+
+// recordListFailure feeds rejected requests into the list integration.
+func (r *requestState) recordListFailure(d decision) {
+	list := r.settings.cloudflareList
+	if list == nil || d.allowed || !isClientFailure(d.reason) {
+		return // Provider and configuration errors say nothing about the client
+	}
+	ip := r.clientIP()
+	if ip == "" {
+		return
+	}
+	id, limiter := list.listID+"|"+ip, r.settings.rateLimiter
+	if limiter.blockedFor(featureCloudflareList, id) > 0 {
+		return // Pushed within the window
+	}
+	if !limiter.take(featureCloudflareList, id, bucketLimit{limit: list.threshold, window: list.window}).exhausted() {
+		return
+	}
+	limiter.block(featureCloudflareList, id, list.window)
+	listPushes.put(listPush{list, ip}, r.settings.sinkOverflow)
+}
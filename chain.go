@@ -0,0 +1,102 @@
+package main
+
+import "slices"
+
+// --- Policy Chain ---
+// Access runs the request through an ordered chain of stages:
+//
+//	bypass checks    route_mode ... session  requests decided without a token
+//	extraction       token and provider from the request
+//	transport        HTTPS and Origin requirements of token-bearing requests
+//	attempt_limit    attempts per client IP, see limits.go
+//	pre_validation   token shape, before the provider is asked
+//	cache            verifications of this request, an earlier one or attempt
+//	verification     siteverify
+//	post_validation  threat level, score and action checks on the answer
+//	decision         publish and follow-up (flow tokens)
+//
+// Each stage returns false once the request has been answered, rejected or
+// let through, which ends the chain; otherwise the next stage runs. A new
+// policy is a new stage at the right place in the chain, not another branch
+// in Access. The preverify endpoint runs the token stages (extraction to
+// post_validation) through verifyToken and issues a pass instead of the
+// decision stage.
+
+// accessStage is one stage of the policy chain.
+type accessStage interface {
+	// run handles the request at this stage. It returns false when the
+	// request has been decided and later stages must not run.
+	run(r *requestState, v *verification) bool
+}
+
+// stageFunc adapts a function to accessStage.
+type stageFunc func(r *requestState, v *verification) bool
+
+func (f stageFunc) run(r *requestState, v *verification) bool { return f(r, v) }
+
+// namedStage is a stage with the name it is logged and measured under.
+type namedStage struct {
+	name  string
+	stage accessStage
+}
+
+// verification is what the token stages find out about the request's token.
+type verification struct {
+	token    string
+	provider *provider
+	clientIP string
+	response *VerificationResult
+
+	fromEarlierInstance bool // Verified by another plugin instance for this request, see dedup.go
+}
+
+// bypassStages decide requests that are not verified with a token.
+var bypassStages = []namedStage{
+	{"route_mode", stageFunc((*requestState).routeModeStage)},
+	{"skip_rules", stageFunc((*requestState).skipRulesStage)},
+	{"bot_verdict", stageFunc((*requestState).botVerdictStage)},
+	{"penalty", stageFunc((*requestState).penaltyStage)},
+	{"reputation", stageFunc(func(r *requestState, _ *verification) bool { return !r.checkReputation() })},
+	{"conditional_request", stageFunc((*requestState).conditionalStage)},
+	{"widget_page", stageFunc((*requestState).widgetPageStage)},
+	{"batch", stageFunc((*requestState).batchStage)},
+	{"edge_assertion", stageFunc(func(r *requestState, _ *verification) bool { return !r.acceptEdgeAssertion() })},
+	{"flow_token", stageFunc(func(r *requestState, _ *verification) bool { return !r.acceptFlowToken() })},
+	{"preverify", stageFunc((*requestState).preverifyStage)},
+	{"pass", stageFunc(func(r *requestState, _ *verification) bool { return !r.acceptPass() })},
+	{"receipt", stageFunc(func(r *requestState, _ *verification) bool { return !r.acceptReceipt() })},
+	{"session", stageFunc(func(r *requestState, _ *verification) bool { return !r.acceptSession() })},
+}
+
+// tokenStages verify the request's token.
+var tokenStages = []namedStage{
+	{"extraction", stageFunc((*requestState).extractionStage)},
+	{"transport", stageFunc((*requestState).transportStage)},
+	{"attempt_limit", stageFunc((*requestState).attemptLimitStage)},
+	{"pre_validation", stageFunc((*requestState).preValidationStage)},
+	{"cache", stageFunc((*requestState).cacheStage)},
+	{"verification", stageFunc((*requestState).verificationStage)},
+	{"post_validation", stageFunc((*requestState).postValidationStage)},
+}
+
+// accessChain is the full chain Access runs.
+var accessChain = slices.Concat(bypassStages, tokenStages, []namedStage{
+	{"decision", stageFunc((*requestState).decisionStage)},
+})
+
+// runChain runs the stages of chain in order, timing each (see timing.go).
+// It returns false when a stage decided the request.
+func (r *requestState) runChain(chain []namedStage, v *verification) bool {
+	for _, s := range chain {
+		if (r.forceChallenge && challengeSkipped[s.name]) || (elevatedSkipped[s.name] && r.threatElevated()) {
+			continue
+		}
+		outer, outerStarted := r.startStage(s.name)
+		done := !s.stage.run(r, v)
+		r.endStage(outer, outerStarted)
+		if done {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/test"
+)
+
+// stageRunner is a plugin running a single stage of accessChain, so stages
+// can be tested on the go-pdk test framework without the rest of the chain.
+type stageRunner struct {
+	conf  *Config
+	stage string
+	setup func(r *requestState, v *verification) // Optional: prepares state left by earlier stages
+
+	r         *requestState
+	v         *verification
+	proceeded bool
+}
+
+func (s *stageRunner) Access(kong *pdk.PDK) {
+	s.r = newRequestState(kong, s.conf.settings())
+	s.v = &verification{}
+	if s.setup != nil {
+		s.setup(s.r, s.v)
+	}
+	for _, named := range accessChain {
+		if named.name == s.stage {
+			s.proceeded = named.stage.run(s.r, s.v)
+			return
+		}
+	}
+	panic("no stage " + s.stage)
+}
+
+// stageTest is one case of TestStages.
+type stageTest struct {
+	name   string
+	stage  string
+	conf   func(conf *Config)                     // Optional: adjusts the base config
+	req    test.Request                           // Default: GET /login
+	setup  func(r *requestState, v *verification) // Optional
+	script []turnstiletest.Reply                  // Optional: siteverify answers
+
+	wantContinue bool
+	wantStatus   int    // Status of the rejection, when the stage rejects
+	wantReason   Reason // Published reason, when the stage decides
+	check        func(t *testing.T, s *stageRunner)
+}
+
+func TestStages(t *testing.T) {
+	badIPs := filepath.Join(t.TempDir(), "bad.txt")
+	if err := os.WriteFile(badIPs, []byte("10.10.10.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, headers http.Header) test.Request {
+		if headers == nil {
+			headers = http.Header{}
+		}
+		return test.Request{Method: "GET", Url: "http://example.com" + path, Headers: headers}
+	}
+	withToken := func(token string) test.Request {
+		return get("/login", http.Header{DefaultTokenHeader: {token}})
+	}
+	provided := func(r *requestState, v *verification) {
+		v.provider, v.token, v.clientIP = r.settings.providers[0], "token-"+strings.ReplaceAll(t.Name(), "/", "-"), "10.10.10.1"
+	}
+	answered := func(res VerificationResult) func(r *requestState, v *verification) {
+		return func(r *requestState, v *verification) {
+			provided(r, v)
+			v.response = &res
+		}
+	}
+
+	tests := []stageTest{
+		// Bypass checks
+		{name: "route mode off", stage: "route_mode", setup: func(r *requestState, _ *verification) { r.routeMode = "off" },
+			wantReason: ReasonAdminOverride},
+		{name: "route mode on", stage: "route_mode", wantContinue: true},
+
+		{name: "bad reputation", stage: "reputation", conf: func(c *Config) { c.ReputationBadFile = badIPs },
+			wantStatus: http.StatusForbidden, wantReason: ReasonBadReputation},
+		{name: "unknown reputation", stage: "reputation", wantContinue: true},
+
+		{name: "relaxed revalidation", stage: "conditional_request", conf: func(c *Config) { c.ConditionalRequests = "relaxed" },
+			req: get("/page", http.Header{"If-None-Match": {`"v1"`}}), wantReason: ReasonConditionalRequest},
+		{name: "enforced revalidation", stage: "conditional_request",
+			req: get("/page", http.Header{"If-None-Match": {`"v1"`}}), wantContinue: true},
+
+		{name: "widget page", stage: "widget_page", conf: func(c *Config) { c.WidgetInjectPaths, c.WidgetSiteKey = []string{"/signup"}, "site-key" },
+			req: get("/signup", nil), wantReason: ReasonWidgetPage},
+		{name: "not a widget page", stage: "widget_page", conf: func(c *Config) { c.WidgetInjectPaths, c.WidgetSiteKey = []string{"/signup"}, "site-key" },
+			wantContinue: true},
+
+		{name: "per item batch", stage: "batch", conf: func(c *Config) { c.BatchMode = "per_item" },
+			req:        test.Request{Method: "POST", Url: "http://example.com/batch", Headers: http.Header{}, Body: []byte("{}")},
+			wantStatus: http.StatusBadRequest},
+		{name: "single batch", stage: "batch", wantContinue: true},
+
+		{name: "flow tokens off", stage: "flow_token", req: get("/step2", http.Header{"X-Turnstile-Flow": {"x"}}), wantContinue: true},
+		{name: "bad flow token", stage: "flow_token", conf: func(c *Config) { c.FlowTokenSecret, c.FlowPaths = "flow-secret", []string{"/step"} },
+			req: get("/step2", http.Header{"X-Turnstile-Flow": {"forged"}}), wantContinue: true},
+
+		{name: "preverify endpoint", stage: "preverify", conf: func(c *Config) { c.PreverifyPath, c.PassSecret = "/preverify", "pass-secret" },
+			req: get("/preverify", nil), wantStatus: http.StatusBadRequest, wantReason: ReasonMissingToken},
+		{name: "other path", stage: "preverify", conf: func(c *Config) { c.PreverifyPath, c.PassSecret = "/preverify", "pass-secret" },
+			wantContinue: true},
+
+		{name: "valid pass", stage: "pass", conf: func(c *Config) { c.PassSecret = "pass-secret" },
+			req: get("/api", http.Header{"X-Turnstile-Pass": {"<pass>"}}), wantReason: ReasonPass},
+		{name: "forged pass", stage: "pass", conf: func(c *Config) { c.PassSecret = "pass-secret" },
+			req: get("/api", http.Header{"X-Turnstile-Pass": {"forged"}}), wantContinue: true},
+		{name: "receipt as pass", stage: "pass", conf: func(c *Config) { c.PassSecret = "pass-secret" },
+			req: get("/api", http.Header{"X-Turnstile-Pass": {"<receipt>"}}), wantContinue: true},
+		{name: "pass as receipt", stage: "receipt", conf: func(c *Config) {
+			c.PassSecret, c.ReceiptCookie, c.PreverifyPath = "pass-secret", "receipt", "/preverify"
+		},
+			req: get("/form", http.Header{"Cookie": {"receipt=<pass>"}, "Referer": {"https://example.com/form"}}), wantContinue: true},
+		{name: "valid receipt", stage: "receipt", conf: func(c *Config) {
+			c.PassSecret, c.ReceiptCookie, c.PreverifyPath = "pass-secret", "receipt", "/preverify"
+		},
+			req: get("/form", http.Header{"Cookie": {"receipt=<receipt>"}, "Referer": {"https://example.com/form"}}), wantReason: ReasonReceipt},
+
+		{name: "receipts off", stage: "receipt", conf: func(c *Config) { c.PassSecret = "pass-secret" }, wantContinue: true},
+
+		// Token stages
+		{name: "token found", stage: "extraction", req: withToken("abc"), wantContinue: true,
+			check: func(t *testing.T, s *stageRunner) {
+				if s.v.token != "abc" || s.v.provider == nil {
+					t.Errorf("verification = %+v, want token 'abc' and a provider", s.v)
+				}
+			}},
+		{name: "token missing", stage: "extraction", wantStatus: http.StatusBadRequest, wantReason: ReasonMissingToken},
+
+		{name: "well-formed token", stage: "pre_validation", setup: provided, wantContinue: true},
+		{name: "overlong token", stage: "pre_validation", setup: func(r *requestState, v *verification) {
+			provided(r, v)
+			v.token = strings.Repeat("x", DefaultMaxTokenLength+1)
+		}, wantStatus: http.StatusBadRequest, wantReason: ReasonMalformedToken},
+
+		{name: "cache miss", stage: "cache", conf: func(c *Config) { c.VerifyCacheTTLSeconds = 60 }, setup: provided, wantContinue: true,
+			check: func(t *testing.T, s *stageRunner) {
+				if s.r.verifiedFromCache {
+					t.Error("verifiedFromCache set without an earlier verification")
+				}
+			}},
+		{name: "cache hit", stage: "cache", conf: func(c *Config) { c.VerifyCacheTTLSeconds = 60 }, setup: func(r *requestState, v *verification) {
+			provided(r, v)
+			v.token += "-cached"
+			verifiedTokens.put(v.provider, v.token, r.clientIP(), &VerificationResult{Success: true, IssuedAt: time.Now()}, time.Minute, time.Now())
+		}, wantContinue: true,
+			check: func(t *testing.T, s *stageRunner) {
+				if !s.r.verifiedFromCache || s.v.response == nil {
+					t.Error("cached verification not used")
+				}
+			}},
+
+		{name: "provider answers", stage: "verification", setup: provided, script: []turnstiletest.Reply{turnstiletest.Failure("invalid-input-response")},
+			wantContinue: true,
+			check: func(t *testing.T, s *stageRunner) {
+				if s.v.response == nil || s.v.response.Success {
+					t.Errorf("response = %+v, want the provider's failure", s.v.response)
+				}
+			}},
+		{name: "provider fails", stage: "verification", setup: provided, script: []turnstiletest.Reply{turnstiletest.ServerError(http.StatusInternalServerError)},
+			wantStatus: http.StatusBadGateway, wantReason: ReasonProviderError},
+		{name: "verified from cache", stage: "verification", setup: func(r *requestState, v *verification) {
+			answered(VerificationResult{Success: true})(r, v)
+			r.verifiedFromCache = true
+		}, wantContinue: true},
+
+		{name: "token accepted", stage: "post_validation", setup: answered(VerificationResult{Success: true, Hostname: "example.com"}), wantContinue: true},
+		{name: "token refused", stage: "post_validation", setup: answered(VerificationResult{ErrorCodes: []string{"invalid-input-response"}}),
+			wantStatus: http.StatusForbidden, wantReason: ReasonInvalidToken},
+		{name: "unexpected action", stage: "post_validation", conf: func(c *Config) { c.ExpectedActions = []string{"login"} },
+			setup: func(r *requestState, v *verification) {
+				answered(VerificationResult{Success: true, Action: "signup"})(r, v)
+				r.readExpectedActions() // Done by Access before the chain runs
+			}, wantStatus: http.StatusForbidden, wantReason: ReasonActionMismatch},
+
+		{name: "verified", stage: "decision", setup: answered(VerificationResult{Success: true}), wantContinue: true, wantReason: ReasonVerified},
+		{name: "from cache", stage: "decision", setup: func(r *requestState, v *verification) {
+			answered(VerificationResult{Success: true})(r, v)
+			r.verifiedFromCache = true
+		}, wantContinue: true, wantReason: ReasonCacheHit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stage+"/"+tt.name, func(t *testing.T) {
+			srv := turnstiletest.NewServer(t)
+			srv.Enqueue(tt.script...)
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			if tt.conf != nil {
+				tt.conf(conf)
+			}
+			req := tt.req
+			if req.Method == "" {
+				req = get("/login", nil)
+			}
+			pass, _ := json.Marshal(passPayload{Type: passType, ID: newUUID(), Expires: time.Now().Add(time.Minute).Unix()})
+			receipt, _ := json.Marshal(receiptPayload{Type: receiptType, ID: newUUID(), Expires: time.Now().Add(time.Minute).Unix(),
+				Page: "https://example.com/form"})
+			for _, name := range []string{"X-Turnstile-Pass", "Cookie"} {
+				value := req.Headers.Get(name)
+				if !strings.Contains(value, "<") {
+					continue
+				}
+				value = strings.Replace(value, "<pass>", conf.settings().passKeys.sign(pass), 1)
+				req.Headers.Set(name, strings.Replace(value, "<receipt>", conf.settings().passKeys.sign(receipt), 1))
+			}
+
+			s := &stageRunner{conf: conf, stage: tt.stage, setup: tt.setup}
+			env := turnstiletest.RunAccess(t, s, req)
+			if settings := conf.settings(); settings.err != nil {
+				t.Fatalf("config error: %v", settings.err)
+			}
+
+			if s.proceeded != tt.wantContinue {
+				t.Errorf("stage returned %v, want %v", s.proceeded, tt.wantContinue)
+			}
+			if rejected := turnstiletest.Rejected(env); rejected != (tt.wantStatus != 0) {
+				t.Errorf("rejected = %v (status %d), want status %d", rejected, env.ClientRes.Status, tt.wantStatus)
+			} else if rejected && env.ClientRes.Status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", env.ClientRes.Status, tt.wantStatus)
+			}
+			if tt.wantReason != "" {
+				if got := decisionReason(t, env); got != string(tt.wantReason) {
+					t.Errorf("reason = %q, want %q", got, tt.wantReason)
+				}
+			} else if d, ok := env.Ctx.Store[SharedDecisionKey]; ok && tt.wantContinue {
+				t.Errorf("continuing stage published %v", d)
+			}
+			if tt.check != nil {
+				tt.check(t, s)
+			}
+		})
+	}
+}
+
+// TestStagesAreNamedUniquely guards the names stages are logged and measured under.
+func TestStagesAreNamedUniquely(t *testing.T) {
+	seen := map[string]bool{}
+	for _, s := range accessChain {
+		if seen[s.name] {
+			t.Errorf("stage %q appears twice in accessChain", s.name)
+		}
+		seen[s.name] = true
+	}
+	if accessChain[len(accessChain)-1].name != "decision" {
+		t.Errorf("last stage is %q, want decision", accessChain[len(accessChain)-1].name)
+	}
+}
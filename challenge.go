@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// --- Challenge Requirements ---
+// API clients and SDKs learn from a rejection how to satisfy the challenge
+// instead of hardcoding our conventions. With a challenge site key
+// (challenge_site_key, or widget_site_key) every rejection a client can fix
+// by solving a challenge carries
+//
+//	WWW-Authenticate: Turnstile sitekey="0x4AAA...", header="cf-turnstile-response", action="login"
+//
+// naming where the token goes (header, field, query parameter, cookie or JSON path) and, with
+// expected_actions, the action to solve for. Clients accepting
+// application/json also get the requirements as body:
+//
+//	{"error": "...", "reason": "missing_token", "retryable": true, "challenge": {"scheme": "Turnstile",
+//	 "sitekey": "...", "header": "cf-turnstile-response", "actions": ["login"]}}
+//
+// challenge_status answers missing tokens with e.g. 401 instead of 400 (see
+// tokenclass.go for the statuses of other rejection classes).
+
+// ChallengeScheme is the authentication scheme named in WWW-Authenticate.
+const ChallengeScheme = "Turnstile"
+
+// challengeRequirements describes how to satisfy the challenge.
+type challengeRequirements struct {
+	Scheme  string   `json:"scheme"`
+	SiteKey string   `json:"sitekey"`
+	Header  string   `json:"header,omitempty"`
+	Field   string   `json:"field,omitempty"`
+	Query   string   `json:"query,omitempty"`
+	Cookie  string   `json:"cookie,omitempty"`
+	JSON    string   `json:"json,omitempty"` // Path in a JSON body
+	Actions []string `json:"actions,omitempty"`
+}
+
+// requirements returns the challenge requirements of the primary provider.
+func (r *requestState) requirements() challengeRequirements {
+	settings := r.settings
+	req := challengeRequirements{Scheme: ChallengeScheme, SiteKey: settings.challengeSiteKey, Actions: r.actions}
+	for _, step := range settings.extraction {
+		if step.provider != settings.providers[0] {
+			continue
+		}
+		switch step.location {
+		case "header":
+			req.Header = step.name
+		case "form":
+			req.Field = step.name
+		case "query":
+			req.Query = step.name
+		case "cookie":
+			req.Cookie = step.name
+		case "body_json":
+			req.JSON = step.name
+		}
+		break
+	}
+	return req
+}
+
+// wwwAuthenticate renders req as a WWW-Authenticate challenge.
+func (req challengeRequirements) wwwAuthenticate() string {
+	params := []string{fmt.Sprintf("sitekey=%q", req.SiteKey)}
+	for _, param := range [][2]string{{"header", req.Header}, {"field", req.Field}, {"query", req.Query}, {"cookie", req.Cookie}, {"json", req.JSON}} {
+		if param[1] != "" {
+			params = append(params, fmt.Sprintf("%s=%q", param[0], param[1]))
+		}
+	}
+	if len(req.Actions) > 0 {
+		params = append(params, fmt.Sprintf("action=%q", req.Actions[0]))
+	}
+	return req.Scheme + " " + strings.Join(params, ", ")
+}
+
+// describeChallenge adds the challenge requirements to a rejection the
+// client can fix by solving a challenge.
+func (r *requestState) describeChallenge(d *decision, body string) ([]byte, map[string][]string) {
+	settings := r.settings
+	if status, ok := settings.tokenStatuses[d.reason]; ok {
+		d.status = status
+	}
+	if settings.challengeSiteKey == "" || !isClientFailure(d.reason) {
+		return []byte(body), nil
+	}
+	req := r.requirements()
+	headers := map[string][]string{"WWW-Authenticate": {req.wwwAuthenticate()}}
+	if settings.errorFormat == "json" {
+		return []byte(body), headers // See formatError
+	}
+	if accept, err := r.kong.Request.GetHeader("Accept"); err != nil || !strings.Contains(accept, "application/json") {
+		return []byte(body), headers
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"error": body, "reason": d.reason, "retryable": isRetryable(d.reason), "challenge": req})
+	headers["Content-Type"] = []string{"application/json"}
+	return payload, headers
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"kong-turnstile-plugin/verifier"
+)
+
+// --- challenge_ts Parsing ---
+// Token freshness (the elevated threat level, the verification cache) rests
+// on challenge_ts. Providers agree on ISO 8601 but not on its details, and
+// custom providers send Unix timestamps, so challenge_ts is read as RFC 3339
+// with or without fractional seconds or zone, with a space instead of the
+// T, or as Unix seconds or milliseconds (see verifier.ParseTimestamp). A timestamp that cannot be read is
+// counted as bad_timestamps per provider and logged at most once a minute
+// per provider; the token's age is then unknown, which the freshness checks
+// treat as too old. A timestamp in the future, because the provider's clock
+// or ours is off, is taken as "now" within max_clock_skew_seconds and as
+// unknown beyond, counted as skewed_timestamps.
+
+const timestampLogEvery = time.Minute
+
+// checkIssuedAt counts and logs a challenge_ts that could not be read and
+// applies max_clock_skew_seconds to one in the future.
+func checkIssuedAt(settings *compiledConfig, p *provider, res *VerificationResult, ts verifier.Timestamp, now time.Time) {
+	switch {
+	case res.IssuedAt.IsZero() && strings.TrimSpace(string(ts)) != "":
+		p.stats.BadTimestamps.Add(1)
+		warnTimestamp(p, now, "turnstile: provider %s sent unreadable challenge_ts %q, token age unknown", p.name, string(ts))
+	case res.IssuedAt.After(now.Add(settings.maxClockSkew)):
+		p.stats.SkewedTimestamps.Add(1)
+		warnTimestamp(p, now, "turnstile: provider %s sent challenge_ts %s, %s in the future (max_clock_skew_seconds %d), token age unknown",
+			p.name, res.challengeTs(), res.IssuedAt.Sub(now).Round(time.Second), int(settings.maxClockSkew.Seconds()))
+		res.IssuedAt = time.Time{}
+	case res.IssuedAt.After(now):
+		res.IssuedAt = now
+	}
+}
+
+// warnTimestamp logs at most every timestampLogEvery per provider.
+func warnTimestamp(p *provider, now time.Time, format string, args ...interface{}) {
+	last := p.stats.lastTimestampWarning.Load()
+	if now.UnixNano()-last < int64(timestampLogEvery) || !p.stats.lastTimestampWarning.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	log.Printf(format, args...)
+}
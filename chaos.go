@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// --- Chaos Mode ---
+// To rehearse fail-open, rate_limited_policy and alerting in staging, the
+// chaos setting makes a share of siteverify calls slow or fail without
+// touching the provider. It only takes effect in plugin servers started
+// with ChaosEnv set to 1 or true; elsewhere it is ignored with a warning,
+// so a staging configuration promoted to production stays harmless.
+// Injected failures go through the same paths as real ones, and probes are
+// affected like any other call. Injections are counted as chaos_injected in
+// support bundles.
+
+// ChaosEnv enables chaos settings for the whole plugin server.
+const ChaosEnv = "TURNSTILE_CHAOS"
+
+// ChaosConfig injects failures into a share of verifications. Percentages
+// are of all siteverify calls; a delayed call may fail as well.
+type ChaosConfig struct {
+	DelayPercent float64  `json:"delay_percent"` // Optional: Calls delayed by delay_ms before going out
+	DelayMs      int      `json:"delay_ms"`      // Optional: Injected delay. Default: 1000
+	ErrorPercent float64  `json:"error_percent"` // Optional: Calls failing without reaching the provider
+	ErrorStatus  int      `json:"error_status"`  // Optional: Provider status those calls simulate, e.g. 429 or 503. Default: 0 (connection error)
+	CodesPercent float64  `json:"codes_percent"` // Optional: Calls answered success=false with error_codes
+	ErrorCodes   []string `json:"error_codes"`   // Optional: Codes of those answers. Default: ['internal-error']
+}
+
+// chaosInjected counts injected delays and failures.
+var chaosInjected atomic.Int64
+
+type chaosSettings struct {
+	delayPercent float64
+	delay        time.Duration
+	errorPercent float64
+	errorStatus  int
+	codesPercent float64
+	errorCodes   []string
+}
+
+// compileChaos returns nil when chaos is not configured or not enabled.
+func compileChaos(conf *ChaosConfig) (*chaosSettings, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	percents := []struct {
+		name  string
+		value float64
+	}{{"delay_percent", conf.DelayPercent}, {"error_percent", conf.ErrorPercent}, {"codes_percent", conf.CodesPercent}}
+	for _, percent := range percents {
+		if percent.value < 0 || percent.value > 100 {
+			return nil, fmt.Errorf("chaos.%s must be between 0 and 100", percent.name)
+		}
+	}
+	if conf.ErrorPercent+conf.CodesPercent > 100 {
+		return nil, fmt.Errorf("chaos.error_percent and chaos.codes_percent must not add up to more than 100")
+	}
+	if conf.ErrorStatus != 0 && (conf.ErrorStatus < 400 || conf.ErrorStatus > 599) {
+		return nil, fmt.Errorf("chaos.error_status must be a 4xx or 5xx status")
+	}
+	if env := os.Getenv(ChaosEnv); env != "1" && env != "true" {
+		log.Printf("turnstile: chaos settings ignored, %s is not set", ChaosEnv)
+		return nil, nil
+	}
+	c := &chaosSettings{
+		delayPercent: conf.DelayPercent,
+		delay:        time.Second,
+		errorPercent: conf.ErrorPercent,
+		errorStatus:  conf.ErrorStatus,
+		codesPercent: conf.CodesPercent,
+		errorCodes:   conf.ErrorCodes,
+	}
+	if conf.DelayMs > 0 {
+		c.delay = time.Duration(conf.DelayMs) * time.Millisecond
+	}
+	if len(c.errorCodes) == 0 {
+		c.errorCodes = []string{"internal-error"}
+	}
+	log.Printf("turnstile: chaos mode active: %g%% delayed by %s, %g%% errors, %g%% error codes",
+		c.delayPercent, c.delay, c.errorPercent, c.codesPercent)
+	return c, nil
+}
+
+// inject delays the call or answers it in the provider's place. It returns
+// injected=false when the call should go out as usual.
+func (c *chaosSettings) inject(p *provider) (resp *VerificationResult, verr *verifyError, injected bool) {
+	if rand.Float64()*100 < c.delayPercent {
+		chaosInjected.Add(1)
+		time.Sleep(c.delay)
+	}
+	roll := rand.Float64() * 100
+	switch {
+	case roll < c.errorPercent:
+		chaosInjected.Add(1)
+		switch {
+		case c.errorStatus == http.StatusTooManyRequests:
+			holdBackProvider(p.verifyURL, time.Second)
+			return nil, rateLimitedError(p, time.Second, true), true
+		case c.errorStatus != 0:
+			return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (API error)",
+				msg: fmt.Sprintf("chaos: %s API returned non-200 status: %d", p.name, c.errorStatus)}, true
+		}
+		return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (connection error)",
+			msg: fmt.Sprintf("chaos: failed to call %s verification API", p.name)}, true
+	case roll < c.errorPercent+c.codesPercent:
+		chaosInjected.Add(1)
+		return &VerificationResult{ErrorCodes: c.errorCodes}, nil, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Shared Circuit State ---
+// Calls held back after a 429 (see ratelimit.go) are held back per plugin
+// server, in memory. A rolling restart during a provider incident would
+// otherwise start every new node with calls flowing again, all hitting the
+// rate-limited provider at once. With TURNSTILE_CIRCUIT_REDIS set to a Redis
+// 'host:port' (and TURNSTILE_CIRCUIT_REDIS_PASSWORD if it needs AUTH), every
+// hold-back is also written there, expiring with it:
+//
+//	SET turnstile:circuit:<sha256 of the verification URL> <until, Unix ns> PX <hold-back ms>
+//
+// and a plugin server reads it back the first time it calls a verification
+// URL, holding back its calls until the recorded time. That first call waits
+// for Redis for at most circuitRedisTimeout; when Redis is unreachable the
+// plugin server starts with calls flowing, as without it. Like persistent
+// caches, this is configured for the whole process through the environment.
+// The plugin has no other circuit or adaptive state to share.
+
+const (
+	CircuitRedisEnv         = "TURNSTILE_CIRCUIT_REDIS"
+	CircuitRedisPasswordEnv = "TURNSTILE_CIRCUIT_REDIS_PASSWORD"
+	circuitRedisTimeout     = 500 * time.Millisecond
+)
+
+// seededBackoffs holds the verification URLs whose hold-back was read from Redis.
+var seededBackoffs sync.Map // map[string]bool
+
+func circuitKey(verifyURL string) string {
+	return "turnstile:circuit:" + tokenHash(verifyURL)
+}
+
+// shareHoldBack records in Redis that calls to verifyURL are held back for wait.
+func shareHoldBack(verifyURL string, wait time.Duration) {
+	addr := os.Getenv(CircuitRedisEnv)
+	if addr == "" {
+		return
+	}
+	until := time.Now().Add(wait).UnixNano()
+	go func() {
+		args := []string{"SET", circuitKey(verifyURL), strconv.FormatInt(until, 10), "PX", strconv.FormatInt(max(wait.Milliseconds(), 1), 10)}
+		if _, _, err := circuitRedis(addr, args); err != nil {
+			log.Printf("turnstile: could not share hold-back of %s on %s: %v", verifyURL, addr, err)
+		}
+	}()
+}
+
+// seedHoldBack takes over a hold-back of verifyURL recorded in Redis, once
+// per plugin server and URL.
+func seedHoldBack(verifyURL string, now time.Time) {
+	addr := os.Getenv(CircuitRedisEnv)
+	if addr == "" {
+		return
+	}
+	if _, seeded := seededBackoffs.LoadOrStore(verifyURL, true); seeded {
+		return
+	}
+	value, found, err := circuitRedis(addr, []string{"GET", circuitKey(verifyURL)})
+	if err != nil {
+		log.Printf("turnstile: could not read hold-back of %s from %s: %v", verifyURL, addr, err)
+		return
+	}
+	until, perr := strconv.ParseInt(value, 10, 64)
+	if !found || perr != nil || until <= now.UnixNano() {
+		return
+	}
+	backoff := backoffFor(verifyURL)
+	if until > backoff.Load() {
+		backoff.Store(until)
+	}
+	log.Printf("turnstile: calls to %s held back for another %s, as recorded in %s", verifyURL, time.Duration(until-now.UnixNano()).Round(time.Millisecond), addr)
+}
+
+// circuitRedis runs one command on the Redis server at addr and returns its
+// string or integer reply; found is false for a nil reply.
+func circuitRedis(addr string, args []string) (reply string, found bool, err error) {
+	return getRedisClient(addr, os.Getenv(CircuitRedisPasswordEnv), 0).exec(circuitRedisTimeout, args)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// --- Clock ---
+// Expiry decisions (challenge_ts freshness, cache and pass lifetimes,
+// sessions, flows, receipts, rate-limit hold-backs, the circuit breaker, the
+// emergency bypass and threat_level_file polling) read the time from clock
+// rather than time.Now, so tests can replace it with a manually advanced
+// clock instead of sleeping:
+//
+//	clk := turnstiletest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+//	t.Cleanup(setClock(clk))
+//	...
+//	clk.Advance(time.Hour) // Cached verifications, passes and sessions have expired
+//
+// Latency measurements, timeouts and sleeps keep using the system clock.
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clock is the plugin server's clock; only tests replace it.
+var clock Clock = systemClock{}
+
+// setClock replaces clock and returns a function restoring the previous one.
+func setClock(c Clock) (restore func()) {
+	previous := clock
+	clock = c
+	return func() { clock = previous }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+var clockStart = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func accessWithToken(t *testing.T, conf *Config, token string) *test.TestEnv {
+	t.Helper()
+	return turnstiletest.RunAccess(t, conf, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/login",
+		Headers: http.Header{DefaultTokenHeader: {token}},
+	})
+}
+
+func TestVerifyCacheExpiresWithClock(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+	srv := turnstiletest.NewServer(t)
+	srv.UseClock(clk)
+
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.VerifyCacheTTLSeconds = 60
+	token := "token-" + t.Name()
+
+	steps := []struct {
+		advance    time.Duration
+		wantReason Reason
+		wantCalls  int
+	}{
+		{0, ReasonVerified, 1},
+		{59 * time.Second, ReasonCacheHit, 1},
+		{2 * time.Second, ReasonVerified, 2}, // 61s after the first verification
+	}
+	for i, step := range steps {
+		clk.Advance(step.advance)
+		env := accessWithToken(t, conf, token)
+		if got := decisionReason(t, env); got != string(step.wantReason) {
+			t.Errorf("step %d: reason = %q, want %q", i, got, step.wantReason)
+		}
+		if calls := len(srv.Calls()); calls != step.wantCalls {
+			t.Errorf("step %d: siteverify called %d times, want %d", i, calls, step.wantCalls)
+		}
+	}
+}
+
+func TestElevatedTokenAgeWithClock(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+	srv := turnstiletest.NewServer(t)
+	srv.UseClock(clk)
+
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.ThreatLevelHeader = "X-Threat-Level"
+	conf.ThreatLevelHeaderCIDRs = []string{"10.10.10.0/24"}
+	conf.ElevatedMaxTokenAgeSeconds = 60
+
+	tests := []struct {
+		name         string
+		solvedAgo    time.Duration
+		wantRejected bool
+	}{
+		{"fresh", 59 * time.Second, false},
+		{"stale", 61 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := turnstiletest.Success()
+			reply.ChallengeTs = clk.Now().Add(-tt.solvedAgo).Format(time.RFC3339)
+			srv.Enqueue(reply)
+
+			env := turnstiletest.RunAccess(t, conf, test.Request{
+				Method:  "GET",
+				Url:     "http://example.com/login",
+				Headers: http.Header{DefaultTokenHeader: {"token-" + t.Name()}, "X-Threat-Level": {"elevated"}},
+			})
+			if got := turnstiletest.Rejected(env); got != tt.wantRejected {
+				t.Fatalf("rejected = %v, want %v", got, tt.wantRejected)
+			}
+			if tt.wantRejected {
+				if got := decisionReason(t, env); got != string(ReasonExpired) {
+					t.Errorf("reason = %q, want %q", got, ReasonExpired)
+				}
+			}
+		})
+	}
+}
+
+func TestThreatFilePollingWithClock(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+	path := filepath.Join(t.TempDir(), "threat-level")
+	write := func(level string) {
+		if err := os.WriteFile(path, []byte(level), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("normal")
+	if threatFileElevated(path) {
+		t.Fatal("normal level read as elevated")
+	}
+	write("critical")
+	clk.Advance(threatFileInterval - time.Second)
+	if threatFileElevated(path) {
+		t.Error("control file re-read before threatFileInterval")
+	}
+	clk.Advance(time.Second)
+	if !threatFileElevated(path) {
+		t.Error("control file not re-read after threatFileInterval")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(threatFileInterval)
+	if threatFileElevated(path) {
+		t.Error("missing control file read as elevated")
+	}
+}
+
+func TestPassExpiresWithClock(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+	srv := turnstiletest.NewServer(t)
+	srv.UseClock(clk)
+
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.PreverifyPath = "/preverify"
+	conf.PassSecret = "pass-secret"
+	conf.PassTTLSeconds = 60
+
+	preverify := func(token string) string {
+		env := turnstiletest.RunAccess(t, conf, test.Request{
+			Method:  "GET",
+			Url:     "http://example.com/preverify",
+			Headers: http.Header{DefaultTokenHeader: {token}},
+		})
+		var answer struct {
+			Pass string `json:"pass"`
+		}
+		if err := json.Unmarshal(env.ClientRes.Body, &answer); err != nil || answer.Pass == "" {
+			t.Fatalf("no pass issued: status %d, body %q", env.ClientRes.Status, env.ClientRes.Body)
+		}
+		return answer.Pass
+	}
+	usePass := func(pass string) string {
+		env := turnstiletest.RunAccess(t, conf, test.Request{
+			Method:  "GET",
+			Url:     "http://example.com/api",
+			Headers: http.Header{DefaultPassHeader: {pass}},
+		})
+		return decisionReason(t, env)
+	}
+
+	early, late := preverify("token-"+t.Name()+"-1"), preverify("token-"+t.Name()+"-2")
+	clk.Advance(59 * time.Second)
+	if got := usePass(early); got != string(ReasonPass) {
+		t.Errorf("pass within pass_ttl_seconds: reason = %q, want %q", got, ReasonPass)
+	}
+	clk.Advance(2 * time.Second)
+	if got := usePass(late); got == string(ReasonPass) {
+		t.Error("pass accepted after pass_ttl_seconds")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"slices"
+)
+
+// --- Config Compatibility ---
+// Fields restructured into newer configuration objects keep working: at
+// load time the flat token_location/token_name fields are mapped to the
+// extraction object they are equivalent to, one step for Turnstile and a
+// fallback per additional provider, and the single flow_token_secret,
+// pass_secret and session_secret join their key rings as the legacy key
+// (see compileKeyRing). remote_ip_location/remote_ip_name keep configuring
+// the client IP lookup extraction.remote_ip now covers. Each deprecated
+// field in use is logged once per configuration as
+//
+//	turnstile: deprecated config field=token_location replacement="..." config_hash=...
+//
+// with the hash support bundles and config change lines show, so operators
+// can find the configurations still to migrate. lint-config reports the
+// same fields.
+
+// deprecatedFields maps fields kept for compatibility to what replaces them.
+var deprecatedFields = map[string]string{
+	"token_location":     "use the extraction object or extraction_pipelines",
+	"token_name":         "use the extraction object or extraction_pipelines",
+	"remote_ip_location": "use extraction.remote_ip",
+	"remote_ip_name":     "use extraction.remote_ip",
+	"flow_token_secret":  "use flow_token_keys, which can be rotated without invalidating flows in progress",
+	"pass_secret":        "use pass_keys, which can be rotated without invalidating passes handed out",
+	"session_secret":     "use session_keys, which can be rotated without ending sessions",
+}
+
+// deprecatedFieldsInUse returns the deprecated fields conf sets, sorted.
+func deprecatedFieldsInUse(conf *Config) []string {
+	set := map[string]bool{
+		"token_location":     conf.TokenLocation != "",
+		"token_name":         conf.TokenName != "",
+		"remote_ip_location": conf.RemoteIPLocation != "",
+		"remote_ip_name":     conf.RemoteIPName != "",
+		"flow_token_secret":  conf.FlowTokenSecret != "",
+		"pass_secret":        conf.PassSecret != "",
+		"session_secret":     conf.SessionSecret != "",
+	}
+	var fields []string
+	for _, field := range slices.Sorted(maps.Keys(deprecatedFields)) {
+		if set[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// logDeprecations logs the deprecated fields conf uses.
+func logDeprecations(conf *Config, hash string) {
+	for _, field := range deprecatedFieldsInUse(conf) {
+		log.Printf("turnstile: deprecated config field=%s replacement=%q config_hash=%s", field, deprecatedFields[field], shortHash(hash))
+	}
+}
+
+// legacyExtraction maps token_location/token_name to the equivalent
+// extraction object: the Turnstile token under token_name, then each
+// additional provider's under its token_name, all at token_location.
+func legacyExtraction(cc *compiledConfig) *ExtractionConfig {
+	ex := &ExtractionConfig{Location: cc.tokenLocation, Name: cc.tokenName}
+	for _, p := range cc.providers[1:] {
+		if p.name == "" || p.tokenName == "" {
+			continue // Reported by validateProviders
+		}
+		ex.Fallbacks = append(ex.Fallbacks, ExtractionStep{Location: cc.tokenLocation, Name: p.tokenName, Provider: p.name})
+	}
+	return ex
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+// --- Conditional Requests ---
+// Cache revalidations (GET/HEAD with If-None-Match or If-Modified-Since)
+// mostly end in a 304 and carry nothing worth protecting, while challenging
+// them defeats browser and CDN caching. With conditional_requests 'relaxed'
+// they skip token verification.
+
+// isConditionalRevalidation reports whether the request is a cache revalidation.
+func (r *requestState) isConditionalRevalidation() bool {
+	method, err := r.kong.Request.GetMethod()
+	if err != nil || (method != http.MethodGet && method != http.MethodHead) {
+		return false
+	}
+	for _, header := range []string{"If-None-Match", "If-Modified-Since"} {
+		if value, err := r.kong.Request.GetHeader(header); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1029 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// --- Configuration Struct ---
+// Holds the configuration parameters defined in Kong's config (kong.conf or CRD)
+type Config struct {
+	TurnstileSecretKey string `json:"turnstile_secret_key"` // REQUIRED: Your Cloudflare Turnstile Secret Key
+	TurnstileVerifyURL string `json:"turnstile_verify_url"` // Optional: Override default verification URL; 'unix:///<socket>[:/<path>]' for a local sidecar
+	TokenLocation      string `json:"token_location"`       // Optional: Where to find the token ('header', 'form', 'cookie', 'body_json'). Default: 'header'
+	TokenName          string `json:"token_name"`           // Optional: Name of header or form field. Default: 'Cf-Turnstile-Response'
+	RemoteIPLocation   string `json:"remote_ip_location"`   // Optional: Where to find client IP ('header', 'pdk'). Default: 'pdk'
+	RemoteIPName       string `json:"remote_ip_name"`       // Optional: Header name if location is 'header'. Default: 'X-Forwarded-For'
+	RequestTimeoutMs   int    `json:"request_timeout_ms"`   // Optional: Timeout for Cloudflare API call. Default: 5000ms
+	MaxResponseBytes   int64  `json:"max_response_bytes"`   // Optional: Largest siteverify response body accepted. Default: 65536
+	MaxBodyBytes       int64  `json:"max_body_bytes"`       // Optional: Largest request body read for token extraction, checked before reading. Default: 1048576
+	StreamMode         string `json:"stream_mode"`          // Optional: Stream (TCP/TLS) routes: 'allow' connections unverified or 'deny' them. Default: 'allow'
+	BatchMode          string `json:"batch_mode"`           // Optional: 'single' (one token per request) or 'per_item' (JSON array body, token per item). Default: 'single'
+	BatchTokenField    string `json:"batch_token_field"`    // Optional: Item field holding the token in 'per_item' mode. Default: 'cf-turnstile-response'
+	BatchMaxItems      int    `json:"batch_max_items"`      // Optional: Largest batch verified in 'per_item' mode. Default: 10
+
+	StripToken *bool `json:"strip_token"` // Optional: Remove the token from headers, cookies, query and body before proxying; bodies are rewritten without the field, the rest kept byte for byte (see striptoken.go). Default: true
+
+	Provider string `json:"provider"` // Optional: Kind of the primary provider: 'turnstile', 'hcaptcha', 'recaptcha_v2' or 'recaptcha_v3' (see providers.go). Default: 'turnstile'
+
+	RateLimitStrategy      string `json:"rate_limit_strategy"`       // Optional: Where the buckets of attempt_limit, verify_quota, penalty_threshold and block_threshold live: 'local' (per plugin server) or 'redis' (see buckets.go). Default: 'local'
+	RateLimitRedis         string `json:"rate_limit_redis"`          // Optional: Redis 'host:port' of rate_limit_strategy 'redis'
+	RateLimitRedisPassword string `json:"rate_limit_redis_password"` // Optional: Redis AUTH password
+	RateLimitRedisDatabase int    `json:"rate_limit_redis_database"` // Optional: Redis database. Default: 0
+
+	AttemptLimit              int `json:"attempt_limit"`                // Optional: Token-bearing requests per client IP per window; more get 429 (see limits.go). Default: 0 (off)
+	AttemptLimitWindowSeconds int `json:"attempt_limit_window_seconds"` // Optional: Window of attempt_limit. Default: 60
+
+	VerifyQuota              int `json:"verify_quota"`                // Optional: Siteverify calls per provider secret per window; more are held back under rate_limited_policy. Default: 0 (off)
+	VerifyQuotaWindowSeconds int `json:"verify_quota_window_seconds"` // Optional: Window of verify_quota. Default: 1
+
+	PenaltyThreshold     int `json:"penalty_threshold"`      // Optional: Client failures per IP per window that ban the IP. Default: 0 (off)
+	PenaltyWindowSeconds int `json:"penalty_window_seconds"` // Optional: Window of penalty_threshold. Default: 300
+	PenaltyBanSeconds    int `json:"penalty_ban_seconds"`    // Optional: Length of a ban. Default: 600
+
+	Preset string `json:"preset"` // Optional: Preset of the TURNSTILE_PRESETS file filling unset fields, unless a route tag 'turnstile-preset:<name>' names another (see presets.go). Default: 'default' if the file has one
+
+	VerifyCacheTTLSeconds int `json:"verify_cache_ttl_seconds"` // Optional: Reuse successful verifications of a resent token, capped to its remaining validity. Default: 0 (off)
+
+	VerifyCacheFailureTTLSeconds int `json:"verify_cache_failure_ttl_seconds"` // Optional: Answer a resent token the provider rejected as invalid or redeemed with the same rejection this long, up to 300. Default: 0 (off)
+
+	VerifyCacheMaxEntries int `json:"verify_cache_max_entries"` // Optional: Entries each verification cache holds per plugin server, shared by all instances, which use the largest value configured. Default: TURNSTILE_VERIFY_CACHE_ENTRIES or 100000
+
+	IdempotencyWindowSeconds int    `json:"idempotency_window_seconds"` // Optional: Accept retries with the same idempotency key and token this long without asking the provider, up to 300. Default: 0 (off)
+	IdempotencyHeader        string `json:"idempotency_header"`         // Optional: Header carrying the idempotency key. Default: 'Idempotency-Key'
+
+	InternalErrorRetries *int `json:"internal_error_retries"` // Optional: Retries of siteverify answers with 'internal-error', up to 5; 0 disables them. Default: 2
+
+	RateLimitedPolicy    string `json:"rate_limited_policy"`      // Optional: Clients' fate while the provider answers 429: 'fail_closed' (503), 'fail_open' or 'queue'. Default: 'fail_closed'
+	RateLimitedMaxWaitMs int    `json:"rate_limited_max_wait_ms"` // Optional: Longest Retry-After waited out under 'queue'. Default: 2000
+	FailureMode          string `json:"failure_mode"`             // Optional: Clients' fate while the provider is unreachable, times out or answers with an error: 'closed' (502) or 'open'. Default: 'closed'
+	FailOpenHeader       string `json:"fail_open_header"`         // Optional: Upstream header receiving the cause of fail-open allowances, e.g. 'rate_limited'; client values are removed
+
+	CircuitBreakerFailures        int `json:"circuit_breaker_failures"`         // Optional: Consecutive failed siteverify calls after which calls are short-circuited under failure_mode. Default: 0 (off)
+	CircuitBreakerCooldownSeconds int `json:"circuit_breaker_cooldown_seconds"` // Optional: How long an open circuit breaker short-circuits calls, up to 3600. Default: 30
+
+	StreamedBodyPolicy   string `json:"streamed_body_policy"`    // Optional: Chunked bodies beyond max_body_bytes: 'reject' (413), 'header' (header/query extraction only) or 'skip'. Default: 'reject'
+	MaxBufferedBodyBytes int64  `json:"max_buffered_body_bytes"` // Optional: Cap on body bytes buffered across in-flight requests; beyond it requests get 503. Default: 67108864
+
+	ConditionalRequests string `json:"conditional_requests"` // Optional: 'enforce' or 'relaxed' (GET/HEAD revalidations skip verification). Default: 'enforce'
+	EnforcementMode     string `json:"enforcement_mode"`     // Optional: 'enforce' or 'advise' (forward failing requests with X-Challenge-Advised). Default: 'enforce'
+
+	EmergencyBypassUntil string `json:"emergency_bypass_until"` // Optional: RFC 3339 time until which rejections are forwarded and audited, at most 72h ahead (see emergencybypass.go)
+
+	DebugPassthroughCIDRs []string `json:"debug_passthrough_cidrs"` // Optional, debug only: Clients in these ranges get the raw siteverify JSON on failure
+
+	ThreatLevelEnv             string `json:"threat_level_env"`               // Optional: Environment variable holding the threat level ('elevated', 'high', 'critical' or > 0)
+	ThreatLevelFile            string `json:"threat_level_file"`              // Optional: Control file holding the threat level, re-read every 5s
+	ThreatLevelHeader          string `json:"threat_level_header"`            // Optional: Request header holding the threat level, e.g. set by an upstream WAF
+	ElevatedMaxTokenAgeSeconds int    `json:"elevated_max_token_age_seconds"` // Optional: Max challenge age while elevated. Default: 60
+
+	ThreatLevelHeaderCIDRs []string `json:"threat_level_header_cidrs"` // Optional: Peers whose threat_level_header is honored, e.g. the WAF in front of Kong; required with threat_level_header
+
+	InteractiveHintHeader         string `json:"interactive_hint_header"`           // Optional: Header the frontend sets ('1', 'true' or 'interactive') when the widget ran an interactive challenge
+	InteractiveMaxTokenAgeSeconds int    `json:"interactive_max_token_age_seconds"` // Optional: Max challenge age while elevated for hinted requests. Default: 180
+
+	MaxTokenAgeSeconds int `json:"max_token_age_seconds"` // Optional: Reject tokens whose challenge was solved longer ago than this, up to 300; tighter than the elevated window if both apply. Default: 0 (off)
+
+	MaxClockSkewSeconds int `json:"max_clock_skew_seconds"` // Optional: How far in the future a challenge_ts is taken as "now"; beyond, the token's age is unknown. Default: 5
+
+	FlowTokenSecret     string   `json:"flow_token_secret"`      // Optional: Enables multi-step flow tokens, signed with this secret
+	FlowTokenHeader     string   `json:"flow_token_header"`      // Optional: Header carrying flow tokens both ways. Default: 'X-Turnstile-Flow'
+	FlowTokenTTLSeconds int      `json:"flow_token_ttl_seconds"` // Optional: Lifetime of a flow. Default: 600
+	FlowSteps           int      `json:"flow_steps"`             // Optional: Requests accepted with flow tokens after the verified one. Default: 3
+	FlowPaths           []string `json:"flow_paths"`             // Optional: Path prefixes accepting flow tokens instead of a Turnstile token
+
+	FlowTokenKeys []SigningKeyConfig `json:"flow_token_keys"` // Optional: Key ring for flow tokens, first key signs; flow_token_secret stays accepted alongside
+	PassKeys      []SigningKeyConfig `json:"pass_keys"`       // Optional: Key ring for passes, first key signs; pass_secret stays accepted alongside
+
+	PreverifyPath  string `json:"preverify_path"`   // Optional: Path answered by the plugin with a pass for a verified token
+	PassSecret     string `json:"pass_secret"`      // Optional: Enables passes, signed with this secret. Required with preverify_path
+	PassHeader     string `json:"pass_header"`      // Optional: Header carrying the pass on later requests. Default: 'X-Turnstile-Pass'
+	PassTTLSeconds int    `json:"pass_ttl_seconds"` // Optional: Lifetime of a pass. Default: 60
+	PassBindIP     bool   `json:"pass_bind_ip"`     // Optional: Only accept a pass from the IP it was issued to. Default: false
+
+	ReceiptCookie     string `json:"receipt_cookie"`      // Optional: preverify_path also sets a receipt in this cookie, accepted instead of a token from the same Referer page
+	ReceiptTTLSeconds int    `json:"receipt_ttl_seconds"` // Optional: Lifetime of a receipt. Default: 300
+
+	PassCookie        string `json:"pass_cookie"`         // Optional: Deliver passes in this HttpOnly cookie, bound to a value the client echoes in pass_binding_header
+	PassBindingHeader string `json:"pass_binding_header"` // Optional: Header carrying the double-submit value of pass cookies. Default: 'X-Turnstile-Binding'
+
+	SessionCookie     string             `json:"session_cookie"`      // Optional: Set this signed HttpOnly cookie after a successful verification; requests carrying it skip verification until it expires
+	SessionSecret     string             `json:"session_secret"`      // Optional: Secret signing session cookies. Required with session_cookie unless session_keys is set
+	SessionKeys       []SigningKeyConfig `json:"session_keys"`        // Optional: Key ring for session cookies, first key signs; session_secret stays accepted alongside
+	SessionTTLSeconds int                `json:"session_ttl_seconds"` // Optional: Lifetime of a session cookie. Default: 1800
+	SessionBindIP     bool               `json:"session_bind_ip"`     // Optional: Only accept a session cookie from the IP it was issued to. Default: false
+
+	EdgeAssertionHeader        string             `json:"edge_assertion_header"`          // Optional: Header in which a gateway in front vouches for a token it verified, e.g. 'X-Edge-Turnstile'; never passed upstream
+	EdgeAssertionKeys          []SigningKeyConfig `json:"edge_assertion_keys"`            // Optional: Key ring the gateway signs assertions with. Required with edge_assertion_header
+	EdgeAssertionMaxAgeSeconds int                `json:"edge_assertion_max_age_seconds"` // Optional: Oldest assertion accepted, up to 300. Default: 30
+
+	CloudflareAPIToken  string `json:"cloudflare_api_token"`  // Optional: API token with 'Account Filter Lists Edit'; enables pushing failing IPs
+	CloudflareAccountID string `json:"cloudflare_account_id"` // Optional: Account owning the list. Required with cloudflare_api_token
+	CloudflareListID    string `json:"cloudflare_list_id"`    // Optional: IP List receiving failing IPs. Required with cloudflare_api_token
+	CloudflareAPIURL    string `json:"cloudflare_api_url"`    // Optional: Override the Cloudflare API base URL
+	BlockThreshold      int    `json:"block_threshold"`       // Optional: Failures per IP within block_window_seconds before pushing. Default: 20
+	BlockWindowSeconds  int    `json:"block_window_seconds"`  // Optional: Failure counting window. Default: 300
+
+	FailureCounterRedis         string `json:"failure_counter_redis"`          // Optional: Redis 'host:port' where failures are counted in rate-limiting-advanced format
+	FailureCounterPassword      string `json:"failure_counter_password"`       // Optional: Redis AUTH password
+	FailureCounterDatabase      int    `json:"failure_counter_database"`       // Optional: Redis database. Default: 0
+	FailureCounterNamespace     string `json:"failure_counter_namespace"`      // Optional: Counter namespace, as in rate-limiting-advanced. Required with failure_counter_redis
+	FailureCounterWindowSeconds int    `json:"failure_counter_window_seconds"` // Optional: Counter window size. Default: 60
+
+	AnalyticsURL          string `json:"analytics_url"`           // Optional: Bulk endpoint receiving decision records as gzipped NDJSON, e.g. ClickHouse JSONEachRow
+	AnalyticsToken        string `json:"analytics_token"`         // Optional: Bearer token for analytics_url
+	AnalyticsHTTPClient   string `json:"analytics_http_client"`   // Optional: Profile for analytics_url calls. Default: 30s timeout, no retries
+	AnalyticsBatchSize    int    `json:"analytics_batch_size"`    // Optional: Records per batch. Default: 500
+	AnalyticsFlushSeconds int    `json:"analytics_flush_seconds"` // Optional: Longest wait before sending a partial batch. Default: 5
+	AnalyticsSpillDir     string `json:"analytics_spill_dir"`     // Optional: Directory keeping batches the endpoint did not accept, resent later
+
+	OTLPTracesURL     string            `json:"otlp_traces_url"`     // Optional: OTLP/HTTP endpoint receiving a span per siteverify call, e.g. 'http://otel-collector:4318/v1/traces'
+	OTLPHeaders       map[string]string `json:"otlp_headers"`        // Optional: Headers sent with every export, e.g. for authentication
+	OTLPHTTPClient    string            `json:"otlp_http_client"`    // Optional: Profile for otlp_traces_url calls. Default: 10s timeout, no retries
+	OTLPServiceName   string            `json:"otlp_service_name"`   // Optional: service.name of exported spans. Default: 'kong-turnstile-plugin'
+	OTLPSamplePercent float64           `json:"otlp_sample_percent"` // Optional: Share of requests without a traceparent whose calls start a new trace, in percent. Default: 0
+
+	SinkOverflowPolicy string `json:"sink_overflow_policy"` // Optional: Events reaching a full async sink queue: 'drop_newest', 'drop_oldest' or 'block'. Default: 'drop_newest'
+	SinkBlockMs        int    `json:"sink_block_ms"`        // Optional: Longest wait for queue room under 'block'. Default: 5
+
+	AdditionalProviders []ProviderConfig `json:"additional_providers"` // Optional: Providers accepted alongside Turnstile, e.g. during a migration
+
+	WidgetInjectPaths  []string `json:"widget_inject_paths"`   // Optional: Path prefixes of HTML pages the Turnstile widget is injected into
+	WidgetSiteKey      string   `json:"widget_site_key"`       // Optional: Site key of injected widgets. Required with widget_inject_paths
+	WidgetMaxBodyBytes int64    `json:"widget_max_body_bytes"` // Optional: Largest page rewritten, larger ones pass unchanged. Default: 524288
+
+	ChallengeSiteKey string `json:"challenge_site_key"` // Optional: Site key advertised in WWW-Authenticate and JSON bodies of rejections clients can fix. Default: widget_site_key
+	ChallengeStatus  int    `json:"challenge_status"`   // Optional: Status for requests without a token, e.g. 401. Default: 400
+
+	ResponsePolicies map[string]ResponsePolicyConfig `json:"response_policies"` // Optional: Status, headers and body template replacing the plugin's rejection response, by reason (see ResponsePolicyConfig)
+
+	ErrorFormat       string            `json:"error_format"`        // Optional: Body of rejections: 'text' or 'json' ({"error": "turnstile_failed", "reason": ..., "message": ...}). Default: 'text'
+	ErrorContentType  string            `json:"error_content_type"`  // Optional: Content-Type of JSON rejections. Default: 'application/json'
+	ErrorIncludeCodes bool              `json:"error_include_codes"` // Optional: Include the provider's error codes in JSON rejections as "codes". Default: false
+	ErrorMessages     map[string]string `json:"error_messages"`      // Optional: Go text/template replacing the rejection message, by reason
+
+	UpstreamHeaders map[string]string `json:"upstream_headers"` // Optional: Upstream headers of allowed requests, name to Go text/template over the verification, e.g. {'X-Verified': '{{.Hostname}}/{{.Action}}'}; client values are removed
+
+	VerificationHeaders     bool              `json:"verification_headers"`      // Optional: Pass the metadata of successful verifications upstream in X-Turnstile-* headers (see verificationheaders.go). Default: false
+	VerificationHeaderNames map[string]string `json:"verification_header_names"` // Optional: Header names by field ('verified', 'hostname', 'action', 'challenge_ts', 'cdata'); '' disables one
+
+	RequireHTTPS   bool     `json:"require_https"`   // Optional: Reject tokens submitted over plain HTTP. Default: false
+	AllowedOrigins []string `json:"allowed_origins"` // Optional: Origins tokens may be submitted from, e.g. 'https://*.example.com'; requests without a listed Origin (or Referer) are rejected
+
+	MaxTokenLength       int `json:"max_token_length"`       // Optional: Longest token passed to the provider, longer ones are malformed. Default: 2048 (Turnstile), 8192 (other schemas)
+	MalformedTokenStatus int `json:"malformed_token_status"` // Optional: Status for tokens failing pre-flight validation. Default: 400
+	InvalidTokenStatus   int `json:"invalid_token_status"`   // Optional: Status for tokens the provider rejects. Default: 403
+	ExpiredTokenStatus   int `json:"expired_token_status"`   // Optional: Status for tokens the provider reports expired or redeemed, and under the elevated threat level too old. Default: 403
+
+	HTTPClients          map[string]HTTPClientConfig `json:"http_clients"`           // Optional: Named outbound client profiles (see HTTPClientConfig)
+	VerifyHTTPClient     string                      `json:"verify_http_client"`     // Optional: Profile for siteverify calls. Default: request_timeout_ms, no retries
+	CloudflareHTTPClient string                      `json:"cloudflare_http_client"` // Optional: Profile for Cloudflare API calls. Default: 10s timeout, no retries
+
+	VerifiedIdentityHeader string `json:"verified_identity_header"` // Optional: Upstream header marking verified traffic, e.g. for mesh policies; client values are removed
+	VerifiedIdentityValue  string `json:"verified_identity_value"`  // Optional: Value of that header, e.g. 'spiffe://example.org/traffic/human-verified'. Default: 'human-verified'
+
+	MinScore    *float64 `json:"min_score"`    // Optional: Reject verified tokens whose Enterprise score is below this (0.0-1.0); tokens without a score pass, except for 'recaptcha_v3'. 0 disables the threshold. Default: none, or 0.5 for 'recaptcha_v3
+	ScoreHeader string   `json:"score_header"` // Optional: Upstream header receiving the Enterprise score; client values are removed
+
+	ReputationGoodFile     string `json:"reputation_good_file"`     // Optional: IPs/CIDRs (one per line) that skip the challenge
+	ReputationBadFile      string `json:"reputation_bad_file"`      // Optional: IPs/CIDRs refused outright; ipsum-style '<ip> <score>' lines are accepted
+	ReputationBadMinScore  int    `json:"reputation_bad_min_score"` // Optional: Lowest score of a reputation_bad_file entry that blocks. Default: 1
+	ReputationURL          string `json:"reputation_url"`           // Optional: Endpoint answering GET ?ip= with {"verdict": "good"|"bad"|"unknown"}
+	ReputationHTTPClient   string `json:"reputation_http_client"`   // Optional: Profile for reputation_url calls. Default: 1s timeout, no retries
+	ReputationCacheSeconds int    `json:"reputation_cache_seconds"` // Optional: How long reputation_url verdicts are reused. Default: 300
+
+	SpotCheckPercent map[string]float64 `json:"spot_check_percent"` // Optional: Share of requests let through by 'skip_rules', 'reputation' or 'bot_verdict' whose token is verified in the background, in percent by rule. Default: none
+
+	SkipMethods []string `json:"skip_methods"` // Optional: Methods let through without a token, e.g. ['OPTIONS']
+	SkipPaths   []string `json:"skip_paths"`   // Optional: Paths let through without a token: globs ('*' spans '/') or, prefixed with '~', regular expressions
+	SkipHosts   []string `json:"skip_hosts"`   // Optional: Hosts let through without a token, exact or '*.example.com' (subdomains only)
+	SkipInvert  bool     `json:"skip_invert"`  // Optional: Verify only requests matching the skip rules and let all others through. Default: false
+
+	ProbeIntervalSeconds int `json:"probe_interval_seconds"` // Optional: Send every provider a canary verification this often, see GET /probes. Default: 0 (off)
+
+	ExportedResponseFields []string `json:"exported_response_fields"` // Optional: siteverify fields published with the decision and logged, of 'hostname', 'action', 'challenge_ts', 'cdata', 'error_codes', 'score'. Default: ['hostname', 'action', 'error_codes', 'score']
+
+	ExpectedActions []string       `json:"expected_actions"` // Optional: Widget actions accepted; tokens solved for other actions are rejected
+	Tenants         []TenantConfig `json:"tenants"`          // Optional: Per-host overrides for multi-tenant routes, first match wins (see TenantConfig)
+
+	ExpectedActionHeader string `json:"expected_action_header"` // Optional: Request header in which an earlier plugin names this request's expected action(s), narrowing expected_actions; removed before proxying
+
+	ExpectedHostnames []string `json:"expected_hostnames"` // Optional: Hostnames the widget must have been solved on, exact or '*.example.com' (subdomains only); tokens solved elsewhere are rejected
+	ExpectedCData     string   `json:"expected_cdata"`     // Optional: cdata the widget must have been given; an earlier plugin can set a per-request value in kong.ctx.shared.turnstile_expected_cdata
+
+	BotVerdictPolicies map[string]string `json:"bot_verdict_policies"` // Optional: Handling per verdict an earlier plugin puts in kong.ctx.shared.turnstile_bot_verdict: 'block', 'challenge', 'relax' or 'verify'
+
+	Extraction          *ExtractionConfig           `json:"extraction"`           // Optional: Structured token/IP lookup, replacing the flat token_* and remote_ip_* fields
+	ExtractionPipelines map[string][]ExtractionStep `json:"extraction_pipelines"` // Optional: Named, ordered token lookups (see ExtractionStep)
+	ExtractionPipeline  string                      `json:"extraction_pipeline"`  // Optional: Pipeline used by this instance instead of token_location/token_name
+
+	MultiValuePolicy string `json:"multi_value_policy"` // Optional: Form fields/query arguments given more than once, or as 'name[]': 'first', 'last' or 'reject' (400). Default: 'first'
+
+	ShareVerification bool `json:"share_verification"` // Optional: Let later instances of the plugin running for the same request reuse this instance's verification (see dedup.go). Default: false
+
+	Chaos *ChaosConfig `json:"chaos"` // Optional, staging only: Inject slow and failing verifications; needs TURNSTILE_CHAOS=1 (see ChaosConfig)
+
+	compileOnce sync.Once       // Guards compiled; Kong keeps one Config per plugin instance
+	compiled    *compiledConfig // Derived settings, see Config.settings
+
+	lastConfigCheck atomic.Int64 // Unix nanoseconds, see checkConfigDrift
+}
+
+// ProviderConfig describes an additional siteverify-compatible provider
+// (hCaptcha, reCAPTCHA, a second Turnstile account, ...). Requests are routed
+// to it when they carry a token under its token_name.
+type ProviderConfig struct {
+	Name      string `json:"name"`       // REQUIRED: Identifier used in logs and counters, e.g. 'recaptcha'
+	SecretKey string `json:"secret_key"` // REQUIRED: Secret key for this provider
+	VerifyURL string `json:"verify_url"` // Optional: Verification endpoint. Default: the schema's, e.g. 'https://www.google.com/recaptcha/api/siteverify'
+	TokenName string `json:"token_name"` // Optional: Header or form field carrying this provider's token (same token_location). Default: the schema's widget field, e.g. 'g-recaptcha-response'
+	Schema    string `json:"schema"`     // Optional: Provider kind: 'turnstile', 'hcaptcha', 'recaptcha_v2' ('recaptcha') or 'recaptcha_v3'. Default: 'turnstile'
+
+	SiteKey  string   `json:"site_key"`  // Optional: Site key, checked by hCaptcha
+	MinScore *float64 `json:"min_score"` // Optional: Score threshold of this provider (0.0-1.0); 0 disables it. Default: min_score, or 0.5 for 'recaptcha_v3'
+}
+
+// --- Derived Configuration ---
+// compiledConfig holds everything derived from Config that would otherwise be
+// recomputed on every request: normalized defaults, parsed durations and, as
+// features need them, compiled patterns. It is immutable once built.
+type compiledConfig struct {
+	hash string // Hex SHA-256 of the JSON-encoded Config
+	err  error  // Non-nil if the configuration is unusable
+
+	lastUsed atomic.Int64 // Unix nanoseconds, the one mutable field, see markUsed
+
+	redacted map[string]interface{} // Source configuration with secrets redacted, for support bundles
+
+	verifyURL           string
+	timeout             time.Duration
+	maxResponseBytes    int64
+	maxBodyBytes        int64
+	maxBufferedBody     int64
+	streamedBodyPolicy  string
+	tokenLocation       string
+	tokenName           string
+	remoteIPLocation    string
+	remoteIPName        string
+	providers           []*provider      // Primary (Turnstile) provider first
+	extraction          []extractionStep // Token lookup pipeline
+	streamMode          string
+	conditionalRequests string
+	enforcementMode     string
+	batchMode           string
+	batchTokenField     string
+	batchMaxItems       int
+
+	debugPassthroughCIDRs []netip.Prefix
+
+	cloudflareList *cloudflareList // nil when the list integration is disabled
+	verifyClient   *httpClient
+
+	threatLevelEnv      string
+	threatLevelFile     string
+	threatLevelHeader   string
+	threatHeaderCIDRs   []netip.Prefix // Peers threatLevelHeader is taken from
+	elevatedMaxTokenAge time.Duration
+	maxTokenAge         time.Duration // Zero when token age is only checked while elevated
+
+	interactiveHintHeader string // Empty when hints are ignored
+	interactiveMaxAge     time.Duration
+
+	maxClockSkew time.Duration // See challengets.go
+
+	flowKeys   *keyRing // nil when flow tokens are disabled
+	flowHeader string
+	flowTTL    time.Duration
+	flowSteps  int
+	flowPaths  []string
+
+	preverifyPath string
+	passKeys      *keyRing // nil when passes are disabled
+	passHeader    string
+	passTTL       time.Duration
+	passBindIP    bool
+
+	verifyCacheTTL        time.Duration // Zero when successful verifications are not cached
+	verifyCacheMaxEntries int           // Zero keeps the plugin server's default, see verifycache.go
+
+	verifyCacheFailureTTL time.Duration // Zero when rejections are not cached
+
+	idempotencyWindow time.Duration // Zero when idempotent retries are verified again
+	idempotencyHeader string
+
+	rateLimitedPolicy  string
+	rateLimitedMaxWait time.Duration
+	failureMode        string
+
+	breakerFailures int // Zero when the circuit breaker is off, see breaker.go
+	breakerCooldown time.Duration
+
+	internalErrorRetries int
+
+	receiptCookie string // Empty when receipts are disabled
+	receiptTTL    time.Duration
+
+	passCookie        string // Empty when passes are delivered in the response body
+	passBindingHeader string
+
+	sessionCookie string   // Empty when sessions are disabled
+	sessionKeys   *keyRing // nil when sessions are disabled
+	sessionTTL    time.Duration
+	sessionBindIP bool
+
+	edgeAssertionHeader string // Empty when edge assertions are disabled, see edgeassertion.go
+	edgeAssertionKeys   *keyRing
+	edgeAssertionMaxAge time.Duration
+
+	widgetPaths        []string
+	widgetSiteKey      string
+	widgetMaxBodyBytes int64
+
+	challengeSiteKey string // Empty when challenge requirements are not advertised
+
+	requireHTTPS   bool
+	allowedOrigins []string // Normalized, empty when Origin is not checked
+
+	maxTokenLength int            // Zero picks the schema's default, see tokenclass.go
+	tokenStatuses  map[Reason]int // Configured statuses by rejection class
+
+	responsePolicies map[Reason]*responsePolicy // By rejection reason, see responsepolicy.go
+
+	errorFormat       string
+	errorContentType  string
+	errorIncludeCodes bool
+	errorMessages     map[Reason]*template.Template // By rejection reason, see errorbody.go
+
+	failureCounter *failureCounter    // nil when failures are not counted in Redis
+	analytics      *analyticsExporter // nil when decisions are not exported
+
+	rateLimiter  *rateLimiter // See buckets.go
+	attemptLimit bucketLimit  // Zero when off, see limits.go
+	verifyQuota  bucketLimit
+	penalty      bucketLimit
+	penaltyBan   time.Duration
+
+	tracing           *spanExporter // nil when siteverify calls are not traced, see tracing.go
+	otlpSamplePercent float64
+
+	emergencyBypassUntil time.Time // Zero without a configured emergency bypass
+
+	sinkOverflow sinkOverflow
+
+	reputation        *reputationSource // nil when no reputation source is configured
+	probeInterval     time.Duration     // Zero when probing is disabled
+	shareVerification bool
+
+	failOpenHeader string // Empty when fail-open allowances are not stamped
+
+	identityHeader string // Empty when identity stamping is disabled
+	identityValue  string
+
+	scoreHeader string // Empty when scores are not forwarded
+
+	expectedActions []string // Empty accepts any action
+	tenants         []*tenant
+
+	expectedActionHeader string // Empty when actions are not taken from a header, see action.go
+
+	botVerdictPolicies map[string]string // By lowercased verdict, see botverdict.go
+
+	expectedHostnames []string // Lowercased patterns, see expected.go
+	expectedCData     string
+
+	spotCheckPercent map[string]float64 // By skip rule, see spotcheck.go
+
+	skipRules *skipRules // nil without skip_* rules, see skiprules.go
+
+	upstreamHeaders []upstreamHeader // Sorted by name, see upstreamheaders.go
+
+	verificationHeaders []verificationHeader // nil when verification_headers is off
+
+	stripToken bool // See striptoken.go
+
+	exportedFields map[string]bool // siteverify fields that may leave the plugin, see exported_response_fields
+	secretIDs      map[string]bool // Secret IDs of the providers, the epochs accepted, see rotation.go
+
+	chaos *chaosSettings // nil unless chaos is configured and enabled
+}
+
+// compiledConfigs caches compiledConfig values by config hash, so instances
+// sharing identical configuration (e.g. the same plugin on several routes)
+// share a single copy and a config push does not recompile unchanged ones.
+// Every config push (secret rotation, declarative reload) adds the new
+// hashes, so configurations no instance has used for compiledConfigIdle are
+// dropped whenever another one is compiled, and one a route was switched
+// away from is dropped once no route runs it (see configwatch.go); either
+// stops its probers (see probe.go). Instances keep their own pointer, so a
+// dropped configuration still serves a rarely used route; its next use puts
+// it back.
+var compiledConfigs sync.Map // map[string]*compiledConfig
+
+// compiledConfigIdle is how long a compiled configuration stays cached
+// without requests.
+const compiledConfigIdle = 10 * time.Minute
+
+// settings returns the compiled form of the configuration, building it on
+// first use for this plugin instance.
+func (conf *Config) settings() *compiledConfig {
+	conf.compileOnce.Do(func() {
+		conf.compiled = compileConfig(conf)
+	})
+	conf.compiled.markUsed(clock.Now())
+	return conf.compiled
+}
+
+// markUsed records that an instance used cc at now. Uses are recorded once a
+// minute at most, which puts cc back into compiledConfigs after an eviction.
+func (cc *compiledConfig) markUsed(now time.Time) {
+	last := cc.lastUsed.Load()
+	if now.UnixNano()-last < int64(time.Minute) || !cc.lastUsed.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	if _, loaded := compiledConfigs.LoadOrStore(cc.hash, cc); !loaded {
+		startProbes(cc)
+	}
+}
+
+// evictIdleConfigs drops compiled configurations unused since compiledConfigIdle.
+func evictIdleConfigs(now time.Time) {
+	compiledConfigs.Range(func(hash, v interface{}) bool {
+		if now.UnixNano()-v.(*compiledConfig).lastUsed.Load() >= int64(compiledConfigIdle) {
+			dropConfig(hash.(string))
+		}
+		return true
+	})
+}
+
+// dropConfig removes the configuration with hash from compiledConfigs and
+// stops the probers only it used. Instances still holding it put it back on
+// their next use (see markUsed).
+func dropConfig(hash string) {
+	if v, ok := compiledConfigs.Load(hash); ok && compiledConfigs.CompareAndDelete(hash, v) {
+		stopProbes(v.(*compiledConfig))
+	}
+}
+
+// configHash returns a stable fingerprint of the configuration.
+func configHash(conf *Config) string {
+	raw, _ := json.Marshal(conf) // Config only holds JSON-friendly types
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// compileConfig normalizes conf, reusing a previously compiled copy with the same hash.
+func compileConfig(conf *Config) *compiledConfig {
+	hash := configHash(conf)
+	if cached, ok := compiledConfigs.Load(hash); ok {
+		return cached.(*compiledConfig)
+	}
+
+	cc := &compiledConfig{
+		hash:                hash,
+		redacted:            redactedConfig(conf),
+		verifyURL:           conf.TurnstileVerifyURL,
+		timeout:             time.Duration(DefaultTimeoutMs) * time.Millisecond,
+		maxResponseBytes:    DefaultMaxResponseBytes,
+		maxBodyBytes:        DefaultMaxBodyBytes,
+		maxBufferedBody:     DefaultMaxBufferedBytes,
+		tokenLocation:       strings.ToLower(conf.TokenLocation),
+		tokenName:           conf.TokenName,
+		remoteIPLocation:    strings.ToLower(conf.RemoteIPLocation),
+		remoteIPName:        conf.RemoteIPName,
+		streamMode:          strings.ToLower(conf.StreamMode),
+		conditionalRequests: strings.ToLower(conf.ConditionalRequests),
+		enforcementMode:     strings.ToLower(conf.EnforcementMode),
+		streamedBodyPolicy:  strings.ToLower(conf.StreamedBodyPolicy),
+		batchMode:           strings.ToLower(conf.BatchMode),
+		batchTokenField:     conf.BatchTokenField,
+		batchMaxItems:       conf.BatchMaxItems,
+
+		threatLevelEnv:      conf.ThreatLevelEnv,
+		threatLevelFile:     conf.ThreatLevelFile,
+		threatLevelHeader:   conf.ThreatLevelHeader,
+		elevatedMaxTokenAge: time.Duration(DefaultElevatedMaxAgeSec) * time.Second,
+
+		flowHeader: conf.FlowTokenHeader,
+		flowTTL:    time.Duration(DefaultFlowTTLSeconds) * time.Second,
+		flowSteps:  DefaultFlowSteps,
+		flowPaths:  conf.FlowPaths,
+
+		preverifyPath: conf.PreverifyPath,
+		passHeader:    conf.PassHeader,
+		passTTL:       time.Duration(DefaultPassTTLSeconds) * time.Second,
+		passBindIP:    conf.PassBindIP,
+	}
+	kind, kindOK := providerKind(conf.Provider)
+	if !kindOK {
+		kind = turnstileVerifier{} // Reported below
+	}
+	if cc.verifyURL == "" {
+		cc.verifyURL = kind.dialect().VerifyURL()
+	}
+	if conf.RequestTimeoutMs > 0 {
+		cc.timeout = time.Duration(conf.RequestTimeoutMs) * time.Millisecond
+	}
+	if conf.MaxResponseBytes > 0 {
+		cc.maxResponseBytes = conf.MaxResponseBytes
+	}
+	if conf.MaxBodyBytes > 0 {
+		cc.maxBodyBytes = conf.MaxBodyBytes
+	}
+	cc.stripToken = conf.StripToken == nil || *conf.StripToken
+	if conf.MaxBufferedBodyBytes > 0 {
+		cc.maxBufferedBody = conf.MaxBufferedBodyBytes
+	}
+	if cc.tokenLocation == "" {
+		cc.tokenLocation = "header" // Default to header
+	}
+	if cc.tokenName == "" && cc.tokenLocation == "body_json" {
+		cc.tokenName = DefaultBatchTokenField // The widget's form field name as JSON key
+	}
+	if cc.tokenName == "" {
+		cc.tokenName = kind.defaultTokenName() // Default header name
+	}
+	if cc.remoteIPLocation == "" {
+		cc.remoteIPLocation = "pdk" // Default to PDK
+	}
+	if cc.remoteIPName == "" {
+		cc.remoteIPName = DefaultRemoteIPHeader
+	}
+	if conf.ElevatedMaxTokenAgeSeconds > 0 {
+		cc.elevatedMaxTokenAge = time.Duration(conf.ElevatedMaxTokenAgeSeconds) * time.Second
+	}
+	cc.maxTokenAge = time.Duration(conf.MaxTokenAgeSeconds) * time.Second
+	cc.interactiveHintHeader = conf.InteractiveHintHeader
+	cc.interactiveMaxAge = time.Duration(DefaultInteractiveAgeSec) * time.Second
+	if conf.InteractiveMaxTokenAgeSeconds > 0 {
+		cc.interactiveMaxAge = time.Duration(conf.InteractiveMaxTokenAgeSeconds) * time.Second
+	}
+	cc.maxClockSkew = time.Duration(DefaultMaxClockSkewSec) * time.Second
+	if conf.MaxClockSkewSeconds > 0 {
+		cc.maxClockSkew = time.Duration(conf.MaxClockSkewSeconds) * time.Second
+	}
+	if cc.flowHeader == "" {
+		cc.flowHeader = DefaultFlowTokenHeader
+	}
+	if conf.FlowTokenTTLSeconds > 0 {
+		cc.flowTTL = time.Duration(conf.FlowTokenTTLSeconds) * time.Second
+	}
+	if conf.FlowSteps > 0 {
+		cc.flowSteps = conf.FlowSteps
+	}
+	if cc.passHeader == "" {
+		cc.passHeader = DefaultPassHeader
+	}
+	if conf.PassTTLSeconds > 0 {
+		cc.passTTL = time.Duration(conf.PassTTLSeconds) * time.Second
+	}
+	cc.verifyCacheTTL = time.Duration(conf.VerifyCacheTTLSeconds) * time.Second
+	cc.verifyCacheFailureTTL = time.Duration(conf.VerifyCacheFailureTTLSeconds) * time.Second
+	cc.verifyCacheMaxEntries = conf.VerifyCacheMaxEntries
+	cc.idempotencyWindow = time.Duration(conf.IdempotencyWindowSeconds) * time.Second
+	cc.idempotencyHeader = conf.IdempotencyHeader
+	if cc.idempotencyHeader == "" {
+		cc.idempotencyHeader = DefaultIdempotencyHeader
+	}
+	cc.rateLimitedPolicy = strings.ToLower(conf.RateLimitedPolicy)
+	if cc.rateLimitedPolicy == "" {
+		cc.rateLimitedPolicy = "fail_closed"
+	}
+	cc.failureMode = strings.ToLower(conf.FailureMode)
+	if cc.failureMode == "" {
+		cc.failureMode = "closed"
+	}
+	cc.breakerFailures = conf.CircuitBreakerFailures
+	cc.breakerCooldown = time.Duration(DefaultBreakerCooldownSeconds) * time.Second
+	if conf.CircuitBreakerCooldownSeconds != 0 {
+		cc.breakerCooldown = time.Duration(conf.CircuitBreakerCooldownSeconds) * time.Second
+	}
+	cc.rateLimitedMaxWait = time.Duration(DefaultRateLimitWaitMs) * time.Millisecond
+	cc.internalErrorRetries = DefaultInternalErrRetries
+	if conf.InternalErrorRetries != nil {
+		cc.internalErrorRetries = *conf.InternalErrorRetries
+	}
+	if conf.RateLimitedMaxWaitMs > 0 {
+		cc.rateLimitedMaxWait = time.Duration(conf.RateLimitedMaxWaitMs) * time.Millisecond
+	}
+	cc.sinkOverflow = sinkOverflow{policy: strings.ToLower(conf.SinkOverflowPolicy), wait: time.Duration(DefaultSinkBlockMs) * time.Millisecond}
+	if cc.sinkOverflow.policy == "" {
+		cc.sinkOverflow.policy = "drop_newest"
+	}
+	if conf.SinkBlockMs > 0 {
+		cc.sinkOverflow.wait = time.Duration(conf.SinkBlockMs) * time.Millisecond
+	}
+	cc.receiptCookie, cc.receiptTTL = conf.ReceiptCookie, time.Duration(DefaultReceiptTTLSeconds)*time.Second
+	if conf.ReceiptTTLSeconds > 0 {
+		cc.receiptTTL = time.Duration(conf.ReceiptTTLSeconds) * time.Second
+	}
+	cc.sessionCookie, cc.sessionBindIP = conf.SessionCookie, conf.SessionBindIP
+	cc.sessionTTL = time.Duration(DefaultSessionTTLSeconds) * time.Second
+	if conf.SessionTTLSeconds > 0 {
+		cc.sessionTTL = time.Duration(conf.SessionTTLSeconds) * time.Second
+	}
+	cc.passCookie, cc.passBindingHeader = conf.PassCookie, conf.PassBindingHeader
+	if cc.passBindingHeader == "" {
+		cc.passBindingHeader = DefaultPassBindingHeader
+	}
+	if cc.conditionalRequests == "" {
+		cc.conditionalRequests = "enforce"
+	}
+	if cc.streamedBodyPolicy == "" {
+		cc.streamedBodyPolicy = "reject"
+	}
+	if cc.enforcementMode == "" {
+		cc.enforcementMode = "enforce"
+	}
+	if cc.streamMode == "" {
+		cc.streamMode = "allow"
+	}
+	if cc.batchMode == "" {
+		cc.batchMode = "single"
+	}
+	if cc.batchTokenField == "" {
+		cc.batchTokenField = DefaultBatchTokenField
+	}
+	if cc.batchMaxItems <= 0 {
+		cc.batchMaxItems = DefaultBatchMaxItems
+	}
+
+	primaryName := "turnstile"
+	if kindOK && conf.Provider != "" {
+		primaryName = strings.ToLower(conf.Provider)
+	}
+	siteKey := conf.ChallengeSiteKey
+	if siteKey == "" {
+		siteKey = conf.WidgetSiteKey
+	}
+	cc.providers = []*provider{{
+		name:      primaryName,
+		verifyURL: cc.verifyURL,
+		secretKey: conf.TurnstileSecretKey,
+		siteKey:   siteKey,
+		tokenName: cc.tokenName,
+		schema:    primaryName,
+		kind:      kind,
+		stats:     statsForProvider(primaryName),
+	}}
+	for _, pc := range conf.AdditionalProviders {
+		p := &provider{
+			name:      pc.Name,
+			verifyURL: pc.VerifyURL,
+			secretKey: pc.SecretKey,
+			siteKey:   pc.SiteKey,
+			tokenName: pc.TokenName,
+			schema:    strings.ToLower(pc.Schema),
+			stats:     statsForProvider(pc.Name),
+		}
+		if pc.Schema == "" {
+			p.schema = "turnstile"
+		}
+		if p.kind, _ = providerKind(p.schema); p.kind != nil {
+			if p.verifyURL == "" {
+				p.verifyURL = p.kind.dialect().VerifyURL()
+			}
+			if p.tokenName == "" {
+				p.tokenName = p.kind.defaultTokenName()
+			}
+		}
+		cc.providers = append(cc.providers, p)
+	}
+	for i, p := range cc.providers {
+		// The provider's own threshold, then min_score, then the kind's default
+		switch {
+		case i > 0 && conf.AdditionalProviders[i-1].MinScore != nil:
+			p.minScore = *conf.AdditionalProviders[i-1].MinScore
+		case conf.MinScore != nil:
+			p.minScore = *conf.MinScore
+		case p.kind != nil:
+			p.minScore = p.kind.dialect().DefaultMinScore()
+		}
+	}
+
+	cc.secretIDs = make(map[string]bool, len(cc.providers))
+	for _, p := range cc.providers {
+		p.secretID = secretID(p.secretKey)
+		cc.secretIDs[p.secretID] = true
+	}
+
+	var socketErr error
+	for _, p := range cc.providers {
+		if p.verifyURL, socketErr = resolveUnixURL(p.verifyURL); socketErr != nil {
+			break
+		}
+	}
+
+	clients, clientErr := compileHTTPClients(conf)
+	if clientErr == nil {
+		cc.verifyClient, clientErr = resolveHTTPClient(clients, "verify_http_client", conf.VerifyHTTPClient,
+			defaultHTTPClient("verify", cc.timeout))
+	}
+
+	var listErr error
+	if conf.CloudflareAPIToken != "" {
+		cc.cloudflareList = &cloudflareList{
+			apiURL:    conf.CloudflareAPIURL,
+			apiToken:  conf.CloudflareAPIToken,
+			accountID: conf.CloudflareAccountID,
+			listID:    conf.CloudflareListID,
+			threshold: DefaultBlockThreshold,
+			window:    time.Duration(DefaultBlockWindowSeconds) * time.Second,
+		}
+		if cc.cloudflareList.apiURL == "" {
+			cc.cloudflareList.apiURL = DefaultCloudflareAPIURL
+		}
+		if conf.BlockThreshold > 0 {
+			cc.cloudflareList.threshold = conf.BlockThreshold
+		}
+		if conf.BlockWindowSeconds > 0 {
+			cc.cloudflareList.window = time.Duration(conf.BlockWindowSeconds) * time.Second
+		}
+		if conf.CloudflareAccountID == "" || conf.CloudflareListID == "" {
+			listErr = fmt.Errorf("cloudflare_api_token requires cloudflare_account_id and cloudflare_list_id")
+		} else {
+			cc.cloudflareList.client, listErr = resolveHTTPClient(clients, "cloudflare_http_client", conf.CloudflareHTTPClient,
+				defaultHTTPClient("cloudflare", 10*time.Second))
+		}
+	}
+
+	limitsErr := compileLimits(conf, cc)
+	var counterErr error
+	if conf.FailureCounterRedis != "" {
+		cc.failureCounter, counterErr = compileFailureCounter(conf)
+	}
+	var analyticsErr error
+	if clientErr == nil && conf.AnalyticsURL != "" {
+		cc.analytics, analyticsErr = compileAnalytics(conf, clients)
+	}
+	var tracingErr error
+	if clientErr == nil && conf.OTLPTracesURL != "" {
+		cc.tracing, tracingErr = compileTracing(conf, clients)
+	}
+	cc.otlpSamplePercent = conf.OTLPSamplePercent
+
+	if conf.ReputationGoodFile != "" || conf.ReputationBadFile != "" || conf.ReputationURL != "" {
+		cc.reputation = &reputationSource{
+			goodFile:    conf.ReputationGoodFile,
+			badFile:     conf.ReputationBadFile,
+			badMinScore: 1,
+			url:         conf.ReputationURL,
+			cacheTTL:    time.Duration(DefaultReputationCacheSec) * time.Second,
+		}
+		if conf.ReputationBadMinScore > 0 {
+			cc.reputation.badMinScore = conf.ReputationBadMinScore
+		}
+		if conf.ReputationCacheSeconds > 0 {
+			cc.reputation.cacheTTL = time.Duration(conf.ReputationCacheSeconds) * time.Second
+		}
+		if clientErr == nil {
+			cc.reputation.client, clientErr = resolveHTTPClient(clients, "reputation_http_client", conf.ReputationHTTPClient,
+				defaultHTTPClient("reputation", time.Second))
+		}
+	}
+
+	var cidrErr error
+	cc.debugPassthroughCIDRs, cidrErr = parseCIDRs("debug_passthrough_cidrs", conf.DebugPassthroughCIDRs)
+	if cidrErr == nil {
+		cc.threatHeaderCIDRs, cidrErr = parseCIDRs("threat_level_header_cidrs", conf.ThreatLevelHeaderCIDRs)
+	}
+	if cidrErr == nil && cc.threatLevelHeader != "" && len(cc.threatHeaderCIDRs) == 0 {
+		cidrErr = fmt.Errorf("threat_level_header requires threat_level_header_cidrs, the peers trusted to set it")
+	}
+
+	var keyErr error
+	cc.flowKeys, keyErr = compileKeyRing("flow_token_keys", conf.FlowTokenKeys, conf.FlowTokenSecret)
+	if keyErr == nil {
+		cc.passKeys, keyErr = compileKeyRing("pass_keys", conf.PassKeys, conf.PassSecret)
+	}
+	if keyErr == nil {
+		cc.sessionKeys, keyErr = compileKeyRing("session_keys", conf.SessionKeys, conf.SessionSecret)
+	}
+	if keyErr == nil {
+		cc.edgeAssertionKeys, keyErr = compileKeyRing("edge_assertion_keys", conf.EdgeAssertionKeys, "")
+	}
+	cc.edgeAssertionHeader = conf.EdgeAssertionHeader
+	cc.edgeAssertionMaxAge = time.Duration(DefaultEdgeAssertionMaxAgeSeconds) * time.Second
+	if conf.EdgeAssertionMaxAgeSeconds != 0 {
+		cc.edgeAssertionMaxAge = time.Duration(conf.EdgeAssertionMaxAgeSeconds) * time.Second
+	}
+
+	extractionErr := compileExtraction(conf, cc)
+	logDeprecations(conf, hash)
+	var chaosErr error
+	cc.chaos, chaosErr = compileChaos(conf.Chaos)
+	cc.expectedActions = conf.ExpectedActions
+	cc.expectedActionHeader = conf.ExpectedActionHeader
+	for _, hostname := range conf.ExpectedHostnames {
+		cc.expectedHostnames = append(cc.expectedHostnames, strings.ToLower(strings.TrimSpace(hostname)))
+	}
+	cc.expectedCData = conf.ExpectedCData
+	cc.probeInterval = time.Duration(conf.ProbeIntervalSeconds) * time.Second
+	cc.shareVerification = conf.ShareVerification
+	cc.identityHeader, cc.identityValue = conf.VerifiedIdentityHeader, conf.VerifiedIdentityValue
+	cc.failOpenHeader = conf.FailOpenHeader
+	cc.scoreHeader = conf.ScoreHeader
+	if cc.identityValue == "" {
+		cc.identityValue = DefaultVerifiedIdentity
+	}
+	cc.widgetPaths, cc.widgetSiteKey, cc.widgetMaxBodyBytes = conf.WidgetInjectPaths, conf.WidgetSiteKey, DefaultWidgetMaxBodyBytes
+	cc.challengeSiteKey, cc.maxTokenLength = conf.ChallengeSiteKey, conf.MaxTokenLength
+	if cc.challengeSiteKey == "" {
+		cc.challengeSiteKey = conf.WidgetSiteKey
+	}
+	if conf.WidgetMaxBodyBytes > 0 {
+		cc.widgetMaxBodyBytes = conf.WidgetMaxBodyBytes
+	}
+	var fieldsErr error
+	cc.exportedFields, fieldsErr = compileExportedFields(conf.ExportedResponseFields)
+	var statusErr, originErr, policyErr, verdictErr, spotCheckErr, skipErr, messageErr, upstreamErr, emergencyErr error
+	cc.emergencyBypassUntil, emergencyErr = compileEmergencyBypass(conf.EmergencyBypassUntil, clock.Now())
+	cc.requireHTTPS = conf.RequireHTTPS
+	cc.allowedOrigins, originErr = compileOrigins(conf.AllowedOrigins)
+	cc.tokenStatuses, statusErr = compileTokenStatuses(conf)
+	cc.responsePolicies, policyErr = compileResponsePolicies(conf.ResponsePolicies)
+	cc.errorMessages, messageErr = compileErrorMessages(conf.ErrorMessages)
+	cc.errorFormat = strings.ToLower(conf.ErrorFormat)
+	if cc.errorFormat == "" {
+		cc.errorFormat = "text"
+	}
+	cc.errorContentType = conf.ErrorContentType
+	if cc.errorContentType == "" {
+		cc.errorContentType = "application/json"
+	}
+	cc.errorIncludeCodes = conf.ErrorIncludeCodes
+	cc.botVerdictPolicies, verdictErr = compileBotVerdictPolicies(conf.BotVerdictPolicies)
+	cc.spotCheckPercent, spotCheckErr = compileSpotChecks(conf.SpotCheckPercent)
+	cc.skipRules, skipErr = compileSkipRules(conf)
+	cc.upstreamHeaders, upstreamErr = compileUpstreamHeaders(conf.UpstreamHeaders)
+	var verificationHeadersErr error
+	cc.verificationHeaders, verificationHeadersErr = compileVerificationHeaders(conf.VerificationHeaders, conf.VerificationHeaderNames)
+	tenantErr := compileTenants(conf, cc)
+
+	switch {
+	case conf.MinScore != nil && (*conf.MinScore < 0 || *conf.MinScore > 1):
+		cc.err = fmt.Errorf("invalid min_score configured: %g. Use a value between 0.0 and 1.0", *conf.MinScore)
+	case !kindOK:
+		cc.err = fmt.Errorf("invalid provider configured: '%s'. Use 'turnstile', 'hcaptcha', 'recaptcha_v2' or 'recaptcha_v3'", conf.Provider)
+	case socketErr != nil:
+		cc.err = socketErr
+	case clientErr != nil:
+		cc.err = clientErr
+	case cidrErr != nil:
+		cc.err = cidrErr
+	case listErr != nil:
+		cc.err = listErr
+	case counterErr != nil:
+		cc.err = counterErr
+	case analyticsErr != nil:
+		cc.err = analyticsErr
+	case tracingErr != nil:
+		cc.err = tracingErr
+	case cc.otlpSamplePercent < 0 || cc.otlpSamplePercent > 100:
+		cc.err = fmt.Errorf("invalid otlp_sample_percent configured: %g. Use a value between 0 and 100", conf.OTLPSamplePercent)
+	case conf.TurnstileSecretKey == "":
+		cc.err = fmt.Errorf("turnstile_secret_key is required")
+	case !slices.Contains([]string{"header", "form", "cookie", "body_json"}, cc.tokenLocation):
+		cc.err = fmt.Errorf("invalid token_location configured: '%s'. Use 'header', 'form', 'cookie' or 'body_json'", conf.TokenLocation)
+	case cc.conditionalRequests != "enforce" && cc.conditionalRequests != "relaxed":
+		cc.err = fmt.Errorf("invalid conditional_requests configured: '%s'. Use 'enforce' or 'relaxed'", conf.ConditionalRequests)
+	case cc.enforcementMode != "enforce" && cc.enforcementMode != "advise":
+		cc.err = fmt.Errorf("invalid enforcement_mode configured: '%s'. Use 'enforce' or 'advise'", conf.EnforcementMode)
+	case emergencyErr != nil:
+		cc.err = emergencyErr
+	case cc.streamedBodyPolicy != "reject" && cc.streamedBodyPolicy != "header" && cc.streamedBodyPolicy != "skip":
+		cc.err = fmt.Errorf("invalid streamed_body_policy configured: '%s'. Use 'reject', 'header' or 'skip'", conf.StreamedBodyPolicy)
+	case cc.rateLimitedPolicy != "fail_closed" && cc.rateLimitedPolicy != "fail_open" && cc.rateLimitedPolicy != "queue":
+		cc.err = fmt.Errorf("invalid rate_limited_policy configured: '%s'. Use 'fail_closed', 'fail_open' or 'queue'", conf.RateLimitedPolicy)
+	case cc.failureMode != "closed" && cc.failureMode != "open":
+		cc.err = fmt.Errorf("invalid failure_mode configured: '%s'. Use 'closed' or 'open'", conf.FailureMode)
+	case cc.breakerFailures < 0:
+		cc.err = fmt.Errorf("invalid circuit_breaker_failures configured: %d", conf.CircuitBreakerFailures)
+	case cc.breakerCooldown <= 0 || cc.breakerCooldown > time.Hour:
+		cc.err = fmt.Errorf("invalid circuit_breaker_cooldown_seconds configured: %d. Use a value between 1 and 3600", conf.CircuitBreakerCooldownSeconds)
+	case cc.sinkOverflow.policy != "drop_newest" && cc.sinkOverflow.policy != "drop_oldest" && cc.sinkOverflow.policy != "block":
+		cc.err = fmt.Errorf("invalid sink_overflow_policy configured: '%s'. Use 'drop_newest', 'drop_oldest' or 'block'", conf.SinkOverflowPolicy)
+	case cc.streamMode != "allow" && cc.streamMode != "deny":
+		cc.err = fmt.Errorf("invalid stream_mode configured: '%s'. Use 'allow' or 'deny'", conf.StreamMode)
+	case cc.batchMode != "single" && cc.batchMode != "per_item":
+		cc.err = fmt.Errorf("invalid batch_mode configured: '%s'. Use 'single' or 'per_item'", conf.BatchMode)
+	case keyErr != nil:
+		cc.err = keyErr
+	case cc.flowKeys != nil && len(cc.flowPaths) == 0:
+		cc.err = fmt.Errorf("flow_token_secret and flow_token_keys require flow_paths")
+	case cc.preverifyPath != "" && cc.passKeys == nil:
+		cc.err = fmt.Errorf("preverify_path requires pass_secret or pass_keys")
+	case cc.sessionCookie != "" && cc.sessionKeys == nil:
+		cc.err = fmt.Errorf("session_cookie requires session_secret or session_keys")
+	case cc.edgeAssertionHeader != "" && cc.edgeAssertionKeys == nil:
+		cc.err = fmt.Errorf("edge_assertion_header requires edge_assertion_keys")
+	case cc.edgeAssertionMaxAge <= 0 || cc.edgeAssertionMaxAge > maxEdgeAssertionMaxAgeSeconds*time.Second:
+		cc.err = fmt.Errorf("invalid edge_assertion_max_age_seconds configured: %d. Use a value between 1 and %d", conf.EdgeAssertionMaxAgeSeconds, maxEdgeAssertionMaxAgeSeconds)
+	case cc.receiptCookie != "" && cc.preverifyPath == "":
+		cc.err = fmt.Errorf("receipt_cookie requires preverify_path")
+	case cc.internalErrorRetries < 0 || cc.internalErrorRetries > maxInternalErrorRetries:
+		cc.err = fmt.Errorf("invalid internal_error_retries configured: %d. Use a value between 0 and %d", cc.internalErrorRetries, maxInternalErrorRetries)
+	case cc.maxTokenAge < 0 || cc.maxTokenAge > tokenValidity:
+		cc.err = fmt.Errorf("invalid max_token_age_seconds configured: %d. Use a value between 0 and %d", conf.MaxTokenAgeSeconds, int(tokenValidity.Seconds()))
+	case cc.verifyCacheFailureTTL < 0 || cc.verifyCacheFailureTTL > tokenValidity:
+		cc.err = fmt.Errorf("invalid verify_cache_failure_ttl_seconds configured: %d. Use a value between 0 and %d", conf.VerifyCacheFailureTTLSeconds, int(tokenValidity.Seconds()))
+	case cc.verifyCacheMaxEntries < 0 || cc.verifyCacheMaxEntries > maxVerifyCacheEntries:
+		cc.err = fmt.Errorf("invalid verify_cache_max_entries configured: %d. Use a value between 0 and %d", conf.VerifyCacheMaxEntries, maxVerifyCacheEntries)
+	case cc.idempotencyWindow < 0 || cc.idempotencyWindow > tokenValidity:
+		cc.err = fmt.Errorf("invalid idempotency_window_seconds configured: %d. Use a value between 0 and %d", conf.IdempotencyWindowSeconds, int(tokenValidity.Seconds()))
+	case statusErr != nil:
+		cc.err = statusErr
+	case policyErr != nil:
+		cc.err = policyErr
+	case messageErr != nil:
+		cc.err = messageErr
+	case cc.errorFormat != "text" && cc.errorFormat != "json":
+		cc.err = fmt.Errorf("invalid error_format configured: '%s'. Use 'text' or 'json'", conf.ErrorFormat)
+	case verdictErr != nil:
+		cc.err = verdictErr
+	case spotCheckErr != nil:
+		cc.err = spotCheckErr
+	case skipErr != nil:
+		cc.err = skipErr
+	case upstreamErr != nil:
+		cc.err = upstreamErr
+	case verificationHeadersErr != nil:
+		cc.err = verificationHeadersErr
+	case originErr != nil:
+		cc.err = originErr
+	case cc.maxTokenLength < 0:
+		cc.err = fmt.Errorf("invalid max_token_length configured: %d", conf.MaxTokenLength)
+	case len(cc.widgetPaths) > 0 && cc.widgetSiteKey == "":
+		cc.err = fmt.Errorf("widget_inject_paths requires widget_site_key")
+	case extractionErr != nil:
+		cc.err = extractionErr
+	case chaosErr != nil:
+		cc.err = chaosErr
+	case fieldsErr != nil:
+		cc.err = fieldsErr
+	case tenantErr != nil:
+		cc.err = tenantErr
+	case limitsErr != nil:
+		cc.err = limitsErr
+	default:
+		cc.err = validateProviders(cc.providers)
+	}
+
+	now := clock.Now()
+	cc.lastUsed.Store(now.UnixNano())
+	evictIdleConfigs(now)
+	actual, loaded := compiledConfigs.LoadOrStore(hash, cc)
+	if !loaded && !compileOnly {
+		startProbes(cc)
+		warmVerifyURLs(cc)
+		applyVerifyCacheLimit(cc)
+	}
+	return actual.(*compiledConfig)
+}
+
+// compileOnly is set by lint-config: configurations are compiled and
+// validated, but start no background work that contacts their endpoints.
+var compileOnly bool
+
+// warmVerifyURLs opens connections to the verify URLs of a valid cc, see
+// verifyPool.warm.
+func warmVerifyURLs(cc *compiledConfig) {
+	if cc.err != nil || cc.verifyClient == nil {
+		return
+	}
+	for _, p := range cc.providers {
+		verifyWorkers.warm(cc.verifyClient, p.verifyURL)
+	}
+}
+
+// validateProviders checks that every provider is complete and that token
+// names, which route requests to providers, are unambiguous.
+func validateProviders(providers []*provider) error {
+	seenNames := make(map[string]bool, len(providers))
+	seenTokens := make(map[string]bool, len(providers))
+	for _, p := range providers {
+		if p.name == "" || p.secretKey == "" {
+			return fmt.Errorf("additional_providers entries require name and secret_key")
+		}
+		token := strings.ToLower(p.tokenName) // Header names are case-insensitive
+		if seenNames[p.name] || seenTokens[token] {
+			return fmt.Errorf("provider '%s' reuses a name or token_name of another provider", p.name)
+		}
+		if !slices.Contains(providerSchemas, p.schema) {
+			return fmt.Errorf("provider '%s' has invalid schema '%s'. Use %s", p.name, p.schema, strings.Join(providerSchemas, ", "))
+		}
+		if p.minScore < 0 || p.minScore > 1 {
+			return fmt.Errorf("provider '%s' has invalid min_score %g. Use a value between 0.0 and 1.0", p.name, p.minScore)
+		}
+		seenNames[p.name], seenTokens[token] = true, true
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func cachedConfig(hash string) bool {
+	_, ok := compiledConfigs.Load(hash)
+	return ok
+}
+
+func TestCompiledConfigsEvictIdleConfigs(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+
+	live := &Config{TurnstileSecretKey: "live-" + t.Name()}
+	liveHash := live.settings().hash
+
+	// Config pushes rotating a secret leave one replaced configuration each
+	var replaced []string
+	for i := 0; i < 5; i++ {
+		conf := &Config{TurnstileSecretKey: fmt.Sprintf("rotated-%d-%s", i, t.Name())}
+		replaced = append(replaced, conf.settings().hash)
+		clk.Advance(time.Minute)
+		live.settings() // Requests keep using the live configuration
+	}
+	for _, hash := range replaced {
+		if !cachedConfig(hash) {
+			t.Fatal("configuration evicted before compiledConfigIdle")
+		}
+	}
+
+	clk.Advance(compiledConfigIdle)
+	live.settings()
+	(&Config{TurnstileSecretKey: "next-push-" + t.Name()}).settings()
+
+	for i, hash := range replaced {
+		if cachedConfig(hash) {
+			t.Errorf("replaced configuration %d still cached after compiledConfigIdle", i)
+		}
+	}
+	if !cachedConfig(liveHash) {
+		t.Error("configuration in use was evicted")
+	}
+}
+
+func TestEvictedConfigReturnsOnUse(t *testing.T) {
+	clk := turnstiletest.NewClock(clockStart)
+	t.Cleanup(setClock(clk))
+
+	rare := &Config{TurnstileSecretKey: "rare-" + t.Name()}
+	cc := rare.settings()
+	clk.Advance(compiledConfigIdle)
+	(&Config{TurnstileSecretKey: "push-" + t.Name()}).settings()
+	if cachedConfig(cc.hash) {
+		t.Fatal("idle configuration not evicted")
+	}
+
+	if rare.settings() != cc {
+		t.Error("instance lost its compiled configuration")
+	}
+	if !cachedConfig(cc.hash) {
+		t.Error("configuration not cached again after use")
+	}
+}
+
+func TestOnlyValidConfigsWarmConnections(t *testing.T) {
+	var heads atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			heads.Add(1)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	newConf := func(secret string) *Config {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = secret
+		conf.TurnstileVerifyURL = srv.URL
+		return conf
+	}
+
+	invalid := newConf("invalid-" + t.Name())
+	invalid.FailureMode = "sometimes"
+	if invalid.settings().err == nil {
+		t.Fatal("invalid failure_mode accepted")
+	}
+	compileOnly = true
+	linted := newConf("linted-" + t.Name()).settings()
+	compileOnly = false
+	if linted.err != nil {
+		t.Fatal(linted.err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := heads.Load(); n != 0 {
+		t.Fatalf("%d warm-up requests for invalid and linted configurations", n)
+	}
+
+	if err := newConf("valid-" + t.Name()).settings().err; err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); heads.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if heads.Load() == 0 {
+		t.Error("valid configuration did not warm connections")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// --- Stale Configuration Detection ---
+// Kong hands every plugin instance its configuration; after a config push
+// all requests of a route should run with the new one. In hybrid mode a
+// partially applied push can leave some workers on the old configuration,
+// which shows up as "half the nodes behave differently". Each plugin instance
+// reports the route it serves and its config hash at most every
+// configCheckInterval. Per route the first hash seen by this plugin server
+// and the current one are kept; a change is logged once, and a request still
+// running with a replaced hash afterwards gets a structured warning naming
+// both hashes. Hashes are listed per route in support bundles, so they can be
+// compared across nodes.
+//
+// A route can legitimately run several instances of the plugin (see
+// dedup.go); later instances find the decision of an earlier one in
+// kong.ctx.shared and are tracked separately, as "<route id>/later".
+
+const (
+	configCheckInterval = 10 * time.Second
+	staleConfigLogEvery = time.Minute
+	maxReplacedHashes   = 8
+)
+
+// routeConfig is the configuration history of one route.
+type routeConfig struct {
+	StartupHash string    `json:"startup_hash"` // First hash seen since the plugin server started
+	CurrentHash string    `json:"current_hash"`
+	ChangedAt   time.Time `json:"changed_at,omitempty"`
+	StaleSeen   int64     `json:"stale_seen"` // Checks that found a replaced hash
+
+	replaced   []string // Hashes CurrentHash replaced, newest last
+	lastWarned time.Time
+}
+
+var routeConfigs = struct {
+	sync.Mutex
+	routes map[string]*routeConfig // By route ID, see checkConfigDrift
+}{routes: make(map[string]*routeConfig)}
+
+// checkConfigDrift records the instance's config hash for the request's
+// route, at most every configCheckInterval per instance.
+func (r *requestState) checkConfigDrift(conf *Config) {
+	now := time.Now()
+	last := conf.lastConfigCheck.Load()
+	if now.UnixNano()-last < int64(configCheckInterval) || !conf.lastConfigCheck.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	route, err := r.kong.Router.GetRoute()
+	if err != nil || route.Id == "" {
+		return // Global plugin on a request without route, e.g. a stream
+	}
+	key := route.Id
+	if earlier, err := r.kong.Ctx.GetSharedAny(SharedDecisionKey); err == nil && earlier != nil {
+		key += "/later"
+	}
+	observeRouteConfig(key, r.settings.hash, now)
+}
+
+func observeRouteConfig(routeID, hash string, now time.Time) {
+	routeConfigs.Lock()
+	defer routeConfigs.Unlock()
+	rc, ok := routeConfigs.routes[routeID]
+	if !ok {
+		routeConfigs.routes[routeID] = &routeConfig{StartupHash: hash, CurrentHash: hash}
+		return
+	}
+	if hash == rc.CurrentHash {
+		return
+	}
+	for _, old := range rc.replaced {
+		if old != hash {
+			continue
+		}
+		rc.StaleSeen++
+		if now.Sub(rc.lastWarned) >= staleConfigLogEvery {
+			rc.lastWarned = now
+			log.Printf("turnstile: stale config route=%s request_hash=%s current_hash=%s startup_hash=%s replaced_at=%s",
+				routeID, shortHash(hash), shortHash(rc.CurrentHash), shortHash(rc.StartupHash), rc.ChangedAt.UTC().Format(time.RFC3339))
+		}
+		return
+	}
+	log.Printf("turnstile: config change route=%s previous_hash=%s current_hash=%s", routeID, shortHash(rc.CurrentHash), shortHash(hash))
+	rc.replaced = append(rc.replaced, rc.CurrentHash)
+	if len(rc.replaced) > maxReplacedHashes {
+		rc.replaced = rc.replaced[1:]
+	}
+	retireSecrets(routeID, rc.CurrentHash, hash)
+	replaced := rc.CurrentHash
+	rc.CurrentHash, rc.ChangedAt = hash, now
+	if !hashCurrent(replaced) {
+		dropConfig(replaced) // Stops probing its secrets
+	}
+}
+
+// hashCurrent reports whether a route still runs with the configuration
+// hash. Callers hold routeConfigs.
+func hashCurrent(hash string) bool {
+	for _, rc := range routeConfigs.routes {
+		if rc.CurrentHash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// shortHash abbreviates a config hash for log lines.
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// allRouteConfigs returns a copy of every route's configuration history.
+func allRouteConfigs() map[string]routeConfig {
+	routeConfigs.Lock()
+	defer routeConfigs.Unlock()
+	routes := make(map[string]routeConfig, len(routeConfigs.routes))
+	for id, rc := range routeConfigs.routes {
+		routes[id] = *rc
+	}
+	return routes
+}
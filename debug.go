@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// --- Debug Passthrough ---
+
+// parseCIDRs parses a list of CIDRs (or bare addresses) from config.
+func parseCIDRs(field string, values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s entry '%s': %v", field, v, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ipInPrefixes reports whether ip falls into any of prefixes. Unparseable
+// addresses never match.
+func ipInPrefixes(ip string, prefixes []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugPassthroughAllowed reports whether the raw siteverify answer may be
+// returned to this client. The address is taken from the PDK, which only
+// honors forwarding headers from Kong's trusted_ips, never from
+// remote_ip_location, as that may be a client-controlled header.
+func (r *requestState) debugPassthroughAllowed() bool {
+	settings := r.settings
+	if len(settings.debugPassthroughCIDRs) == 0 {
+		return false
+	}
+	ip, err := r.kong.Client.GetForwardedIp()
+	if err != nil || ip == "" {
+		return false
+	}
+	return ipInPrefixes(ip, settings.debugPassthroughCIDRs)
+}
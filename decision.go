@@ -0,0 +1,299 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// --- Decisions ---
+// The PDK offers external plugins no event bus, so every decision is
+// published to kong.ctx.shared under SharedDecisionKey instead. Plugins that
+// run after this one (e.g. a bot-score plugin) and every plugin's log phase
+// can read it without any HTTP-level coupling. The value is a table:
+//
+//	allowed     boolean
+//	advised     boolean, true when a failure was forwarded in enforcement_mode 'advise'
+//	shadow      boolean, true when a rejection was forwarded in route mode 'shadow'
+//	emergency_bypass boolean, true when that was an emergency bypass, see emergencybypass.go
+//	reason      string, see Reason
+//	status      number, status the client was answered with (0 when proxied)
+//	provider    string, provider that verified the token, if any
+//	tenant      string, tenant whose settings applied, if any
+//	hostname     string, hostname reported by the provider, if any
+//	action       string, action reported by the provider, if any
+//	challenge_ts string, challenge timestamp reported by the provider, if any
+//	cdata        string, customer data reported by the provider, if any
+//	error_codes  array of strings reported by the provider, if any
+//	score        number reported by Enterprise providers, if any
+//
+// Of the provider fields, only those in exported_response_fields are
+// included, see exportedField.
+//
+//	trace_id    string, from the request's traceparent header, if any
+//	span_id     string, from the request's traceparent header, if any
+//	fingerprint string, see requestFingerprint
+const SharedDecisionKey = "turnstile_decision"
+
+// Reason is the machine-readable cause of a decision. Reasons are stable:
+// clients, dashboards and log pipelines key on them, so existing values are
+// never renamed, only added to. Rejections carry the reason in ReasonHeader and
+// kong.ctx.shared carries it under "reason".
+type Reason string
+
+// Decision reasons.
+const (
+	// Allowed requests
+	ReasonVerified           Reason = "verified"            // Token verified by the provider
+	ReasonFlowToken          Reason = "flow_token"          // Valid multi-step flow token
+	ReasonPreverified        Reason = "preverified"         // Token verified by the preverify endpoint, pass issued
+	ReasonPass               Reason = "pass"                // Valid pass from the preverify endpoint
+	ReasonReceipt            Reason = "receipt"             // Valid receipt from the preverify endpoint for the referring page
+	ReasonConditionalRequest Reason = "conditional_request" // Conditional revalidation under conditional_requests 'relaxed'
+	ReasonBypassAllowlist    Reason = "bypass_allowlist"    // Client or route exempt from verification, e.g. by good IP reputation
+	ReasonCacheHit           Reason = "cache_hit"           // Token verified earlier, provider not asked again
+	ReasonWidgetPage         Reason = "widget_page"         // Page the widget is injected into, see widget_inject_paths
+	ReasonStreamedBody       Reason = "streamed_body"       // Unbufferable streamed body under streamed_body_policy 'skip'
+	ReasonFailOpen           Reason = "fail_open"           // Provider unavailable, request let through under a fail-open policy
+	ReasonAdminOverride      Reason = "admin_override"      // Route switched off through the admin endpoint
+	ReasonIdempotentRetry    Reason = "idempotent_retry"    // Retry of a verified request with the same idempotency key and token
+	ReasonSession            Reason = "session"             // Valid session cookie from an earlier verification, see session_cookie
+	ReasonEdgeAssertion      Reason = "edge_assertion"      // Token verified by a gateway in front, vouched for in edge_assertion_header
+
+	// Rejected requests
+	ReasonConfigError      Reason = "config_error"      // Plugin misconfigured
+	ReasonMissingToken     Reason = "missing_token"     // No token found, or the request could not be read
+	ReasonAmbiguousToken   Reason = "ambiguous_token"   // Token given several times under multi_value_policy 'reject'
+	ReasonInvalidToken     Reason = "invalid_token"     // Provider rejected the token
+	ReasonExpired          Reason = "expired"           // Token, pass or flow token too old, or token reported expired by the provider
+	ReasonHostnameMismatch Reason = "hostname_mismatch" // Token solved on an unexpected hostname
+	ReasonActionMismatch   Reason = "action_mismatch"   // Token solved for an unexpected action
+	ReasonProviderError    Reason = "provider_error"    // Provider unreachable or answered garbage
+	ReasonBatchTooLarge    Reason = "batch_too_large"   // More items than batch_max_items
+	ReasonBodyTooLarge     Reason = "body_too_large"    // Body larger than max_body_bytes
+	ReasonOverloaded       Reason = "overloaded"        // Request shed to protect the plugin server
+	ReasonBadReputation    Reason = "bad_reputation"    // Client address has a bad reputation
+
+	ReasonProviderRateLimited Reason = "provider_rate_limited" // Provider answered 429, see rate_limited_policy
+	ReasonLowScore            Reason = "low_score"             // Provider score below min_score
+	ReasonMalformedToken      Reason = "malformed_token"       // Token failed pre-flight validation, provider not asked
+	ReasonInsecureTransport   Reason = "insecure_transport"    // Token submitted over plain HTTP under require_https
+	ReasonOriginNotAllowed    Reason = "origin_not_allowed"    // Token submitted without an Origin in allowed_origins
+	ReasonBotDetected         Reason = "bot_detected"          // Refused by bot_verdict_policies 'block'
+	ReasonCDataMismatch       Reason = "cdata_mismatch"        // Token solved with other cdata than expected_cdata
+	ReasonAttemptLimited      Reason = "attempt_limited"       // Client over attempt_limit, see limits.go
+	ReasonPenaltyBanned       Reason = "penalty_banned"        // Client banned after penalty_threshold failures
+)
+
+// ReasonHeader carries the decision reason on responses the plugin sends.
+const ReasonHeader = "X-Turnstile-Reason"
+
+// decision is what the plugin concluded for one request.
+type decision struct {
+	allowed   bool
+	reason    Reason
+	status    int
+	provider  *provider
+	response  *VerificationResult
+	advised   bool // Failure forwarded in enforcement_mode 'advise'
+	shadowed  bool // Rejection forwarded in route mode 'shadow'
+	emergency bool // ... by an emergency bypass
+
+	failOpenCause string // Why a fail_open decision let the request through, see failopen.go
+	message       string // Plain-text message of a rejection when the body is not, see responsepolicy.go
+}
+
+// publish stores the decision in kong.ctx.shared. Failures are only logged,
+// a missing decision entry must never change the outcome of the request.
+func (r *requestState) publish(d decision) {
+	countDecision(d.reason)
+	r.countTenantDecision(d)
+	r.recordListFailure(d)
+	r.recordPenalty(d)
+	r.countFailure(d)
+	r.stampIdentity(d)
+	r.forwardScore(d)
+	r.stampFailOpen(d)
+	r.setUpstreamHeaders(d)
+	r.setVerificationHeaders(d)
+	value := map[string]interface{}{
+		"allowed": d.allowed,
+		"reason":  string(d.reason),
+		"status":  d.status,
+	}
+	if d.advised {
+		value["advised"] = true
+	}
+	if d.shadowed {
+		value["shadow"] = true
+	}
+	if d.emergency {
+		value["emergency_bypass"] = true
+	}
+	if d.provider != nil {
+		value["provider"] = d.provider.name
+	}
+	if d.failOpenCause != "" {
+		value["fail_open_cause"] = d.failOpenCause
+	}
+	if r.tenant != "" {
+		value["tenant"] = r.tenant
+	}
+	if d.response != nil {
+		fields := r.settings.exportedFields
+		if fields["hostname"] {
+			value["hostname"] = d.response.Hostname
+		}
+		if fields["action"] {
+			value["action"] = d.response.Action
+		}
+		if fields["challenge_ts"] {
+			value["challenge_ts"] = d.response.challengeTs()
+		}
+		if fields["cdata"] {
+			value["cdata"] = d.response.CData
+		}
+		if fields["score"] && d.response.Score != nil {
+			value["score"] = *d.response.Score
+		}
+		if fields["error_codes"] {
+			codes := make([]interface{}, len(d.response.ErrorCodes))
+			for i, code := range d.response.ErrorCodes {
+				codes[i] = code
+			}
+			value["error_codes"] = codes
+		}
+	}
+	if r.trace.valid() {
+		value["trace_id"] = r.trace.TraceID
+		value["span_id"] = r.trace.SpanID
+	}
+	value["fingerprint"] = r.requestFingerprint()
+	r.publishTimings(value)
+	if err := r.kong.Ctx.SetShared(SharedDecisionKey, value); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not publish Turnstile decision to kong.ctx.shared: %v", err))
+	}
+	r.exportDecision(value)
+}
+
+// requestFingerprint identifies repeated requests without personal data: a
+// hash of method, path (without query), hashed client IP and hashed
+// User-Agent. Retries of a request share it, so analytics can group them and
+// follow failure streaks of one client.
+func (r *requestState) requestFingerprint() string {
+	method, _ := r.kong.Request.GetMethod()
+	path, _ := r.kong.Request.GetPath()
+	userAgent, _ := r.kong.Request.GetHeader("User-Agent")
+	uaSum := sha256.Sum256([]byte(userAgent))
+	sum := sha256.Sum256([]byte(method + "\x00" + path + "\x00" + hashIP(r.clientIP()) + "\x00" + hex.EncodeToString(uaSum[:8])))
+	return hex.EncodeToString(sum[:8])
+}
+
+// --- Exported Response Fields ---
+// siteverify answers can carry data the operator must not ship to a log
+// vendor, cdata in particular is free-form and often holds user identifiers.
+// exported_response_fields lists the fields that may leave the plugin, both
+// in the published decision and in log lines; the rest are withheld.
+
+// responseFields are the siteverify fields exported_response_fields may name.
+var responseFields = []string{"hostname", "action", "challenge_ts", "cdata", "error_codes", "score"}
+
+// defaultExportedFields keeps what was published before the setting existed,
+// plus the score.
+var defaultExportedFields = []string{"hostname", "action", "error_codes", "score"}
+
+func compileExportedFields(names []string) (map[string]bool, error) {
+	if names == nil {
+		names = defaultExportedFields
+	}
+	fields := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !slices.Contains(responseFields, name) {
+			return nil, fmt.Errorf("invalid exported_response_fields entry: '%s'. Use %s", name, strings.Join(responseFields, ", "))
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// exportedField returns value for use in a log line, or a placeholder when
+// the field is not in exported_response_fields.
+func (r *requestState) exportedField(name, value string) string {
+	if !r.settings.exportedFields[name] {
+		return "[withheld]"
+	}
+	return value
+}
+
+// exit publishes a rejection and ends the request. In enforcement_mode
+// 'advise', client failures are forwarded instead, see advise, and in route
+// mode 'shadow' every rejection is, see shadow. error_messages and
+// error_format shape the answer, see formatError, and response_policies can
+// replace it, see applyResponsePolicy.
+func (r *requestState) exit(d decision, body []byte, headers map[string][]string) {
+	switch {
+	case r.routeMode == "shadow":
+		r.shadow(d)
+		return
+	case r.routeMode == "" && r.settings.enforcementMode == "advise" && isClientFailure(d.reason):
+		r.advise(d)
+		return
+	}
+	var message string
+	body, headers, message = r.formatError(&d, body, headers, cmp.Or(d.message, string(body)))
+	body, headers = r.applyResponsePolicy(&d, body, headers, message)
+	r.publish(d)
+	if headers == nil {
+		headers = make(map[string][]string, 1)
+	}
+	headers[ReasonHeader] = []string{string(d.reason)}
+	r.addServerTiming(headers)
+	r.exited = true
+	if r.isHeadRequest() {
+		body = nil // See head.go
+	}
+	r.kong.Response.Exit(d.status, body, headers)
+}
+
+// --- Advisory Enforcement ---
+// API-first clients often cannot show a widget on their first call. In
+// enforcement_mode 'advise' their failing requests still reach the upstream,
+// marked with ChallengeAdvisedHeader, and the response carries the same
+// header so the client knows to present a token on its next call. Operators
+// watch the advised share fall before switching to 'enforce'.
+
+// ChallengeAdvisedHeader marks forwarded requests that failed verification.
+const ChallengeAdvisedHeader = "X-Challenge-Advised"
+
+// isClientFailure reports whether reason is the client's fault, as opposed to
+// provider or configuration trouble, which still fails the request.
+func isClientFailure(reason Reason) bool {
+	switch reason {
+	case ReasonMissingToken, ReasonAmbiguousToken, ReasonInvalidToken, ReasonExpired, ReasonHostnameMismatch, ReasonActionMismatch, ReasonCDataMismatch, ReasonLowScore, ReasonMalformedToken:
+		return true
+	}
+	return false
+}
+
+// advise forwards a failed request upstream instead of rejecting it.
+func (r *requestState) advise(d decision) {
+	r.log.Info(fmt.Sprintf("Turnstile: forwarding request that failed verification (%s) with %s", d.reason, ChallengeAdvisedHeader))
+	if err := r.kong.ServiceRequest.SetHeader(ChallengeAdvisedHeader, "true"); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not set %s upstream: %v", ChallengeAdvisedHeader, err))
+	}
+	if err := r.kong.Response.SetHeader(ChallengeAdvisedHeader, "true"); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not set %s on the response: %v", ChallengeAdvisedHeader, err))
+	}
+	d.allowed, d.status, d.advised = true, 0, true
+	r.publish(d)
+}
+
+// reject is exit for the common plain-text case.
+func (r *requestState) reject(d decision, body string) {
+	d.message = body
+	payload, headers := r.describeChallenge(&d, body)
+	r.exit(d, payload, headers)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Duplicate Execution ---
+// When several instances of the plugin run for one request (e.g. global and
+// route scope through a custom plugin iterator, or a copy under another
+// name), the second one would send the already used token to the provider
+// again and get 'timeout-or-duplicate'. With share_verification set on the
+// instance that runs first, its successful provider verifications are
+// remembered in this process under an ID that is stored in kong.ctx.shared;
+// a later instance finding it reuses the answer for the same token and
+// applies its own checks on top, so the strictest instance decides. Only the
+// opaque ID is shared, the provider's answer stays here, for at most
+// requestVerificationTTL and maxRequestVerifications requests in flight.
+// Collisions are counted as duplicate_executions in support bundles.
+
+// SharedVerificationKey holds the ID of the request's first verification.
+const SharedVerificationKey = "turnstile_verification_id"
+
+const (
+	requestVerificationTTL  = time.Minute // Outlives any request
+	maxRequestVerifications = 10000
+)
+
+// duplicateExecutions counts verifications that found an earlier one.
+var duplicateExecutions atomic.Int64
+
+type requestVerification struct {
+	id        string
+	tokenHash string
+	provider  string
+	secretID  string
+	response  *VerificationResult
+	expires   time.Time
+}
+
+// requestVerificationStore remembers successful verifications of requests
+// in flight. All entries live for requestVerificationTTL, so order, oldest
+// first, is also their expiry order.
+type requestVerificationStore struct {
+	mu        sync.Mutex
+	entries   map[string]requestVerification
+	order     []string // Entry IDs, oldest first; purged IDs are skipped
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+var requestVerifications = newRequestVerificationStore()
+
+func newRequestVerificationStore() *requestVerificationStore {
+	s := &requestVerificationStore{entries: make(map[string]requestVerification)}
+	registerCache("request_verifications", s)
+	return s
+}
+
+// earlierVerification returns the answer an earlier instance of the plugin
+// got for token during this request, if any.
+func (r *requestState) earlierVerification(p *provider, token string) (*VerificationResult, bool) {
+	id, err := r.kong.Ctx.GetSharedString(SharedVerificationKey)
+	if err != nil || id == "" {
+		return nil, false
+	}
+	duplicateExecutions.Add(1)
+	r.log.Warn("Turnstile: another instance of this plugin already verified this request, check the plugin's scopes")
+
+	s := requestVerifications
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok || entry.tokenHash != tokenHash(token) || entry.provider != p.name || entry.secretID != p.secretID || clock.Now().After(entry.expires) {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	return entry.response, true
+}
+
+// rememberVerification makes a successful verification available to later
+// instances of the plugin running for this request, if share_verification
+// is set.
+func (r *requestState) rememberVerification(p *provider, token string, resp *VerificationResult) {
+	if !r.settings.shareVerification {
+		return
+	}
+	id := randomID()
+	requestVerifications.add(requestVerification{id: id, tokenHash: tokenHash(token), provider: p.name, secretID: p.secretID, response: resp,
+		expires: clock.Now().Add(requestVerificationTTL)})
+
+	if err := r.kong.Ctx.SetShared(SharedVerificationKey, id); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not share verification with later plugin instances: %v", err))
+	}
+}
+
+// add stores entry, dropping expired entries and, when full, the oldest one.
+func (s *requestVerificationStore) add(entry requestVerification) {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.order) > 0 {
+		oldest, ok := s.entries[s.order[0]]
+		if ok && !now.After(oldest.expires) && len(s.entries) < maxRequestVerifications {
+			break
+		}
+		if ok {
+			delete(s.entries, s.order[0])
+			s.evictions++
+		}
+		s.order = s.order[1:]
+	}
+	s.entries[entry.id] = entry
+	s.order = append(s.order, entry.id)
+}
+
+func (s *requestVerificationStore) Stats() cacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cacheStats{Entries: len(s.entries), Hits: s.hits, Misses: s.misses, Evictions: s.evictions}
+}
+
+// Purge only supports removing everything; entries belong to requests in flight.
+func (s *requestVerificationStore) Purge(filter cacheFilter) (int, bool) {
+	if !filter.all() {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := len(s.entries)
+	s.entries = make(map[string]requestVerification)
+	s.order = nil
+	return removed, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func TestVerificationSharedOnlyWhenConfigured(t *testing.T) {
+	for _, share := range []bool{false, true} {
+		t.Run(fmt.Sprint(share), func(t *testing.T) {
+			srv := turnstiletest.NewServer(t)
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			conf.ShareVerification = share
+
+			env := accessWithToken(t, conf, "token-"+t.Name())
+
+			if turnstiletest.Rejected(env) {
+				t.Fatal("request rejected")
+			}
+			if _, shared := env.Ctx.Store[SharedVerificationKey]; shared != share {
+				t.Errorf("verification shared = %v, want %v", shared, share)
+			}
+		})
+	}
+}
+
+func TestRequestVerificationStoreIsBounded(t *testing.T) {
+	s := &requestVerificationStore{entries: make(map[string]requestVerification)}
+	t.Cleanup(setClock(turnstiletest.NewClock(clockStart)))
+	for i := 0; i <= maxRequestVerifications; i++ {
+		s.add(requestVerification{id: fmt.Sprint(i), expires: clockStart.Add(requestVerificationTTL)})
+	}
+
+	if stats := s.Stats(); stats.Entries != maxRequestVerifications || stats.Evictions != 1 {
+		t.Errorf("stats = %+v, want %d entries and 1 eviction", stats, maxRequestVerifications)
+	}
+	if _, ok := s.entries["0"]; ok {
+		t.Error("the oldest entry should have been evicted")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --- Edge Assertions ---
+// Requests arriving through another gateway that already verified the token
+// (e.g. a CDN worker calling siteverify itself) would otherwise be verified
+// twice, and billed twice. With edge_assertion_header set, that gateway can
+// vouch for the request instead: it sends a token signed with a key of
+// edge_assertion_keys, in the format of sign.go ('<key id>.<payload>.<mac>',
+// HMAC-SHA256, base64url without padding), whose payload is the JSON of
+// edgeAssertion:
+//
+//	{"jti": "8f3c...", "iat": 1760000000, "ip": "203.0.113.7", "hostname": "shop.example.com", "action": "login"}
+//
+// A valid assertion lets the request through with reason edge_assertion,
+// without a token and without calling the provider. It must be at most
+// edge_assertion_max_age_seconds old and is single-use: its jti is remembered
+// until it expires, so a captured header cannot be replayed (per plugin
+// server, as for passes, see replay.go). ip, hostname and action are
+// optional; when present, ip must be the client IP as the plugin sees it,
+// and hostname and action must satisfy expected_hostnames and
+// expected_actions. Invalid assertions are logged and the request is verified
+// as usual. The header is never passed upstream.
+
+const (
+	DefaultEdgeAssertionMaxAgeSeconds = 30
+	maxEdgeAssertionMaxAgeSeconds     = 300
+)
+
+// edgeAssertion is the signed content of an edge assertion.
+type edgeAssertion struct {
+	ID       string `json:"jti"`
+	IssuedAt int64  `json:"iat"` // Unix seconds
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+// usedEdgeAssertions remembers consumed assertion IDs until they expire.
+var usedEdgeAssertions = newUsedTokenStore("edge_assertions")
+
+// clearEdgeAssertion drops the assertion header from the upstream request.
+func (r *requestState) clearEdgeAssertion() {
+	header := r.settings.edgeAssertionHeader
+	if header == "" {
+		return
+	}
+	if err := r.kong.ServiceRequest.ClearHeader(header); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header, err))
+	}
+}
+
+// acceptEdgeAssertion checks for a valid edge assertion. On success it
+// publishes the decision and returns true; otherwise the request continues
+// with regular verification.
+func (r *requestState) acceptEdgeAssertion() bool {
+	settings := r.settings
+	if settings.edgeAssertionHeader == "" {
+		return false
+	}
+	header, err := r.kong.Request.GetHeader(settings.edgeAssertionHeader)
+	if err != nil || header == "" {
+		return false
+	}
+
+	now := clock.Now()
+	var assertion edgeAssertion
+	raw, ok := settings.edgeAssertionKeys.open(header, now)
+	if !ok || json.Unmarshal(raw, &assertion) != nil || assertion.ID == "" {
+		r.log.Warn("Edge assertion has an invalid signature, falling back to Turnstile verification")
+		return false
+	}
+	issued := time.Unix(assertion.IssuedAt, 0)
+	if age := now.Sub(issued); age > settings.edgeAssertionMaxAge || age < -settings.maxClockSkew {
+		r.log.Info(fmt.Sprintf("Edge assertion %s issued %s ago, outside edge_assertion_max_age_seconds, falling back to Turnstile verification", assertion.ID, age.Round(time.Second)))
+		return false
+	}
+	if assertion.IP != "" && assertion.IP != r.clientIP() {
+		r.log.Warn(fmt.Sprintf("Edge assertion %s issued for %s, presented from %s, falling back to Turnstile verification", assertion.ID, assertion.IP, r.clientIP()))
+		return false
+	}
+	hostname := strings.ToLower(assertion.Hostname)
+	if hostname != "" && len(settings.expectedHostnames) > 0 &&
+		!slices.ContainsFunc(settings.expectedHostnames, func(pattern string) bool { return hostMatches(pattern, hostname) }) {
+		r.log.Warn(fmt.Sprintf("Edge assertion %s for unexpected hostname '%s', falling back to Turnstile verification", assertion.ID, assertion.Hostname))
+		return false
+	}
+	if assertion.Action != "" && len(r.actions) > 0 && !slices.Contains(r.actions, assertion.Action) {
+		r.log.Warn(fmt.Sprintf("Edge assertion %s for unexpected action '%s', falling back to Turnstile verification", assertion.ID, assertion.Action))
+		return false
+	}
+	if !usedEdgeAssertions.consume(assertion.ID, issued.Add(settings.edgeAssertionMaxAge).Unix(), now) {
+		r.log.Warn(fmt.Sprintf("Edge assertion %s replayed, falling back to Turnstile verification", assertion.ID))
+		return false
+	}
+
+	r.log.Debug(fmt.Sprintf("Edge assertion %s accepted", assertion.ID))
+	resp := &VerificationResult{Success: true, Hostname: assertion.Hostname, Action: assertion.Action, IssuedAt: issued}
+	r.publish(decision{allowed: true, reason: ReasonEdgeAssertion, response: resp})
+	return true
+}
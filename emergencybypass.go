@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Emergency Bypass ---
+// When verification itself is the incident (a provider outage, a broken
+// widget release), every route can be switched to route mode 'shadow' at
+// once: requests are still verified, but those the plugin would reject are
+// forwarded. The bypass always has an end. It is enabled either in the
+// configuration, emergency_bypass_until with an RFC 3339 timestamp, or for
+// every route of the plugin server through the admin endpoint:
+//
+//	GET    /emergency-bypass                                   state, audit trail and recent bypassed requests
+//	POST   /emergency-bypass?until=<RFC 3339>&actor=&reason=   enable until the given time
+//	POST   /emergency-bypass?minutes=<n>&actor=&reason=        enable for n minutes
+//	DELETE /emergency-bypass?actor=&reason=                    end early
+//
+// Either way the end lies at most maxEmergencyBypass ahead, and enforcement
+// resumes on its own once it passes; the first request after that logs the
+// end. The later of both ends applies. Route mode 'off' set through
+// /route-modes still wins. Every request the bypass forwards is logged at
+// warn level, counted, marked emergency_bypass in the published decision
+// and kept among the last maxEmergencyBypassRequests shown by GET. Changes are
+// kept in an audit trail like route mode changes. Admin state lives in
+// memory only.
+
+const (
+	maxEmergencyBypass         = 72 * time.Hour
+	maxEmergencyBypassAudit    = 100
+	maxEmergencyBypassRequests = 200
+)
+
+// emergencyBypassChange is one audit trail entry.
+type emergencyBypassChange struct {
+	At     string `json:"at"`
+	Until  string `json:"until"` // Empty when the bypass was ended
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// bypassedRequest is a request forwarded by the emergency bypass.
+type bypassedRequest struct {
+	At       string `json:"at"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	ClientIP string `json:"client_ip"`
+	Reason   Reason `json:"reason"` // Of the rejection that was skipped
+	Status   int    `json:"status"`
+}
+
+var emergencyBypass = struct {
+	sync.Mutex
+	until    atomic.Int64 // Unix nanoseconds of the admin bypass' end, 0 when none was set
+	ended    atomic.Int64 // Latest end already logged
+	bypassed atomic.Int64
+	actor    string
+	reason   string
+	audit    []emergencyBypassChange
+	requests []bypassedRequest
+}{}
+
+func init() {
+	adminMux.HandleFunc("/emergency-bypass", handleEmergencyBypass)
+}
+
+// compileEmergencyBypass parses emergency_bypass_until.
+func compileEmergencyBypass(until string, now time.Time) (time.Time, error) {
+	if until == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid emergency_bypass_until configured: '%s'. Use an RFC 3339 timestamp, e.g. '2025-01-31T18:00:00Z'", until)
+	}
+	if t.Sub(now) > maxEmergencyBypass {
+		return time.Time{}, fmt.Errorf("invalid emergency_bypass_until configured: '%s' lies more than %s ahead", until, maxEmergencyBypass)
+	}
+	return t, nil
+}
+
+// emergencyBypassEnd returns when the bypass applying to settings ends.
+func emergencyBypassEnd(settings *compiledConfig) time.Time {
+	end := settings.emergencyBypassUntil
+	if until := emergencyBypass.until.Load(); until != 0 && time.Unix(0, until).After(end) {
+		end = time.Unix(0, until)
+	}
+	return end
+}
+
+// applyEmergencyBypass switches the request to route mode 'shadow' while an
+// emergency bypass is active.
+func (r *requestState) applyEmergencyBypass() {
+	end := emergencyBypassEnd(r.settings)
+	if end.IsZero() {
+		return
+	}
+	now := clock.Now()
+	if !now.Before(end) {
+		if ended := emergencyBypass.ended.Load(); end.UnixNano() > ended && emergencyBypass.ended.CompareAndSwap(ended, end.UnixNano()) {
+			log.Printf("turnstile: emergency bypass ended at %s, enforcement resumed", end.UTC().Format(time.RFC3339))
+		}
+		return
+	}
+	if r.routeMode == "off" {
+		return
+	}
+	r.routeMode, r.emergencyBypass = "shadow", true
+	r.log.Debug(fmt.Sprintf("Turnstile: emergency bypass active until %s", end.UTC().Format(time.RFC3339)))
+}
+
+// auditEmergencyBypass records a rejection the emergency bypass forwarded.
+func (r *requestState) auditEmergencyBypass(d decision) {
+	method, _ := r.kong.Request.GetMethod()
+	path, _ := r.kong.Request.GetPath()
+	entry := bypassedRequest{At: clock.Now().UTC().Format(time.RFC3339), Method: method, Path: path,
+		ClientIP: r.clientIP(), Reason: d.reason, Status: d.status}
+	r.log.Warn(fmt.Sprintf("Turnstile emergency bypass: forwarding %s %s from %s that would get %d (%s)",
+		entry.Method, entry.Path, entry.ClientIP, entry.Status, entry.Reason))
+	emergencyBypass.bypassed.Add(1)
+	emergencyBypass.Lock()
+	defer emergencyBypass.Unlock()
+	if len(emergencyBypass.requests) >= maxEmergencyBypassRequests {
+		emergencyBypass.requests = emergencyBypass.requests[1:]
+	}
+	emergencyBypass.requests = append(emergencyBypass.requests, entry)
+}
+
+// recordEmergencyBypassChange sets or, with a zero until, ends the admin
+// bypass. Callers hold emergencyBypass.
+func recordEmergencyBypassChange(until time.Time, actor, reason string, now time.Time) {
+	change := emergencyBypassChange{At: now.UTC().Format(time.RFC3339), Actor: actor, Reason: reason}
+	if until.IsZero() {
+		emergencyBypass.until.Store(0)
+	} else {
+		change.Until = until.UTC().Format(time.RFC3339)
+		emergencyBypass.until.Store(until.UnixNano())
+	}
+	emergencyBypass.actor, emergencyBypass.reason = actor, reason
+	if len(emergencyBypass.audit) >= maxEmergencyBypassAudit {
+		emergencyBypass.audit = emergencyBypass.audit[1:]
+	}
+	emergencyBypass.audit = append(emergencyBypass.audit, change)
+	log.Printf("turnstile: emergency bypass until %q (actor=%q reason=%q)", change.Until, actor, reason)
+}
+
+func handleEmergencyBypass(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := clock.Now()
+	var until time.Time
+	switch r.Method {
+	case http.MethodGet:
+		emergencyBypass.Lock()
+		state := map[string]interface{}{
+			"active":   false,
+			"bypassed": emergencyBypass.bypassed.Load(),
+			"audit":    append([]emergencyBypassChange(nil), emergencyBypass.audit...),
+			"requests": append([]bypassedRequest(nil), emergencyBypass.requests...),
+		}
+		if end := emergencyBypass.until.Load(); end > now.UnixNano() {
+			state["active"] = true
+			state["until"] = time.Unix(0, end).UTC().Format(time.RFC3339)
+			state["actor"], state["reason"] = emergencyBypass.actor, emergencyBypass.reason
+		}
+		emergencyBypass.Unlock()
+		writeAdminJSON(w, http.StatusOK, state)
+		return
+	case http.MethodPost:
+		var err error
+		switch {
+		case query.Get("until") != "":
+			until, err = time.Parse(time.RFC3339, query.Get("until"))
+		case query.Get("minutes") != "":
+			var minutes int
+			if minutes, err = strconv.Atoi(query.Get("minutes")); err == nil {
+				until = now.Add(time.Duration(minutes) * time.Minute)
+			}
+		default:
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "until or minutes is required"})
+			return
+		}
+		if err != nil || !until.After(now) || until.Sub(now) > maxEmergencyBypass {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("the bypass must end in the future, at most %s ahead", maxEmergencyBypass)})
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	emergencyBypass.Lock()
+	defer emergencyBypass.Unlock()
+	if until.IsZero() && emergencyBypass.until.Load() <= now.UnixNano() {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "no emergency bypass active"})
+		return
+	}
+	recordEmergencyBypassChange(until, query.Get("actor"), query.Get("reason"), now)
+	response := map[string]interface{}{"active": !until.IsZero()}
+	if !until.IsZero() {
+		response["until"] = until.UTC().Format(time.RFC3339)
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
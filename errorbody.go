@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// --- Error Bodies ---
+// Rejections answer with a plain-text message by default. API clients
+// expecting JSON set error_format 'json' and get every rejection as
+//
+//	{"error": "turnstile_failed", "reason": "invalid_token", "message": "Verification failed",
+//	 "retryable": true, "codes": ["invalid-input-response"], "challenge": {...}}
+//
+// with Content-Type error_content_type (default application/json). codes
+// holds the provider's error codes with error_include_codes, and only while
+// 'error_codes' is in exported_response_fields; challenge holds the challenge
+// requirements where challenge.go would advertise them. retryable tells
+// single-page apps whether rendering the widget again and retrying with the
+// new token can succeed (see isRetryable). Answers the plugin already sends
+// as JSON, e.g. debug passthroughs, are left alone.
+//
+// error_messages replaces the message of a reason, in plain-text and JSON
+// bodies alike, with a Go text/template rendered with responseTemplateData:
+//
+//	error_messages:
+//	  missing_token: 'Solve the challenge for {{.SiteKey}} first'
+//	  provider_error: 'Verification is unavailable, try again later'
+//
+// Statuses are set per class with the *_status fields (see tokenclass.go)
+// or per reason with response_policies, which also take precedence over
+// both settings here (see responsepolicy.go).
+
+// ErrorBodyError is the "error" value of every JSON error body.
+const ErrorBodyError = "turnstile_failed"
+
+// errorBody is a rejection under error_format 'json'.
+type errorBody struct {
+	Error     string                 `json:"error"`
+	Reason    Reason                 `json:"reason"`
+	Message   string                 `json:"message"`
+	Retryable bool                   `json:"retryable"`
+	Codes     []string               `json:"codes,omitempty"`
+	Challenge *challengeRequirements `json:"challenge,omitempty"`
+}
+
+// isRetryable reports whether a freshly solved token can get past a
+// rejection with reason: the token was missing, unusable or too old. A new
+// token would again be solved on the wrong site, for another action or with
+// other cdata, refused clients stay refused, and provider trouble is not fixed
+// by a new token (Retry-After says when to come back where it is known).
+func isRetryable(reason Reason) bool {
+	switch reason {
+	case ReasonMissingToken, ReasonInvalidToken, ReasonExpired, ReasonMalformedToken:
+		return true
+	}
+	return false
+}
+
+// compileErrorMessages validates and compiles error_messages.
+func compileErrorMessages(messages map[string]string) (map[Reason]*template.Template, error) {
+	compiled := make(map[Reason]*template.Template, len(messages))
+	for name, text := range messages {
+		reason := Reason(strings.ToLower(name))
+		if !slices.Contains(rejectionReasons, reason) {
+			return nil, fmt.Errorf("invalid error_messages entry '%s': not a rejection reason", name)
+		}
+		message, err := template.New(name).Parse(text)
+		if err == nil {
+			err = message.Execute(io.Discard, responseTemplateData{}) // Catches unknown fields now
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid error_messages.%s: %v", name, err)
+		}
+		compiled[reason] = message
+	}
+	return compiled, nil
+}
+
+// formatError applies error_messages and error_format to the answer to a
+// rejection. It returns the body, headers and message to send.
+func (r *requestState) formatError(d *decision, body []byte, headers map[string][]string, message string) ([]byte, map[string][]string, string) {
+	settings := r.settings
+	if _, isJSON := headers["Content-Type"]; isJSON {
+		return body, headers, message
+	}
+	if tmpl := settings.errorMessages[d.reason]; tmpl != nil {
+		var rendered bytes.Buffer
+		data := r.templateData(d, message)
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			r.log.Warn(fmt.Sprintf("Turnstile error message for %s failed, sending the default: %v", d.reason, err))
+		} else {
+			message = rendered.String()
+			body = rendered.Bytes()
+		}
+	}
+	if settings.errorFormat != "json" {
+		return body, headers, message
+	}
+
+	payload := errorBody{Error: ErrorBodyError, Reason: d.reason, Message: message, Retryable: isRetryable(d.reason)}
+	if settings.errorIncludeCodes && settings.exportedFields["error_codes"] && d.response != nil {
+		payload.Codes = d.response.ErrorCodes
+	}
+	if settings.challengeSiteKey != "" && isClientFailure(d.reason) {
+		req := r.requirements()
+		payload.Challenge = &req
+	}
+	body, _ = json.Marshal(payload)
+	if headers == nil {
+		headers = make(map[string][]string, 2)
+	}
+	headers["Content-Type"] = []string{settings.errorContentType}
+	return body, headers, message
+}
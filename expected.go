@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// --- Expected Response Fields ---
+// success=true only says the challenge was solved, not where and for what.
+// A token solved on another site using the same secret, or for another
+// widget, is rejected by checking the rest of the siteverify answer:
+//
+//	hostname  in expected_hostnames, exact or '*.example.com' (subdomains
+//	          only), compared lowercased; reason hostname_mismatch
+//	action    in the request's expected actions (see action.go); reason
+//	          action_mismatch
+//	cdata     equal to expected_cdata, or to the value an earlier plugin put
+//	          in kong.ctx.shared.turnstile_expected_cdata (SharedExpectedCDataKey),
+//	          e.g. a session ID the page passed to the widget; reason
+//	          cdata_mismatch
+//
+// All answer with 403 and each logs its own line. The cdata value is never
+// logged: it often identifies the user. Checks without configuration are
+// skipped. Tenants may set their own expected_hostnames.
+
+// SharedExpectedCDataKey is where earlier plugins put the expected cdata.
+const SharedExpectedCDataKey = "turnstile_expected_cdata"
+
+// checkExpectedFields rejects resp unless it was solved on an expected
+// hostname, for an expected action and with the expected cdata. label names
+// the token in log lines, e.g. "batch item 2".
+func (r *requestState) checkExpectedFields(p *provider, resp *VerificationResult, label string) bool {
+	settings := r.settings
+	rejected := decision{status: http.StatusForbidden, provider: p, response: resp}
+	if len(settings.expectedHostnames) > 0 && !slices.ContainsFunc(settings.expectedHostnames, func(pattern string) bool {
+		return hostMatches(pattern, strings.ToLower(resp.Hostname))
+	}) {
+		rejected.reason = ReasonHostnameMismatch
+		r.log.Warn(fmt.Sprintf("Turnstile %s rejected: hostname '%s' not in expected hostnames [%s]", label, r.exportedField("hostname", resp.Hostname), strings.Join(settings.expectedHostnames, ", ")))
+	} else if len(r.actions) > 0 && !slices.Contains(r.actions, resp.Action) {
+		rejected.reason = ReasonActionMismatch
+		r.log.Warn(fmt.Sprintf("Turnstile %s rejected: action '%s' not in expected actions [%s]", label, r.exportedField("action", resp.Action), strings.Join(r.actions, ", ")))
+	} else if expected := r.expectedCData(); expected != "" && resp.CData != expected {
+		rejected.reason = ReasonCDataMismatch
+		r.log.Warn(fmt.Sprintf("Turnstile %s rejected: cdata does not match the expected value", label))
+	} else {
+		return true
+	}
+	p.stats.Rejected.Add(1)
+	r.reject(rejected, "Verification failed")
+	return false
+}
+
+// expectedCData is the cdata the request's token must carry, empty when
+// cdata is not checked.
+func (r *requestState) expectedCData() string {
+	if shared, err := r.kong.Ctx.GetSharedString(SharedExpectedCDataKey); err == nil && shared != "" {
+		return shared
+	}
+	return r.settings.expectedCData
+}
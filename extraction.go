@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// --- Token Extraction ---
+// Tokens are located by an extraction pipeline: an ordered list of steps,
+// each naming a location, a field name, an optional transform and the
+// provider that verifies what it finds. The first step yielding a non-empty
+// value wins. The pipeline of an instance comes from, in order of precedence:
+//
+//  1. extraction_pipeline, naming one of extraction_pipelines
+//  2. the structured extraction object (a step plus ordered fallbacks)
+//  3. the flat token_location/token_name fields, with one step per provider
+//
+// The flat fields keep working unchanged; setting them together with the
+// extraction object is rejected as ambiguous.
+
+// ExtractionConfig is the structured form of the extraction settings:
+//
+//	extraction:
+//	  location: header            # 'header', 'form', 'query', 'cookie' or 'body_json'
+//	  name: Cf-Turnstile-Response
+//	  transform: trim             # optional, see ExtractionStep
+//	  strip: false                # optional, see ExtractionStep
+//	  fallbacks:                  # optional, tried in order
+//	    - location: form
+//	      name: cf-turnstile-response
+//	  remote_ip:                  # optional, replaces remote_ip_location/remote_ip_name
+//	    location: header          # 'pdk' or 'header'
+//	    name: X-Real-IP
+type ExtractionConfig struct {
+	Location  string           `json:"location"`  // REQUIRED: 'header', 'form', 'query', 'cookie' or 'body_json'
+	Name      string           `json:"name"`      // REQUIRED: Header, form field, query argument or cookie name, or JSON path for 'body_json'
+	Transform string           `json:"transform"` // Optional: See ExtractionStep
+	Provider  string           `json:"provider"`  // Optional: See ExtractionStep
+	Strip     bool             `json:"strip"`     // Optional: See ExtractionStep
+	Fallbacks []ExtractionStep `json:"fallbacks"` // Optional: Further lookups, tried in order
+	RemoteIP  *RemoteIPConfig  `json:"remote_ip"` // Optional: Where to find the client IP
+}
+
+// RemoteIPConfig is the structured form of remote_ip_location/remote_ip_name.
+type RemoteIPConfig struct {
+	Location string `json:"location"` // 'pdk' or 'header'. Default: 'pdk'
+	Name     string `json:"name"`     // Header name if location is 'header'. Default: 'X-Forwarded-For'
+}
+
+// ExtractionStep is one entry of a named extraction pipeline.
+type ExtractionStep struct {
+	Location  string `json:"location"`  // REQUIRED: 'header', 'form', 'query', 'cookie' or 'body_json'
+	Name      string `json:"name"`      // REQUIRED: Header, form field, query argument or cookie name, or JSON path for 'body_json'
+	Transform string `json:"transform"` // Optional: 'trim', 'bearer' (strip a 'Bearer ' prefix), 'first_csv' or 'url_decode'
+	Provider  string `json:"provider"`  // Optional: Provider verifying tokens found by this step. Default: 'turnstile'
+	Strip     bool   `json:"strip"`     // Optional, 'query' only: Remove the argument before proxying, for redirect flows. Default: false
+}
+
+// extractionStep is the compiled form of ExtractionStep.
+type extractionStep struct {
+	location  string
+	name      string
+	transform func(string) string
+	provider  *provider
+	strip     bool
+
+	multiValue string // multi_value_policy: 'first', 'last' or 'reject'
+}
+
+// requestSource is the part of the PDK request API extraction needs. It
+// keeps pipelines independent of a live Kong connection.
+type requestSource interface {
+	GetHeader(k string) (string, error)
+	GetRawQuery() (string, error)
+	GetRawBody() ([]byte, error)
+}
+
+// bodyReadError means the request body could not be read or parsed, as
+// opposed to the token simply not being there.
+type bodyReadError struct{ err error }
+
+func (e *bodyReadError) Error() string { return fmt.Sprintf("could not read form data: %v", e.err) }
+
+// ambiguousTokenError means a form field or query argument was given more
+// than once under multi_value_policy 'reject'.
+type ambiguousTokenError struct {
+	location, name string
+	count          int
+}
+
+func (e *ambiguousTokenError) Error() string {
+	return fmt.Sprintf("token given %d times in %s '%s'", e.count, e.location, e.name)
+}
+
+var tokenTransforms = map[string]func(string) string{
+	"trim": strings.TrimSpace,
+	"bearer": func(v string) string {
+		v = strings.TrimSpace(v)
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+		return v
+	},
+	"first_csv": func(v string) string {
+		first, _, _ := strings.Cut(v, ",")
+		return strings.TrimSpace(first)
+	},
+	"url_decode": func(v string) string {
+		if decoded, err := url.QueryUnescape(v); err == nil {
+			return decoded
+		}
+		return v
+	},
+}
+
+// tokenLocations are the locations an extraction step can read.
+var tokenLocations = []string{"header", "form", "query", "cookie", "body_json"}
+
+// compileExtractionSteps resolves transforms and providers of a pipeline.
+func compileExtractionSteps(pipeline string, steps []ExtractionStep, providers []*provider) ([]extractionStep, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("extraction pipeline '%s' has no steps", pipeline)
+	}
+	compiled := make([]extractionStep, 0, len(steps))
+	for i, step := range steps {
+		cs := extractionStep{location: strings.ToLower(step.Location), name: step.Name, provider: providers[0], strip: step.Strip}
+		switch {
+		case !slices.Contains(tokenLocations, cs.location):
+			return nil, fmt.Errorf("extraction pipeline '%s' step %d: invalid location '%s'. Use 'header', 'form', 'query', 'cookie' or 'body_json'", pipeline, i, step.Location)
+		case cs.location == "body_json":
+			if err := validateJSONPath(step.Name); step.Name != "" && err != nil {
+				return nil, fmt.Errorf("extraction pipeline '%s' step %d: %v", pipeline, i, err)
+			}
+		}
+		if cs.name == "" {
+			return nil, fmt.Errorf("extraction pipeline '%s' step %d: name is required", pipeline, i)
+		}
+		if cs.strip && cs.location != "query" {
+			return nil, fmt.Errorf("extraction pipeline '%s' step %d: strip only applies to 'query' steps", pipeline, i)
+		}
+		if step.Transform != "" {
+			transform, ok := tokenTransforms[strings.ToLower(step.Transform)]
+			if !ok {
+				return nil, fmt.Errorf("extraction pipeline '%s' step %d: unknown transform '%s'", pipeline, i, step.Transform)
+			}
+			cs.transform = transform
+		}
+		if step.Provider != "" {
+			cs.provider = nil
+			for _, p := range providers {
+				if p.name == step.Provider {
+					cs.provider = p
+				}
+			}
+			if cs.provider == nil {
+				return nil, fmt.Errorf("extraction pipeline '%s' step %d: unknown provider '%s'", pipeline, i, step.Provider)
+			}
+		}
+		compiled = append(compiled, cs)
+	}
+	return compiled, nil
+}
+
+// compileExtraction builds cc.extraction (and the remote IP lookup of the
+// extraction object) from whichever configuration style conf uses.
+func compileExtraction(conf *Config, cc *compiledConfig) error {
+	policy := strings.ToLower(conf.MultiValuePolicy)
+	if policy == "" {
+		policy = "first"
+	}
+	if policy != "first" && policy != "last" && policy != "reject" {
+		return fmt.Errorf("invalid multi_value_policy configured: '%s'. Use 'first', 'last' or 'reject'", conf.MultiValuePolicy)
+	}
+	err := compileExtractionPipeline(conf, cc)
+	for i := range cc.extraction {
+		cc.extraction[i].multiValue = policy
+	}
+	return err
+}
+
+// compileExtractionPipeline builds the steps of cc.extraction.
+func compileExtractionPipeline(conf *Config, cc *compiledConfig) error {
+	if ex := conf.Extraction; ex != nil {
+		if conf.TokenLocation != "" || conf.TokenName != "" {
+			return fmt.Errorf("extraction cannot be combined with token_location/token_name")
+		}
+		if ex.RemoteIP != nil {
+			if conf.RemoteIPLocation != "" || conf.RemoteIPName != "" {
+				return fmt.Errorf("extraction.remote_ip cannot be combined with remote_ip_location/remote_ip_name")
+			}
+			cc.remoteIPLocation = strings.ToLower(ex.RemoteIP.Location)
+			if cc.remoteIPLocation == "" {
+				cc.remoteIPLocation = "pdk"
+			}
+			cc.remoteIPName = ex.RemoteIP.Name
+			if cc.remoteIPName == "" {
+				cc.remoteIPName = DefaultRemoteIPHeader
+			}
+		}
+	}
+
+	switch {
+	case conf.ExtractionPipeline != "":
+		steps, ok := conf.ExtractionPipelines[conf.ExtractionPipeline]
+		if !ok {
+			return fmt.Errorf("extraction_pipeline '%s' is not defined in extraction_pipelines", conf.ExtractionPipeline)
+		}
+		var err error
+		cc.extraction, err = compileExtractionSteps(conf.ExtractionPipeline, steps, cc.providers)
+		return err
+	case conf.Extraction != nil:
+		ex := conf.Extraction
+		steps := append([]ExtractionStep{{Location: ex.Location, Name: ex.Name, Transform: ex.Transform, Provider: ex.Provider, Strip: ex.Strip}}, ex.Fallbacks...)
+		var err error
+		cc.extraction, err = compileExtractionSteps("extraction", steps, cc.providers)
+		return err
+	default:
+		// Legacy flat fields, see compat.go
+		ex := legacyExtraction(cc)
+		steps := append([]ExtractionStep{{Location: ex.Location, Name: ex.Name}}, ex.Fallbacks...)
+		var err error
+		cc.extraction, err = compileExtractionSteps("token_location", steps, cc.providers)
+		return err
+	}
+}
+
+// extractToken runs the pipeline against req. It returns an empty token when
+// no step found one, a *bodyTooLargeError when a form or body_json step needed a body
+// larger than maxBody (a *bodyStreamedError for bodies without declared
+// length), a *bodyBufferFullError when buffering it would exceed
+// maxBuffered, a *bodyReadError when it needed an unreadable one and an
+// *ambiguousTokenError when multi_value_policy rejects repeated values.
+// Header and query lookup errors count as "not found".
+func extractToken(req requestSource, steps []extractionStep, maxBody, maxBuffered int64) (string, *provider, error) {
+	var form, query url.Values
+	var document interface{} // Parsed JSON body
+	documentParsed := false
+
+	// The body is read at most once, for form and body_json steps alike
+	var rawBody []byte
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	body := func() ([]byte, error) {
+		if release != nil {
+			return rawBody, nil
+		}
+		var err error
+		rawBody, release, err = readBody(req, maxBody, maxBuffered)
+		switch err.(type) {
+		case nil:
+			return rawBody, nil
+		case *bodyTooLargeError, *bodyStreamedError, *bodyBufferFullError:
+			return nil, err
+		default:
+			return nil, &bodyReadError{err}
+		}
+	}
+
+	for _, step := range steps {
+		var value string
+		var err error
+		switch step.location {
+		case "header":
+			value, _ = req.GetHeader(step.name)
+		case "cookie":
+			header, _ := req.GetHeader("Cookie")
+			value = cookieValue(header, step.name)
+		case "query":
+			if query == nil {
+				rawQuery, _ := req.GetRawQuery()
+				query, _ = url.ParseQuery(rawQuery) // Malformed pairs are skipped
+			}
+			value, err = step.pickValue(query)
+		case "form":
+			if form == nil {
+				raw, err := body()
+				if err != nil {
+					return "", nil, err
+				}
+				if form, err = url.ParseQuery(string(raw)); err != nil {
+					return "", nil, &bodyReadError{err}
+				}
+			}
+			value, err = step.pickValue(form)
+		case "body_json":
+			if !documentParsed {
+				raw, err := body()
+				if err != nil {
+					return "", nil, err
+				}
+				document, documentParsed = parseJSONBody(raw), true
+			}
+			value = jsonPathValue(document, step.name)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if step.transform != nil {
+			value = step.transform(value)
+		}
+		if value != "" {
+			return value, step.provider, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// pickValue returns the step's value from a parsed form or query. Values of
+// "name" and of the array syntax "name[]" (PHP, Rails) are considered
+// together; when there are several, multi_value_policy decides.
+func (step extractionStep) pickValue(values url.Values) (string, error) {
+	all := slices.Concat(values[step.name], values[step.name+"[]"])
+	switch {
+	case len(all) == 0:
+		return "", nil
+	case len(all) == 1 || step.multiValue == "first":
+		return all[0], nil
+	case step.multiValue == "last":
+		return all[len(all)-1], nil
+	}
+	return "", &ambiguousTokenError{step.location, step.name, len(all)}
+}
+
+// withoutBodySteps returns the steps that do not need the request body.
+func withoutBodySteps(steps []extractionStep) []extractionStep {
+	kept := make([]extractionStep, 0, len(steps))
+	for _, step := range steps {
+		if step.location != "form" && step.location != "body_json" {
+			kept = append(kept, step)
+		}
+	}
+	return kept
+}
+
+// --- Query Tokens ---
+// Redirect-based flows can only carry the token in the URL. Query steps with
+// strip, and all query steps under strip_token (see striptoken.go), remove
+// their argument from the upstream request, whatever the outcome, so the
+// token never reaches upstream URLs and their logs. The
+// plugin itself never logs token values or request URIs.
+
+// stripQueryTokens removes the arguments of stripping query steps from the
+// upstream request, preserving the order and encoding of all others.
+func (r *requestState) stripQueryTokens() {
+	strip := make(map[string]bool)
+	for _, step := range r.settings.extraction {
+		if step.strip || (step.location == "query" && r.settings.stripToken) {
+			strip[step.name] = true
+		}
+	}
+	if len(strip) == 0 {
+		return
+	}
+	rawQuery, err := r.kong.Request.GetRawQuery()
+	if err != nil || rawQuery == "" {
+		return
+	}
+	kept, removed := removeQueryArgs(rawQuery, strip)
+	if !removed {
+		return
+	}
+	if err := r.kong.ServiceRequest.SetRawQuery(kept); err != nil {
+		r.log.Err(fmt.Sprintf("Could not strip token arguments from the upstream query: %v", err))
+	}
+}
+
+// removeQueryArgs drops the arguments named in names from rawQuery.
+func removeQueryArgs(rawQuery string, names map[string]bool) (string, bool) {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(key); err == nil && names[name] {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&"), len(kept) < len(parts)
+}
+
+// describeSteps renders a pipeline for log lines, e.g. "header 'A', form 'b'".
+func describeSteps(steps []extractionStep) string {
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		parts[i] = fmt.Sprintf("%s '%s'", step.location, step.name)
+	}
+	return strings.Join(parts, ", ")
+}
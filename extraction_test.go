@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+func TestExtractTokenMultiValuePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		location  string
+		query     string
+		body      string
+		wantToken string
+		wantErr   bool
+	}{
+		{"single query value", "reject", "query", "t=one", "", "one", false},
+		{"first query value", "first", "query", "t=one&t=two", "", "one", false},
+		{"last query value", "last", "query", "t=one&t=two", "", "two", false},
+		{"reject repeated query value", "reject", "query", "t=one&t=two", "", "", true},
+		{"array syntax alone", "reject", "query", "t[]=one", "", "one", false},
+		{"array syntax after plain", "last", "query", "t[]=two&t=one", "", "two", false},
+		{"reject plain and array syntax", "reject", "query", "t=one&t[]=two", "", "", true},
+		{"first form value", "first", "form", "", "t=one&t=two", "one", false},
+		{"last form value", "last", "form", "", "t=one&t[]=two", "two", false},
+		{"reject repeated form value", "reject", "form", "", "t=one&t=two", "", true},
+		{"missing", "reject", "form", "", "other=x", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &compiledConfig{providers: []*provider{{name: "turnstile"}}}
+			conf := &Config{MultiValuePolicy: tt.policy, Extraction: &ExtractionConfig{Location: tt.location, Name: "t"}}
+			if err := compileExtraction(conf, cc); err != nil {
+				t.Fatal(err)
+			}
+			req := &fakeRequest{query: tt.query, body: []byte(tt.body)}
+
+			token, _, err := extractToken(req, cc.extraction, 1024, 1<<20)
+			if _, ambiguous := err.(*ambiguousTokenError); ambiguous != tt.wantErr {
+				t.Fatalf("extractToken() error = %v, want ambiguous: %v", err, tt.wantErr)
+			}
+			if token != tt.wantToken {
+				t.Errorf("extractToken() token = %q, want %q", token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestCompileExtractionRejectsUnknownMultiValuePolicy(t *testing.T) {
+	cc := &compiledConfig{providers: []*provider{{name: "turnstile"}}}
+	if err := compileExtraction(&Config{MultiValuePolicy: "all"}, cc); err == nil {
+		t.Error("compileExtraction() accepted multi_value_policy 'all'")
+	}
+}
+
+func TestMultiValuePolicyRejectAnswers400(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.MultiValuePolicy = "reject"
+	conf.Extraction = &ExtractionConfig{Location: "query", Name: "cf-turnstile-response"}
+
+	env := turnstiletest.RunAccess(t, conf, test.Request{
+		Method: "GET",
+		Url:    "http://example.com/login?cf-turnstile-response=a&cf-turnstile-response[]=b",
+	})
+	if env.ClientRes.Status != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", env.ClientRes.Status, http.StatusBadRequest)
+	}
+	if got := decisionReason(t, env); got != string(ReasonAmbiguousToken) {
+		t.Errorf("reason = %q, want %q", got, ReasonAmbiguousToken)
+	}
+	if calls := srv.Calls(); len(calls) != 0 {
+		t.Errorf("siteverify called %d times for an ambiguous token", len(calls))
+	}
+}
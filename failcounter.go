@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Shared Failure Counters ---
+// Organisations running rate-limiting-advanced with the Redis strategy
+// already build abuse dashboards and limits on its counters. With
+// failure_counter_redis set, every client failure is counted there in the
+// same layout, so those dashboards and any rate-limiting-advanced instance
+// configured with the same namespace pick up Turnstile failures:
+//
+//	HINCRBY <window start>:<window size>:<namespace> <client ip> 1
+//	EXPIRE  <window start>:<window size>:<namespace> <2 * window size>
+//
+// The client IP is Kong's forwarded IP, the identifier rate-limiting-advanced
+// uses with identifier 'ip'. Increments are sent asynchronously by one
+// goroutine per Redis server, over the client of redis.go; when Redis is
+// unreachable they are dropped rather than slowing requests down.
+
+const (
+	failureCounterQueueSize = 1024
+	failureCounterTimeout   = 2 * time.Second
+)
+
+// failureCounter is the compiled counter integration of one configuration.
+type failureCounter struct {
+	namespace string
+	window    int64 // Seconds
+	sender    *redisSender
+}
+
+func compileFailureCounter(conf *Config) (*failureCounter, error) {
+	if conf.FailureCounterNamespace == "" {
+		return nil, fmt.Errorf("failure_counter_redis requires failure_counter_namespace")
+	}
+	if _, _, err := net.SplitHostPort(conf.FailureCounterRedis); err != nil {
+		return nil, fmt.Errorf("invalid failure_counter_redis '%s': %v", conf.FailureCounterRedis, err)
+	}
+	counter := &failureCounter{
+		namespace: conf.FailureCounterNamespace,
+		window:    DefaultCounterWindowSec,
+		sender:    getRedisSender(conf.FailureCounterRedis, conf.FailureCounterPassword, conf.FailureCounterDatabase),
+	}
+	if conf.FailureCounterWindowSeconds > 0 {
+		counter.window = int64(conf.FailureCounterWindowSeconds)
+	}
+	return counter, nil
+}
+
+// countFailure feeds rejected requests into the shared counters.
+func (r *requestState) countFailure(d decision) {
+	counter := r.settings.failureCounter
+	if counter == nil || d.allowed || !isClientFailure(d.reason) {
+		return
+	}
+	ip, err := r.kong.Client.GetForwardedIp()
+	if err != nil || ip == "" {
+		return
+	}
+	start := clock.Now().Unix() / counter.window * counter.window
+	key := fmt.Sprintf("%d:%d:%s", start, counter.window, counter.namespace)
+	counter.sender.send([][]string{
+		{"HINCRBY", key, ip, "1"},
+		{"EXPIRE", key, strconv.FormatInt(2*counter.window, 10)},
+	}, r.settings.sinkOverflow)
+}
+
+// redisSender writes commands to one Redis server from a single goroutine.
+type redisSender struct {
+	addr   string
+	client *redisClient
+	queue  *sinkQueue[[][]string]
+	failed bool // Last attempt failed; logged once until it recovers
+}
+
+// redisSenders holds one sender per server, password and database.
+var redisSenders sync.Map // map[*redisClient]*redisSender
+
+func getRedisSender(addr, password string, database int) *redisSender {
+	client := getRedisClient(addr, password, database)
+	if sender, ok := redisSenders.Load(client); ok {
+		return sender.(*redisSender)
+	}
+	queue := newSinkQueue[[][]string](fmt.Sprintf("failure_counter:%s/%d", addr, database), failureCounterQueueSize, nil)
+	sender := &redisSender{addr: addr, client: client, queue: queue}
+	actual, loaded := redisSenders.LoadOrStore(client, sender)
+	if !loaded {
+		queue.register()
+		go sender.loop()
+	}
+	return actual.(*redisSender)
+}
+
+// send queues a pipeline of commands.
+func (s *redisSender) send(commands [][]string, overflow sinkOverflow) {
+	s.queue.put(commands, overflow)
+}
+
+func (s *redisSender) loop() {
+	for commands := range s.queue.items {
+		_, _, err := s.client.exec(failureCounterTimeout, commands...)
+		switch {
+		case err != nil && !s.failed:
+			log.Printf("turnstile: could not update failure counters on %s: %v", s.addr, err)
+		case err == nil && s.failed:
+			log.Printf("turnstile: failure counters on %s updated again", s.addr)
+		}
+		s.failed = err != nil
+	}
+}
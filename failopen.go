@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Fail-Open Accounting ---
+// Every request let through unverified under a fail-open policy is counted
+// by cause, so security review can quantify how much unverified traffic the
+// policy admits. Causes the plugin has today:
+//
+//	rate_limited    the provider answered the call with 429 (rate_limited_policy 'fail_open')
+//	circuit_open    the call was not sent, calls are held back after a 429 (rate_limited_policy 'fail_open')
+//	provider_error  the provider was unreachable, timed out or answered with an error (failure_mode 'open')
+//	breaker_open    the call was not sent, the circuit breaker is open (failure_mode 'open', see breaker.go)
+//
+// failure_mode 'open' trades strict verification for availability during a
+// provider outage; a full verification queue (reason overloaded) is this
+// server's own capacity and still fails closed. The cause is published with
+// the decision as "fail_open_cause", counted per cause and provider in
+// support bundles under fail_open, and with fail_open_header set stamped on
+// the upstream request, so the upstream can treat the request with
+// suspicion. A client-supplied fail_open_header is dropped. While the threat
+// level is elevated (see threat.go), both policies fail closed.
+
+// Fail-open causes.
+const (
+	FailOpenRateLimited   = "rate_limited"
+	FailOpenCircuitOpen   = "circuit_open"
+	FailOpenProviderError = "provider_error"
+	FailOpenBreakerOpen   = "breaker_open"
+)
+
+// failOpenCounts counts fail-open allowances by "<cause>/<provider>".
+var failOpenCounts sync.Map // map[string]*atomic.Int64
+
+// failOpenCause labels a verification error that let a request through.
+func failOpenCause(verr *verifyError) string {
+	if verr.answered {
+		return FailOpenRateLimited
+	}
+	return FailOpenCircuitOpen
+}
+
+// providerFailed applies failure_mode to a verification the provider gave
+// no usable answer to. msg is logged.
+func (r *requestState) providerFailed(p *provider, verr *verifyError, msg string) {
+	p.stats.Errors.Add(1)
+	reason := verifyErrorReason(verr)
+	failOpen := r.settings.failureMode == "open" && reason == ReasonProviderError
+	if failOpen && r.threatElevated() {
+		failOpen = false
+		msg += " (failure_mode 'open' suspended under elevated threat level)"
+	}
+	if failOpen {
+		cause := FailOpenProviderError
+		if verr.breakerOpen {
+			cause = FailOpenBreakerOpen
+		}
+		r.log.Warn(fmt.Sprintf("%s, letting request through unverified (failure_mode 'open')", msg))
+		r.publish(decision{allowed: true, reason: ReasonFailOpen, provider: p, failOpenCause: cause})
+		return
+	}
+	r.log.Err(msg)
+	r.reject(decision{status: verr.status, reason: reason, provider: p}, verr.body)
+}
+
+// countFailOpen counts an allowance under a fail-open policy.
+func countFailOpen(cause string, p *provider) {
+	key := cause
+	if p != nil {
+		key += "/" + p.name
+	}
+	v, _ := failOpenCounts.LoadOrStore(key, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+}
+
+// allFailOpenCounts returns the fail-open allowances by cause and provider.
+func allFailOpenCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	failOpenCounts.Range(func(k, v interface{}) bool {
+		counts[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// clearFailOpenHeader drops a client-supplied fail-open header.
+func (r *requestState) clearFailOpenHeader() {
+	header := r.settings.failOpenHeader
+	if header == "" {
+		return
+	}
+	if err := r.kong.ServiceRequest.ClearHeader(header); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header, err))
+	}
+}
+
+// stampFailOpen counts a fail-open decision and marks the upstream request.
+func (r *requestState) stampFailOpen(d decision) {
+	if d.reason != ReasonFailOpen {
+		return
+	}
+	countFailOpen(d.failOpenCause, d.provider)
+	header := r.settings.failOpenHeader
+	if header == "" {
+		return
+	}
+	if err := r.kong.ServiceRequest.SetHeader(header, d.failOpenCause); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not set %s on the upstream request: %v", header, err))
+	}
+}
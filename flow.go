@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// --- Flow Tokens ---
+// Multi-step forms only solve the widget once. After a successful
+// verification the plugin answers with a signed flow token (flow_token_header)
+// that replaces the Turnstile token on flow_paths for flow_token_ttl_seconds.
+// Flow tokens are single-use: each accepted one is exchanged for a new token
+// with one step less, until flow_steps are used up.
+//
+// Used tokens are tracked in this plugin server's memory, so with several
+// Kong nodes a token may be replayed once per node.
+
+// flowPayload is the signed content of a flow token.
+type flowPayload struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`          // Unix seconds
+	Steps   int    `json:"steps"`        // Remaining uses, including this one
+	Epoch   string `json:"sk,omitempty"` // See rotation.go
+}
+
+// usedFlowTokens remembers consumed flow token IDs until they expire.
+var usedFlowTokens = newUsedTokenStore("flow_tokens")
+
+func newFlowToken(settings *compiledConfig, steps int, expires time.Time, epoch string) string {
+	payload, _ := json.Marshal(flowPayload{ID: randomID(), Expires: expires.Unix(), Steps: steps, Epoch: epoch})
+	return settings.flowKeys.sign(payload)
+}
+
+// issueFlowToken hands the client a fresh flow token after a verification by p.
+func (r *requestState) issueFlowToken(p *provider) {
+	settings := r.settings
+	if settings.flowKeys == nil {
+		return
+	}
+	token := newFlowToken(settings, settings.flowSteps, clock.Now().Add(settings.flowTTL), p.secretID)
+	if err := r.kong.Response.SetHeader(settings.flowHeader, token); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not issue flow token: %v", err))
+	}
+}
+
+// flowPathMatches reports whether path is one of the configured flow steps.
+func flowPathMatches(settings *compiledConfig, path string) bool {
+	return hasPathPrefix(settings.flowPaths, path)
+}
+
+// acceptFlowToken checks for a valid flow token on a flow path. On success
+// it publishes the decision, exchanges the token for the next one and returns
+// true; otherwise the request continues with regular verification.
+func (r *requestState) acceptFlowToken() bool {
+	settings := r.settings
+	if settings.flowKeys == nil {
+		return false
+	}
+	token, err := r.kong.Request.GetHeader(settings.flowHeader)
+	if err != nil || token == "" {
+		return false
+	}
+	path, err := r.kong.Request.GetPath()
+	if err != nil || !flowPathMatches(settings, path) {
+		return false
+	}
+
+	now := clock.Now()
+	var payload flowPayload
+	raw, ok := settings.flowKeys.open(token, now)
+	if !ok || json.Unmarshal(raw, &payload) != nil {
+		r.log.Warn("Flow token has an invalid signature, falling back to Turnstile verification")
+		return false
+	}
+	if payload.Expires < now.Unix() || payload.Steps < 1 {
+		r.log.Info("Flow token expired or used up, falling back to Turnstile verification")
+		return false
+	}
+	if r.staleEpoch(payload.Epoch) {
+		r.log.Info(fmt.Sprintf("Flow token %s was issued under a replaced secret, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if !usedFlowTokens.consume(payload.ID, payload.Expires, now) {
+		r.log.Warn(fmt.Sprintf("Flow token %s replayed, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+
+	r.log.Info(fmt.Sprintf("Flow token accepted for %s (%d steps left)", path, payload.Steps-1))
+	r.publish(decision{allowed: true, reason: ReasonFlowToken})
+	if payload.Steps > 1 {
+		next := newFlowToken(settings, payload.Steps-1, time.Unix(payload.Expires, 0), payload.Epoch)
+		if err := r.kong.Response.SetHeader(settings.flowHeader, next); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not issue flow token: %v", err))
+		}
+	}
+	return true
+}
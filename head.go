@@ -0,0 +1,26 @@
+package main
+
+import "net/http"
+
+// --- HEAD Requests ---
+// HEAD requests are verified like GET requests: a token is required in a
+// header, query argument or cookie. They carry no body, so form and
+// body_json extraction steps are skipped instead of failing to read one
+// ("Could not read form data"), and a route extracting tokens only from
+// bodies rejects them as missing_token. In
+// batch_mode 'per_item' they are verified as single requests. Rejections of
+// HEAD requests keep their status and headers but send no body.
+
+// isHeadRequest reports whether the request is a HEAD request.
+func (r *requestState) isHeadRequest() bool {
+	method, err := r.kong.Request.GetMethod()
+	return err == nil && method == http.MethodHead
+}
+
+// extractionSteps returns the extraction steps applicable to the request.
+func (r *requestState) extractionSteps() []extractionStep {
+	if r.isHeadRequest() {
+		return withoutBodySteps(r.settings.extraction)
+	}
+	return r.settings.extraction
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+// runHead runs the Access phase for a HEAD request to url. The go-pdk test
+// framework only accepts GET and body-carrying methods, so the request is
+// set up as a GET and turned into a HEAD before the plugin sees it.
+func runHead(t *testing.T, conf *Config, url string, headers http.Header) *test.TestEnv {
+	t.Helper()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	env, err := test.New(t, test.Request{Method: "GET", Url: url, Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.ClientReq.Method = http.MethodHead
+	env.DoAccess(conf)
+	return env
+}
+
+func TestHeadRequests(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	formOnly := func(c *Config) {
+		c.Extraction = &ExtractionConfig{Location: "form", Name: "cf-turnstile-response"}
+	}
+	formThenHeader := func(c *Config) {
+		c.Extraction = &ExtractionConfig{Location: "form", Name: "cf-turnstile-response",
+			Fallbacks: []ExtractionStep{{Location: "header", Name: DefaultTokenHeader}}}
+	}
+	perItem := func(c *Config) { c.BatchMode = "per_item" }
+
+	tests := []struct {
+		name         string
+		conf         func(c *Config)
+		token        string
+		wantRejected bool
+		wantStatus   int
+		wantReason   Reason
+	}{
+		{name: "header token", token: "head-header", wantReason: ReasonVerified},
+		{name: "form step skipped", conf: formThenHeader, token: "head-fallback", wantReason: ReasonVerified},
+		{name: "form only route", conf: formOnly, token: "head-form-only", wantRejected: true, wantStatus: http.StatusBadRequest, wantReason: ReasonMissingToken},
+		{name: "missing token", wantRejected: true, wantStatus: http.StatusBadRequest, wantReason: ReasonMissingToken},
+		{name: "per item batch as single request", conf: perItem, token: "head-batch", wantReason: ReasonVerified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			if tt.conf != nil {
+				tt.conf(conf)
+			}
+			headers := http.Header{}
+			if tt.token != "" {
+				headers.Set(DefaultTokenHeader, tt.token)
+			}
+
+			env := runHead(t, conf, "http://example.com/page", headers)
+
+			if got := turnstiletest.Rejected(env); got != tt.wantRejected {
+				t.Fatalf("rejected = %v, want %v (status %d, body %q)", got, tt.wantRejected, env.ClientRes.Status, env.ClientRes.Body)
+			}
+			if got := decisionReason(t, env); got != string(tt.wantReason) {
+				t.Errorf("reason = %q, want %q", got, tt.wantReason)
+			}
+			if !tt.wantRejected {
+				return
+			}
+			if env.ClientRes.Status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", env.ClientRes.Status, tt.wantStatus)
+			}
+			if len(env.ClientRes.Body) != 0 {
+				t.Errorf("HEAD rejection has body %q", env.ClientRes.Body)
+			}
+			if got := env.ClientRes.Headers.Get(ReasonHeader); got != string(tt.wantReason) {
+				t.Errorf("%s = %q, want %q", ReasonHeader, got, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestGetRejectionKeepsBody(t *testing.T) {
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	env := turnstiletest.RunAccess(t, conf, test.Request{Method: "GET", Url: "http://example.com/page"})
+	if len(env.ClientRes.Body) == 0 {
+		t.Error("GET rejection has no body")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Outbound HTTP Client Profiles ---
+// Each outbound dependency (the siteverify call, the Cloudflare list
+// integration) can reference a named profile from http_clients, so a slow
+// management API does not dictate the timeouts of the verification hot path.
+// Dependencies without a profile keep their built-in defaults.
+//
+// Connections are kept alive and pooled per transport, and transports are
+// shared by the whole plugin server: every client with the same transport
+// settings (proxy, CA bundle, pool tuning) reuses the same pool, across
+// routes, consumers and configuration changes, so TLS handshakes with the
+// provider are paid once per connection rather than per plugin instance.
+
+// HTTPClientConfig describes one outbound client profile.
+type HTTPClientConfig struct {
+	TimeoutMs          int    `json:"timeout_ms"`           // Optional: Overall timeout per attempt. Default: 5000
+	ProxyURL           string `json:"proxy_url"`            // Optional: Proxy for this destination. Default: HTTP(S)_PROXY from the environment
+	CAFile             string `json:"ca_file"`              // Optional: PEM bundle trusted instead of the system roots
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Optional, testing only: Skip TLS certificate verification
+	Retries            int    `json:"retries"`              // Optional: Extra attempts after connection errors and retry_on_status answers, up to 5. Default: 0
+	BackoffMs          int    `json:"backoff_ms"`           // Optional: Pause before the first retry, doubled for each further one up to 10000. Default: 100
+	RetryOnStatus      []int  `json:"retry_on_status"`      // Optional: Answer statuses retried, e.g. [502, 503, 504]; 429 is never retried (see rate_limited_policy). Default: all 5xx
+
+	MaxIdleConnsPerHost    int  `json:"max_idle_conns_per_host"`   // Optional: Idle keep-alive connections kept per host. Default: one per verification worker
+	IdleConnTimeoutSeconds int  `json:"idle_conn_timeout_seconds"` // Optional: How long an idle connection is kept. Default: 90
+	DisableCompression     bool `json:"disable_compression"`       // Optional: Do not ask for gzip-compressed answers. Default: false
+
+	IPFamily     string `json:"ip_family"`     // Optional: Address family connections are made over: 'any', 'ipv4' or 'ipv6'. Default: 'any'
+	LocalAddress string `json:"local_address"` // Optional: Local IP, or network interface whose address is used, to connect from, e.g. '192.0.2.10' or 'eth1'
+}
+
+// httpClient is a compiled profile.
+type httpClient struct {
+	name          string
+	client        *http.Client
+	retries       int
+	backoff       time.Duration
+	retryOnStatus []int // nil for every 5xx
+	compress      bool  // Ask for compressed answers, see disable_compression
+}
+
+// retryBackoff is the pause before the first retry, doubled for each further
+// one up to maxRetryBackoff.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+	maxHTTPRetries  = 5
+)
+
+// transportKey identifies the settings of a shared transport.
+type transportKey struct {
+	proxyURL            string
+	caHash              string // Hash of the ca_file contents, so a changed bundle gets a new transport
+	insecureSkipVerify  bool
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	disableCompression  bool
+	network             string // 'tcp', 'tcp4' or 'tcp6'
+	localIP             string // Empty to let the system choose
+}
+
+// transports holds the shared transports by settings.
+var transports sync.Map // map[transportKey]*http.Transport
+
+// sharedTransport returns the transport for key, building it with configure
+// the first time.
+func sharedTransport(key transportKey, configure func(*http.Transport)) *http.Transport {
+	if transport, ok := transports.Load(key); ok {
+		return transport.(*http.Transport)
+	}
+	transport := newTransport(key.network, net.ParseIP(key.localIP))
+	if key.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = key.maxIdleConnsPerHost
+	}
+	if key.idleConnTimeout > 0 {
+		transport.IdleConnTimeout = key.idleConnTimeout
+	}
+	transport.DisableCompression = key.disableCompression
+	configure(transport)
+	actual, _ := transports.LoadOrStore(key, transport)
+	return actual.(*http.Transport)
+}
+
+// newTransport returns a transport keeping enough idle connections per host
+// for every verification worker to reuse one. TCP connections are made over
+// tcpNetwork ('tcp4' or 'tcp6' to pin the address family, "" for either),
+// from localIP if set. Hosts standing for a Unix domain socket are dialed
+// there, bypassing any proxy.
+func newTransport(tcpNetwork string, localIP net.IP) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = verifyWorkers.workers
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if localIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if socket, ok := unixSockets.Load(addr); ok {
+			return (&net.Dialer{Timeout: dialer.Timeout}).DialContext(ctx, "unix", socket.(string))
+		}
+		if tcpNetwork != "" && network == "tcp" {
+			network = tcpNetwork
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	transport.Proxy = bypassForSockets(transport.Proxy)
+	return transport
+}
+
+// bypassForSockets wraps proxy so socket hosts are never proxied.
+func bypassForSockets(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if _, ok := unixSockets.Load(req.URL.Hostname() + ":80"); ok || proxy == nil {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+}
+
+// --- Unix Domain Sockets ---
+// Verification URLs may name a local sidecar verifier listening on a Unix
+// domain socket instead of TCP, as unix://<socket path>[:<HTTP path>], e.g.
+//
+//	unix:///run/turnstile/verifier.sock:/turnstile/v0/siteverify
+//
+// The HTTP path defaults to "/". Such URLs are rewritten to plain HTTP on a
+// reserved host name that every client transport dials on the socket, so
+// profiles, retries and the worker pool apply unchanged.
+
+// unixSockets maps reserved "host:80" addresses to socket paths.
+var unixSockets sync.Map // map[string]string
+
+// resolveUnixURL rewrites a unix:// URL as described above and returns
+// other URLs unchanged.
+func resolveUnixURL(raw string) (string, error) {
+	rest, ok := strings.CutPrefix(raw, "unix://")
+	if !ok {
+		return raw, nil
+	}
+	socket, path, found := strings.Cut(rest, ":")
+	if !found || path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(socket, "/") || !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("invalid unix socket URL '%s': use unix:///<socket path>[:/<HTTP path>]", raw)
+	}
+	sum := sha256.Sum256([]byte(socket))
+	host := "unix-" + hex.EncodeToString(sum[:6]) + ".sock.invalid"
+	unixSockets.Store(host+":80", socket)
+	return "http://" + host + path, nil
+}
+
+// defaultHTTPClient is used by dependencies without a profile.
+func defaultHTTPClient(name string, timeout time.Duration) *httpClient {
+	return &httpClient{name: name, client: &http.Client{Timeout: timeout, Transport: sharedTransport(transportKey{}, func(*http.Transport) {})}, backoff: retryBackoff, compress: true}
+}
+
+// compileHTTPClient builds the client of one profile.
+func compileHTTPClient(name string, pc HTTPClientConfig) (*httpClient, error) {
+	key := transportKey{
+		proxyURL:            pc.ProxyURL,
+		insecureSkipVerify:  pc.InsecureSkipVerify,
+		maxIdleConnsPerHost: pc.MaxIdleConnsPerHost,
+		idleConnTimeout:     time.Duration(pc.IdleConnTimeoutSeconds) * time.Second,
+		disableCompression:  pc.DisableCompression,
+	}
+	var proxy *url.URL
+	if pc.ProxyURL != "" {
+		var err error
+		if proxy, err = url.Parse(pc.ProxyURL); err != nil {
+			return nil, fmt.Errorf("http_clients.%s: invalid proxy_url: %v", name, err)
+		}
+	}
+	var roots *x509.CertPool
+	if pc.CAFile != "" {
+		pem, err := os.ReadFile(pc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("http_clients.%s: reading ca_file: %v", name, err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("http_clients.%s: no certificates found in ca_file", name)
+		}
+		key.caHash = tokenHash(string(pem))
+	}
+	if pc.Retries < 0 || pc.Retries > maxHTTPRetries {
+		return nil, fmt.Errorf("http_clients.%s: invalid retries %d. Use a value between 0 and %d", name, pc.Retries, maxHTTPRetries)
+	}
+	if pc.BackoffMs < 0 || pc.BackoffMs > int(maxRetryBackoff/time.Millisecond) {
+		return nil, fmt.Errorf("http_clients.%s: invalid backoff_ms %d. Use a value between 0 and %d", name, pc.BackoffMs, maxRetryBackoff/time.Millisecond)
+	}
+	for _, status := range pc.RetryOnStatus {
+		if status < 400 || status > 599 || status == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("http_clients.%s: invalid retry_on_status entry %d. Use 4xx or 5xx statuses other than 429", name, status)
+		}
+	}
+	var err error
+	if key.network, key.localIP, err = compileEgress(pc.IPFamily, pc.LocalAddress); err != nil {
+		return nil, fmt.Errorf("http_clients.%s: %v", name, err)
+	}
+	if pc.MaxIdleConnsPerHost < 0 || pc.IdleConnTimeoutSeconds < 0 {
+		return nil, fmt.Errorf("http_clients.%s: max_idle_conns_per_host and idle_conn_timeout_seconds must not be negative", name)
+	}
+	transport := sharedTransport(key, func(transport *http.Transport) {
+		if proxy != nil {
+			transport.Proxy = bypassForSockets(http.ProxyURL(proxy))
+		}
+		if roots != nil || pc.InsecureSkipVerify {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: pc.InsecureSkipVerify, RootCAs: roots}
+		}
+	})
+
+	timeout := time.Duration(DefaultTimeoutMs) * time.Millisecond
+	if pc.TimeoutMs > 0 {
+		timeout = time.Duration(pc.TimeoutMs) * time.Millisecond
+	}
+	backoff := retryBackoff
+	if pc.BackoffMs > 0 {
+		backoff = time.Duration(pc.BackoffMs) * time.Millisecond
+	}
+	return &httpClient{name: name, client: &http.Client{Timeout: timeout, Transport: transport},
+		retries: pc.Retries, backoff: backoff, retryOnStatus: pc.RetryOnStatus, compress: !pc.DisableCompression}, nil
+}
+
+// compileEgress resolves ip_family and local_address to the dial network and
+// local IP of a transport. An interface name stands for its first address of
+// the family.
+func compileEgress(family, local string) (network, localIP string, err error) {
+	switch strings.ToLower(family) {
+	case "", "any":
+	case "ipv4":
+		network = "tcp4"
+	case "ipv6":
+		network = "tcp6"
+	default:
+		return "", "", fmt.Errorf("invalid ip_family '%s'. Use 'any', 'ipv4' or 'ipv6'", family)
+	}
+	if local == "" {
+		return network, "", nil
+	}
+	fits := func(ip net.IP) bool {
+		return network == "" || (network == "tcp4") == (ip.To4() != nil)
+	}
+	if ip := net.ParseIP(local); ip != nil {
+		if !fits(ip) {
+			return "", "", fmt.Errorf("local_address %s is not an address of ip_family '%s'", local, family)
+		}
+		return network, ip.String(), nil
+	}
+	iface, err := net.InterfaceByName(local)
+	if err != nil {
+		return "", "", fmt.Errorf("local_address '%s' is neither an IP address nor a network interface: %v", local, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", "", fmt.Errorf("reading addresses of interface %s: %v", local, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && fits(ipNet.IP) && !ipNet.IP.IsLinkLocalUnicast() {
+			return network, ipNet.IP.String(), nil
+		}
+	}
+	return "", "", fmt.Errorf("interface %s has no usable address for ip_family '%s'", local, cmp.Or(family, "any"))
+}
+
+// compileHTTPClients compiles every profile of conf.
+func compileHTTPClients(conf *Config) (map[string]*httpClient, error) {
+	clients := make(map[string]*httpClient, len(conf.HTTPClients))
+	for name, pc := range conf.HTTPClients {
+		c, err := compileHTTPClient(name, pc)
+		if err != nil {
+			return nil, err
+		}
+		clients[name] = c
+	}
+	return clients, nil
+}
+
+// resolveHTTPClient returns the profile named by field, or fallback when it is empty.
+func resolveHTTPClient(clients map[string]*httpClient, field, name string, fallback *httpClient) (*httpClient, error) {
+	if name == "" {
+		return fallback, nil
+	}
+	c, ok := clients[name]
+	if !ok {
+		return nil, fmt.Errorf("%s references unknown http_clients profile '%s'", field, name)
+	}
+	return c, nil
+}
+
+// do sends the request built by newRequest, building a fresh one for each
+// retry since bodies are consumed. Connection errors and retry_on_status
+// answers are retried; the last outcome is returned.
+func (c *httpClient) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return c.doUntil(time.Time{}, newRequest)
+}
+
+// doUntil is do for a caller waiting until deadline at most: no retry is
+// made that would start after it. The zero deadline allows every retry.
+func (c *httpClient) doUntil(deadline time.Time, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Do(req)
+		pause := c.retryPause(attempt)
+		if attempt >= c.retries || (err == nil && !c.retryStatus(resp.StatusCode)) ||
+			(!deadline.IsZero() && time.Now().Add(pause).After(deadline)) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		time.Sleep(pause)
+	}
+}
+
+// retryPause is the pause after attempt before the next one.
+func (c *httpClient) retryPause(attempt int) time.Duration {
+	return min(c.backoff<<attempt, maxRetryBackoff)
+}
+
+// retryStatus reports whether an answer with status is retried.
+func (c *httpClient) retryStatus(status int) bool {
+	if c.retryOnStatus == nil {
+		return status >= 500
+	}
+	return slices.Contains(c.retryOnStatus, status)
+}
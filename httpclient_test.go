@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingTLSServer starts a TLS siteverify stand-in that counts the
+// connections clients open to it.
+func newCountingTLSServer(tb testing.TB) (*httptest.Server, *atomic.Int64) {
+	var conns atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, successAnswer)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	tb.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func postVerify(tb testing.TB, c *http.Client, url string) {
+	resp, err := c.Post(url, "application/x-www-form-urlencoded", strings.NewReader("secret=s&response=t"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestProfilesShareTransports(t *testing.T) {
+	a, err := compileHTTPClient("a", HTTPClientConfig{TimeoutMs: 1000, MaxIdleConnsPerHost: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := compileHTTPClient("b", HTTPClientConfig{TimeoutMs: 2000, MaxIdleConnsPerHost: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := compileHTTPClient("c", HTTPClientConfig{MaxIdleConnsPerHost: 7, DisableCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.client.Transport != b.client.Transport {
+		t.Error("profiles differing only in timeout got separate transports")
+	}
+	if a.client.Transport == c.client.Transport {
+		t.Error("profiles with different compression settings share a transport")
+	}
+	transport := a.client.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 7 {
+		t.Errorf("MaxIdleConnsPerHost = %d, want 7", transport.MaxIdleConnsPerHost)
+	}
+	if !c.client.Transport.(*http.Transport).DisableCompression {
+		t.Error("disable_compression not applied to the transport")
+	}
+}
+
+func TestSharedTransportReusesConnections(t *testing.T) {
+	srv, conns := newCountingTLSServer(t)
+	for i := 0; i < 2; i++ {
+		// A config change compiles the profile again; the pool must survive it
+		c, err := compileHTTPClient("verify", HTTPClientConfig{InsecureSkipVerify: true, IdleConnTimeoutSeconds: 31})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			postVerify(t, c.client, srv.URL)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("10 sequential calls opened %d connections, want 1", n)
+	}
+}
+
+// BenchmarkSiteverifyTransport compares calls over the shared keep-alive
+// transport with building a client and transport per request, as the plugin
+// did before, against a local TLS server. The difference is the TLS
+// handshake, which grows with the round-trip time to the provider.
+func BenchmarkSiteverifyTransport(b *testing.B) {
+	srv, conns := newCountingTLSServer(b)
+
+	b.Run("shared", func(b *testing.B) {
+		c, err := compileHTTPClient("bench", HTTPClientConfig{InsecureSkipVerify: true, IdleConnTimeoutSeconds: 32})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns.Store(0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			postVerify(b, c.client, srv.URL)
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+
+	b.Run("per_request", func(b *testing.B) {
+		conns.Store(0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			postVerify(b, &http.Client{Transport: transport}, srv.URL)
+			transport.CloseIdleConnections()
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+}
+
+func TestRetryLimits(t *testing.T) {
+	for _, pc := range []HTTPClientConfig{{Retries: -1}, {Retries: maxHTTPRetries + 1}, {BackoffMs: -1}, {BackoffMs: 10001}} {
+		if _, err := compileHTTPClient("limits", pc); err == nil {
+			t.Errorf("%+v accepted", pc)
+		}
+	}
+	c, err := compileHTTPClient("limits", HTTPClientConfig{Retries: maxHTTPRetries, BackoffMs: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < maxHTTPRetries; attempt++ {
+		if pause := c.retryPause(attempt); pause <= 0 || pause > maxRetryBackoff {
+			t.Errorf("pause after attempt %d = %s", attempt, pause)
+		}
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	tests := []struct {
+		retryOnStatus []int
+		status        int
+		want          bool
+	}{
+		{nil, http.StatusServiceUnavailable, true},
+		{nil, http.StatusNotFound, false},
+		{[]int{http.StatusBadGateway}, http.StatusBadGateway, true},
+		{[]int{http.StatusBadGateway}, http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		c := &httpClient{retryOnStatus: tt.retryOnStatus}
+		if got := c.retryStatus(tt.status); got != tt.want {
+			t.Errorf("retryStatus(%d) with %v = %v, want %v", tt.status, tt.retryOnStatus, got, tt.want)
+		}
+	}
+}
+
+// newFailingServer answers the first failures requests with 503 and the
+// rest with success, counting all of them.
+func newFailingServer(t *testing.T, failures int64) (*httptest.Server, *atomic.Int64) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, successAnswer)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestDoRetries(t *testing.T) {
+	srv, calls := newFailingServer(t, 2)
+	c, err := compileHTTPClient("retry", HTTPClientConfig{Retries: 2, BackoffMs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.do(func() (*http.Request, error) { return http.NewRequest("GET", srv.URL, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("status %d after %d calls, want 200 after 3", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestDoUntilStopsRetryingAtDeadline(t *testing.T) {
+	srv, calls := newFailingServer(t, 10)
+	c, err := compileHTTPClient("retry", HTTPClientConfig{Retries: maxHTTPRetries, BackoffMs: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	resp, err := c.doUntil(started.Add(50*time.Millisecond), func() (*http.Request, error) { return http.NewRequest("GET", srv.URL, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("status %d after %d calls, want 503 after 1", resp.StatusCode, calls.Load())
+	}
+	if elapsed := time.Since(started); elapsed > 150*time.Millisecond {
+		t.Errorf("doUntil took %s past its deadline", elapsed)
+	}
+}
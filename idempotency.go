@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// --- Idempotent Retries ---
+// Payment-style APIs let clients retry a request that timed out with the
+// same Idempotency-Key, and the upstream makes sure it is executed once.
+// The retry carries the same, now used, token, which the provider answers
+// with 'timeout-or-duplicate'. With idempotency_window_seconds set, a
+// successful verification of a request carrying idempotency_header is
+// remembered for that window under the key and token together; a retry
+// with both is accepted without asking the provider again, with reason
+// idempotent_retry. Unlike verify_cache_ttl_seconds this does not depend on
+// the client address, which mobile clients often change between attempts,
+// and a token resent without the key, or under another key, is verified as
+// usual. Entries live in this process only and are bound to the provider's
+// secret (see rotation.go).
+
+const maxIdempotentItems = 100000
+
+type idempotentEntry struct {
+	secretID  string
+	tokenHash string // For purging by token
+	ip        string // Address of the first attempt, for purging by IP
+	response  *VerificationResult
+	expires   time.Time
+}
+
+// idempotentStore remembers successful verifications by key and token.
+type idempotentStore struct {
+	mu        sync.Mutex
+	entries   map[string]idempotentEntry
+	lastSweep time.Time
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+var idempotentRetries = newIdempotentStore()
+
+func newIdempotentStore() *idempotentStore {
+	s := &idempotentStore{entries: make(map[string]idempotentEntry)}
+	registerCache("idempotent_retries", s)
+	return s
+}
+
+func idempotentKey(p *provider, key, token string) string {
+	sum := sha256.Sum256([]byte(p.name + "\x00" + key + "\x00" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyKey returns the request's idempotency key, or "" when retries
+// are not tolerated.
+func (r *requestState) idempotencyKey() string {
+	settings := r.settings
+	if settings.idempotencyWindow <= 0 {
+		return ""
+	}
+	key, err := r.kong.Request.GetHeader(settings.idempotencyHeader)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// earlierAttempt returns the verification of an earlier attempt of this
+// request, if any.
+func (r *requestState) earlierAttempt(p *provider, token string) (*VerificationResult, bool) {
+	key := r.idempotencyKey()
+	if key == "" {
+		return nil, false
+	}
+	s := idempotentRetries
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[idempotentKey(p, key, token)]
+	if !ok || entry.secretID != p.secretID || clock.Now().After(entry.expires) {
+		s.misses++
+		return nil, false
+	}
+	s.hits++
+	return entry.response, true
+}
+
+// rememberAttempt makes a successful verification available to retries of
+// this request.
+func (r *requestState) rememberAttempt(p *provider, token, ip string, resp *VerificationResult) {
+	key := r.idempotencyKey()
+	if key == "" {
+		return
+	}
+	now := clock.Now()
+	s := idempotentRetries
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute || len(s.entries) >= maxIdempotentItems {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+				s.evictions++
+			}
+		}
+		s.lastSweep = now
+		if len(s.entries) >= maxIdempotentItems {
+			return
+		}
+	}
+	s.entries[idempotentKey(p, key, token)] = idempotentEntry{secretID: p.secretID, tokenHash: tokenHash(token), ip: ip,
+		response: resp, expires: now.Add(r.settings.idempotencyWindow)}
+}
+
+func (s *idempotentStore) Stats() cacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cacheStats{Entries: len(s.entries), Hits: s.hits, Misses: s.misses, Evictions: s.evictions}
+}
+
+// Purge removes all entries, or those matching a token hash or client IP.
+func (s *idempotentStore) Purge(filter cacheFilter) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for k, entry := range s.entries {
+		if (filter.TokenHash == "" || filter.TokenHash == entry.tokenHash) && (filter.IP == "" || filter.IP == entry.ip) {
+			delete(s.entries, k)
+			removed++
+		}
+	}
+	return removed, true
+}
+
+// purgeSecrets removes entries verified under the given secret IDs.
+func (s *idempotentStore) purgeSecrets(ids map[string]bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for k, entry := range s.entries {
+		if ids[entry.secretID] {
+			delete(s.entries, k)
+			removed++
+		}
+	}
+	return removed
+}
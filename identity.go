@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// --- Verified Traffic Identity ---
+// Service meshes behind Kong can key policies on verification when upstream
+// requests carry a traffic-class header, e.g. an SPIFFE-style identity such
+// as 'spiffe://example.org/traffic/human-verified'. The header is removed
+// from every request first, so clients cannot claim the class themselves,
+// and only set on requests a person verifiably stands behind.
+
+// clearIdentity drops a client-supplied identity header.
+func (r *requestState) clearIdentity() {
+	header := r.settings.identityHeader
+	if header == "" {
+		return
+	}
+	if err := r.kong.ServiceRequest.ClearHeader(header); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header, err))
+	}
+}
+
+// isHumanVerified reports whether reason means a solved challenge stands
+// behind the request.
+func isHumanVerified(reason Reason) bool {
+	switch reason {
+	case ReasonVerified, ReasonFlowToken, ReasonPass, ReasonReceipt, ReasonCacheHit, ReasonEdgeAssertion:
+		return true
+	}
+	return false
+}
+
+// stampIdentity marks the upstream request as human-verified traffic.
+func (r *requestState) stampIdentity(d decision) {
+	header := r.settings.identityHeader
+	if header == "" || !d.allowed || d.advised || !isHumanVerified(d.reason) {
+		return
+	}
+	if err := r.kong.ServiceRequest.SetHeader(header, r.settings.identityValue); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not set %s on the upstream request: %v", header, err))
+	}
+}
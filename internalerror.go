@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// --- Provider Internal Errors ---
+// Cloudflare answers 'internal-error' when siteverify itself failed to
+// validate the token, and documents the call as safe to retry. Such answers
+// are retried up to internal_error_retries times (default 2), pausing
+// retryBackoff before the first retry and doubling it for each further one.
+// Answers are counted per provider as internal_errors, retries as
+// internal_error_retries. When the last attempt still answers
+// 'internal-error', the request fails with 502 and reason provider_error
+// rather than 403 invalid_token: the client's token was never judged.
+
+// ProviderInternalErrorCode is the error code of failures inside siteverify.
+const ProviderInternalErrorCode = "internal-error"
+
+// maxInternalErrorRetries bounds internal_error_retries.
+const maxInternalErrorRetries = 5
+
+// isInternalError reports whether resp is an 'internal-error' answer.
+func isInternalError(resp *VerificationResult) bool {
+	return resp != nil && !resp.Success && slices.Contains(resp.ErrorCodes, ProviderInternalErrorCode)
+}
+
+// retryInternalErrors verifies again while the provider answers
+// 'internal-error', and turns a last such answer into a verification error.
+func (r *requestState) retryInternalErrors(p *provider, token, clientIP string, resp *VerificationResult, verr *verifyError) (*VerificationResult, *verifyError) {
+	for attempt := 0; verr == nil && isInternalError(resp); attempt++ {
+		p.stats.InternalErrors.Add(1)
+		if attempt >= r.settings.internalErrorRetries {
+			return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (API error)",
+				msg: fmt.Sprintf("%s answered '%s' %d times", p.name, ProviderInternalErrorCode, attempt+1)}
+		}
+		p.stats.InternalErrorRetries.Add(1)
+		r.log.Info(fmt.Sprintf("%s answered '%s', retrying", p.name, ProviderInternalErrorCode))
+		time.Sleep(retryBackoff << attempt)
+		resp, verr = r.verifyCall(p, token, clientIP)
+	}
+	return resp, verr
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+func TestInternalErrorRetries(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+	tests := []struct {
+		name      string
+		retries   *int
+		wantCalls int
+	}{
+		{"default", nil, 1 + DefaultInternalErrRetries},
+		{"disabled", intPtr(0), 1},
+		{"one retry", intPtr(1), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := turnstiletest.NewServer(t)
+			srv.SetDefault(turnstiletest.Failure(ProviderInternalErrorCode))
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			conf.InternalErrorRetries = tt.retries
+
+			env := turnstiletest.RunAccess(t, conf, test.Request{
+				Method:  "GET",
+				Url:     "http://example.com/login",
+				Headers: http.Header{DefaultTokenHeader: {"token-" + t.Name()}},
+			})
+
+			if env.ClientRes.Status != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", env.ClientRes.Status, http.StatusBadGateway)
+			}
+			if got := decisionReason(t, env); got != string(ReasonProviderError) {
+				t.Errorf("reason = %q, want %q", got, ReasonProviderError)
+			}
+			if calls := len(srv.Calls()); calls != tt.wantCalls {
+				t.Errorf("siteverify called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestInternalErrorRetriesBounds(t *testing.T) {
+	for _, n := range []int{-1, maxInternalErrorRetries + 1} {
+		if err := compileConfig(&Config{TurnstileSecretKey: "secret", InternalErrorRetries: &n}).err; err == nil {
+			t.Errorf("internal_error_retries %d accepted", n)
+		}
+	}
+}
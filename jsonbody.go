@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// --- JSON Body Extraction ---
+// SPAs often POST application/json and cannot easily switch to form encoding
+// or add a header. Extraction steps with location 'body_json' read the body
+// (within max_body_bytes, like form steps) and take the token from the field
+// named by a dot-separated path, e.g. "data.turnstile_token"; numeric
+// segments index arrays ("items.0.token"). Keys containing dots cannot be
+// addressed. A body that is not JSON, a path that does not exist and a
+// field that is not a string all count as "not found", so a later step, e.g.
+// a form field, can still find the token.
+
+// parseJSONBody parses a request body, returning nil when it is not JSON.
+func parseJSONBody(body []byte) interface{} {
+	var document interface{}
+	if json.Unmarshal(body, &document) != nil {
+		return nil
+	}
+	return document
+}
+
+// jsonPathValue returns the string at path in document, or "".
+func jsonPathValue(document interface{}, path string) string {
+	node := document
+	for _, segment := range strings.Split(path, ".") {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(n) {
+				return ""
+			}
+			node = n[i]
+		default:
+			return ""
+		}
+	}
+	value, _ := node.(string)
+	return value
+}
+
+// validateJSONPath rejects paths with empty segments.
+func validateJSONPath(path string) error {
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return fmt.Errorf("invalid JSON path '%s'. Use dot-separated keys, e.g. 'data.turnstile_token'", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Attempt Limits, Verify Quotas and Penalty Bans ---
+// Three limits on the token buckets of buckets.go, all off by default:
+//
+//	attempt_limit      token-bearing requests per client IP and
+//	                   attempt_limit_window_seconds (default 60). Further
+//	                   requests get 429 with Retry-After, reason
+//	                   attempt_limited, before the token is looked at.
+//	verify_quota       siteverify calls per provider secret and
+//	                   verify_quota_window_seconds (default 1), probes
+//	                   included. Further calls are held back as after a 429
+//	                   from the provider, so rate_limited_policy applies.
+//	penalty_threshold  client failures (missing, malformed, invalid tokens
+//	                   and the like) per client IP and penalty_window_seconds
+//	                   (default 300). The failure draining the bucket bans the
+//	                   IP for penalty_ban_seconds (default 600): its requests
+//	                   get 429 with Retry-After, reason penalty_banned, unless
+//	                   route modes, skip rules or bot verdicts decide them first.
+//
+// Limits allow bursts of their full size and refill continuously, e.g.
+// attempt_limit 10 allows one more attempt every 6 seconds once 10 were made.
+// Counts are per plugin server, or shared through rate_limit_strategy 'redis'.
+
+// Bucket features, as in keys and the turnstile_rate_limit_total metric.
+const (
+	featureAttemptLimit   = "attempt_limit"
+	featureVerifyQuota    = "verify_quota"
+	featurePenalty        = "penalty"
+	featureCloudflareList = "cloudflare_list"
+)
+
+// compileLimits sets up rate_limit_strategy and the limits.
+func compileLimits(conf *Config, cc *compiledConfig) error {
+	cc.rateLimiter = localRateLimiter
+	limiter, err := compileRateLimiter(conf)
+	if err != nil {
+		return err
+	}
+	cc.rateLimiter = limiter
+	if cc.attemptLimit, err = compileLimit("attempt_limit", conf.AttemptLimit, conf.AttemptLimitWindowSeconds, DefaultAttemptWindowSec); err != nil {
+		return err
+	}
+	if cc.verifyQuota, err = compileLimit("verify_quota", conf.VerifyQuota, conf.VerifyQuotaWindowSeconds, DefaultQuotaWindowSec); err != nil {
+		return err
+	}
+	if cc.penalty, err = compileLimit("penalty_threshold", conf.PenaltyThreshold, conf.PenaltyWindowSeconds, DefaultPenaltyWindowSec); err != nil {
+		return err
+	}
+	if conf.PenaltyBanSeconds < 0 {
+		return fmt.Errorf("invalid penalty_ban_seconds configured: %d", conf.PenaltyBanSeconds)
+	}
+	cc.penaltyBan = time.Duration(DefaultPenaltyBanSec) * time.Second
+	if conf.PenaltyBanSeconds > 0 {
+		cc.penaltyBan = time.Duration(conf.PenaltyBanSeconds) * time.Second
+	}
+	return nil
+}
+
+// compileLimit reads a limit and its window, defaultWindow when unset.
+func compileLimit(field string, limit, windowSeconds, defaultWindow int) (bucketLimit, error) {
+	if limit < 0 || windowSeconds < 0 {
+		return bucketLimit{}, fmt.Errorf("invalid %s configured: %d per %d seconds", field, limit, windowSeconds)
+	}
+	if windowSeconds == 0 {
+		windowSeconds = defaultWindow
+	}
+	return bucketLimit{limit: limit, window: time.Duration(windowSeconds) * time.Second}, nil
+}
+
+// retryAfterHeader carries wait, rounded up to whole seconds.
+func retryAfterHeader(wait time.Duration) map[string][]string {
+	return map[string][]string{"Retry-After": {strconv.Itoa(int((wait + time.Second - 1) / time.Second))}}
+}
+
+// attemptLimitStage rejects clients over attempt_limit.
+func (r *requestState) attemptLimitStage(v *verification) bool {
+	settings := r.settings
+	ip := r.clientIP()
+	if !settings.attemptLimit.enabled() || ip == "" {
+		return true
+	}
+	take := settings.rateLimiter.take(featureAttemptLimit, ip, settings.attemptLimit)
+	if take.allowed() {
+		return true
+	}
+	r.log.Warn(fmt.Sprintf("Turnstile: %s exceeded attempt_limit of %d per %s, next attempt in %s",
+		ip, settings.attemptLimit.limit, settings.attemptLimit.window, take.wait.Round(time.Millisecond)))
+	r.exit(decision{status: http.StatusTooManyRequests, reason: ReasonAttemptLimited, provider: v.provider},
+		[]byte("Too many verification attempts"), retryAfterHeader(take.wait))
+	return false
+}
+
+// verifyQuotaWait takes a call to p from verify_quota and returns how long
+// calls are held back when none is left.
+func verifyQuotaWait(settings *compiledConfig, p *provider) time.Duration {
+	if !settings.verifyQuota.enabled() {
+		return 0
+	}
+	return settings.rateLimiter.take(featureVerifyQuota, p.secretID, settings.verifyQuota).wait
+}
+
+func quotaExceededError(p *provider, wait time.Duration) *verifyError {
+	return &verifyError{status: http.StatusServiceUnavailable, body: "Turnstile verification temporarily unavailable",
+		msg:        fmt.Sprintf("verify_quota for %s exhausted, holding back calls for another %s", p.name, wait.Round(time.Millisecond)),
+		retryAfter: wait}
+}
+
+// penaltyStage rejects banned clients.
+func (r *requestState) penaltyStage(_ *verification) bool {
+	settings := r.settings
+	ip := r.clientIP()
+	if !settings.penalty.enabled() || ip == "" {
+		return true
+	}
+	wait := settings.rateLimiter.blockedFor(featurePenalty, ip)
+	if wait <= 0 {
+		return true
+	}
+	r.log.Warn(fmt.Sprintf("Turnstile: refusing %s, banned for repeated failures for another %s", ip, wait.Round(time.Second)))
+	r.exit(decision{status: http.StatusTooManyRequests, reason: ReasonPenaltyBanned},
+		[]byte("Too many failed verifications"), retryAfterHeader(wait))
+	return false
+}
+
+// recordPenalty counts a client failure, banning the client once it drains
+// its penalty bucket.
+func (r *requestState) recordPenalty(d decision) {
+	settings := r.settings
+	if !settings.penalty.enabled() || d.allowed || !isClientFailure(d.reason) {
+		return
+	}
+	ip := r.clientIP()
+	if ip == "" || !settings.rateLimiter.take(featurePenalty, ip, settings.penalty).exhausted() {
+		return
+	}
+	settings.rateLimiter.block(featurePenalty, ip, settings.penaltyBan)
+	r.log.Warn(fmt.Sprintf("Turnstile: banning %s for %s after %d failures (penalty_threshold)", ip, settings.penaltyBan, settings.penalty.limit))
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// --- Config Linting ---
+// "kong-turnstile-plugin lint-config [-offline] [-strict] <file>" checks a
+// plugin configuration before it is applied, so a GitOps pipeline can gate
+// changes. The file (or stdin, for "-" or no file) holds the plugin's config
+// object as JSON, or a plugin entry as Kong's Admin API and declarative
+// config have it ({"name": ..., "config": {...}}). Findings are printed one
+// per line as "error: <field>: ..." or "warning: <field>: ...":
+//
+//   - errors: fields Kong's schema does not know (with the closest known
+//     name), values of the wrong type, the validation error the plugin would
+//     answer every request with 500 for, and verify URLs that cannot be
+//     reached or reject the secret key
+//   - warnings: deprecated fields (see compat.go) and insecure combinations, e.g. fail_open
+//     without fail_open_header or secrets written into the file
+//
+// Every provider's verify URL is sent a canary verification as by
+// probe_interval_seconds; -offline skips this for pipelines without egress.
+// The exit code is 1 with errors (or, with -strict, warnings), else 0.
+
+// minSigningSecretLength is the shortest HMAC secret not warned about.
+const minSigningSecretLength = 32
+
+// lintFinding is one line of lint-config output.
+type lintFinding struct {
+	severity string // "error" or "warning"
+	field    string
+	msg      string
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.severity, f.field, f.msg)
+}
+
+type lintReport struct {
+	findings []lintFinding
+}
+
+func (l *lintReport) errorf(field, format string, args ...interface{}) {
+	l.findings = append(l.findings, lintFinding{severity: "error", field: field, msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *lintReport) warnf(field, format string, args ...interface{}) {
+	l.findings = append(l.findings, lintFinding{severity: "warning", field: field, msg: fmt.Sprintf(format, args...)})
+}
+
+func (l *lintReport) count(severity string) int {
+	n := 0
+	for _, f := range l.findings {
+		if f.severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+func isLintConfigInvocation() bool {
+	return len(os.Args) > 1 && os.Args[1] == "lint-config"
+}
+
+// runLintConfig implements the lint-config subcommand and returns the exit code.
+func runLintConfig(args []string) int {
+	compileOnly = true
+	flags := flag.NewFlagSet("lint-config", flag.ContinueOnError)
+	offline := flags.Bool("offline", false, "do not contact the verify URLs")
+	strict := flags.Bool("strict", false, "exit 1 on warnings too")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: lint-config [-offline] [-strict] [<config.json>|-]")
+		return 2
+	}
+
+	in := io.Reader(os.Stdin)
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "lint-config: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	raw, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lint-config: %v\n", err)
+		return 1
+	}
+
+	report := lintConfig(raw, !*offline)
+	for _, f := range report.findings {
+		fmt.Println(f)
+	}
+	errors, warnings := report.count("error"), report.count("warning")
+	fmt.Printf("%d error(s), %d warning(s)\n", errors, warnings)
+	if errors > 0 || (*strict && warnings > 0) {
+		return 1
+	}
+	return 0
+}
+
+// lintConfig checks raw, a config object or plugin entry.
+func lintConfig(raw []byte, online bool) *lintReport {
+	report := &lintReport{}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		report.errorf("config", "not a JSON object: %v", err)
+		return report
+	}
+	if entry, ok := fields["config"]; ok && fields["name"] != nil {
+		raw = entry
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			report.errorf("config", "not a JSON object: %v", err)
+			return report
+		}
+	}
+
+	lintUnknownFields(report, "", raw, reflect.TypeOf(Config{}))
+	conf := New().(*Config)
+	if err := json.Unmarshal(raw, conf); err != nil {
+		report.errorf(lintTypeErrorField(err), "%v", err)
+		return report
+	}
+	for _, name := range deprecatedFieldsInUse(conf) {
+		report.warnf(name, "deprecated, %s", deprecatedFields[name])
+	}
+
+	cc := compileConfig(conf)
+	if cc.err != nil {
+		report.errorf("config", "%v; every request would be answered with 500", cc.err)
+		return report
+	}
+	lintInsecure(report, conf, cc)
+	if online {
+		lintVerifyURLs(report, conf, cc)
+	}
+	return report
+}
+
+// lintUnknownFields reports keys of raw that type t has no field for,
+// descending into nested objects, arrays and maps.
+func lintUnknownFields(report *lintReport, path string, raw json.RawMessage, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil {
+			return // Reported as a type error
+		}
+		known := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if f.IsExported() && name != "" && name != "-" {
+				known[name] = f.Type
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(fields)) {
+			ft, ok := known[name]
+			if !ok {
+				msg := "unknown field, Kong rejects the configuration"
+				if suggestion := closestName(name, slices.Sorted(maps.Keys(known))); suggestion != "" {
+					msg += fmt.Sprintf("; did you mean '%s'?", suggestion)
+				}
+				report.errorf(path+name, "%s", msg)
+				continue
+			}
+			lintUnknownFields(report, path+name+".", fields[name], ft)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return
+		}
+		for i, item := range items {
+			lintUnknownFields(report, fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i), item, t.Elem())
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(raw, &entries) != nil {
+			return
+		}
+		for _, key := range slices.Sorted(maps.Keys(entries)) {
+			lintUnknownFields(report, path+key+".", entries[key], t.Elem())
+		}
+	}
+}
+
+// lintTypeErrorField names the field of a decoding error, if it has one.
+func lintTypeErrorField(err error) string {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return typeErr.Field
+	}
+	return "config"
+}
+
+// lintInsecure warns about combinations that weaken the protection.
+func lintInsecure(report *lintReport, conf *Config, cc *compiledConfig) {
+	secrets := []struct{ field, value string }{
+		{"turnstile_secret_key", conf.TurnstileSecretKey},
+		{"pass_secret", conf.PassSecret},
+		{"flow_token_secret", conf.FlowTokenSecret},
+		{"session_secret", conf.SessionSecret},
+		{"cloudflare_api_token", conf.CloudflareAPIToken},
+		{"analytics_token", conf.AnalyticsToken},
+		{"failure_counter_password", conf.FailureCounterPassword},
+		{"rate_limit_redis_password", conf.RateLimitRedisPassword},
+	}
+	for i, pc := range conf.AdditionalProviders {
+		secrets = append(secrets, struct{ field, value string }{fmt.Sprintf("additional_providers[%d].secret_key", i), pc.SecretKey})
+	}
+	for _, s := range secrets {
+		if s.value != "" && !strings.HasPrefix(s.value, "{vault://") {
+			report.warnf(s.field, "secret written into the configuration; use a vault reference such as '{vault://env/turnstile-secret}'")
+		}
+	}
+	for _, s := range []struct{ field, value string }{{"pass_secret", conf.PassSecret}, {"flow_token_secret", conf.FlowTokenSecret}, {"session_secret", conf.SessionSecret}} {
+		if s.value != "" && !strings.HasPrefix(s.value, "{vault://") && len(s.value) < minSigningSecretLength {
+			report.warnf(s.field, "shorter than %d bytes, signed tokens can be forged by guessing it", minSigningSecretLength)
+		}
+	}
+
+	for i, p := range cc.providers {
+		field := "turnstile_verify_url"
+		if i > 0 {
+			field = fmt.Sprintf("additional_providers[%d].verify_url", i-1)
+		}
+		if u, err := url.Parse(p.verifyURL); err == nil && u.Scheme == "http" && !lintLoopback(u.Hostname()) {
+			report.warnf(field, "plain HTTP, the secret key and tokens can be read on the way; use https://")
+		}
+	}
+	if cc.rateLimitedPolicy == "fail_open" && conf.FailOpenHeader == "" {
+		report.warnf("rate_limited_policy", "'fail_open' lets requests through unverified while the provider answers 429; set fail_open_header so the upstream can tell")
+	}
+	if cc.failureMode == "open" && conf.FailOpenHeader == "" {
+		report.warnf("failure_mode", "'open' lets requests through unverified while the provider is unavailable; set fail_open_header so the upstream can tell")
+	}
+	if cc.enforcementMode == "advise" {
+		report.warnf("enforcement_mode", "'advise' forwards requests failing verification to the upstream")
+	}
+	if cc.streamedBodyPolicy == "skip" {
+		report.warnf("streamed_body_policy", "'skip' lets chunked bodies beyond max_body_bytes through unverified")
+	}
+	for _, cidr := range conf.DebugPassthroughCIDRs {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err == nil && prefix.Bits() == 0 {
+			report.warnf("debug_passthrough_cidrs", "'%s' shows raw siteverify answers and timings to every client", cidr)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(conf.HTTPClients)) {
+		if conf.HTTPClients[name].InsecureSkipVerify {
+			report.warnf("http_clients."+name+".insecure_skip_verify", "TLS certificates are not verified, for testing only")
+		}
+	}
+	if cc.preverifyPath != "" && !conf.PassBindIP && conf.PassCookie == "" {
+		report.warnf("pass_bind_ip", "passes can be used from any IP; set pass_bind_ip or pass_cookie")
+	}
+}
+
+// lintLoopback reports whether host names the local machine, where plain
+// HTTP to a sidecar is fine.
+func lintLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// lintVerifyURLs sends every provider a canary verification.
+func lintVerifyURLs(report *lintReport, conf *Config, cc *compiledConfig) {
+	for i, p := range cc.providers {
+		field := "turnstile_verify_url"
+		if i > 0 {
+			field = fmt.Sprintf("additional_providers[%d].verify_url", i-1)
+		}
+		resp, verr := siteVerify(cc, p, probeToken, "")
+		switch {
+		case verr != nil:
+			report.errorf(field, "unreachable: %s", verr.msg)
+		case slices.Contains(resp.ErrorCodes, "invalid-input-secret") && !strings.HasPrefix(p.secretKey, "{vault://"):
+			report.errorf(field, "%s rejected the secret key", p.name)
+		case !resp.Success && !slices.Contains(resp.ErrorCodes, "invalid-input-response") && !slices.Contains(resp.ErrorCodes, "invalid-input-secret"):
+			report.warnf(field, "unexpected answer to a canary verification, error codes: %s", strings.Join(resp.ErrorCodes, ", "))
+		}
+	}
+}
+
+// closestName returns the entry of names within two edits of name, if any.
+func closestName(name string, names []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range names {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -1,50 +1,63 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
+	"os"
 	"strings"
-	"time"
+
+	"kong-turnstile-plugin/verifier"
 
 	"github.com/Kong/go-pdk"
 	"github.com/Kong/go-pdk/server"
 )
 
 const (
-	PluginVersion               = "0.1.0"
-	PluginPriority              = 1000 // Run before authentication plugins
-	DefaultTurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
-	DefaultTimeoutMs          = 5000 // 5 seconds
+	PluginVersion             = "0.1.0"
+	PluginPriority            = 1000 // Run before authentication plugins
+	DefaultTurnstileVerifyURL = verifier.TurnstileVerifyURL
+	DefaultHCaptchaVerifyURL  = verifier.HCaptchaVerifyURL
+	DefaultRecaptchaVerifyURL = verifier.RecaptchaVerifyURL
+	DefaultTimeoutMs          = 5000                    // 5 seconds
 	DefaultTokenHeader        = "Cf-Turnstile-Response" // Common header for Turnstile token
-	DefaultRemoteIPHeader     = "X-Forwarded-For"      // Common header for client IP
+	DefaultRemoteIPHeader     = "X-Forwarded-For"       // Common header for client IP
+	DefaultBatchTokenField    = "cf-turnstile-response" // Per-item token field in batch_mode 'per_item'
+	DefaultBatchMaxItems      = 10                      // Upper bound on per-item verifications for one request
+	DefaultElevatedMaxAgeSec  = 60                      // Max token age while the threat level is elevated
+	DefaultInteractiveAgeSec  = 180                     // Same, for requests hinting at an interactive challenge
+	DefaultMaxClockSkewSec    = 5                       // Tolerance for a challenge_ts in the future
+	DefaultFlowTokenHeader    = "X-Turnstile-Flow"      // Header carrying multi-step flow tokens
+	DefaultFlowTTLSeconds     = 600                     // Lifetime of a flow token
+	DefaultFlowSteps          = 3                       // Requests a flow token covers after the verified one
+	DefaultPassHeader         = "X-Turnstile-Pass"      // Header carrying preverify passes
+	DefaultPassTTLSeconds     = 60                      // Lifetime of a preverify pass
+	DefaultPassBindingHeader  = "X-Turnstile-Binding"   // Header echoing the double-submit value of pass cookies
+	DefaultRateLimitWaitMs    = 2000                    // Longest Retry-After waited out under rate_limited_policy 'queue'
+	DefaultReceiptTTLSeconds  = 300                     // Lifetime of a Referer receipt
+	DefaultSessionTTLSeconds  = 1800                    // Lifetime of a session cookie
+	DefaultInternalErrRetries = 2                       // Retries of siteverify answers with 'internal-error'
+	DefaultAnalyticsBatch     = 500                     // Records per analytics_url batch
+	DefaultSinkBlockMs        = 5                       // Longest wait for room in a full sink queue under sink_overflow_policy 'block'
+	DefaultAnalyticsFlushSec  = 5                       // Longest wait before a partial batch is sent
+	DefaultMaxBodyBytes       = 1024 * 1024             // Largest request body read for token extraction
+	DefaultMaxResponseBytes   = 64 * 1024               // Siteverify responses are a few hundred bytes
+	DefaultMaxBufferedBytes   = 64 * 1024 * 1024        // Body bytes buffered across all in-flight requests
+	DefaultWidgetMaxBodyBytes = 512 * 1024              // Largest page the widget is injected into
+	DefaultIdempotencyHeader  = "Idempotency-Key"       // Header carrying the key of idempotent retries
+	DefaultMaxTokenLength     = 2048                    // Longest Turnstile token, as documented by Cloudflare
+	DefaultMaxOtherTokenLen   = 8192                    // Longest token of other provider schemas
+	DefaultVerifiedIdentity   = "human-verified"        // Value of verified_identity_header
+	DefaultReputationCacheSec = 300                     // Reuse of reputation_url verdicts
+	DefaultCloudflareAPIURL   = "https://api.cloudflare.com/client/v4"
+	DefaultBlockThreshold     = 20  // Failures per IP before it is pushed to the Cloudflare list
+	DefaultBlockWindowSeconds = 300 // Window for counting those failures
+	DefaultCounterWindowSec   = 60  // Window of failure_counter_namespace counters
+	DefaultAttemptWindowSec   = 60  // Window of attempt_limit
+	DefaultQuotaWindowSec     = 1   // Window of verify_quota
+	DefaultPenaltyWindowSec   = 300 // Window of penalty_threshold
+	DefaultPenaltyBanSec      = 600 // Length of a penalty ban
 )
 
-// --- Configuration Struct ---
-// Holds the configuration parameters defined in Kong's config (kong.conf or CRD)
-type Config struct {
-	TurnstileSecretKey string `json:"turnstile_secret_key"`       // REQUIRED: Your Cloudflare Turnstile Secret Key
-	TurnstileVerifyURL string `json:"turnstile_verify_url"`       // Optional: Override default verification URL
-	TokenLocation      string `json:"token_location"`             // Optional: Where to find the token ('header', 'form'). Default: 'header'
-	TokenName          string `json:"token_name"`                 // Optional: Name of header or form field. Default: 'Cf-Turnstile-Response'
-	RemoteIPLocation   string `json:"remote_ip_location"`       // Optional: Where to find client IP ('header', 'pdk'). Default: 'pdk'
-	RemoteIPName       string `json:"remote_ip_name"`           // Optional: Header name if location is 'header'. Default: 'X-Forwarded-For'
-	RequestTimeoutMs   int    `json:"request_timeout_ms"`       // Optional: Timeout for Cloudflare API call. Default: 5000ms
-}
-
-// --- Cloudflare SiteVerify Response Struct ---
-type SiteVerifyResponse struct {
-	Success     bool     `json:"success"`
-	ChallengeTs string   `json:"challenge_ts"` // Timestamp of the challenge load (ISO format yyyy-MM-ddTHH:mm:ssZZ)
-	Hostname    string   `json:"hostname"`     // Hostname of site where challenge was solved
-	ErrorCodes  []string `json:"error-codes"`  // Optional error codes
-	Action      string   `json:"action"`       // Optional: Customer widget identifier passed to the widget on the client side
-	CData       string   `json:"cdata"`        // Optional: Customer data passed to the widget on the client side
-}
-
 // --- Kong Plugin Constructor ---
 func New() interface{} {
 	return &Config{}
@@ -53,177 +66,351 @@ func New() interface{} {
 // --- Plugin Implementation ---
 
 // Access phase: This is where we intercept the request *before* it hits the upstream service.
-func (conf Config) Access(kong *pdk.PDK) {
-	kong.Log.Info("Turnstile Plugin: Starting Access Phase")
+func (conf *Config) Access(kong *pdk.PDK) {
+	settings := conf.requestSettings(kong)
+	r := newRequestState(kong, settings)
+	r.log.Info("Turnstile Plugin: Starting Access Phase")
+	r.checkConfigDrift(conf)
 
 	// --- Validate Configuration ---
-	if conf.TurnstileSecretKey == "" {
-		kong.Log.Err("Turnstile configuration error: turnstile_secret_key is required")
-		kong.Response.Exit(http.StatusInternalServerError, []byte("Plugin Configuration Error"), nil)
+	if settings.err != nil {
+		r.log.Err(fmt.Sprintf("Turnstile configuration error: %v", settings.err))
+		r.reject(decision{status: http.StatusInternalServerError, reason: ReasonConfigError}, "Plugin Configuration Error")
 		return
 	}
 
-	// --- Get Turnstile Token ---
-	tokenLocation := strings.ToLower(conf.TokenLocation)
-	if tokenLocation == "" {
-		tokenLocation = "header" // Default to header
+	// --- Route Mode Override ---
+	r.applyRouteMode()
+	r.applyEmergencyBypass()
+
+	// --- Tenants ---
+	r.selectTenant()
+	r.clearIdentity()
+	r.clearScoreHeader()
+	r.clearFailOpenHeader()
+	r.clearUpstreamHeaders()
+	r.clearVerificationHeaders()
+	r.clearEdgeAssertion()
+	r.readExpectedActions()
+	r.stripQueryTokens()
+
+	// --- Policy Chain ---
+	v := &verification{}
+	r.runChain(accessChain, v)
+	r.logProviderTotals(v)
+	if !r.exited {
+		r.stripTokens()
+		r.addServerTiming(nil)
 	}
-	tokenName := conf.TokenName
-	if tokenName == "" {
-		tokenName = DefaultTokenHeader // Default header name
+}
+
+// --- Bypass Checks ---
+
+func (r *requestState) routeModeStage(*verification) bool {
+	if r.routeMode == "off" {
+		r.publish(decision{allowed: true, reason: ReasonAdminOverride})
+		return false
 	}
+	return true
+}
 
-	var turnstileToken string
-	var err error
+func (r *requestState) conditionalStage(*verification) bool {
+	if r.settings.conditionalRequests == "relaxed" && r.isConditionalRevalidation() {
+		r.log.Debug("Turnstile: conditional revalidation passed without verification")
+		r.publish(decision{allowed: true, reason: ReasonConditionalRequest})
+		return false
+	}
+	return true
+}
 
-	switch tokenLocation {
-	case "header":
-		turnstileToken, err = kong.Request.GetHeader(tokenName)
-		if err != nil {
-			kong.Log.Err(fmt.Sprintf("Error getting Turnstile token from header '%s': %v", tokenName, err))
-			kong.Response.Exit(http.StatusBadRequest, []byte("Turnstile token missing or invalid"), nil)
-			return
-		}
-	case "form":
-		formArgs, err := kong.Request.GetForm()
-		if err != nil {
-			kong.Log.Err(fmt.Sprintf("Error getting form arguments: %v", err))
-			kong.Response.Exit(http.StatusBadRequest, []byte("Could not read form data"), nil)
-			return
-		}
-		tokenValues, ok := formArgs[tokenName]
-		if !ok || len(tokenValues) == 0 {
-			kong.Log.Warn(fmt.Sprintf("Turnstile token not found in form field '%s'", tokenName))
-			kong.Response.Exit(http.StatusBadRequest, []byte("Turnstile token missing"), nil)
-			return
-		}
-		turnstileToken = tokenValues[0] // Use the first value if multiple exist
-	default:
-		kong.Log.Err(fmt.Sprintf("Invalid token_location configured: '%s'. Use 'header' or 'form'.", conf.TokenLocation))
-		kong.Response.Exit(http.StatusInternalServerError, []byte("Plugin Configuration Error"), nil)
-		return
+func (r *requestState) widgetPageStage(*verification) bool {
+	if r.isWidgetPageRequest() {
+		r.log.Debug("Turnstile: widget page served without verification")
+		r.publish(decision{allowed: true, reason: ReasonWidgetPage})
+		return false
 	}
+	return true
+}
 
-	if turnstileToken == "" {
-		kong.Log.Warn("Turnstile token is empty")
-		kong.Response.Exit(http.StatusBadRequest, []byte("Turnstile token missing"), nil)
-		return
+func (r *requestState) batchStage(*verification) bool {
+	if r.settings.batchMode == "per_item" && !r.isHeadRequest() {
+		r.verifyBatch(r.clientIP())
+		return false
 	}
+	return true
+}
 
-	// --- Get Client IP Address ---
-	remoteIPLocation := strings.ToLower(conf.RemoteIPLocation)
-	if remoteIPLocation == "" {
-		remoteIPLocation = "pdk" // Default to PDK
+func (r *requestState) preverifyStage(*verification) bool {
+	if r.isPreverifyRequest() {
+		r.handlePreverify()
+		return false
 	}
-	remoteIPName := conf.RemoteIPName
-	if remoteIPName == "" {
-		remoteIPName = DefaultRemoteIPHeader
+	return true
+}
+
+// verifyToken runs the token stages: it extracts the request's token and
+// has the matching provider verify it. It returns ok=false after answering
+// the client when the token is missing, invalid or could not be verified,
+// and after letting a request through under streamed_body_policy 'skip',
+// rate_limited_policy 'fail_open' or failure_mode 'open'.
+func (r *requestState) verifyToken() (*VerificationResult, *provider, bool) {
+	v := &verification{}
+	ok := r.runChain(tokenStages, v)
+	r.logProviderTotals(v)
+	return v.response, v.provider, ok
+}
+
+// logProviderTotals lets operators watch the old provider drain during a
+// migration window.
+func (r *requestState) logProviderTotals(v *verification) {
+	if p := v.provider; p != nil && len(r.settings.providers) > 1 {
+		r.log.Info(fmt.Sprintf("Provider %s totals: verified=%d rejected=%d errors=%d rate_limited=%d", p.name,
+			p.stats.Verified.Load(), p.stats.Rejected.Load(), p.stats.Errors.Load(), p.stats.RateLimited.Load()))
 	}
-	var clientIP string
+}
 
-	switch remoteIPLocation {
-	case "pdk":
-		clientIP, err = kong.Request.GetForwardedIp() // Recommended PDK function
-		if err != nil || clientIP == "" {
-			// Fallback if GetForwardedIp fails
-			clientIP, err = kong.Request.GetClientIp()
-			if err != nil {
-				kong.Log.Warn(fmt.Sprintf("Could not get client IP using PDK: %v", err))
-				// Optionally proceed without IP if Cloudflare doesn't require it strictly
-			}
-		}
-	case "header":
-		clientIP, err = kong.Request.GetHeader(remoteIPName)
-		if err != nil {
-			kong.Log.Warn(fmt.Sprintf("Could not get client IP from header '%s': %v", remoteIPName, err))
-			// Optionally proceed without IP
+// --- Extraction ---
+
+func (r *requestState) extractionStage(v *verification) bool {
+	settings := r.settings
+	// With additional providers configured, the step that finds a token
+	// decides which provider verifies it; earlier steps win ties.
+	steps := r.extractionSteps()
+	token, tokenProvider, err := extractToken(r.kong.Request, steps, settings.maxBodyBytes, settings.maxBufferedBody)
+	if streamed, ok := err.(*bodyStreamedError); ok {
+		switch settings.streamedBodyPolicy {
+		case "header":
+			r.log.Info(fmt.Sprintf("Turnstile: %v, falling back to header and query extraction", streamed))
+			token, tokenProvider, err = extractToken(r.kong.Request, withoutBodySteps(steps), 0, 0)
+		case "skip":
+			r.log.Warn(fmt.Sprintf("Turnstile: %v, passing request without verification (streamed_body_policy 'skip')", streamed))
+			r.publish(decision{allowed: true, reason: ReasonStreamedBody})
+			return false
 		}
-		// Often headers like X-Forwarded-For contain a list, take the first one
-		if strings.Contains(clientIP, ",") {
-			clientIP = strings.TrimSpace(strings.Split(clientIP, ",")[0])
+	}
+	if r.rejectBodyError(err) {
+		return false
+	}
+	if ambiguous, ok := err.(*ambiguousTokenError); ok {
+		r.log.Warn(fmt.Sprintf("Turnstile %v (multi_value_policy 'reject')", ambiguous))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonAmbiguousToken}, "Turnstile token given more than once")
+		return false
+	}
+	if err != nil {
+		r.log.Err(fmt.Sprintf("Error getting Turnstile token: %v", err))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Could not read form data")
+		return false
+	}
+	if token == "" {
+		if len(steps) == 0 {
+			r.log.Warn(fmt.Sprintf("Turnstile token not found: HEAD requests have no body for %s", describeSteps(settings.extraction)))
+		} else {
+			r.log.Warn(fmt.Sprintf("Turnstile token not found in %s", describeSteps(steps)))
 		}
-	default:
-		kong.Log.Warn(fmt.Sprintf("Invalid remote_ip_location configured: '%s'. Use 'pdk' or 'header'. Proceeding without remote IP.", conf.RemoteIPLocation))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMissingToken}, "Turnstile token missing")
+		return false
 	}
+	v.token, v.provider = token, tokenProvider
+	return true
+}
 
-	kong.Log.Info(fmt.Sprintf("Verifying Turnstile token for IP: %s", clientIP))
+// --- Pre-Validation ---
 
-	// --- Call Cloudflare SiteVerify API ---
-	verifyURL := conf.TurnstileVerifyURL
-	if verifyURL == "" {
-		verifyURL = DefaultTurnstileVerifyURL
+func (r *requestState) preValidationStage(v *verification) bool {
+	if problem := r.malformedToken(v.provider, v.token); problem != "" {
+		r.log.Warn(fmt.Sprintf("Turnstile token malformed (provider: %s): %s", v.provider.name, problem))
+		r.reject(decision{status: http.StatusBadRequest, reason: ReasonMalformedToken, provider: v.provider}, "Turnstile token malformed")
+		return false
 	}
-	timeout := time.Duration(DefaultTimeoutMs) * time.Millisecond
-	if conf.RequestTimeoutMs > 0 {
-		timeout = time.Duration(conf.RequestTimeoutMs) * time.Millisecond
+	return true
+}
+
+// --- Cache ---
+// Tokens verified earlier, by another instance of the plugin for this
+// request, for an earlier request or an earlier attempt of this one, are not
+// sent to the provider again. Neither are tokens it rejected before.
+
+func (r *requestState) cacheStage(v *verification) bool {
+	v.clientIP = r.clientIP()
+	r.log.Info(fmt.Sprintf("Verifying %s token for IP: %s", v.provider.name, v.clientIP))
+	if r.threatElevated() {
+		return true // Every token goes to the provider, see threat.go
 	}
 
-	httpClient := &http.Client{Timeout: timeout}
+	v.response, v.fromEarlierInstance = r.earlierVerification(v.provider, v.token)
+	r.verifiedFromCache = v.fromEarlierInstance
+	if !r.verifiedFromCache && r.settings.verifyCacheTTL > 0 && !r.forceChallenge {
+		v.response, r.verifiedFromCache = verifiedTokens.get(v.provider, v.token, v.clientIP, clock.Now())
+	}
+	if !r.verifiedFromCache && !r.forceChallenge {
+		v.response, r.idempotentRetry = r.earlierAttempt(v.provider, v.token)
+		r.verifiedFromCache = r.idempotentRetry
+	}
+	// Last, so a verification the token still passes wins over the
+	// 'timeout-or-duplicate' a resend from elsewhere got
+	if !r.verifiedFromCache && r.settings.verifyCacheFailureTTL > 0 {
+		v.response, r.verifiedFromCache = rejectedTokens.get(v.provider, v.token, v.clientIP, clock.Now())
+	}
+	return true
+}
 
-	// Prepare form data
-	formData := url.Values{}
-	formData.Set("secret", conf.TurnstileSecretKey)
-	formData.Set("response", turnstileToken)
-	if clientIP != "" {
-		formData.Set("remoteip", clientIP)
+// --- Verification ---
+
+func (r *requestState) verificationStage(v *verification) bool {
+	if r.verifiedFromCache {
+		return true
+	}
+	var verr *verifyError
+	v.response, verr = r.verify(v.provider, v.token, v.clientIP)
+	if verr != nil && verr.retryAfter > 0 {
+		r.rateLimited(v.provider, verr)
+		return false
+	}
+	if verr != nil {
+		r.providerFailed(v.provider, verr, verr.msg)
+		return false
 	}
+	return true
+}
 
-	reqBody := bytes.NewBufferString(formData.Encode())
+// --- Post-Validation ---
 
-	req, err := http.NewRequest("POST", verifyURL, reqBody)
-	if err != nil {
-		kong.Log.Err(fmt.Sprintf("Failed to create request to Cloudflare: %v", err))
-		kong.Response.Exit(http.StatusInternalServerError, []byte("Turnstile verification failed (request creation)"), nil)
-		return
+func (r *requestState) postValidationStage(v *verification) bool {
+	settings, tokenProvider, verifyResponse := r.settings, v.provider, v.response
+	if !verifyResponse.Success {
+		tokenProvider.stats.Rejected.Add(1)
+		errorCodes := r.exportedField("error_codes", strings.Join(verifyResponse.ErrorCodes, ", "))
+		if r.verifiedFromCache {
+			r.log.Warn(fmt.Sprintf("Turnstile token rejected earlier, provider not asked again (provider: %s). Error codes: [%s]", tokenProvider.name, errorCodes))
+		} else {
+			r.log.Warn(fmt.Sprintf("Turnstile verification failed (provider: %s). Error codes: [%s]", tokenProvider.name, errorCodes))
+			if settings.verifyCacheFailureTTL > 0 && cacheableRejection(verifyResponse) {
+				rejectedTokens.putRejection(tokenProvider, v.token, v.clientIP, verifyResponse, settings.verifyCacheFailureTTL, clock.Now())
+			}
+		}
+		rejected := decision{status: http.StatusForbidden, reason: providerRejection(verifyResponse), provider: tokenProvider, response: verifyResponse}
+		if r.debugPassthroughAllowed() {
+			// Trusted internal client: hand back the provider's answer verbatim to ease integration work
+			r.exit(rejected, verifyResponse.raw, map[string][]string{
+				"Content-Type":      {"application/json"},
+				"X-Turnstile-Debug": {"raw-siteverify"},
+			})
+		} else {
+			// Provide a more generic error to the client for security
+			r.reject(rejected, "Verification failed")
+		}
+		return false
+	}
+	if !r.checkTokenAge(tokenProvider, verifyResponse, "token") {
+		return false
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		kong.Log.Err(fmt.Sprintf("Failed to call Cloudflare verification API: %v", err))
-		kong.Response.Exit(http.StatusBadGateway, []byte("Turnstile verification failed (connection error)"), nil)
-		return
+	if !r.checkScore(tokenProvider, verifyResponse) {
+		return false
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		kong.Log.Err(fmt.Sprintf("Failed to read Cloudflare response body: %v", err))
-		kong.Response.Exit(http.StatusInternalServerError, []byte("Turnstile verification failed (read error)"), nil)
-		return
+	if !r.checkExpectedFields(tokenProvider, verifyResponse, "token") {
+		return false
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		kong.Log.Err(fmt.Sprintf("Cloudflare API returned non-200 status: %d - Body: %s", resp.StatusCode, string(bodyBytes)))
-		kong.Response.Exit(http.StatusBadGateway, []byte("Turnstile verification failed (API error)"), nil)
-		return
+	// The token holds up: remember it for later plugin instances, requests
+	// and attempts
+	if !v.fromEarlierInstance {
+		r.rememberVerification(tokenProvider, v.token, verifyResponse)
+	}
+	if r.verifiedFromCache {
+		r.log.Info(fmt.Sprintf("Turnstile token verified earlier, provider not asked again (provider: %s)", tokenProvider.name))
+		return true
+	}
+	tokenProvider.stats.Verified.Add(1)
+	if settings.verifyCacheTTL > 0 {
+		verifiedTokens.put(tokenProvider, v.token, v.clientIP, verifyResponse, settings.verifyCacheTTL, clock.Now())
 	}
+	r.rememberAttempt(tokenProvider, v.token, v.clientIP, verifyResponse)
+	r.log.Info(fmt.Sprintf("Turnstile verification successful! (provider: %s)", tokenProvider.name))
+	return true
+}
 
-	// --- Parse Cloudflare Response ---
-	var verifyResponse SiteVerifyResponse
-	err = json.Unmarshal(bodyBytes, &verifyResponse)
-	if err != nil {
-		kong.Log.Err(fmt.Sprintf("Failed to parse Cloudflare JSON response: %v - Body: %s", err, string(bodyBytes)))
-		kong.Response.Exit(http.StatusInternalServerError, []byte("Turnstile verification failed (parse error)"), nil)
-		return
+// --- Decision ---
+
+func (r *requestState) decisionStage(v *verification) bool {
+	reason := ReasonVerified
+	if r.idempotentRetry {
+		reason = ReasonIdempotentRetry
+	} else if r.verifiedFromCache {
+		reason = ReasonCacheHit
 	}
+	r.publish(decision{allowed: true, reason: reason, provider: v.provider, response: v.response})
+	r.issueFlowToken(v.provider)
+	r.issueSession(v.provider)
+	return true
+}
 
-	// --- Make Decision ---
-	if verifyResponse.Success {
-		kong.Log.Info("Turnstile verification successful!")
-		// Optional: Set headers with verification details if needed by upstream
-		// kong.ServiceRequest.SetHeader("X-Turnstile-Verified", "true")
-		// kong.ServiceRequest.SetHeader("X-Turnstile-Hostname", verifyResponse.Hostname)
-	} else {
-		errorCodes := strings.Join(verifyResponse.ErrorCodes, ", ")
-		kong.Log.Warn(fmt.Sprintf("Turnstile verification failed. Error codes: [%s]", errorCodes))
-		// Provide a more generic error to the client for security
-		kong.Response.Exit(http.StatusForbidden, []byte("Verification failed"), nil)
+// clientIP resolves the client address forwarded to the provider as remoteip.
+// Failures are logged and yield an empty string, as remoteip is optional.
+// The result is remembered for the rest of the request.
+func (r *requestState) clientIP() string {
+	if !r.clientIPResolved {
+		r.clientIPValue, r.clientIPResolved = r.resolveClientIP(), true
 	}
+	return r.clientIPValue
+}
+
+func (r *requestState) resolveClientIP() string {
+	kong, settings := r.kong, r.settings
+	remoteIPName := settings.remoteIPName
+	var clientIP string
+	var err error
+
+	switch settings.remoteIPLocation {
+	case "pdk":
+		clientIP, err = kong.Client.GetForwardedIp() // Recommended PDK function
+		if err != nil || clientIP == "" {
+			// Fallback if GetForwardedIp fails
+			clientIP, err = kong.Client.GetIp()
+			if err != nil {
+				r.log.Warn(fmt.Sprintf("Could not get client IP using PDK: %v", err))
+				// Optionally proceed without IP if Cloudflare doesn't require it strictly
+			}
+		}
+	case "header":
+		clientIP, err = kong.Request.GetHeader(remoteIPName)
+		if err != nil {
+			r.log.Warn(fmt.Sprintf("Could not get client IP from header '%s': %v", remoteIPName, err))
+			// Optionally proceed without IP
+		}
+		// Often headers like X-Forwarded-For contain a list, take the first one
+		if strings.Contains(clientIP, ",") {
+			clientIP = strings.TrimSpace(strings.Split(clientIP, ",")[0])
+		}
+	default:
+		r.log.Warn(fmt.Sprintf("Invalid remote_ip_location configured: '%s'. Use 'pdk' or 'header'. Proceeding without remote IP.", settings.remoteIPLocation))
+	}
+	return clientIP
 }
 
 // --- Main function to run the plugin server ---
 func main() {
+	if isSupportBundleInvocation() {
+		os.Exit(runSupportBundle(os.Args[2:]))
+	}
+	if isLintConfigInvocation() {
+		os.Exit(runLintConfig(os.Args[2:]))
+	}
+	if !isDumpInvocation() {
+		logVersion()
+		startPersistence()
+		startAdminServer()
+	}
 	server.StartServer(New, PluginVersion, PluginPriority)
 }
 
+// isDumpInvocation reports whether Kong only asked for the plugin info (-dump).
+func isDumpInvocation() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "-dump" || arg == "--dump" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Prometheus Metrics ---
+// GET /metrics on the admin endpoint serves the plugin server's counters in
+// the Prometheus text format, for alerting on spikes in failed challenges
+// and on provider slowness (scrape it with the admin token as bearer token):
+//
+//	turnstile_verifications_total{provider,outcome}   siteverify outcomes: success, failure, error, rate_limited
+//	turnstile_verify_failures_total{provider,code}    failed verifications by provider error code ('none' without one)
+//	turnstile_decisions_total{reason}                 published decisions, e.g. verified, bypass_allowlist, cache_hit
+//	turnstile_cache_hits_total{cache}                 lookups per cache (see GET /caches), also _misses_total
+//	turnstile_cache_entries{cache}
+//	turnstile_siteverify_duration_seconds{provider}   histogram of siteverify calls sent to the provider
+//	turnstile_siteverify_parse_errors_total{provider,kind,snippet}   unparsable answers, see parsediag.go
+//	turnstile_rate_limit_total{feature,outcome}       token bucket outcomes (allowed, limited, blocked), see buckets.go
+//
+// Counters start at zero with the plugin server. Failure codes are capped at
+// maxFailureCodeLabels distinct values per plugin server, further codes are
+// counted as 'other'.
+
+const maxFailureCodeLabels = 50
+
+// siteVerifyBuckets are the upper bounds of the latency histogram, in seconds.
+var siteVerifyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram is a concurrent Prometheus histogram.
+type latencyHistogram struct {
+	buckets []atomic.Int64 // Per bucket, not cumulative
+	count   atomic.Int64
+	sum     atomic.Int64 // Nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(siteVerifyBuckets, d.Seconds())
+	if i < len(h.buckets) {
+		h.buckets[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// siteVerifyLatency holds a histogram per provider name.
+var siteVerifyLatency sync.Map // map[string]*latencyHistogram
+
+// failureCodeCounts counts failed verifications by "<provider>\x00<code>".
+var failureCodeCounts = struct {
+	sync.Mutex
+	counts map[string]int64
+	codes  map[string]bool
+}{counts: make(map[string]int64), codes: make(map[string]bool)}
+
+func init() {
+	adminMux.HandleFunc("/metrics", handleMetrics)
+}
+
+// observeSiteVerify records the duration and outcome codes of a siteverify call.
+func observeSiteVerify(p *provider, d time.Duration, resp *VerificationResult) {
+	h, _ := siteVerifyLatency.LoadOrStore(p.name, &latencyHistogram{buckets: make([]atomic.Int64, len(siteVerifyBuckets))})
+	h.(*latencyHistogram).observe(d)
+	if resp == nil || resp.Success {
+		return
+	}
+	codes := resp.ErrorCodes
+	if len(codes) == 0 {
+		codes = []string{"none"}
+	}
+	failureCodeCounts.Lock()
+	defer failureCodeCounts.Unlock()
+	for _, code := range codes {
+		if !failureCodeCounts.codes[code] {
+			if len(failureCodeCounts.codes) >= maxFailureCodeLabels {
+				code = "other"
+			}
+			failureCodeCounts.codes[code] = true
+		}
+		failureCodeCounts.counts[p.name+"\x00"+code]++
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	writeMetrics(out)
+	_ = out.Flush()
+}
+
+// writeMetrics writes every metric in the Prometheus text format.
+func writeMetrics(out *bufio.Writer) {
+	metricHeader(out, "turnstile_verifications_total", "counter", "siteverify outcomes by provider.")
+	allProviderStats.Range(func(k, v interface{}) bool {
+		stats, provider := v.(*providerStats), k.(string)
+		for _, outcome := range []struct {
+			name  string
+			value int64
+		}{
+			{"success", stats.Verified.Load()},
+			{"failure", stats.Rejected.Load()},
+			{"error", stats.Errors.Load()},
+			{"rate_limited", stats.RateLimited.Load()},
+		} {
+			fmt.Fprintf(out, "turnstile_verifications_total{provider=%s,outcome=%s} %d\n", labelValue(provider), labelValue(outcome.name), outcome.value)
+		}
+		return true
+	})
+
+	metricHeader(out, "turnstile_verify_failures_total", "counter", "Failed verifications by provider error code.")
+	failureCodeCounts.Lock()
+	keys := make([]string, 0, len(failureCodeCounts.counts))
+	for key := range failureCodeCounts.counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		provider, code, _ := strings.Cut(key, "\x00")
+		fmt.Fprintf(out, "turnstile_verify_failures_total{provider=%s,code=%s} %d\n", labelValue(provider), labelValue(code), failureCodeCounts.counts[key])
+	}
+	failureCodeCounts.Unlock()
+
+	metricHeader(out, "turnstile_decisions_total", "counter", "Published decisions by reason.")
+	decisionCounts.Range(func(k, v interface{}) bool {
+		fmt.Fprintf(out, "turnstile_decisions_total{reason=%s} %d\n", labelValue(string(k.(Reason))), v.(*atomic.Int64).Load())
+		return true
+	})
+
+	caches := allCacheStats()
+	names := make([]string, 0, len(caches))
+	for name := range caches {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, metric := range []struct {
+		name, kind, help string
+		value            func(cacheStats) int64
+	}{
+		{"turnstile_cache_hits_total", "counter", "Cache lookups that found an entry.", func(s cacheStats) int64 { return s.Hits }},
+		{"turnstile_cache_misses_total", "counter", "Cache lookups that found no entry.", func(s cacheStats) int64 { return s.Misses }},
+		{"turnstile_cache_entries", "gauge", "Entries held per cache.", func(s cacheStats) int64 { return int64(s.Entries) }},
+	} {
+		metricHeader(out, metric.name, metric.kind, metric.help)
+		for _, name := range names {
+			fmt.Fprintf(out, "%s{cache=%s} %d\n", metric.name, labelValue(name), metric.value(caches[name]))
+		}
+	}
+
+	metricHeader(out, "turnstile_siteverify_parse_errors_total", "counter", "siteverify answers that could not be parsed, by kind and snippet hash.")
+	parseErrorCounts.Lock()
+	keys = keys[:0]
+	for key := range parseErrorCounts.counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		labels := strings.SplitN(key, "\x00", 3)
+		fmt.Fprintf(out, "turnstile_siteverify_parse_errors_total{provider=%s,kind=%s,snippet=%s} %d\n",
+			labelValue(labels[0]), labelValue(labels[1]), labelValue(labels[2]), parseErrorCounts.counts[key])
+	}
+	parseErrorCounts.Unlock()
+
+	metricHeader(out, "turnstile_rate_limit_total", "counter", "Token bucket outcomes, by feature.")
+	keys = keys[:0]
+	rateLimitCounts.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	slices.Sort(keys)
+	for _, key := range keys {
+		labels := strings.SplitN(key, "\x00", 2)
+		counter, _ := rateLimitCounts.Load(key)
+		fmt.Fprintf(out, "turnstile_rate_limit_total{feature=%s,outcome=%s} %d\n",
+			labelValue(labels[0]), labelValue(labels[1]), counter.(*atomic.Int64).Load())
+	}
+
+	metricHeader(out, "turnstile_siteverify_duration_seconds", "histogram", "Duration of siteverify calls sent to the provider.")
+	siteVerifyLatency.Range(func(k, v interface{}) bool {
+		h, provider := v.(*latencyHistogram), labelValue(k.(string))
+		var cumulative int64
+		for i, bound := range siteVerifyBuckets {
+			cumulative += h.buckets[i].Load()
+			fmt.Fprintf(out, "turnstile_siteverify_duration_seconds_bucket{provider=%s,le=\"%s\"} %d\n", provider, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		count := h.count.Load()
+		fmt.Fprintf(out, "turnstile_siteverify_duration_seconds_bucket{provider=%s,le=\"+Inf\"} %d\n", provider, count)
+		fmt.Fprintf(out, "turnstile_siteverify_duration_seconds_sum{provider=%s} %s\n", provider, strconv.FormatFloat(time.Duration(h.sum.Load()).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(out, "turnstile_siteverify_duration_seconds_count{provider=%s} %d\n", provider, count)
+		return true
+	})
+}
+
+func metricHeader(out *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelValue quotes a label value as the text format requires.
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// --- Parse Diagnostics ---
+// A siteverify answer that is not the expected JSON almost never comes from
+// the provider's API itself but from something in between: an edge error
+// page, a corporate proxy, a sidecar cut off mid-answer. Rather than logging
+// the raw body (which can echo request data), failed parses are classified:
+//
+//	empty                no body at all
+//	truncated            JSON cut off before its end
+//	html_cloudflare      an HTML page mentioning Cloudflare, e.g. a 5xx edge error page
+//	html                 any other HTML page, typically from a proxy
+//	wrong_content_type   not JSON, and not declared as JSON either (e.g. text/plain)
+//	wrong_field_type     valid JSON whose fields have unexpected types
+//	invalid_json         anything else
+//
+// Logs carry the kind, the Content-Type, the body length and a snippet hash:
+// the first maxSnippetBytes with digits masked and whitespace collapsed,
+// hashed and shortened, so repeated answers of the same page share a hash
+// while Ray IDs and timestamps do not split them. The
+// turnstile_siteverify_parse_errors_total{provider,kind,snippet} metric
+// counts them, with at most maxSnippetLabels distinct snippet hashes per
+// plugin server before 'other'.
+
+const (
+	maxSnippetBytes  = 512
+	maxSnippetLabels = 50
+)
+
+// parseErrorCounts counts failed parses by "<provider>\x00<kind>\x00<snippet>".
+var parseErrorCounts = struct {
+	sync.Mutex
+	counts   map[string]int64
+	snippets map[string]bool
+}{counts: make(map[string]int64), snippets: make(map[string]bool)}
+
+// parseDiagnosis describes a siteverify answer that could not be parsed.
+type parseDiagnosis struct {
+	kind        string
+	contentType string
+	length      int
+	snippet     string // Hash of the sanitized start of the body
+}
+
+func (d parseDiagnosis) String() string {
+	return fmt.Sprintf("kind=%s content_type=%q length=%d snippet=%s", d.kind, d.contentType, d.length, d.snippet)
+}
+
+// diagnoseParseError classifies why body, sent with contentType, failed to
+// parse with err.
+func diagnoseParseError(contentType string, body []byte, err error) parseDiagnosis {
+	d := parseDiagnosis{contentType: contentType, length: len(body), snippet: snippetHash(body)}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	trimmed := bytes.TrimSpace(body)
+	start := bytes.ToLower(trimmed[:min(len(trimmed), maxSnippetBytes)])
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case len(trimmed) == 0:
+		d.kind = "empty"
+	case start[0] == '<' || mediaType == "text/html":
+		d.kind = "html"
+		if bytes.Contains(bytes.ToLower(trimmed), []byte("cloudflare")) {
+			d.kind = "html_cloudflare"
+		}
+	case errors.As(err, &typeErr):
+		d.kind = "wrong_field_type"
+	case (start[0] == '{' || start[0] == '[') && (err.Error() == "unexpected end of JSON input" ||
+		errors.As(err, &syntaxErr) && syntaxErr.Offset >= int64(len(body))):
+		d.kind = "truncated"
+	case !strings.Contains(mediaType, "json"):
+		d.kind = "wrong_content_type"
+	default:
+		d.kind = "invalid_json"
+	}
+	return d
+}
+
+// snippetHash hashes the start of body with digits masked and whitespace
+// collapsed.
+func snippetHash(body []byte) string {
+	if len(body) == 0 {
+		return "none"
+	}
+	snippet := body[:min(len(body), maxSnippetBytes)]
+	sanitized := make([]byte, 0, len(snippet))
+	for _, c := range snippet {
+		switch {
+		case c >= '0' && c <= '9':
+			c = '0'
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			if n := len(sanitized); n > 0 && sanitized[n-1] == ' ' {
+				continue
+			}
+			c = ' '
+		}
+		sanitized = append(sanitized, c)
+	}
+	sum := sha256.Sum256(sanitized)
+	return hex.EncodeToString(sum[:6])
+}
+
+// countParseError records a failed parse for the metrics.
+func countParseError(p *provider, d parseDiagnosis) {
+	parseErrorCounts.Lock()
+	defer parseErrorCounts.Unlock()
+	snippet := d.snippet
+	if !parseErrorCounts.snippets[snippet] {
+		if len(parseErrorCounts.snippets) >= maxSnippetLabels {
+			snippet = "other"
+		}
+		parseErrorCounts.snippets[snippet] = true
+	}
+	parseErrorCounts.counts[p.name+"\x00"+d.kind+"\x00"+snippet]++
+}
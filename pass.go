@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// --- Preverify Passes ---
+// Takes captcha latency out of the business request: the frontend POSTs the
+// token to preverify_path as soon as the widget is solved; the plugin
+// verifies it and answers with a short-lived, single-use signed pass. The
+// real request then only carries the pass in pass_header, which is checked
+// locally without calling the provider.
+//
+// With pass_cookie set, the pass is delivered in an HttpOnly cookie instead,
+// and the response body carries its double-submit binding (see sign.go). The
+// client echoes the binding in pass_binding_header; a pass presented without
+// it is not accepted, wherever it comes from.
+//
+// Passes and receipts (see receipt.go) share the pass keys, so each payload
+// names what it is in typ, and neither is accepted in place of the other.
+
+// passPayload is the signed content of a pass.
+type passPayload struct {
+	Type    string `json:"typ"` // Always passType
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`          // Unix seconds
+	IPHash  string `json:"ip,omitempty"` // Set when pass_bind_ip is enabled
+	Epoch   string `json:"sk,omitempty"` // See rotation.go
+}
+
+// Payload types, see passPayload.Type and receiptPayload.Type.
+const (
+	passType    = "pass"
+	receiptType = "receipt"
+)
+
+// usedPasses remembers consumed pass IDs until they expire.
+var usedPasses = newUsedTokenStore("passes")
+
+// hashIP keeps raw client addresses out of tokens handed to clients.
+func hashIP(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (r *requestState) isPreverifyRequest() bool {
+	if r.settings.preverifyPath == "" {
+		return false
+	}
+	path, err := r.kong.Request.GetPath()
+	return err == nil && path == r.settings.preverifyPath
+}
+
+// handlePreverify verifies the token and answers with a pass instead of
+// proxying the request.
+func (r *requestState) handlePreverify() {
+	verifyResponse, tokenProvider, ok := r.verifyToken()
+	if !ok {
+		return
+	}
+
+	payload := passPayload{Type: passType, ID: randomID(), Expires: clock.Now().Add(r.settings.passTTL).Unix(), Epoch: tokenProvider.secretID}
+	if r.settings.passBindIP {
+		payload.IPHash = hashIP(r.clientIP())
+	}
+	raw, _ := json.Marshal(payload)
+	pass := r.settings.passKeys.sign(raw)
+	expiresIn := int(r.settings.passTTL / time.Second)
+	headers := map[string][]string{"Content-Type": {"application/json"}, "Cache-Control": {"no-store"}}
+	var body []byte
+	if receipt := r.newReceipt(tokenProvider); receipt != "" {
+		headers["Set-Cookie"] = append(headers["Set-Cookie"], passCookie(r.settings.receiptCookie, receipt, int(r.settings.receiptTTL/time.Second)))
+	}
+	if r.settings.passCookie != "" {
+		headers["Set-Cookie"] = append(headers["Set-Cookie"], passCookie(r.settings.passCookie, pass, expiresIn))
+		body, _ = json.Marshal(map[string]interface{}{
+			"binding":    r.settings.passKeys.binding(pass, clock.Now()),
+			"header":     r.settings.passBindingHeader,
+			"expires_in": expiresIn,
+		})
+	} else {
+		body, _ = json.Marshal(map[string]interface{}{
+			"pass":       pass,
+			"header":     r.settings.passHeader,
+			"expires_in": expiresIn,
+		})
+	}
+
+	r.log.Info(fmt.Sprintf("Issued preverify pass %s", payload.ID))
+	r.exit(decision{allowed: true, reason: ReasonPreverified, status: http.StatusOK, provider: tokenProvider, response: verifyResponse},
+		body, headers)
+}
+
+// passCookie renders the Set-Cookie value delivering pass (or a receipt); a
+// negative maxAge removes the cookie.
+func passCookie(name, pass string, maxAge int) string {
+	cookie := &http.Cookie{Name: name, Value: pass, Path: "/", MaxAge: maxAge, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode}
+	return cookie.String()
+}
+
+// presentedPass returns the pass from pass_header or, failing that, from pass_cookie.
+func (r *requestState) presentedPass() (pass string, fromCookie bool) {
+	if pass, err := r.kong.Request.GetHeader(r.settings.passHeader); err == nil && pass != "" {
+		return pass, false
+	}
+	if r.settings.passCookie == "" {
+		return "", false
+	}
+	pass = r.requestCookie(r.settings.passCookie)
+	return pass, pass != ""
+}
+
+// requestCookie returns the value of the request's cookie name, if any.
+func (r *requestState) requestCookie(name string) string {
+	header, err := r.kong.Request.GetHeader("Cookie")
+	if err != nil {
+		return ""
+	}
+	return cookieValue(header, name)
+}
+
+// cookieValue returns the value of cookie name in a Cookie header, if any.
+func cookieValue(header, name string) string {
+	if header == "" {
+		return ""
+	}
+	cookie, err := (&http.Request{Header: http.Header{"Cookie": {header}}}).Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// acceptPass checks for a valid pass. On success it publishes the decision
+// and returns true; otherwise the request continues with regular verification.
+func (r *requestState) acceptPass() bool {
+	if r.settings.passKeys == nil {
+		return false
+	}
+	pass, fromCookie := r.presentedPass()
+	if pass == "" {
+		return false
+	}
+
+	now := clock.Now()
+	var payload passPayload
+	raw, ok := r.settings.passKeys.open(pass, now)
+	if !ok || json.Unmarshal(raw, &payload) != nil {
+		r.log.Warn("Pass has an invalid signature, falling back to Turnstile verification")
+		return false
+	}
+	if payload.Type != passType {
+		r.log.Warn("Pass is not a pass (a receipt?), falling back to Turnstile verification")
+		return false
+	}
+	if payload.Expires < now.Unix() {
+		r.log.Info("Pass expired, falling back to Turnstile verification")
+		return false
+	}
+	if r.staleEpoch(payload.Epoch) {
+		r.log.Info(fmt.Sprintf("Pass %s was issued under a replaced secret, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if payload.IPHash != "" && payload.IPHash != hashIP(r.clientIP()) {
+		r.log.Warn(fmt.Sprintf("Pass %s presented from a different IP, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if r.settings.passCookie != "" {
+		binding, _ := r.kong.Request.GetHeader(r.settings.passBindingHeader)
+		if !r.settings.passKeys.checkBinding(pass, binding, now) {
+			r.log.Warn(fmt.Sprintf("Pass %s presented without its %s, falling back to Turnstile verification", payload.ID, r.settings.passBindingHeader))
+			return false
+		}
+	}
+	if !usedPasses.consume(payload.ID, payload.Expires, now) {
+		r.log.Warn(fmt.Sprintf("Pass %s replayed, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if fromCookie {
+		// Passes are single-use, so the cookie is spent
+		if err := r.kong.Response.AddHeader("Set-Cookie", passCookie(r.settings.passCookie, "", -1)); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not clear pass cookie: %v", err))
+		}
+	}
+
+	r.log.Info(fmt.Sprintf("Pass %s accepted", payload.ID))
+	r.publish(decision{allowed: true, reason: ReasonPass})
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// --- Persistent Caches ---
+// Replay caches live in memory, so a plugin-server restart would forget every
+// used flow token and pass and allow each to be replayed until it expires.
+// When TURNSTILE_STATE_DIR is set, caches implementing persistentCache are
+// snapshotted there every persistInterval and on SIGTERM/SIGINT, and reloaded
+// at startup with expired entries dropped. Like the admin endpoint, this is
+// configured for the whole process through the environment.
+const (
+	StateDirEnv     = "TURNSTILE_STATE_DIR"
+	persistInterval = 30 * time.Second
+	stateVersion    = 1
+)
+
+// persistentCache is implemented by registered caches whose entries survive
+// restarts. Entries map a key to its expiry in Unix seconds.
+type persistentCache interface {
+	snapshot() map[string]int64
+	restore(entries map[string]int64, now time.Time) int
+}
+
+// stateFile is the on-disk form of one cache.
+type stateFile struct {
+	Version int              `json:"version"`
+	SavedAt int64            `json:"saved_at"`
+	Entries map[string]int64 `json:"entries"`
+}
+
+// startPersistence reloads saved caches and starts saving them, if configured.
+func startPersistence() {
+	dir := os.Getenv(StateDirEnv)
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("turnstile: cannot use %s=%s, caches will not persist: %v", StateDirEnv, dir, err)
+		return
+	}
+	loadCaches(dir, clock.Now())
+	loadWarmup(dir, clock.Now())
+
+	go func() {
+		ticker := time.NewTicker(persistInterval)
+		for range ticker.C {
+			saveCaches(dir, clock.Now())
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		saveCaches(dir, clock.Now())
+		log.Printf("turnstile: caches saved, exiting on %v", sig)
+		os.Exit(0)
+	}()
+}
+
+// persistentCaches returns the registered caches that can be persisted, by name.
+func persistentCaches() map[string]persistentCache {
+	caches := make(map[string]persistentCache)
+	for _, name := range registeredCaches() {
+		c, _ := lookupCache(name)
+		if pc, ok := c.(persistentCache); ok {
+			caches[name] = pc
+		}
+	}
+	return caches
+}
+
+func loadCaches(dir string, now time.Time) {
+	for name, c := range persistentCaches() {
+		raw, err := os.ReadFile(filepath.Join(dir, name+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		var state stateFile
+		if err == nil {
+			err = json.Unmarshal(raw, &state)
+		}
+		if err == nil && state.Version != stateVersion {
+			err = fmt.Errorf("unsupported version %d", state.Version)
+		}
+		if err != nil {
+			log.Printf("turnstile: ignoring saved state of cache %s: %v", name, err)
+			continue
+		}
+		restored := c.restore(state.Entries, now)
+		log.Printf("turnstile: restored %d of %d saved entries of cache %s", restored, len(state.Entries), name)
+	}
+}
+
+func saveCaches(dir string, now time.Time) {
+	for name, c := range persistentCaches() {
+		if err := saveCache(dir, name, c, now); err != nil {
+			log.Printf("turnstile: could not save cache %s: %v", name, err)
+		}
+	}
+	if err := saveWarmup(dir, now); err != nil {
+		log.Printf("turnstile: could not save warmup entries: %v", err)
+	}
+}
+
+func saveCache(dir, name string, c persistentCache, now time.Time) error {
+	return writeState(dir, name+".json", stateFile{Version: stateVersion, SavedAt: now.Unix(), Entries: c.snapshot()})
+}
+
+// writeState writes state as JSON through a temporary file, so a crash
+// never leaves a truncated snapshot behind.
+func writeState(dir, file string, state interface{}) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, file+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, file))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"kong-turnstile-plugin/verifier"
+)
+
+// maxPooledBufferSize keeps unusually large buffers from being pinned in the pool.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool recycles the buffers used to encode siteverify requests and read
+// their responses, which are allocated on every verification otherwise.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// pooledBody is a request body backed by a pooled buffer. The transport closes
+// the body once it is done with it (possibly after Do returns), which is the
+// only safe point to hand the buffer back.
+type pooledBody struct {
+	*bytes.Reader
+	once sync.Once
+	buf  *bytes.Buffer
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putBuffer(b.buf) })
+	return nil
+}
+
+// newVerifyBody encodes the siteverify form parameters of req, as kind
+// expects them, into a pooled buffer.
+func newVerifyBody(kind siteVerifier, req verifier.Request) *pooledBody {
+	buf := getBuffer()
+	kind.dialect().AppendForm(buf, req)
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
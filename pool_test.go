@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"testing"
+
+	"kong-turnstile-plugin/verifier"
+)
+
+func TestNewVerifyBodyMatchesURLValues(t *testing.T) {
+	tests := []struct {
+		name string
+		kind siteVerifier
+		req  verifier.Request
+		want url.Values
+	}{
+		{"plain", turnstileVerifier{}, verifier.Request{Secret: "0x4AAAAAAA", Token: "token-value", RemoteIP: "203.0.113.7"},
+			url.Values{"secret": {"0x4AAAAAAA"}, "response": {"token-value"}, "remoteip": {"203.0.113.7"}}},
+		{"no remote IP", turnstileVerifier{}, verifier.Request{Secret: "secret", Token: "token"},
+			url.Values{"secret": {"secret"}, "response": {"token"}}},
+		{"escaping", turnstileVerifier{}, verifier.Request{Secret: "s&e=c r+t", Token: "to/ken?=&%", RemoteIP: "2001:db8::1"},
+			url.Values{"secret": {"s&e=c r+t"}, "response": {"to/ken?=&%"}, "remoteip": {"2001:db8::1"}}},
+		{"idempotency key", turnstileVerifier{}, verifier.Request{Secret: "secret", Token: "token", IdempotencyKey: "6f1e2a4b-0c3d-4e5f-8a9b-0c1d2e3f4a5b"},
+			url.Values{"secret": {"secret"}, "response": {"token"}, "idempotency_key": {"6f1e2a4b-0c3d-4e5f-8a9b-0c1d2e3f4a5b"}}},
+		{"turnstile ignores site key", turnstileVerifier{}, verifier.Request{Secret: "secret", Token: "token", SiteKey: "site"},
+			url.Values{"secret": {"secret"}, "response": {"token"}}},
+		{"hcaptcha site key", hcaptchaVerifier{}, verifier.Request{Secret: "secret", Token: "token", SiteKey: "site"},
+			url.Values{"secret": {"secret"}, "response": {"token"}, "sitekey": {"site"}}},
+		{"recaptcha ignores idempotency key", recaptchaVerifier{v3: true}, verifier.Request{Secret: "secret", Token: "token", IdempotencyKey: "key"},
+			url.Values{"secret": {"secret"}, "response": {"token"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := newVerifyBody(tt.kind, tt.req)
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := url.ParseQuery(string(got))
+			if err != nil {
+				t.Fatalf("body %q does not parse: %v", got, err)
+			}
+			if parsed.Encode() != tt.want.Encode() {
+				t.Errorf("body = %q, want %q", parsed.Encode(), tt.want.Encode())
+			}
+		})
+	}
+}
+
+func TestPooledBodyCloseIsIdempotent(t *testing.T) {
+	body := newVerifyBody(turnstileVerifier{}, verifier.Request{Secret: "secret", Token: "token"})
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	putBuffer(nil) // Must not panic
+
+	large := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBufferSize))
+	putBuffer(large)
+	for i := 0; i < 10; i++ {
+		if getBuffer() == large {
+			t.Fatal("buffer above maxPooledBufferSize was pooled")
+		}
+	}
+}
+
+func TestGetBufferIsReset(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("leftover")
+	putBuffer(buf)
+	if got := getBuffer(); got.Len() != 0 {
+		t.Errorf("pooled buffer not reset, holds %q", got.String())
+	}
+}
+
+func BenchmarkVerifyBody(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body := newVerifyBody(turnstileVerifier{}, verifier.Request{Secret: "0x4AAAAAAA", Token: "token-value", RemoteIP: "203.0.113.7"})
+			body.Close()
+		}
+	})
+	b.Run("url.Values", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			form := url.Values{}
+			form.Set("secret", "0x4AAAAAAA")
+			form.Set("response", "token-value")
+			form.Set("remoteip", "203.0.113.7")
+			_ = bytes.NewBufferString(form.Encode())
+		}
+	})
+}
+
+func BenchmarkReadVerifyResponse(b *testing.B) {
+	answer := []byte(`{"success":true,"challenge_ts":"2024-01-01T00:00:00Z","hostname":"example.com","error-codes":[]}`)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := getBuffer()
+			if _, err := buf.ReadFrom(io.LimitReader(bytes.NewReader(answer), DefaultMaxResponseBytes)); err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+	b.Run("io.ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(bytes.NewReader(answer)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
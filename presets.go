@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Kong/go-pdk"
+)
+
+// --- Configuration Presets ---
+// Platform teams manage shared defaults (timeouts, failure modes, sinks, ...)
+// in one presets file instead of every plugin instance, so application
+// teams only configure their secret and expected actions. TURNSTILE_PRESETS
+// names the file, either a path (e.g. a mounted ConfigMap) or an http(s)
+// URL; it is re-read every presetsRefreshInterval, and the last good version
+// is kept when reading fails. The file maps preset names to plugin
+// configuration fields:
+//
+//	{"presets": {
+//	  "default":  {"request_timeout_ms": 3000, "failure_mode": "closed"},
+//	  "payments": {"request_timeout_ms": 1500, "analytics_url": "https://..."}
+//	}}
+//
+// Each request uses, in order, the preset named by a route tag
+// 'turnstile-preset:<name>', the instance's preset field, or the preset
+// named 'default' if the file has one. go-pdk does not expose workspaces;
+// tag a workspace's routes (e.g. with decK select_tags) to select a preset
+// per workspace. Fields the instance sets win over the preset's; null,
+// false, 0, empty strings, lists and objects count as unset. Naming a preset
+// the file lacks, or one that does not combine into a valid configuration,
+// is a configuration error. Without TURNSTILE_PRESETS, the preset field must
+// be empty.
+
+const (
+	PresetsEnv             = "TURNSTILE_PRESETS"
+	presetTagPrefix        = "turnstile-preset:"
+	presetsRefreshInterval = 30 * time.Second
+)
+
+// presetsFile is the format of the presets file.
+type presetsFile struct {
+	Presets map[string]json.RawMessage `json:"presets"`
+}
+
+var presets = struct {
+	sync.Mutex
+	once    sync.Once
+	source  string
+	version string // Hex SHA-256 of the file
+	entries map[string]json.RawMessage
+	err     error // Of the first load, when no version could be read
+}{}
+
+// presetSettings caches the settings of instance and preset combinations
+// of the current presets version.
+var presetSettings sync.Map // map[string]*compiledConfig
+
+// loadPresets reads the presets file and starts refreshing it.
+func loadPresets() {
+	presets.source = os.Getenv(PresetsEnv)
+	if presets.source == "" {
+		return
+	}
+	presets.err = refreshPresets()
+	go func() {
+		for range time.Tick(presetsRefreshInterval) {
+			if err := refreshPresets(); err != nil {
+				log.Printf("turnstile: could not refresh presets from %s, keeping the last version: %v", presets.source, err)
+			}
+		}
+	}()
+}
+
+// refreshPresets reads the presets file, replacing the current version
+// when it changed.
+func refreshPresets() error {
+	raw, err := readPresets(presets.source)
+	if err != nil {
+		return err
+	}
+	var file presetsFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("invalid presets file: %v", err)
+	}
+	sum := sha256.Sum256(raw)
+	version := hex.EncodeToString(sum[:])
+	presets.Lock()
+	defer presets.Unlock()
+	if version != presets.version {
+		presets.version, presets.entries, presets.err = version, file.Presets, nil
+		presetSettings.Clear()
+		log.Printf("turnstile: loaded %d presets from %s (version %s)", len(file.Presets), presets.source, version[:12])
+	}
+	return nil
+}
+
+var presetsClient = defaultHTTPClient("presets", 10*time.Second)
+
+func readPresets(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	resp, err := presetsClient.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, source, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// requestSettings returns the settings for the current request: the
+// instance's, combined with the preset selected for the request, if any.
+func (conf *Config) requestSettings(kong *pdk.PDK) *compiledConfig {
+	settings := conf.settings()
+	presets.once.Do(loadPresets)
+	if presets.source == "" {
+		if conf.Preset != "" && settings.err == nil {
+			return &compiledConfig{hash: settings.hash, err: fmt.Errorf("preset '%s' configured, but %s is not set", conf.Preset, PresetsEnv)}
+		}
+		return settings
+	}
+
+	name := conf.Preset
+	if route, err := kong.Router.GetRoute(); err == nil {
+		for _, tag := range route.Tags {
+			if preset, ok := strings.CutPrefix(tag, presetTagPrefix); ok {
+				name = preset
+				break
+			}
+		}
+	}
+	presets.Lock()
+	version, entries, loadErr := presets.version, presets.entries, presets.err
+	presets.Unlock()
+	if name == "" {
+		if _, ok := entries["default"]; !ok {
+			return settings
+		}
+		name = "default"
+	}
+
+	key := settings.hash + "\x00" + name + "\x00" + version
+	if cached, ok := presetSettings.Load(key); ok {
+		return cached.(*compiledConfig)
+	}
+	var cc *compiledConfig
+	preset, ok := entries[name]
+	switch {
+	case loadErr != nil:
+		cc = &compiledConfig{hash: settings.hash, err: fmt.Errorf("preset '%s': presets could not be loaded from %s: %v", name, presets.source, loadErr)}
+	case !ok:
+		cc = &compiledConfig{hash: settings.hash, err: fmt.Errorf("preset '%s' not found in %s", name, presets.source)}
+	default:
+		merged, err := applyPreset(conf, preset)
+		if err != nil {
+			cc = &compiledConfig{hash: settings.hash, err: fmt.Errorf("preset '%s': %v", name, err)}
+		} else if cc = compileConfig(merged); cc.err != nil {
+			cc = &compiledConfig{hash: cc.hash, err: fmt.Errorf("preset '%s': %v", name, cc.err)}
+		}
+	}
+	presetSettings.Store(key, cc)
+	return cc
+}
+
+// applyPreset returns conf with the unset fields taken from preset.
+func applyPreset(conf *Config, preset json.RawMessage) (*Config, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(preset, &fields); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %v", err)
+	}
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	var instance map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &instance); err != nil {
+		return nil, err
+	}
+	for name, value := range instance {
+		if !isUnsetJSON(value) {
+			fields[name] = value
+		}
+	}
+	delete(fields, "preset")
+	raw, err = json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	merged := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields() // Catches typos in the presets file
+	if err := decoder.Decode(merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// isUnsetJSON reports whether a marshaled Config field holds its zero value.
+func isUnsetJSON(value json.RawMessage) bool {
+	switch string(value) {
+	case "null", "false", "0", `""`, "[]", "{}":
+		return true
+	}
+	return false
+}
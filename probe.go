@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Synthetic Probe ---
+// With probe_interval_seconds set, every provider is sent a canary
+// verification of a token that can never be valid, in the background and
+// independently of user traffic. An answer rejecting it with
+// 'invalid-input-response' proves the endpoint is up; its latency is
+// recorded. Results are reported by the admin endpoint under GET /probes and
+// in support bundles. Canaries bypass the verification worker pool and the
+// provider counters. A prober runs while a cached configuration uses its
+// provider endpoint and secret: once the last one is evicted or replaced
+// (see config.go), it stops and its results are dropped, so retired secrets
+// are not probed.
+
+// probeToken is never issued by any widget.
+const probeToken = "XXXX.DUMMY.TOKEN.XXXX"
+
+// probeResult is what a prober reports.
+type probeResult struct {
+	Provider    string  `json:"provider"`
+	VerifyURL   string  `json:"verify_url"`
+	Healthy     bool    `json:"healthy"`
+	LastAt      string  `json:"last_at,omitempty"`
+	LastLatency float64 `json:"last_latency_ms"`
+	LastError   string  `json:"last_error,omitempty"`
+	Successes   int64   `json:"successes"`
+	Failures    int64   `json:"failures"`
+}
+
+// probeState holds the results of one prober.
+type probeState struct {
+	mu     sync.Mutex
+	result probeResult
+
+	users map[string]bool // Hashes of the configurations probing, guarded by probes
+	stop  chan struct{}   // Closed when the last user is gone
+}
+
+// probes holds one prober per provider endpoint and secret.
+var probes = struct {
+	sync.Mutex
+	states map[string]*probeState
+}{states: make(map[string]*probeState)}
+
+func init() {
+	adminMux.HandleFunc("/probes", handleProbes)
+}
+
+func probeKey(p *provider) string {
+	sum := sha256.Sum256([]byte(p.name + "\x00" + p.verifyURL + "\x00" + p.secretKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// startProbes starts a prober for every provider of cc not probed yet and
+// records cc as a user of all of them.
+func startProbes(cc *compiledConfig) {
+	if cc.probeInterval <= 0 || cc.err != nil {
+		return
+	}
+	probes.Lock()
+	defer probes.Unlock()
+	for _, p := range cc.providers {
+		key := probeKey(p)
+		state, running := probes.states[key]
+		if !running {
+			state = &probeState{result: probeResult{Provider: p.name, VerifyURL: p.verifyURL},
+				users: make(map[string]bool), stop: make(chan struct{})}
+			probes.states[key] = state
+			go state.run(cc, p)
+		}
+		state.users[cc.hash] = true
+	}
+}
+
+// stopProbes removes cc as a user of its probers, stopping those it was the
+// last user of.
+func stopProbes(cc *compiledConfig) {
+	if cc.probeInterval <= 0 || cc.err != nil {
+		return
+	}
+	probes.Lock()
+	defer probes.Unlock()
+	for _, p := range cc.providers {
+		key := probeKey(p)
+		state, running := probes.states[key]
+		if !running {
+			continue
+		}
+		delete(state.users, cc.hash)
+		if len(state.users) == 0 {
+			close(state.stop)
+			delete(probes.states, key)
+		}
+	}
+}
+
+func (s *probeState) run(settings *compiledConfig, p *provider) {
+	ticker := time.NewTicker(settings.probeInterval)
+	defer ticker.Stop()
+	for {
+		s.probe(settings, p)
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// probe sends one canary and records the outcome.
+func (s *probeState) probe(settings *compiledConfig, p *provider) {
+	started := time.Now()
+	resp, verr := siteVerify(settings, p, probeToken, "")
+	latency := time.Since(started)
+
+	var problem string
+	switch {
+	case verr != nil:
+		problem = verr.msg
+	case !resp.Success && !slices.Contains(resp.ErrorCodes, "invalid-input-response"):
+		problem = "unexpected error codes: " + strings.Join(resp.ErrorCodes, ", ")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &s.result
+	wasHealthy := res.Healthy || res.LastAt == ""
+	res.LastAt = started.UTC().Format(time.RFC3339)
+	res.LastLatency = float64(latency) / float64(time.Millisecond)
+	res.LastError = problem
+	res.Healthy = problem == ""
+	if res.Healthy {
+		res.Successes++
+	} else {
+		res.Failures++
+	}
+	if wasHealthy != res.Healthy {
+		log.Printf("turnstile: probe of %s (%s) now healthy=%v %s", res.Provider, res.VerifyURL, res.Healthy, problem)
+	}
+}
+
+func (s *probeState) snapshot() probeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+// allProbes returns the results of every prober.
+func allProbes() []probeResult {
+	probes.Lock()
+	states := make([]*probeState, 0, len(probes.states))
+	for _, state := range probes.states {
+		states = append(states, state)
+	}
+	probes.Unlock()
+	var results []probeResult
+	for _, state := range states {
+		results = append(results, state.snapshot())
+	}
+	return results
+}
+
+func handleProbes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, allProbes())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func probeRunning(p *provider) bool {
+	probes.Lock()
+	defer probes.Unlock()
+	_, running := probes.states[probeKey(p)]
+	return running
+}
+
+func TestProbesStopWithTheirConfig(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	newConf := func(secret string) *Config {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = secret
+		conf.TurnstileVerifyURL = srv.URL()
+		conf.ProbeIntervalSeconds = 3600
+		return conf
+	}
+	rotated := newConf("rotated-" + t.Name())
+	current := newConf("current-" + t.Name())
+	route := "route-" + t.Name()
+
+	observeRouteConfig(route, rotated.settings().hash, clockStart)
+	if !probeRunning(rotated.settings().providers[0]) {
+		t.Fatal("no prober started")
+	}
+	observeRouteConfig(route, current.settings().hash, clockStart)
+	if probeRunning(rotated.settings().providers[0]) {
+		t.Error("rotated secret still probed after its route switched configuration")
+	}
+	if !probeRunning(current.settings().providers[0]) {
+		t.Error("current secret not probed")
+	}
+
+	evictIdleConfigs(time.Now().Add(compiledConfigIdle + time.Minute))
+	if probeRunning(current.settings().providers[0]) || len(allProbes()) != 0 {
+		t.Error("prober still running after its configuration was evicted")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"kong-turnstile-plugin/verifier"
+)
+
+// --- Provider Kinds ---
+// The plugin verifies Cloudflare Turnstile tokens by default; provider
+// selects another kind for the primary provider, and schema does the same
+// for additional_providers entries:
+//
+//	turnstile      Cloudflare Turnstile
+//	hcaptcha       hCaptcha
+//	recaptcha_v2   Google reCAPTCHA v2 (checkbox and invisible); 'recaptcha' is an alias
+//	recaptcha_v3   Google reCAPTCHA v3, which scores every request
+//
+// A kind supplies the default verify URL (turnstile_verify_url or
+// verify_url override it) and token name; its dialect in the verifier
+// package encodes the siteverify form and normalizes the answer. Only Turnstile takes
+// idempotency_key; hCaptcha gets the site key (widget_site_key, or site_key
+// of additional providers) so it rejects tokens solved for other sites.
+// reCAPTCHA v3 tokens scoring below DefaultRecaptchaV3MinScore are
+// rejected unless min_score, or min_score of the additional provider, sets
+// another threshold; see score.go. The plugin keeps its Turnstile naming
+// (turnstile_secret_key, the Turnstile widget of widget_inject_paths) for
+// every kind.
+
+// DefaultRecaptchaV3MinScore is the score threshold Google suggests for reCAPTCHA v3.
+const DefaultRecaptchaV3MinScore = verifier.RecaptchaV3MinScore
+
+// siteVerifier is the provider-specific part of a siteverify call. The
+// request form and answer are encoded by its dialect, shared with the
+// verifier library.
+type siteVerifier interface {
+	dialect() verifier.Kind
+	defaultTokenName() string
+	maxTokenLength() int
+}
+
+// providerKinds maps provider and schema values to their kind.
+var providerKinds = map[string]siteVerifier{
+	"turnstile":    turnstileVerifier{},
+	"hcaptcha":     hcaptchaVerifier{},
+	"recaptcha":    recaptchaVerifier{},
+	"recaptcha_v2": recaptchaVerifier{},
+	"recaptcha_v3": recaptchaVerifier{v3: true},
+}
+
+// Provider schemas, see ProviderConfig.Schema.
+var providerSchemas = func() []string {
+	schemas := make([]string, 0, len(providerKinds))
+	for schema := range providerKinds {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	return schemas
+}()
+
+// providerKind returns the kind a provider or schema value names; empty
+// names Turnstile.
+func providerKind(name string) (siteVerifier, bool) {
+	if name == "" {
+		return turnstileVerifier{}, true
+	}
+	kind, ok := providerKinds[strings.ToLower(name)]
+	return kind, ok
+}
+
+type turnstileVerifier struct{}
+
+func (turnstileVerifier) dialect() verifier.Kind   { return verifier.Turnstile }
+func (turnstileVerifier) defaultTokenName() string { return DefaultTokenHeader }
+func (turnstileVerifier) maxTokenLength() int      { return DefaultMaxTokenLength }
+
+type hcaptchaVerifier struct{}
+
+func (hcaptchaVerifier) dialect() verifier.Kind   { return verifier.HCaptcha }
+func (hcaptchaVerifier) defaultTokenName() string { return "h-captcha-response" }
+func (hcaptchaVerifier) maxTokenLength() int      { return DefaultMaxOtherTokenLen }
+
+type recaptchaVerifier struct {
+	v3 bool
+}
+
+func (recaptchaVerifier) defaultTokenName() string { return "g-recaptcha-response" }
+func (recaptchaVerifier) maxTokenLength() int      { return DefaultMaxOtherTokenLen }
+
+func (v recaptchaVerifier) dialect() verifier.Kind {
+	if v.v3 {
+		return verifier.RecaptchaV3
+	}
+	return verifier.RecaptchaV2
+}
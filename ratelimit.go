@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Provider Rate Limiting ---
+// A 429 from a verification endpoint is not an outage: the provider says
+// when to come back. Its Retry-After is honoured for every request of the
+// plugin server, calls to that endpoint are held back until it has passed,
+// and rate_limited_policy decides what clients get meanwhile:
+//
+//	fail_closed  503 with the remaining Retry-After (default)
+//	fail_open    the request is let through unverified, reason 'fail_open'
+//	queue        the request waits out a Retry-After of up to
+//	             rate_limited_max_wait_ms and is verified then; longer waits
+//	             and batch verifications fail closed
+//
+// Affected calls are counted in the provider's rate_limited counter rather
+// than its errors. Hold-backs can be shared through Redis, see
+// circuitstate.go.
+
+const (
+	defaultRetryAfter = time.Second     // 429 without a usable Retry-After
+	maxRetryAfter     = 5 * time.Minute // Bounds a bogus Retry-After
+)
+
+// providerBackoffs holds, per verification URL, the Unix nanoseconds until
+// which calls are held back.
+var providerBackoffs sync.Map // map[string]*atomic.Int64
+
+func backoffFor(verifyURL string) *atomic.Int64 {
+	until, _ := providerBackoffs.LoadOrStore(verifyURL, new(atomic.Int64))
+	return until.(*atomic.Int64)
+}
+
+// holdBackProvider holds back calls to verifyURL for wait.
+func holdBackProvider(verifyURL string, wait time.Duration) {
+	backoffFor(verifyURL).Store(clock.Now().Add(wait).UnixNano())
+}
+
+// rateLimitRemaining returns how long calls to verifyURL are still held back.
+func rateLimitRemaining(verifyURL string, now time.Time) time.Duration {
+	until, ok := providerBackoffs.Load(verifyURL)
+	if !ok {
+		return 0
+	}
+	return time.Duration(until.(*atomic.Int64).Load() - now.UnixNano())
+}
+
+// parseRetryAfter reads a Retry-After value in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	wait := defaultRetryAfter
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		wait = date.Sub(now)
+	}
+	return min(wait, maxRetryAfter)
+}
+
+func rateLimitedError(p *provider, wait time.Duration, answered bool) *verifyError {
+	msg := fmt.Sprintf("%s API is rate limiting, holding back calls for another %s", p.name, wait.Round(time.Millisecond))
+	if answered {
+		msg = fmt.Sprintf("%s API returned 429, holding back calls for %s", p.name, wait.Round(time.Millisecond))
+	}
+	return &verifyError{status: http.StatusServiceUnavailable, body: "Turnstile verification temporarily unavailable", msg: msg, retryAfter: wait, answered: answered}
+}
+
+// verify runs a verification on the worker pool, waiting out a short
+// Retry-After under rate_limited_policy 'queue'.
+func (r *requestState) verify(p *provider, token, clientIP string) (*VerificationResult, *verifyError) {
+	settings := r.settings
+	resp, verr := r.verifyCall(p, token, clientIP)
+	if verr != nil && verr.retryAfter > 0 && settings.rateLimitedPolicy == "queue" && verr.retryAfter <= settings.rateLimitedMaxWait {
+		r.log.Info(fmt.Sprintf("%s, waiting before verifying", verr.msg))
+		time.Sleep(verr.retryAfter)
+		resp, verr = r.verifyCall(p, token, clientIP)
+	}
+	return r.retryInternalErrors(p, token, clientIP, resp, verr)
+}
+
+// rateLimited applies rate_limited_policy to a verification held back by
+// the provider's rate limiting.
+func (r *requestState) rateLimited(p *provider, verr *verifyError) {
+	p.stats.RateLimited.Add(1)
+	msg, failOpen := verr.msg, r.settings.rateLimitedPolicy == "fail_open"
+	if failOpen && r.threatElevated() {
+		failOpen = false
+		msg += " (rate_limited_policy 'fail_open' suspended under elevated threat level)"
+	}
+	if failOpen {
+		r.log.Warn(fmt.Sprintf("%s, letting request through unverified (rate_limited_policy 'fail_open')", msg))
+		r.publish(decision{allowed: true, reason: ReasonFailOpen, provider: p, failOpenCause: failOpenCause(verr)})
+		return
+	}
+	r.log.Err(msg)
+	r.exit(decision{status: verr.status, reason: ReasonProviderRateLimited, provider: p}, []byte(verr.body),
+		retryAfterHeader(verr.retryAfter))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// --- Referer Receipts ---
+// Static sites cannot add a token or header to a plain HTML form post. With
+// receipt_cookie set, the preverify endpoint additionally sets a signed
+// receipt cookie naming the page it was called from (its Referer), and a
+// later request is accepted without a token when it carries an unexpired
+// receipt and comes from that same page. Receipts are signed with the pass
+// keys, single-use, bound to the client IP under pass_bind_ip, and
+// compared on scheme, host and path only.
+//
+// Browsers shorten cross-origin Referers to the origin by default; since the
+// preverify call and the form post usually cross the same origin boundary,
+// both are shortened alike and still match.
+
+// receiptPayload is the signed content of a receipt.
+type receiptPayload struct {
+	Type    string `json:"typ"` // Always receiptType
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`  // Unix seconds
+	Page    string `json:"page"` // Normalized Referer of the preverify call
+	IPHash  string `json:"ip,omitempty"`
+	Epoch   string `json:"sk,omitempty"` // See rotation.go
+}
+
+// normalizePage reduces a Referer to scheme, host and path.
+func normalizePage(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return u.Scheme + "://" + u.Host + path
+}
+
+// referringPage returns the normalized Referer of the request.
+func (r *requestState) referringPage() string {
+	referer, err := r.kong.Request.GetHeader("Referer")
+	if err != nil {
+		return ""
+	}
+	return normalizePage(referer)
+}
+
+// newReceipt signs a receipt for the page the preverify call came from, whose
+// token p verified. It returns "" when receipts are disabled or the call has
+// no usable Referer.
+func (r *requestState) newReceipt(p *provider) string {
+	settings := r.settings
+	if settings.receiptCookie == "" {
+		return ""
+	}
+	page := r.referringPage()
+	if page == "" {
+		r.log.Warn("Preverify request has no Referer, not issuing a receipt")
+		return ""
+	}
+	payload := receiptPayload{Type: receiptType, ID: randomID(), Expires: clock.Now().Add(settings.receiptTTL).Unix(), Page: page, Epoch: p.secretID}
+	if settings.passBindIP {
+		payload.IPHash = hashIP(r.clientIP())
+	}
+	raw, _ := json.Marshal(payload)
+	r.log.Info(fmt.Sprintf("Issued receipt %s for %s", payload.ID, page))
+	return settings.passKeys.sign(raw)
+}
+
+// acceptReceipt checks for a valid receipt matching the request's Referer.
+// On success it publishes the decision and returns true; otherwise the
+// request continues with regular verification.
+func (r *requestState) acceptReceipt() bool {
+	settings := r.settings
+	if settings.receiptCookie == "" || settings.passKeys == nil {
+		return false
+	}
+	receipt := r.requestCookie(settings.receiptCookie)
+	if receipt == "" {
+		return false
+	}
+
+	now := clock.Now()
+	var payload receiptPayload
+	raw, ok := settings.passKeys.open(receipt, now)
+	if !ok || json.Unmarshal(raw, &payload) != nil {
+		r.log.Warn("Receipt has an invalid signature, falling back to Turnstile verification")
+		return false
+	}
+	if payload.Type != receiptType {
+		r.log.Warn("Receipt is not a receipt (a pass?), falling back to Turnstile verification")
+		return false
+	}
+	if payload.Expires < now.Unix() {
+		r.log.Info("Receipt expired, falling back to Turnstile verification")
+		return false
+	}
+	if r.staleEpoch(payload.Epoch) {
+		r.log.Info(fmt.Sprintf("Receipt %s was issued under a replaced secret, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if page := r.referringPage(); page != payload.Page {
+		r.log.Info(fmt.Sprintf("Receipt %s was issued for another page, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if payload.IPHash != "" && payload.IPHash != hashIP(r.clientIP()) {
+		r.log.Warn(fmt.Sprintf("Receipt %s presented from a different IP, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if !usedPasses.consume(payload.ID, payload.Expires, now) {
+		r.log.Warn(fmt.Sprintf("Receipt %s replayed, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+
+	if err := r.kong.Response.AddHeader("Set-Cookie", passCookie(settings.receiptCookie, "", -1)); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not clear receipt cookie: %v", err))
+	}
+	r.log.Info(fmt.Sprintf("Receipt %s accepted for %s", payload.ID, payload.Page))
+	r.publish(decision{allowed: true, reason: ReasonReceipt})
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Redis Client ---
+// Token buckets (rate_limit_redis), failure counters (failure_counter_redis)
+// and shared circuit state (TURNSTILE_CIRCUIT_REDIS) speak to Redis through
+// one minimal client. It keeps up to redisIdleConns idle connections per
+// server, password and database, so features pointed at the same Redis
+// share them; new connections are authenticated and switched to the
+// database before their first command. Every call is bounded by the timeout
+// of the feature making it, and a connection that failed is closed rather
+// than reused.
+
+const redisIdleConns = 16 // Idle connections kept per server, password and database
+
+// redisClient runs commands on one Redis server and database.
+type redisClient struct {
+	addr     string
+	password string
+	database int
+	idle     chan *redisConn
+}
+
+// redisConn is a connection of a redisClient.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisClients holds one client per server, password and database.
+var redisClients sync.Map // map[string]*redisClient
+
+func getRedisClient(addr, password string, database int) *redisClient {
+	key := fmt.Sprintf("%s\x00%s\x00%d", addr, password, database)
+	if client, ok := redisClients.Load(key); ok {
+		return client.(*redisClient)
+	}
+	client, _ := redisClients.LoadOrStore(key, &redisClient{addr: addr, password: password, database: database,
+		idle: make(chan *redisConn, redisIdleConns)})
+	return client.(*redisClient)
+}
+
+// exec runs commands as one pipeline on an idle or new connection, within
+// timeout, and returns the string or integer reply of the last; found is
+// false for a nil reply.
+func (c *redisClient) exec(timeout time.Duration, commands ...[]string) (reply string, found bool, err error) {
+	deadline := time.Now().Add(timeout)
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", c.addr, timeout)
+		if err != nil {
+			return "", false, err
+		}
+		rc = &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+		var setup [][]string
+		if c.password != "" {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+		if c.database != 0 {
+			setup = append(setup, []string{"SELECT", strconv.Itoa(c.database)})
+		}
+		commands = append(setup, commands...)
+	}
+
+	_ = rc.conn.SetDeadline(deadline)
+	if reply, found, err = rc.exec(commands); err != nil {
+		rc.conn.Close()
+		return "", false, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, found, nil
+}
+
+// exec runs commands as one pipeline and returns the reply of the last.
+func (rc *redisConn) exec(commands [][]string) (reply string, found bool, err error) {
+	if err := writeRedisCommands(rc.conn, commands); err != nil {
+		return "", false, err
+	}
+	for range commands {
+		if reply, found, err = readRedisReply(rc.reader); err != nil {
+			return "", false, err
+		}
+	}
+	return reply, found, nil
+}
+
+// writeRedisCommands writes commands in the Redis protocol.
+func writeRedisCommands(conn io.Writer, commands [][]string) error {
+	w := bufio.NewWriter(conn)
+	for _, args := range commands {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	return w.Flush()
+}
+
+// readRedisReply reads one status, error, integer or bulk string reply.
+func readRedisReply(reader *bufio.Reader) (string, bool, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	if len(line) < 3 {
+		return "", false, fmt.Errorf("malformed reply %q", line)
+	}
+	content := line[1 : len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return content, true, nil
+	case '-':
+		return "", false, fmt.Errorf("redis: %s", content)
+	case '$':
+		n, err := strconv.Atoi(content)
+		if err != nil || n < 0 {
+			return "", false, err
+		}
+		bulk := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return "", false, err
+		}
+		return string(bulk[:n]), true, nil
+	}
+	return "", false, fmt.Errorf("unexpected reply %q", line)
+}
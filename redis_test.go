@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers every command with :1 and records what it received.
+type fakeRedis struct {
+	addr string
+
+	mu       sync.Mutex
+	commands []string
+	accepted int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRedis{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.accepted++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(reader, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(reader, "$%d\r\n", &size); err != nil {
+				return
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		f.mu.Unlock()
+		conn.Write([]byte(":1\r\n"))
+	}
+}
+
+func TestRedisClientSetsUpAndReusesConnections(t *testing.T) {
+	f := newFakeRedis(t)
+	client := getRedisClient(f.addr, "pw", 2)
+	if getRedisClient(f.addr, "pw", 2) != client {
+		t.Error("same server, password and database got another client")
+	}
+
+	for i := 0; i < 2; i++ {
+		reply, found, err := client.exec(time.Second, []string{"INCR", "a"}, []string{"INCR", "b"})
+		if err != nil || !found || reply != "1" {
+			t.Fatalf("exec = %q, %v, %v", reply, found, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	want := []string{"AUTH pw", "SELECT 2", "INCR a", "INCR b", "INCR a", "INCR b"}
+	if strings.Join(f.commands, ",") != strings.Join(want, ",") {
+		t.Errorf("commands = %q, want %q", f.commands, want)
+	}
+	if f.accepted != 1 {
+		t.Errorf("%d connections, want 1", f.accepted)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// --- Single-Use Tokens ---
+// Flow tokens and passes are signed, so the plugin server only needs to
+// remember which ones were already used. Entries live in this process only
+// (surviving restarts with TURNSTILE_STATE_DIR, see persist.go): with several
+// Kong nodes, a token may be replayed once per node. The stores are listed on
+// the admin endpoint but cannot be purged.
+
+// usedTokenStore remembers the IDs of consumed single-use tokens until they expire.
+type usedTokenStore struct {
+	mu        sync.Mutex
+	ids       map[string]int64 // ID -> expiry (Unix seconds)
+	lastSweep time.Time
+	hits      int64 // Replays caught
+	misses    int64 // First uses
+	evictions int64
+}
+
+// newUsedTokenStore creates a store and registers it as cache name.
+func newUsedTokenStore(name string) *usedTokenStore {
+	s := &usedTokenStore{ids: make(map[string]int64)}
+	registerCache(name, s)
+	return s
+}
+
+// consume marks id as used, returning false if it already was.
+func (s *usedTokenStore) consume(id string, expires int64, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for usedID, exp := range s.ids {
+			if exp < now.Unix() {
+				delete(s.ids, usedID)
+				s.evictions++
+			}
+		}
+		s.lastSweep = now
+	}
+	if _, used := s.ids[id]; used {
+		s.hits++
+		return false
+	}
+	s.misses++
+	s.ids[id] = expires
+	return true
+}
+
+func (s *usedTokenStore) Stats() cacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cacheStats{Entries: len(s.ids), Hits: s.hits, Misses: s.misses, Evictions: s.evictions}
+}
+
+// Purge removes nothing: forgetting an ID would let its token be replayed
+// until it expires.
+func (s *usedTokenStore) Purge(cacheFilter) (int, bool) {
+	return 0, false
+}
+
+func (s *usedTokenStore) snapshot() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make(map[string]int64, len(s.ids))
+	for id, exp := range s.ids {
+		entries[id] = exp
+	}
+	return entries
+}
+
+// restore adds the entries that have not expired yet.
+func (s *usedTokenStore) restore(entries map[string]int64, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := 0
+	for id, exp := range entries {
+		if exp >= now.Unix() {
+			s.ids[id] = exp
+			restored++
+		}
+	}
+	return restored
+}
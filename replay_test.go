@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPurgeKeepsConsumedPasses(t *testing.T) {
+	id := "pass-" + t.Name()
+	expires := clockStart.Add(time.Hour)
+	if !usedPasses.consume(id, expires.Unix(), clockStart) {
+		t.Fatal("first use rejected")
+	}
+
+	rec := httptest.NewRecorder()
+	handleCachePurge(rec, httptest.NewRequest(http.MethodPost, "/caches/purge", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("purge status = %d", rec.Code)
+	}
+
+	if usedPasses.consume(id, expires.Unix(), clockStart) {
+		t.Error("consumed pass accepted again after a purge")
+	}
+}
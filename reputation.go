@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- IP Reputation ---
+// An optional lookup before any verification: known-good addresses skip the
+// challenge, known-bad ones are refused outright. Sources are range files
+// (one IP or CIDR per line, '#' comments, optionally followed by an
+// ipsum-style score) re-read when they change, and an HTTP endpoint answering
+// GET <reputation_url>?ip=<address> with {"verdict": "good"|"bad"|"unknown"}.
+// Files win over the endpoint; lookup failures mean "unknown".
+//
+// The address is taken from the PDK, which honors forwarding headers only from
+// Kong's trusted_ips: a "good" verdict skips the challenge, so it must not be
+// claimable through a client-controlled header. While the threat level is
+// elevated, "good" verdicts are ignored.
+
+type reputationVerdict string
+
+const (
+	reputationUnknown reputationVerdict = "unknown"
+	reputationGood    reputationVerdict = "good"
+	reputationBad     reputationVerdict = "bad"
+
+	reputationFileInterval = 30 * time.Second // Bounds how often range files are checked for changes
+	maxReputationEntries   = 100000           // Bounds the endpoint verdict cache
+)
+
+// reputationSource is the compiled reputation configuration.
+type reputationSource struct {
+	goodFile    string
+	badFile     string
+	badMinScore int // ipsum-style score a bad file entry needs
+	url         string
+	client      *httpClient
+	cacheTTL    time.Duration
+}
+
+// --- Range Files ---
+
+type rangeFileState struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	modTime   time.Time
+	prefixes  []netip.Prefix
+}
+
+var rangeFiles sync.Map // map[string]*rangeFileState, keyed by path and min score
+
+// parseRangeFile reads one IP or CIDR per line. Lines may carry a score as
+// second field (ipsum format); entries scoring below minScore are skipped.
+func parseRangeFile(content []byte, minScore int) []netip.Prefix {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 1 {
+			if score, err := strconv.Atoi(fields[1]); err == nil && score < minScore {
+				continue
+			}
+		}
+		if parsed, err := parseCIDRs("range file", fields[:1]); err == nil {
+			prefixes = append(prefixes, parsed...)
+		}
+	}
+	return prefixes
+}
+
+// rangeFileContains checks ip against the file at path, re-reading it at most
+// every reputationFileInterval and only when its modification time changed.
+// A missing or unreadable file keeps the last good contents.
+func rangeFileContains(path string, minScore int, ip string) bool {
+	v, _ := rangeFiles.LoadOrStore(fmt.Sprintf("%s|%d", path, minScore), &rangeFileState{})
+	state := v.(*rangeFileState)
+	state.mu.Lock()
+	if time.Since(state.checkedAt) >= reputationFileInterval {
+		state.checkedAt = time.Now()
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(state.modTime) {
+			if content, err := os.ReadFile(path); err == nil {
+				state.prefixes, state.modTime = parseRangeFile(content, minScore), info.ModTime()
+			}
+		}
+	}
+	prefixes := state.prefixes
+	state.mu.Unlock()
+	return ipInPrefixes(ip, prefixes)
+}
+
+// --- Reputation Endpoint ---
+
+type reputationEntry struct {
+	verdict reputationVerdict
+	expires time.Time
+}
+
+// reputationCache remembers endpoint verdicts per IP.
+type reputationCache struct {
+	mu        sync.Mutex
+	entries   map[string]reputationEntry
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+var reputationVerdicts = newReputationCache()
+
+func newReputationCache() *reputationCache {
+	c := &reputationCache{entries: make(map[string]reputationEntry)}
+	registerCache("reputation", c)
+	return c
+}
+
+func (c *reputationCache) get(ip string, now time.Time) (reputationVerdict, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[ip]
+	if !ok || now.After(entry.expires) {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	return entry.verdict, true
+}
+
+func (c *reputationCache) put(ip string, verdict reputationVerdict, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxReputationEntries {
+		now := clock.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+				c.evictions++
+			}
+		}
+		if len(c.entries) >= maxReputationEntries {
+			return
+		}
+	}
+	c.entries[ip] = reputationEntry{verdict, expires}
+}
+
+func (c *reputationCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// Purge removes all verdicts, or the one of an IP.
+func (c *reputationCache) Purge(filter cacheFilter) (int, bool) {
+	if filter.TokenHash != "" {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if filter.IP != "" {
+		if _, ok := c.entries[filter.IP]; !ok {
+			return 0, true
+		}
+		delete(c.entries, filter.IP)
+		return 1, true
+	}
+	removed := len(c.entries)
+	c.entries = make(map[string]reputationEntry)
+	return removed, true
+}
+
+// queryReputation asks the endpoint about ip.
+func (s *reputationSource) queryReputation(ip string) (reputationVerdict, error) {
+	endpoint := s.url + "?ip=" + url.QueryEscape(ip)
+	if strings.Contains(s.url, "?") {
+		endpoint = s.url + "&ip=" + url.QueryEscape(ip)
+	}
+	resp, err := s.client.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, endpoint, nil)
+	})
+	if err != nil {
+		return reputationUnknown, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reputationUnknown, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var answer struct {
+		Verdict reputationVerdict `json:"verdict"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&answer); err != nil {
+		return reputationUnknown, err
+	}
+	switch answer.Verdict {
+	case reputationGood, reputationBad:
+		return answer.Verdict, nil
+	}
+	return reputationUnknown, nil
+}
+
+// reputation looks up the client's verdict.
+func (r *requestState) reputation() reputationVerdict {
+	source := r.settings.reputation
+	if source == nil {
+		return reputationUnknown
+	}
+	ip, err := r.kong.Client.GetForwardedIp()
+	if err != nil || ip == "" {
+		return reputationUnknown
+	}
+	if source.badFile != "" && rangeFileContains(source.badFile, source.badMinScore, ip) {
+		return reputationBad
+	}
+	if source.goodFile != "" && rangeFileContains(source.goodFile, 0, ip) {
+		return reputationGood
+	}
+	if source.url == "" {
+		return reputationUnknown
+	}
+
+	now := clock.Now()
+	if verdict, ok := reputationVerdicts.get(ip, now); ok {
+		return verdict
+	}
+	verdict, err := source.queryReputation(ip)
+	if err != nil {
+		r.log.Warn(fmt.Sprintf("Reputation lookup for %s failed, treating it as unknown: %v", ip, err))
+		return reputationUnknown // Not cached, the next request retries
+	}
+	reputationVerdicts.put(ip, verdict, now.Add(source.cacheTTL))
+	return verdict
+}
+
+// checkReputation applies the client's verdict. It returns true when the
+// request was decided: refused for bad addresses, let through for good ones.
+func (r *requestState) checkReputation() bool {
+	switch r.reputation() {
+	case reputationBad:
+		r.log.Warn("Turnstile: refusing client with bad IP reputation")
+		r.reject(decision{status: http.StatusForbidden, reason: ReasonBadReputation}, "Forbidden")
+		return true
+	case reputationGood:
+		if r.threatElevated() || r.forceChallenge {
+			return false
+		}
+		r.log.Debug("Turnstile: client with good IP reputation passed without verification")
+		r.spotCheck(SpotCheckReputation)
+		r.publish(decision{allowed: true, reason: ReasonBypassAllowlist})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Kong/go-pdk"
+)
+
+// --- Request State ---
+
+// requestState bundles what the Access helpers share while handling one request.
+type requestState struct {
+	kong     *pdk.PDK
+	settings *compiledConfig
+	trace    traceContext
+	log      requestLog
+	tenant   string // Name of the tenant whose settings apply, if any
+	started  time.Time
+
+	tenantsConfigured bool // Tenant metrics are kept, see tenantmetrics.go
+
+	clientIPValue    string // See clientIP
+	clientIPResolved bool
+
+	currentStage stageTiming // Running stage of the policy chain, see timing.go
+	stageStarted time.Time
+	timings      []stageTiming // Finished stages
+	exited       bool          // The plugin answered the request itself
+
+	verifiedFromCache bool   // The token was served from the verification cache
+	idempotentRetry   bool   // The token was verified for an earlier attempt, see idempotency.go
+	routeMode         string // Override set through the admin endpoint, see routemode.go
+	emergencyBypass   bool   // routeMode 'shadow' comes from an emergency bypass, see emergencybypass.go
+
+	actions        []string // Actions the token must be solved for, see action.go
+	forceChallenge bool     // A bot verdict requires a freshly verified token, see botverdict.go
+	threatChecked  bool     // threatValue is set, see threat.go
+	threatValue    bool
+
+	spanTrace        traceContext // Trace siteverify spans are exported in, zero when not traced, see tracing.go
+	spanTraceDecided bool
+}
+
+func newRequestState(kong *pdk.PDK, settings *compiledConfig) *requestState {
+	var trace traceContext
+	if header, err := kong.Request.GetHeader("traceparent"); err == nil && header != "" {
+		trace = parseTraceparent(header)
+	}
+	return &requestState{kong: kong, settings: settings, trace: trace, log: newRequestLog(kong, trace), started: time.Now()}
+}
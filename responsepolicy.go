@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// --- Response Policies ---
+// Every rejection the plugin sends goes through exit, which answers with the
+// status of the rejection class, the plain-text (or, see challenge.go, JSON)
+// message and the challenge headers. Sites whose clients expect something
+// else, e.g. an HTML error page, a redirect to a login page or a body in
+// their API's error format, take over the response per reason with
+// response_policies:
+//
+//	response_policies:
+//	  missing_token:
+//	    status: 302
+//	    headers: {Location: /challenge}
+//	  invalid_token:
+//	    headers: {Content-Type: application/problem+json}
+//	    body: '{"type": "about:blank", "title": {{printf "%q" .Message}}, "status": {{.Status}}}'
+//
+// status replaces the status of the reason (including the *_status fields of
+// tokenclass.go), headers are added to those the plugin sends, replacing
+// headers of the same name, and body is a Go text/template rendered with
+// responseTemplateData. A replaced body drops the plugin's Content-Type
+// unless headers sets one. ReasonHeader is always sent. Reasons a policy
+// does not name keep the plugin's answer; templates failing at request time
+// fall back to the plugin's body with a warning.
+
+// ResponsePolicyConfig is the response sent for one rejection reason.
+type ResponsePolicyConfig struct {
+	Status  int               `json:"status"`  // Optional: Status sent instead of the plugin's, 200-599
+	Headers map[string]string `json:"headers"` // Optional: Headers added to the response, replacing the plugin's of the same name
+	Body    string            `json:"body"`    // Optional: Go text/template of the body, see responseTemplateData
+}
+
+// responseTemplateData is what response policy body templates can use.
+type responseTemplateData struct {
+	Reason    string // Decision reason, e.g. 'missing_token'
+	Status    int    // Status sent
+	Message   string // The plugin's plain-text message, e.g. 'Turnstile token missing'
+	Retryable bool   // A freshly solved token can succeed, see isRetryable
+	SiteKey   string // challenge_site_key (or widget_site_key), if any
+	TraceID   string // From the request's traceparent header, if any
+}
+
+// responsePolicy is the compiled form of ResponsePolicyConfig.
+type responsePolicy struct {
+	status  int
+	headers map[string]string
+	body    *template.Template
+}
+
+// rejectionReasons are the reasons response_policies may name.
+var rejectionReasons = []Reason{
+	ReasonConfigError, ReasonMissingToken, ReasonAmbiguousToken, ReasonInvalidToken, ReasonExpired,
+	ReasonHostnameMismatch, ReasonActionMismatch, ReasonProviderError, ReasonBatchTooLarge, ReasonBodyTooLarge,
+	ReasonOverloaded, ReasonBadReputation, ReasonProviderRateLimited, ReasonLowScore, ReasonMalformedToken,
+	ReasonInsecureTransport, ReasonOriginNotAllowed, ReasonBotDetected, ReasonCDataMismatch, ReasonAttemptLimited,
+	ReasonPenaltyBanned,
+}
+
+// compileResponsePolicies validates and compiles response_policies.
+func compileResponsePolicies(policies map[string]ResponsePolicyConfig) (map[Reason]*responsePolicy, error) {
+	compiled := make(map[Reason]*responsePolicy, len(policies))
+	for name, pc := range policies {
+		reason := Reason(strings.ToLower(name))
+		if !slices.Contains(rejectionReasons, reason) {
+			return nil, fmt.Errorf("invalid response_policies entry '%s': not a rejection reason", name)
+		}
+		if pc.Status != 0 && (pc.Status < 200 || pc.Status > 599) {
+			return nil, fmt.Errorf("invalid response_policies.%s.status configured: %d. Use a status between 200 and 599", name, pc.Status)
+		}
+		policy := &responsePolicy{status: pc.Status, headers: pc.Headers}
+		if pc.Body != "" {
+			body, err := template.New(name).Parse(pc.Body)
+			if err == nil {
+				err = body.Execute(io.Discard, responseTemplateData{}) // Catches unknown fields now
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid response_policies.%s.body: %v", name, err)
+			}
+			policy.body = body
+		}
+		compiled[reason] = policy
+	}
+	return compiled, nil
+}
+
+// templateData is what templates answering d are rendered with.
+func (r *requestState) templateData(d *decision, message string) responseTemplateData {
+	return responseTemplateData{Reason: string(d.reason), Status: d.status, Message: message, Retryable: isRetryable(d.reason), SiteKey: r.settings.challengeSiteKey, TraceID: r.trace.TraceID}
+}
+
+// applyResponsePolicy replaces the plugin's answer to a rejection with the
+// response policy of its reason, if there is one.
+func (r *requestState) applyResponsePolicy(d *decision, body []byte, headers map[string][]string, message string) ([]byte, map[string][]string) {
+	policy := r.settings.responsePolicies[d.reason]
+	if policy == nil {
+		return body, headers
+	}
+	if policy.status != 0 {
+		d.status = policy.status
+	}
+	if headers == nil {
+		headers = make(map[string][]string, len(policy.headers)+1)
+	}
+	if policy.body != nil {
+		var rendered bytes.Buffer
+		if err := policy.body.Execute(&rendered, r.templateData(d, message)); err != nil {
+			r.log.Warn(fmt.Sprintf("Turnstile response policy for %s failed, sending the default body: %v", d.reason, err))
+		} else {
+			body = rendered.Bytes()
+			delete(headers, "Content-Type") // Set by describeChallenge for JSON bodies
+		}
+	}
+	for name, value := range policy.headers {
+		for existing := range headers {
+			if strings.EqualFold(existing, name) {
+				delete(headers, existing)
+			}
+		}
+		headers[name] = []string{value}
+	}
+	return body, headers
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+)
+
+// --- Secret Rotation ---
+// A secret key may be rotated because it leaked. Everything the plugin
+// vouches for on the strength of an earlier verification is therefore bound
+// to the secret it was verified under: cached verifications, passes,
+// receipts, sessions and flow tokens carry the secret ID of the provider that
+// verified the token (their epoch). Once that secret is no longer used by any
+// provider of the configuration they are not accepted and clients verify
+// again; adding, removing or reordering other providers does not affect them. When a route's configuration
+// changes (see configwatch.go) and a secret was retired with it, cache
+// entries bound to it are purged right away instead of waiting for expiry.
+// Passes and flow tokens issued before secret epochs existed are accepted
+// until they expire.
+
+// secretID identifies a secret key without revealing it.
+func secretID(secret string) string {
+	sum := sha256.Sum256([]byte("turnstile-secret\x00" + secret))
+	return hex.EncodeToString(sum[:6])
+}
+
+// staleEpoch reports whether a pass, receipt, session or flow token was
+// issued under a secret that has been retired since.
+func (r *requestState) staleEpoch(epoch string) bool {
+	return epoch != "" && !r.settings.secretIDs[epoch]
+}
+
+// secretIDs collects the secret IDs used by cc and its tenants.
+func secretIDs(cc *compiledConfig, ids map[string]bool) {
+	for _, p := range cc.providers {
+		ids[p.secretID] = true
+	}
+	for _, t := range cc.tenants {
+		secretIDs(t.settings, ids)
+	}
+}
+
+// retireSecrets purges cache entries bound to secrets the configuration
+// with oldHash used and the one with newHash no longer does.
+func retireSecrets(routeID, oldHash, newHash string) {
+	oldConfig, ok1 := compiledConfigs.Load(oldHash)
+	newConfig, ok2 := compiledConfigs.Load(newHash)
+	if !ok1 || !ok2 {
+		return
+	}
+	before, after := make(map[string]bool), make(map[string]bool)
+	secretIDs(oldConfig.(*compiledConfig), before)
+	secretIDs(newConfig.(*compiledConfig), after)
+	retired := make(map[string]bool)
+	for id := range before {
+		if !after[id] {
+			retired[id] = true
+		}
+	}
+	if len(retired) == 0 {
+		return
+	}
+	removed := verifiedTokens.purgeSecrets(retired) + rejectedTokens.purgeSecrets(retired) + idempotentRetries.purgeSecrets(retired)
+	log.Printf("turnstile: secret rotated on route=%s, purged %d cached verifications; passes and flow tokens issued under the old secret are no longer accepted", routeID, removed)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestSecretEpochSurvivesProviderChanges(t *testing.T) {
+	compile := func(secret string, additional ...ProviderConfig) *compiledConfig {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = secret
+		conf.AdditionalProviders = additional
+		cc := conf.settings()
+		if cc.err != nil {
+			t.Fatal(cc.err)
+		}
+		return cc
+	}
+	hcaptcha := ProviderConfig{Name: "hcaptcha", SecretKey: "hcaptcha-" + t.Name(), Schema: "hcaptcha"}
+	recaptcha := ProviderConfig{Name: "recaptcha", SecretKey: "recaptcha-" + t.Name(), Schema: "recaptcha_v2"}
+	issued := compile("turnstile-"+t.Name(), hcaptcha)
+	epoch := issued.providers[0].secretID
+
+	tests := []struct {
+		name      string
+		settings  *compiledConfig
+		wantStale bool
+	}{
+		{"unchanged", issued, false},
+		{"provider added", compile("turnstile-"+t.Name(), hcaptcha, recaptcha), false},
+		{"other provider removed", compile("turnstile-" + t.Name()), false},
+		{"other secret rotated", compile("turnstile-"+t.Name(), ProviderConfig{Name: "hcaptcha", SecretKey: "rotated", Schema: "hcaptcha"}), false},
+		{"verifying secret rotated", compile("rotated-"+t.Name(), hcaptcha), true},
+	}
+	for _, tt := range tests {
+		r := &requestState{settings: tt.settings}
+		if got := r.staleEpoch(epoch); got != tt.wantStale {
+			t.Errorf("%s: stale = %v, want %v", tt.name, got, tt.wantStale)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Route Mode Overrides ---
+// During an incident, operators can switch single routes to another mode
+// through the admin endpoint faster than a Kong deploy:
+//
+//	enforce  verify and reject as configured; also overrides enforcement_mode 'advise'
+//	shadow   verify, but forward every request the plugin would have rejected
+//	off      skip verification; client identity headers are still removed
+//
+// Overrides live in memory only. An override binds to the configuration its
+// route runs with when it is first applied, and is dropped as soon as the
+// route runs with another one, i.e. at the next config push. Every change is
+// logged and kept in an audit trail:
+//
+//	GET    /route-modes                                         overrides and audit trail
+//	POST   /route-modes?route=<id or name>&mode=&actor=&reason= set an override
+//	DELETE /route-modes?route=<id or name>&actor=&reason=       remove an override
+
+const maxRouteModeAudit = 100
+
+// routeOverride is the override of one route.
+type routeOverride struct {
+	Route      string `json:"route"` // Route ID or name, as given
+	Mode       string `json:"mode"`
+	ConfigHash string `json:"config_hash,omitempty"` // Bound on first use
+	Actor      string `json:"actor,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	SetAt      string `json:"set_at"`
+}
+
+// routeModeChange is one audit trail entry.
+type routeModeChange struct {
+	At     string `json:"at"`
+	Route  string `json:"route"`
+	From   string `json:"from"` // Empty when no override was active
+	To     string `json:"to"`   // Empty when the override was removed
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var routeModes = struct {
+	sync.Mutex
+	overrides map[string]*routeOverride
+	audit     []routeModeChange
+	active    atomic.Int32 // len(overrides), read without the lock on every request
+}{overrides: make(map[string]*routeOverride)}
+
+func init() {
+	adminMux.HandleFunc("/route-modes", handleRouteModes)
+}
+
+// recordRouteModeChange sets or, with mode "", removes the override of route.
+// Callers hold routeModes.
+func recordRouteModeChange(route, mode, actor, reason string, now time.Time) {
+	change := routeModeChange{At: now.UTC().Format(time.RFC3339), Route: route, To: mode, Actor: actor, Reason: reason}
+	if previous, ok := routeModes.overrides[route]; ok {
+		change.From = previous.Mode
+	}
+	if mode == "" {
+		delete(routeModes.overrides, route)
+	} else {
+		routeModes.overrides[route] = &routeOverride{Route: route, Mode: mode, Actor: actor, Reason: reason, SetAt: change.At}
+	}
+	routeModes.active.Store(int32(len(routeModes.overrides)))
+	if len(routeModes.audit) >= maxRouteModeAudit {
+		routeModes.audit = routeModes.audit[1:]
+	}
+	routeModes.audit = append(routeModes.audit, change)
+	log.Printf("turnstile: route %s mode override %q -> %q (actor=%q reason=%q)", route, change.From, mode, actor, reason)
+}
+
+// applyRouteMode looks up the override of the request's route, if any.
+func (r *requestState) applyRouteMode() {
+	if routeModes.active.Load() == 0 {
+		return // Spares the router lookup in the common case
+	}
+	route, err := r.kong.Router.GetRoute()
+	if err != nil {
+		return
+	}
+	routeModes.Lock()
+	defer routeModes.Unlock()
+	key := route.Id
+	override, ok := routeModes.overrides[key]
+	if !ok && route.Name != "" {
+		key = route.Name
+		override, ok = routeModes.overrides[key]
+	}
+	if !ok {
+		return
+	}
+	switch override.ConfigHash {
+	case "":
+		override.ConfigHash = r.settings.hash
+	case r.settings.hash:
+	default:
+		recordRouteModeChange(key, "", "", "configuration changed", clock.Now())
+		return
+	}
+	r.routeMode = override.Mode
+	r.log.Info(fmt.Sprintf("Turnstile: route mode '%s' set through the admin endpoint", override.Mode))
+}
+
+// shadow forwards a request the plugin would have rejected under route mode 'shadow'.
+func (r *requestState) shadow(d decision) {
+	r.log.Info(fmt.Sprintf("Turnstile: shadow mode, forwarding request that would get %d (%s)", d.status, d.reason))
+	if r.emergencyBypass {
+		r.auditEmergencyBypass(d)
+		d.emergency = true
+	}
+	d.allowed, d.status, d.shadowed = true, 0, true
+	r.publish(d)
+}
+
+func handleRouteModes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	route, mode := query.Get("route"), query.Get("mode")
+	switch r.Method {
+	case http.MethodGet:
+		routeModes.Lock()
+		overrides := make([]routeOverride, 0, len(routeModes.overrides))
+		for _, override := range routeModes.overrides {
+			overrides = append(overrides, *override)
+		}
+		audit := append([]routeModeChange(nil), routeModes.audit...)
+		routeModes.Unlock()
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"overrides": overrides, "audit": audit})
+		return
+	case http.MethodPost:
+		if mode != "enforce" && mode != "shadow" && mode != "off" {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "mode must be 'enforce', 'shadow' or 'off'"})
+			return
+		}
+	case http.MethodDelete:
+		mode = ""
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if route == "" {
+		writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "route is required"})
+		return
+	}
+
+	routeModes.Lock()
+	defer routeModes.Unlock()
+	if _, ok := routeModes.overrides[route]; !ok && mode == "" {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "no override for route " + route})
+		return
+	}
+	recordRouteModeChange(route, mode, query.Get("actor"), query.Get("reason"), clock.Now())
+	writeAdminJSON(w, http.StatusOK, map[string]string{"route": route, "mode": mode})
+}
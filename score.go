@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// --- Provider Scores ---
+// Enterprise accounts (Turnstile Enterprise, reCAPTCHA v3, hCaptcha
+// Enterprise) can get a risk score with each verification, normalized to
+// 0.0 (likely automated) to 1.0 (likely human). When present it is
+// published as "score" (see exported_response_fields), forwarded upstream
+// in score_header and counted per provider in tenths for support bundles.
+// With min_score set, verified tokens scoring below it are rejected with
+// reason low_score; tokens without a score are not affected, so the setting
+// is safe on accounts without scoring. Additional providers can set their
+// own threshold, and reCAPTCHA v3 defaults to one (see providers.go); 0
+// disables it. reCAPTCHA v3 answers always score, so one without a score,
+// e.g. from a v2 secret, is rejected with low_score whatever the threshold.
+
+const scoreBuckets = 10
+
+// clearScoreHeader drops a client-supplied score header.
+func (r *requestState) clearScoreHeader() {
+	header := r.settings.scoreHeader
+	if header == "" {
+		return
+	}
+	if err := r.kong.ServiceRequest.ClearHeader(header); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header, err))
+	}
+}
+
+// checkScore counts the score of a verification and rejects the request
+// when it is below min_score. It returns false after answering the client.
+func (r *requestState) checkScore(p *provider, resp *VerificationResult) bool {
+	if resp.Score == nil {
+		if p.kind == nil || !p.kind.dialect().Scores() {
+			return true
+		}
+		p.stats.Rejected.Add(1)
+		p.stats.LowScore.Add(1)
+		r.log.Warn(fmt.Sprintf("Turnstile token rejected: %s answered without a score (check that its secret is a v3 key)", p.name))
+		r.reject(decision{status: http.StatusForbidden, reason: ReasonLowScore, provider: p, response: resp}, "Verification failed")
+		return false
+	}
+	score := *resp.Score
+	if !r.verifiedFromCache {
+		bucket := min(max(int(score*scoreBuckets), 0), scoreBuckets-1)
+		p.stats.Scores[bucket].Add(1)
+	}
+	if score >= p.minScore {
+		return true
+	}
+	p.stats.Rejected.Add(1)
+	p.stats.LowScore.Add(1)
+	r.log.Warn(fmt.Sprintf("Turnstile token rejected: score %s below min_score %g", r.exportedField("score", formatScore(score)), p.minScore))
+	r.reject(decision{status: http.StatusForbidden, reason: ReasonLowScore, provider: p, response: resp}, "Verification failed")
+	return false
+}
+
+// forwardScore passes the score of an allowed decision upstream.
+func (r *requestState) forwardScore(d decision) {
+	header := r.settings.scoreHeader
+	if header == "" || !d.allowed || d.response == nil || d.response.Score == nil {
+		return
+	}
+	if err := r.kong.ServiceRequest.SetHeader(header, formatScore(*d.response.Score)); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not set %s on the upstream request: %v", header, err))
+	}
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+func TestMinScore(t *testing.T) {
+	zero, high := 0.0, 0.9
+	tests := []struct {
+		name         string
+		provider     string
+		minScore     *float64
+		score        string // JSON score field, "" for none
+		wantRejected bool
+	}{
+		{"turnstile without threshold", "", nil, `,"score":0.1`, false},
+		{"turnstile threshold", "", &high, `,"score":0.5`, true},
+		{"turnstile without score", "", &high, "", false},
+		{"v3 default threshold", "recaptcha_v3", nil, `,"score":0.3`, true},
+		{"v3 above default threshold", "recaptcha_v3", nil, `,"score":0.7`, false},
+		{"v3 threshold disabled", "recaptcha_v3", &zero, `,"score":0.3`, false},
+		{"v3 without score", "recaptcha_v3", &zero, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := turnstiletest.NewServer(t)
+			srv.Enqueue(turnstiletest.Reply{Body: `{"success":true,"hostname":"example.com"` + tt.score + `}`})
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL()
+			conf.Provider = tt.provider
+			conf.TokenName = DefaultTokenHeader
+			conf.MinScore = tt.minScore
+
+			env := accessWithToken(t, conf, "token-"+t.Name())
+
+			if err := conf.settings().err; err != nil {
+				t.Fatalf("config error: %v", err)
+			}
+			if rejected := turnstiletest.Rejected(env); rejected != tt.wantRejected {
+				t.Fatalf("rejected = %v, want %v (status %d)", rejected, tt.wantRejected, env.ClientRes.Status)
+			}
+			if tt.wantRejected {
+				if reason := decisionReason(t, env); reason != string(ReasonLowScore) {
+					t.Errorf("reason = %q, want %q", reason, ReasonLowScore)
+				}
+			}
+		})
+	}
+}
+
+func TestMinScoreValidation(t *testing.T) {
+	for _, score := range []float64{-0.1, 1.5} {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = "secret"
+		conf.MinScore = &score
+		if conf.settings().err == nil {
+			t.Errorf("min_score %g accepted", score)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// --- Session Cookies ---
+// Browser apps should not have to attach a token to every request. With
+// session_cookie set, a request whose token was verified gets a signed,
+// expiring HttpOnly cookie, and later requests carrying it are let through
+// with reason session until it expires, without a token and without
+// calling the provider. Unlike passes and receipts, a session cookie is not
+// single-use. It is signed with session_keys (or session_secret, see
+// sign.go), bound to the client IP under session_bind_ip and, like
+// everything signed, void once the provider's secret key changes (see
+// rotation.go). An invalid or expired session cookie is ignored and the
+// request is verified as usual.
+
+// sessionPayload is the signed content of a session cookie.
+type sessionPayload struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`          // Unix seconds
+	IPHash  string `json:"ip,omitempty"` // Set when session_bind_ip is enabled
+	Epoch   string `json:"sk,omitempty"` // See rotation.go
+}
+
+// issueSession sets a session cookie on the response to a request verified by p.
+func (r *requestState) issueSession(p *provider) {
+	settings := r.settings
+	if settings.sessionCookie == "" {
+		return
+	}
+	payload := sessionPayload{ID: randomID(), Expires: clock.Now().Add(settings.sessionTTL).Unix(), Epoch: p.secretID}
+	if settings.sessionBindIP {
+		payload.IPHash = hashIP(r.clientIP())
+	}
+	raw, _ := json.Marshal(payload)
+	cookie := passCookie(settings.sessionCookie, settings.sessionKeys.sign(raw), int(settings.sessionTTL/time.Second))
+	if err := r.kong.Response.AddHeader("Set-Cookie", cookie); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not issue session cookie: %v", err))
+		return
+	}
+	r.log.Info(fmt.Sprintf("Issued session %s", payload.ID))
+}
+
+// acceptSession checks for a valid session cookie. On success it publishes
+// the decision and returns true; otherwise the request continues with
+// regular verification.
+func (r *requestState) acceptSession() bool {
+	settings := r.settings
+	if settings.sessionCookie == "" {
+		return false
+	}
+	session := r.requestCookie(settings.sessionCookie)
+	if session == "" {
+		return false
+	}
+
+	now := clock.Now()
+	var payload sessionPayload
+	raw, ok := settings.sessionKeys.open(session, now)
+	if !ok || json.Unmarshal(raw, &payload) != nil {
+		r.log.Warn("Session cookie has an invalid signature, falling back to Turnstile verification")
+		return false
+	}
+	if payload.Expires < now.Unix() {
+		r.log.Info("Session expired, falling back to Turnstile verification")
+		return false
+	}
+	if r.staleEpoch(payload.Epoch) {
+		r.log.Info(fmt.Sprintf("Session %s was issued under a replaced secret, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+	if payload.IPHash != "" && payload.IPHash != hashIP(r.clientIP()) {
+		r.log.Warn(fmt.Sprintf("Session %s presented from a different IP, falling back to Turnstile verification", payload.ID))
+		return false
+	}
+
+	r.log.Debug(fmt.Sprintf("Session %s accepted", payload.ID))
+	r.publish(decision{allowed: true, reason: ReasonSession})
+	return true
+}
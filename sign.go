@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Signed Tokens ---
+// Small HMAC-SHA256 signed tokens of the form base64url(payload).base64url(mac),
+// used wherever the plugin hands clients something it must later trust.
+
+func signToken(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// openToken returns the payload of token if its signature is valid for key.
+func openToken(key []byte, token string) ([]byte, bool) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, false
+	}
+	gotMAC, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(gotMAC, mac.Sum(nil)) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// randomID returns 128 random bits, hex encoded, to identify single-use tokens.
+func randomID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// --- Key Rings ---
+// Signing keys are rotated through config without invalidating everything
+// already handed out: the first key of a ring signs, the others only verify,
+// each until its accept_until. Keys with an ID prefix their tokens with
+// "id."; the legacy single secret has no ID and signs plain tokens.
+
+// SigningKeyConfig is one key of a ring.
+type SigningKeyConfig struct {
+	ID          string `json:"id"`           // REQUIRED: Short identifier embedded in tokens, e.g. '2026-10'; no '.'
+	Secret      string `json:"secret"`       // REQUIRED: HMAC secret
+	AcceptUntil string `json:"accept_until"` // Optional: RFC 3339 end of the grace period of a retired key. Not allowed on the first key
+}
+
+type signingKey struct {
+	id          string
+	secret      []byte
+	acceptUntil time.Time // Zero accepts indefinitely
+}
+
+// keyRing signs with keys[0] and verifies with any key.
+type keyRing struct {
+	keys []signingKey
+}
+
+// compileKeyRing builds the ring of field from keys, followed by the legacy
+// secret, if any. It returns nil when neither is configured.
+func compileKeyRing(field string, keys []SigningKeyConfig, legacySecret string) (*keyRing, error) {
+	ring := &keyRing{}
+	seen := make(map[string]bool)
+	for i, kc := range keys {
+		switch {
+		case kc.ID == "" || strings.Contains(kc.ID, "."):
+			return nil, fmt.Errorf("%s[%d]: id is required and must not contain '.'", field, i)
+		case seen[kc.ID]:
+			return nil, fmt.Errorf("%s[%d]: duplicate id '%s'", field, i, kc.ID)
+		case kc.Secret == "":
+			return nil, fmt.Errorf("%s[%d]: secret is required", field, i)
+		case i == 0 && kc.AcceptUntil != "":
+			return nil, fmt.Errorf("%s[0] signs new tokens and cannot have accept_until", field)
+		}
+		seen[kc.ID] = true
+		key := signingKey{id: kc.ID, secret: []byte(kc.Secret)}
+		if kc.AcceptUntil != "" {
+			until, err := time.Parse(time.RFC3339, kc.AcceptUntil)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: invalid accept_until: %v", field, i, err)
+			}
+			key.acceptUntil = until
+		}
+		ring.keys = append(ring.keys, key)
+	}
+	if legacySecret != "" {
+		ring.keys = append(ring.keys, signingKey{secret: []byte(legacySecret)})
+	}
+	if len(ring.keys) == 0 {
+		return nil, nil
+	}
+	return ring, nil
+}
+
+func (k *keyRing) sign(payload []byte) string {
+	key := k.keys[0]
+	if key.id == "" {
+		return signToken(key.secret, payload)
+	}
+	return key.id + "." + signToken(key.secret, payload)
+}
+
+// open returns the payload of token if a key of the ring, still accepted at
+// now, signed it.
+func (k *keyRing) open(token string, now time.Time) ([]byte, bool) {
+	key, token, ok := k.keyFor(token, now)
+	if !ok {
+		return nil, false
+	}
+	return openToken(key.secret, token)
+}
+
+// keyFor finds the key token claims to be signed with and strips its ID.
+func (k *keyRing) keyFor(token string, now time.Time) (signingKey, string, bool) {
+	id := ""
+	if strings.Count(token, ".") == 2 {
+		id, token, _ = strings.Cut(token, ".")
+	}
+	for _, key := range k.keys {
+		if key.id != id {
+			continue
+		}
+		if !key.acceptUntil.IsZero() && now.After(key.acceptUntil) {
+			return signingKey{}, "", false
+		}
+		return key, token, true
+	}
+	return signingKey{}, "", false
+}
+
+// --- Double Submit ---
+// A token delivered in an HttpOnly cookie is paired with a binding value the
+// client keeps in script and echoes in a header. The binding is an HMAC of
+// the token under the key that signed it, so a stolen cookie alone, or a
+// cross-site request riding on it, is not enough to use the token.
+
+// binding returns the double-submit value of token, which must be valid.
+func (k *keyRing) binding(token string, now time.Time) string {
+	key, _, _ := k.keyFor(token, now)
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte("double-submit\x00" + token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkBinding reports whether value is the double-submit value of token.
+func (k *keyRing) checkBinding(token, value string, now time.Time) bool {
+	if _, _, ok := k.keyFor(token, now); !ok || value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(k.binding(token, now)))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Async Sink Queues ---
+// Every asynchronous sink (analytics export, Cloudflare list pushes, shared
+// failure counters) hands its events to a bounded sinkQueue drained by one
+// goroutine; spot checks (see spotcheck.go) use one too, always dropping the
+// newest sample when full. When a sink cannot keep up, sink_overflow_policy decides:
+//
+//	drop_newest  discard the event being queued (default)
+//	drop_oldest  discard the oldest queued event to make room
+//	block        wait up to sink_block_ms for room, then discard the event
+//
+// so a failing sink costs requests at most sink_block_ms. Discarded events
+// are counted per queue, logged at most once per minute, and listed under
+// GET /sinks on the admin endpoint and in support bundles.
+
+const sinkDropLogInterval = time.Minute
+
+// sinkOverflow is the compiled overflow behaviour of one configuration.
+type sinkOverflow struct {
+	policy string
+	wait   time.Duration // For policy 'block'
+}
+
+// sinkStats is reported per queue.
+type sinkStats struct {
+	Queued   int   `json:"queued"`
+	Capacity int   `json:"capacity"`
+	Dropped  int64 `json:"dropped"`
+	Blocked  int64 `json:"blocked"` // Events that had to wait for room
+}
+
+// sinkQueue is a bounded queue of events for one sink.
+type sinkQueue[T any] struct {
+	name  string
+	items chan T
+
+	// overflow, if set, is offered every discarded event and returns true
+	// when it kept it elsewhere, e.g. in the analytics spill directory.
+	overflow func(T) bool
+
+	dropped atomic.Int64
+	blocked atomic.Int64
+	lastLog atomic.Int64 // Unix nanoseconds of the last drop log line
+}
+
+// sinkQueues holds every queue by name for reporting.
+var sinkQueues sync.Map // map[string]interface{ stats() sinkStats }
+
+func init() {
+	adminMux.HandleFunc("/sinks", handleSinks)
+}
+
+func newSinkQueue[T any](name string, size int, overflow func(T) bool) *sinkQueue[T] {
+	return &sinkQueue[T]{name: name, items: make(chan T, size), overflow: overflow}
+}
+
+// register lists q in sink statistics; called once its consumer runs.
+func (q *sinkQueue[T]) register() {
+	sinkQueues.Store(q.name, q)
+}
+
+// put queues item according to o, never waiting longer than o.wait.
+func (q *sinkQueue[T]) put(item T, o sinkOverflow) {
+	select {
+	case q.items <- item:
+		return
+	default:
+	}
+	switch o.policy {
+	case "drop_oldest":
+		for attempt := 0; attempt < 3; attempt++ { // Other senders may take the freed slot
+			select {
+			case oldest := <-q.items:
+				q.discard(oldest)
+			default:
+			}
+			select {
+			case q.items <- item:
+				return
+			default:
+			}
+		}
+	case "block":
+		q.blocked.Add(1)
+		timer := time.NewTimer(o.wait)
+		defer timer.Stop()
+		select {
+		case q.items <- item:
+			return
+		case <-timer.C:
+		}
+	}
+	q.discard(item)
+}
+
+func (q *sinkQueue[T]) discard(item T) {
+	if q.overflow != nil && q.overflow(item) {
+		return
+	}
+	dropped := q.dropped.Add(1)
+	now := time.Now().UnixNano()
+	last := q.lastLog.Load()
+	if now-last >= int64(sinkDropLogInterval) && q.lastLog.CompareAndSwap(last, now) {
+		log.Printf("turnstile: %s queue full, %d events dropped so far", q.name, dropped)
+	}
+}
+
+func (q *sinkQueue[T]) stats() sinkStats {
+	return sinkStats{Queued: len(q.items), Capacity: cap(q.items), Dropped: q.dropped.Load(), Blocked: q.blocked.Load()}
+}
+
+// allSinkStats returns the statistics of every queue by name.
+func allSinkStats() map[string]sinkStats {
+	stats := make(map[string]sinkStats)
+	sinkQueues.Range(func(k, v interface{}) bool {
+		stats[k.(string)] = v.(interface{ stats() sinkStats }).stats()
+		return true
+	})
+	return stats
+}
+
+func handleSinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, allSinkStats())
+}
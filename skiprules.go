@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// --- Skip Rules ---
+// Applied to a whole service, the plugin would challenge health checks,
+// webhooks, CORS preflights and static assets too. Requests matching any of
+//
+//	skip_methods  e.g. ['OPTIONS'], case-insensitive
+//	skip_paths    globs, where '*' matches any characters including '/' and
+//	              '?' one character, e.g. '/static/*' or '*.css'; a leading '~'
+//	              makes the rest a regular expression anchored at the start,
+//	              as in Kong routes, e.g. '~/webhooks/[a-z]+$'
+//	skip_hosts    exact hosts or '*.example.com' (subdomains only)
+//
+// are let through without a token, with reason bypass_allowlist, before any
+// token lookup. With skip_invert the rules select the requests to verify
+// instead: only matching requests are verified, all others skipped. A share
+// of skipped requests can be spot-checked (see spotcheck.go).
+
+// skipRules is the compiled form of the skip_* fields.
+type skipRules struct {
+	methods []string // Uppercased
+	paths   []*regexp.Regexp
+	hosts   []string // Lowercased patterns
+	invert  bool
+}
+
+// compileSkipRules compiles the skip_* fields; it returns nil when none is set.
+func compileSkipRules(conf *Config) (*skipRules, error) {
+	if len(conf.SkipMethods) == 0 && len(conf.SkipPaths) == 0 && len(conf.SkipHosts) == 0 {
+		if conf.SkipInvert {
+			return nil, fmt.Errorf("skip_invert requires skip_methods, skip_paths or skip_hosts")
+		}
+		return nil, nil
+	}
+	rules := &skipRules{invert: conf.SkipInvert}
+	for _, method := range conf.SkipMethods {
+		rules.methods = append(rules.methods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+	for _, pattern := range conf.SkipPaths {
+		expr, ok := strings.CutPrefix(pattern, "~")
+		if ok {
+			expr = "^(?:" + expr + ")"
+		} else {
+			expr = globToRegexp(pattern)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid skip_paths entry '%s': %v", pattern, err)
+		}
+		rules.paths = append(rules.paths, re)
+	}
+	for _, host := range conf.SkipHosts {
+		rules.hosts = append(rules.hosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+	return rules, nil
+}
+
+// globToRegexp translates a skip_paths glob into an anchored expression.
+func globToRegexp(glob string) string {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return "^" + expr + "$"
+}
+
+// matches reports whether method, path or host matches a rule.
+func (rules *skipRules) matches(method, path, host string) bool {
+	if slices.Contains(rules.methods, strings.ToUpper(method)) {
+		return true
+	}
+	if slices.ContainsFunc(rules.paths, func(re *regexp.Regexp) bool { return re.MatchString(path) }) {
+		return true
+	}
+	host = strings.ToLower(host)
+	return slices.ContainsFunc(rules.hosts, func(pattern string) bool { return hostMatches(pattern, host) })
+}
+
+// skipRulesStage lets requests the skip rules exempt through without a token.
+func (r *requestState) skipRulesStage(*verification) bool {
+	rules := r.settings.skipRules
+	if rules == nil {
+		return true
+	}
+	method, _ := r.kong.Request.GetMethod()
+	path, _ := r.kong.Request.GetPath()
+	host, _ := r.kong.Request.GetHost()
+	if rules.matches(method, path, host) == rules.invert {
+		return true
+	}
+	r.log.Debug(fmt.Sprintf("Turnstile: %s %s%s exempt by skip rules, passed without verification", method, host, path))
+	r.spotCheck(SpotCheckSkipRules)
+	r.publish(decision{allowed: true, reason: ReasonBypassAllowlist})
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Spot Checks ---
+// Requests let through without a token by a skip rule are trusted wholesale:
+// skip_* rules (see skiprules.go), a good IP reputation or a 'relax' bot
+// verdict (see botverdict.go). To notice when such a source starts sending
+// bots, spot_check_percent verifies a random share of them per rule, e.g.
+// {skip_rules: 1, reputation: 1, bot_verdict: 5}, in shadow: the request is
+// let through as before, and if it carries a token in a header, query
+// argument or cookie, the token is verified in the background. Bodies are
+// never read for a spot check, so allowlisted uploads are not buffered.
+// Checks wait in a queue of spotCheckQueueSize for spotCheckWorkers; when it
+// is full, further samples are dropped (see GET /sinks). Outcomes are
+// counted by "<rule>/<outcome>" in support bundles under spot_checks, where
+// outcome is
+// verified, missing_token, provider_error or the rejection reason
+// (invalid_token, expired). Anything but verified is also logged with the
+// client IP:
+//
+//	turnstile: spot check of request skipped by reputation: outcome=missing_token ip=10.1.2.3
+//
+// Spot-checked tokens are redeemed with the provider, so a client reusing
+// one later, or an upstream verifying it again, gets 'timeout-or-duplicate':
+// leave spot checks off for routes whose upstream verifies tokens itself.
+
+// Skip rules spot_check_percent can name.
+const (
+	SpotCheckSkipRules  = "skip_rules"
+	SpotCheckReputation = "reputation"
+	SpotCheckBotVerdict = "bot_verdict"
+)
+
+const (
+	spotCheckQueueSize = 256
+	spotCheckWorkers   = 4
+)
+
+// spotCheckCounts counts spot check outcomes by "<rule>/<outcome>".
+var spotCheckCounts sync.Map // map[string]*atomic.Int64
+
+// spotCheckJob is one sampled token waiting to be verified.
+type spotCheckJob struct {
+	rule     string
+	settings *compiledConfig
+	provider *provider
+	token    string
+	ip       string
+}
+
+var (
+	spotChecks      = newSinkQueue[spotCheckJob]("spot_checks", spotCheckQueueSize, nil)
+	spotChecksStart sync.Once
+)
+
+// compileSpotChecks validates spot_check_percent.
+func compileSpotChecks(percents map[string]float64) (map[string]float64, error) {
+	for rule, percent := range percents {
+		if rule != SpotCheckSkipRules && rule != SpotCheckReputation && rule != SpotCheckBotVerdict {
+			return nil, fmt.Errorf("invalid spot_check_percent entry '%s': use '%s', '%s' or '%s'", rule, SpotCheckSkipRules, SpotCheckReputation, SpotCheckBotVerdict)
+		}
+		if percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid spot_check_percent.%s configured: %g. Use a value between 0 and 100", rule, percent)
+		}
+	}
+	return percents, nil
+}
+
+// spotCheck verifies the token of a request rule lets through, at
+// spot_check_percent of such requests. The outcome is recorded, never acted on.
+func (r *requestState) spotCheck(rule string) {
+	settings := r.settings
+	percent := settings.spotCheckPercent[rule]
+	if percent <= 0 || rand.Float64()*100 >= percent {
+		return
+	}
+	ip := r.clientIP()
+	token, p, err := extractToken(r.kong.Request, withoutBodySteps(r.extractionSteps()), settings.maxBodyBytes, settings.maxBufferedBody)
+	if err != nil || token == "" {
+		recordSpotCheck(rule, string(ReasonMissingToken), ip)
+		return
+	}
+	r.log.Debug(fmt.Sprintf("Turnstile: spot-checking request skipped by %s", rule))
+	spotChecksStart.Do(func() {
+		for i := 0; i < spotCheckWorkers; i++ {
+			go runSpotChecks()
+		}
+		spotChecks.register()
+	})
+	spotChecks.put(spotCheckJob{rule: rule, settings: settings, provider: p, token: token, ip: ip}, sinkOverflow{policy: "drop_newest"})
+}
+
+// runSpotChecks verifies queued spot checks and records their outcomes.
+func runSpotChecks() {
+	for job := range spotChecks.items {
+		resp, verr := verifyWorkers.verify(job.settings, job.provider, job.token, job.ip)
+		switch {
+		case verr != nil:
+			recordSpotCheck(job.rule, string(ReasonProviderError), job.ip)
+		case !resp.Success:
+			recordSpotCheck(job.rule, string(providerRejection(resp)), job.ip)
+		default:
+			recordSpotCheck(job.rule, string(ReasonVerified), job.ip)
+		}
+	}
+}
+
+// recordSpotCheck counts a spot check outcome and logs failures.
+func recordSpotCheck(rule, outcome, ip string) {
+	v, _ := spotCheckCounts.LoadOrStore(rule+"/"+outcome, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+	if outcome != string(ReasonVerified) {
+		log.Printf("turnstile: spot check of request skipped by %s: outcome=%s ip=%s", rule, outcome, ip)
+	}
+}
+
+// allSpotCheckCounts returns the spot check outcomes by rule and outcome.
+func allSpotCheckCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	spotCheckCounts.Range(func(k, v interface{}) bool {
+		counts[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
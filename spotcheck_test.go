@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+func TestSpotChecksReadOnlyHeaders(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.SkipPaths = []string{"/health*"}
+	conf.SpotCheckPercent = map[string]float64{SpotCheckSkipRules: 100}
+
+	before := allSpotCheckCounts()[SpotCheckSkipRules+"/"+string(ReasonVerified)]
+	env := turnstiletest.RunAccess(t, conf, test.Request{
+		Method:  "GET",
+		Url:     "http://example.com/health",
+		Headers: http.Header{"Cf-Turnstile-Response": {"header-token"}},
+	})
+	if env.ClientRes.Status != 0 && env.ClientRes.Status != http.StatusOK {
+		t.Fatalf("skipped request got status %d", env.ClientRes.Status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for allSpotCheckCounts()[SpotCheckSkipRules+"/"+string(ReasonVerified)] == before {
+		if time.Now().After(deadline) {
+			t.Fatal("header token was not spot-checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conf.TokenLocation = "form"
+	before = allSpotCheckCounts()[SpotCheckSkipRules+"/"+string(ReasonMissingToken)]
+	turnstiletest.RunAccess(t, conf, test.Request{
+		Method:  "POST",
+		Url:     "http://example.com/health",
+		Headers: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:    []byte("cf-turnstile-response=form-token"),
+	})
+	if got := allSpotCheckCounts()[SpotCheckSkipRules+"/"+string(ReasonMissingToken)]; got != before+1 {
+		t.Errorf("form token: missing_token count %d, want %d", got, before+1)
+	}
+	if calls := len(srv.Calls()); calls != 1 {
+		t.Errorf("%d siteverify calls, want 1 (header token only)", calls)
+	}
+}
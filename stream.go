@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Kong/go-pdk"
+)
+
+// --- Stream Routes ---
+// On TCP/TLS (stream) routes there are no headers or bodies to carry a
+// Turnstile token, so nothing can be verified. Gateways mixing HTTP and
+// stream services can still attach the plugin globally: by default stream
+// connections pass untouched (stream_mode 'allow'), or they are closed
+// (stream_mode 'deny') for deployments that want fail-safe behavior.
+
+// streamNotices makes sure each plugin instance explains the no-op once at
+// warn level, rather than once per connection.
+var streamNotices sync.Map // map[string]bool, keyed by config hash
+
+// Preread phase: runs for stream routes only.
+func (conf *Config) Preread(kong *pdk.PDK) {
+	settings := conf.requestSettings(kong)
+	if settings.err != nil {
+		kong.Log.Err(fmt.Sprintf("Turnstile configuration error: %v", settings.err))
+		return
+	}
+
+	if _, seen := streamNotices.LoadOrStore(settings.hash, true); !seen {
+		kong.Log.Warn(fmt.Sprintf("Turnstile plugin attached to a stream route: tokens cannot be verified on TCP/TLS, stream_mode is '%s'", settings.streamMode))
+	}
+
+	if settings.streamMode == "deny" {
+		kong.Log.Info("Turnstile: closing stream connection (stream_mode 'deny')")
+		kong.Response.ExitStatus(403) // Only the status is meaningful in the stream subsystem
+		return
+	}
+	kong.Log.Debug("Turnstile: stream connection passed without verification (stream_mode 'allow')")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// --- Token Stripping ---
+// Tokens are single-use and mean nothing to upstream services, but they end
+// up in their logs. With strip_token (the default), the plugin removes the
+// token from every location its extraction pipeline reads before proxying,
+// whatever the outcome and whichever step found it:
+//
+//	header     the header is cleared
+//	cookie     the cookie is dropped from the Cookie header
+//	query      the argument is removed, as for query steps with strip
+//	form       the field is removed from application/x-www-form-urlencoded bodies
+//	body_json  the field is cut from JSON bodies, along with one comma
+//
+// Form fields are removed with their array form ('name[]'). Everything else
+// in a rewritten body stays as sent, byte for byte: key order, whitespace,
+// escaping and number formatting. Bodies are only
+// rewritten when their Content-Type matches, they fit max_body_bytes and they
+// contain the field. Set strip_token to false for upstreams that verify the
+// token themselves.
+
+// stripTokens removes the token locations of the extraction pipeline,
+// except query arguments, from the upstream request.
+func (r *requestState) stripTokens() {
+	settings := r.settings
+	if !settings.stripToken {
+		return
+	}
+	cookies, form := make(map[string]bool), make(map[string]bool)
+	var jsonPaths []string
+	for _, step := range settings.extraction {
+		switch step.location {
+		case "header":
+			if err := r.kong.ServiceRequest.ClearHeader(step.name); err != nil {
+				r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", step.name, err))
+			}
+		case "cookie":
+			cookies[step.name] = true
+		case "form":
+			form[step.name], form[step.name+"[]"] = true, true
+		case "body_json":
+			jsonPaths = append(jsonPaths, step.name)
+		}
+	}
+	if len(cookies) > 0 {
+		r.stripCookies(cookies)
+	}
+	if len(form) > 0 || len(jsonPaths) > 0 {
+		r.stripBodyTokens(form, jsonPaths)
+	}
+}
+
+// stripCookies drops the named cookies from the upstream Cookie header.
+func (r *requestState) stripCookies(names map[string]bool) {
+	header, err := r.kong.Request.GetHeader("Cookie")
+	if err != nil || header == "" {
+		return
+	}
+	parts := strings.Split(header, ";")
+	kept := parts[:0]
+	for _, part := range parts {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if !names[name] {
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	if len(kept) == len(parts) {
+		return
+	}
+	if len(kept) == 0 {
+		err = r.kong.ServiceRequest.ClearHeader("Cookie")
+	} else {
+		err = r.kong.ServiceRequest.SetHeader("Cookie", strings.Join(kept, "; "))
+	}
+	if err != nil {
+		r.log.Err(fmt.Sprintf("Could not strip token cookies from the upstream request: %v", err))
+	}
+}
+
+// stripBodyTokens removes form fields or JSON paths from the upstream body.
+func (r *requestState) stripBodyTokens(form map[string]bool, jsonPaths []string) {
+	contentType, _ := r.kong.Request.GetHeader("Content-Type")
+	contentType = strings.ToLower(contentType)
+	isForm := len(form) > 0 && strings.HasPrefix(contentType, "application/x-www-form-urlencoded")
+	isJSON := len(jsonPaths) > 0 && strings.Contains(contentType, "json")
+	if !isForm && !isJSON {
+		return
+	}
+	raw, release, err := readBody(r.kong.Request, r.settings.maxBodyBytes, r.settings.maxBufferedBody)
+	if err != nil {
+		r.log.Debug(fmt.Sprintf("Turnstile token not stripped from the upstream body: %v", err))
+		return
+	}
+	defer release()
+
+	var stripped []byte
+	if isForm {
+		if kept, removed := removeQueryArgs(string(raw), form); removed {
+			stripped = []byte(kept)
+		}
+	} else {
+		stripped = removeJSONPaths(raw, jsonPaths)
+	}
+	if stripped == nil {
+		return
+	}
+	if err := r.kong.ServiceRequest.SetRawBody(string(stripped)); err != nil {
+		r.log.Err(fmt.Sprintf("Could not strip the token from the upstream body: %v", err))
+	}
+}
+
+// removeJSONPaths cuts the fields at paths out of a JSON body, leaving the
+// rest of it byte for byte. It returns nil when the body is not JSON or has
+// none of them.
+func removeJSONPaths(body []byte, paths []string) []byte {
+	var stripped []byte
+	for _, path := range paths {
+		start, end, ok := jsonMemberSpan(body, strings.Split(path, "."))
+		if !ok {
+			continue
+		}
+		stripped = append(append(make([]byte, 0, len(body)-(end-start)), body[:start]...), body[end:]...)
+		body = stripped
+	}
+	return stripped
+}
+
+// jsonMemberSpan locates the string member at the path segments of body
+// and returns the bytes to cut for removing it: the member and the comma
+// before it, or after it for the first member of an object.
+func jsonMemberSpan(body []byte, segments []string) (start, end int, ok bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // Keeps large numbers intact
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, 0, false
+	}
+	return findJSONMember(decoder, body, token, segments)
+}
+
+// findJSONMember descends into the value starting with token.
+func findJSONMember(decoder *json.Decoder, body []byte, token json.Token, segments []string) (int, int, bool) {
+	last := len(segments) == 1
+	switch token {
+	case json.Delim('{'):
+		for first := true; decoder.More(); first = false {
+			start := int(decoder.InputOffset()) // After the previous member, before its comma
+			key, err := decoder.Token()
+			if err != nil {
+				return 0, 0, false
+			}
+			value, err := decoder.Token()
+			if err != nil {
+				return 0, 0, false
+			}
+			if key != segments[0] {
+				if skipJSONValue(decoder, value) != nil {
+					return 0, 0, false
+				}
+				continue
+			}
+			if !last {
+				return findJSONMember(decoder, body, value, segments[1:])
+			}
+			if _, isString := value.(string); !isString {
+				return 0, 0, false
+			}
+			end := int(decoder.InputOffset())
+			if first {
+				// Take the comma after the member instead of the one before it
+				rest := bytes.TrimLeft(body[end:], " \t\r\n")
+				if len(rest) > 0 && rest[0] == ',' {
+					end = len(body) - len(rest) + 1
+				}
+			}
+			return start, end, true
+		}
+	case json.Delim('['):
+		i, err := strconv.Atoi(segments[0])
+		if err != nil || i < 0 || last {
+			return 0, 0, false // Array elements are not removed, it would shift the others
+		}
+		for n := 0; decoder.More(); n++ {
+			value, err := decoder.Token()
+			if err != nil {
+				return 0, 0, false
+			}
+			if n == i {
+				return findJSONMember(decoder, body, value, segments[1:])
+			}
+			if skipJSONValue(decoder, value) != nil {
+				return 0, 0, false
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// skipJSONValue reads past the object or array starting with token.
+func skipJSONValue(decoder *json.Decoder, token json.Token) error {
+	depth := 0
+	for {
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+		var err error
+		if token, err = decoder.Token(); err != nil {
+			return err
+		}
+	}
+}
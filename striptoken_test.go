@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestRemoveJSONPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		paths []string
+		want  string // "" for no rewrite
+	}{
+		{"only member", `{"token":"t"}`, []string{"token"}, `{}`},
+		{"first member", `{"token": "t", "b": 1}`, []string{"token"}, `{ "b": 1}`},
+		{"later member", `{"z": 1, "token": "t"}`, []string{"token"}, `{"z": 1}`},
+		{"formatting kept", "{\n  \"html\": \"<a>&amp;\\u003c\",\n  \"token\": \"t\",\n  \"n\": 1.50\n}", []string{"token"},
+			"{\n  \"html\": \"<a>&amp;\\u003c\",\n  \"n\": 1.50\n}"},
+		{"nested", `{"a": {"b": [{"token": "t", "x": 2}]}, "c": "token"}`, []string{"a.b.0.token"}, `{"a": {"b": [{ "x": 2}]}, "c": "token"}`},
+		{"skips nested values", `{"token": {"token": "no"}, "x": [1, {"y": 2}], "t": "yes"}`, []string{"t"}, `{"token": {"token": "no"}, "x": [1, {"y": 2}]}`},
+		{"two paths", `{"a": "1", "b": "2", "c": "3"}`, []string{"a", "c"}, `{ "b": "2"}`},
+		{"escaped value", `{"x": 1, "token": "a\"b,c"}`, []string{"token"}, `{"x": 1}`},
+		{"not a string", `{"token": 5}`, []string{"token"}, ""},
+		{"array element", `["t"]`, []string{"0"}, ""},
+		{"missing", `{"a": "1"}`, []string{"token"}, ""},
+		{"not JSON", `token=t`, []string{"token"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(removeJSONPaths([]byte(tt.body), tt.paths)); got != tt.want {
+				t.Errorf("removeJSONPaths() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
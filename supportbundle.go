@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Support Bundle ---
+// Much of the plugin server's state exists only in memory. GET
+// /support-bundle on the admin endpoint collects it into one JSON document
+// for bug reports: version, effective configurations with secrets redacted,
+// decision and provider counters, cache, worker pool and probe state. The
+// support-bundle subcommand fetches it from the running plugin server:
+//
+//	kong-turnstile-plugin support-bundle [-o bundle.json]
+//
+// using TURNSTILE_ADMIN_LISTEN and TURNSTILE_ADMIN_TOKEN from the environment.
+
+var startedAt = time.Now()
+
+func init() {
+	adminMux.HandleFunc("/support-bundle", handleSupportBundle)
+}
+
+// decisionCounts counts published decisions by reason.
+var decisionCounts sync.Map // map[Reason]*atomic.Int64
+
+func countDecision(reason Reason) {
+	v, _ := decisionCounts.LoadOrStore(reason, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+}
+
+// redactedConfig returns conf as a JSON object with the values of secret
+// fields replaced, for display.
+func redactedConfig(conf *Config) map[string]interface{} {
+	raw, _ := json.Marshal(conf)
+	var doc map[string]interface{}
+	_ = json.Unmarshal(raw, &doc)
+	redactSecrets(doc)
+	return doc
+}
+
+// redactSecrets walks a decoded JSON document, replacing non-empty values of
+// keys that hold credentials.
+func redactSecrets(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && s != "" && (strings.Contains(key, "secret") || strings.Contains(key, "password") || key == "cloudflare_api_token" || key == "analytics_token") {
+				v[key] = "[REDACTED]"
+				continue
+			}
+			redactSecrets(value)
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactSecrets(item)
+		}
+	}
+}
+
+// supportBundle is the document served by GET /support-bundle.
+type supportBundle struct {
+	Version       string                      `json:"version"`
+	GoVersion     string                      `json:"go_version"`
+	GeneratedAt   string                      `json:"generated_at"`
+	UptimeSeconds int64                       `json:"uptime_seconds"`
+	Configs       []map[string]interface{}    `json:"configs"`
+	Decisions     map[string]int64            `json:"decisions"`
+	Providers     map[string]map[string]int64 `json:"providers"`
+	Caches        map[string]cacheStats       `json:"caches"`
+	VerifyPool    verifyPoolStats             `json:"verify_pool"`
+	Probes        []probeResult               `json:"probes"`
+	Environment   map[string]string           `json:"environment"`
+
+	DuplicateExecutions int64                          `json:"duplicate_executions"` // See dedup.go
+	Analytics           map[string]analyticsStats      `json:"analytics"`            // By analytics_url
+	Sinks               map[string]sinkStats           `json:"sinks"`                // See sinkqueue.go
+	RouteConfigs        map[string]routeConfig         `json:"route_configs"`        // By route ID, see configwatch.go
+	ChaosInjected       int64                          `json:"chaos_injected"`       // See chaos.go
+	StageTimings        map[string]durationStats       `json:"stage_timings"`        // By policy chain stage, see timing.go
+	FailOpen            map[string]int64               `json:"fail_open"`            // By "<cause>/<provider>", see failopen.go
+	Tenants             map[string]tenantMetricsReport `json:"tenants"`              // By tenant, see tenantmetrics.go
+	SpotChecks          map[string]int64               `json:"spot_checks"`          // By "<rule>/<outcome>", see spotcheck.go
+}
+
+func collectSupportBundle(now time.Time) supportBundle {
+	b := supportBundle{
+		Version:       PluginVersion,
+		GoVersion:     runtime.Version(),
+		GeneratedAt:   now.UTC().Format(time.RFC3339),
+		UptimeSeconds: int64(now.Sub(startedAt) / time.Second),
+		Decisions:     make(map[string]int64),
+		Providers:     make(map[string]map[string]int64),
+		Caches:        allCacheStats(),
+		VerifyPool:    verifyWorkers.stats(),
+		Probes:        allProbes(),
+		Environment:   make(map[string]string),
+
+		DuplicateExecutions: duplicateExecutions.Load(),
+		Analytics:           allAnalyticsStats(),
+		Sinks:               allSinkStats(),
+		RouteConfigs:        allRouteConfigs(),
+		ChaosInjected:       chaosInjected.Load(),
+		StageTimings:        allStageTimings(),
+		FailOpen:            allFailOpenCounts(),
+		Tenants:             allTenantReports(),
+		SpotChecks:          allSpotCheckCounts(),
+	}
+	compiledConfigs.Range(func(_, v interface{}) bool {
+		cc := v.(*compiledConfig)
+		entry := map[string]interface{}{"hash": cc.hash, "config": cc.redacted}
+		if cc.err != nil {
+			entry["error"] = cc.err.Error()
+		}
+		b.Configs = append(b.Configs, entry)
+		return true
+	})
+	decisionCounts.Range(func(k, v interface{}) bool {
+		b.Decisions[string(k.(Reason))] = v.(*atomic.Int64).Load()
+		return true
+	})
+	allProviderStats.Range(func(k, v interface{}) bool {
+		stats := v.(*providerStats)
+		b.Providers[k.(string)] = map[string]int64{
+			"verified": stats.Verified.Load(),
+			"rejected": stats.Rejected.Load(),
+			"errors":   stats.Errors.Load(),
+
+			"rate_limited": stats.RateLimited.Load(),
+			"low_score":    stats.LowScore.Load(),
+
+			"breaker_failures": stats.BreakerFailures.Load(),
+			"breaker_open":     stats.BreakerOpen.Load(),
+
+			"bad_timestamps":    stats.BadTimestamps.Load(),
+			"skewed_timestamps": stats.SkewedTimestamps.Load(),
+
+			"internal_errors":        stats.InternalErrors.Load(),
+			"internal_error_retries": stats.InternalErrorRetries.Load(),
+		}
+		for i := range stats.Scores {
+			if n := stats.Scores[i].Load(); n > 0 {
+				b.Providers[k.(string)][fmt.Sprintf("score_%.1f", float64(i)/scoreBuckets)] = n
+			}
+		}
+		return true
+	})
+	for _, name := range []string{AdminListenEnv, StateDirEnv, VerifyWorkersEnv, VerifyQueueEnv, ChaosEnv, PresetsEnv} {
+		b.Environment[name] = os.Getenv(name)
+	}
+	return b
+}
+
+func handleSupportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, collectSupportBundle(time.Now()))
+}
+
+// isSupportBundleInvocation reports whether the support-bundle subcommand was requested.
+func isSupportBundleInvocation() bool {
+	return len(os.Args) > 1 && os.Args[1] == "support-bundle"
+}
+
+// runSupportBundle implements the support-bundle subcommand and returns the exit code.
+func runSupportBundle(args []string) int {
+	flags := flag.NewFlagSet("support-bundle", flag.ContinueOnError)
+	output := flags.String("o", "", "write the bundle to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	addr, token := os.Getenv(AdminListenEnv), os.Getenv(AdminTokenEnv)
+	if addr == "" || token == "" {
+		fmt.Fprintf(os.Stderr, "support-bundle: %s and %s must be set as for the running plugin server\n", AdminListenEnv, AdminTokenEnv)
+		return 1
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/support-bundle", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "support-bundle: %v\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "support-bundle: is the plugin server running? %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "support-bundle: admin endpoint answered %s\n", resp.Status)
+		return 1
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "support-bundle: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "support-bundle: %v\n", err)
+		return 1
+	}
+	return 0
+}
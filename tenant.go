@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// --- Tenants ---
+// SaaS operators front many customer domains with one route. Instead of one
+// plugin instance per domain, tenants lists per-host overrides: the first
+// entry with a pattern matching the request's Host compiles to its own
+// settings, built from the instance configuration with the entry's fields
+// replacing the instance's. Requests matching no entry use the instance
+// configuration itself.
+
+// TenantConfig overrides the instance configuration for matching hosts.
+// Empty fields keep the instance's value.
+type TenantConfig struct {
+	Name               string   `json:"name"`                 // Optional: Used in logs and the published decision. Default: first host
+	Hosts              []string `json:"hosts"`                // REQUIRED: Exact hosts or '*.example.com' (subdomains only)
+	TurnstileSecretKey string   `json:"turnstile_secret_key"` // Optional: This tenant's Turnstile secret key
+	ExpectedActions    []string `json:"expected_actions"`     // Optional: Actions this tenant's widgets use; others are rejected
+	ExpectedHostnames  []string `json:"expected_hostnames"`   // Optional: Hostnames this tenant's widgets are solved on; others are rejected
+	EnforcementMode    string   `json:"enforcement_mode"`     // Optional: 'enforce' or 'advise'
+	PassSecret         string   `json:"pass_secret"`          // Optional: Secret signing this tenant's preverify passes
+	PassTTLSeconds     int      `json:"pass_ttl_seconds"`     // Optional: Lifetime of this tenant's passes
+}
+
+// tenant is a compiled TenantConfig.
+type tenant struct {
+	name     string
+	hosts    []string // Lowercased patterns
+	settings *compiledConfig
+}
+
+// compileTenants compiles conf.Tenants into cc.tenants.
+func compileTenants(conf *Config, cc *compiledConfig) error {
+	if len(conf.Tenants) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	for i, tc := range conf.Tenants {
+		name := tc.Name
+		if name == "" && len(tc.Hosts) > 0 {
+			name = tc.Hosts[0]
+		}
+		if len(tc.Hosts) == 0 {
+			return fmt.Errorf("tenants[%d] requires hosts", i)
+		}
+
+		derived := &Config{}
+		if err := json.Unmarshal(raw, derived); err != nil {
+			return err
+		}
+		derived.Tenants = nil
+		if tc.TurnstileSecretKey != "" {
+			derived.TurnstileSecretKey = tc.TurnstileSecretKey
+		}
+		if tc.ExpectedActions != nil {
+			derived.ExpectedActions = tc.ExpectedActions
+		}
+		if tc.ExpectedHostnames != nil {
+			derived.ExpectedHostnames = tc.ExpectedHostnames
+		}
+		if tc.EnforcementMode != "" {
+			derived.EnforcementMode = tc.EnforcementMode
+		}
+		if tc.PassSecret != "" {
+			derived.PassSecret = tc.PassSecret
+		}
+		if tc.PassTTLSeconds > 0 {
+			derived.PassTTLSeconds = tc.PassTTLSeconds
+		}
+
+		t := &tenant{name: name, settings: compileConfig(derived)}
+		if t.settings.err != nil {
+			return fmt.Errorf("tenant '%s': %v", name, t.settings.err)
+		}
+		for _, host := range tc.Hosts {
+			t.hosts = append(t.hosts, strings.ToLower(strings.TrimSpace(host)))
+		}
+		cc.tenants = append(cc.tenants, t)
+	}
+	return nil
+}
+
+// hostMatches reports whether host matches an exact or '*.' pattern.
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// selectTenant switches r to the settings of the first tenant matching the
+// request's Host, if any.
+func (r *requestState) selectTenant() {
+	if len(r.settings.tenants) == 0 {
+		return
+	}
+	r.tenantsConfigured = true
+	host, err := r.kong.Request.GetHost()
+	if err != nil {
+		r.log.Warn(fmt.Sprintf("Could not get request host for tenant lookup: %v", err))
+		return
+	}
+	host = strings.ToLower(host)
+	for _, t := range r.settings.tenants {
+		for _, pattern := range t.hosts {
+			if hostMatches(pattern, host) {
+				r.log.Debug(fmt.Sprintf("Turnstile: host '%s' belongs to tenant '%s'", host, t.name))
+				r.settings, r.tenant = t.settings, t.name
+				r.log.fields += " tenant=" + t.name
+				return
+			}
+		}
+	}
+}
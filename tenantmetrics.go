@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Tenant Metrics ---
+// With tenants configured, one gateway serves many customers, and each
+// customer's pass rate and latency are reported separately: every published
+// decision is counted under its tenant, by reason, with the time from the
+// start of the Access phase to the decision. Requests of no tenant are
+// counted as DefaultTenantLabel. The tenant is also an audit field of the
+// published decision (and so of analytics records) and of log lines.
+//
+// Tenant names come from configuration, but every plugin instance can bring
+// its own; beyond maxTenantLabels distinct names, further tenants are
+// counted together as OtherTenantLabel so support bundles stay bounded.
+// GET /tenants on the admin endpoint lists the counters.
+
+const (
+	DefaultTenantLabel = "_default"
+	OtherTenantLabel   = "_other"
+	maxTenantLabels    = 200
+)
+
+// tenantMetrics counts the decisions of one tenant.
+type tenantMetrics struct {
+	allowed  atomic.Int64
+	rejected atomic.Int64
+	reasons  sync.Map // map[Reason]*atomic.Int64
+	latency  durationCounter
+}
+
+// tenantMetricsReport is the reported form of tenantMetrics.
+type tenantMetricsReport struct {
+	Allowed   int64            `json:"allowed"`
+	Rejected  int64            `json:"rejected"`
+	Decisions map[string]int64 `json:"decisions"` // By reason
+	Latency   durationStats    `json:"latency"`   // Access phase start to decision
+}
+
+var allTenantMetrics = struct {
+	sync.Mutex
+	tenants map[string]*tenantMetrics
+}{tenants: make(map[string]*tenantMetrics)}
+
+func init() {
+	adminMux.HandleFunc("/tenants", handleTenants)
+}
+
+// metricsFor returns the counters of tenant, capping the number of labels.
+func metricsFor(tenant string) *tenantMetrics {
+	allTenantMetrics.Lock()
+	defer allTenantMetrics.Unlock()
+	m, ok := allTenantMetrics.tenants[tenant]
+	if ok {
+		return m
+	}
+	if len(allTenantMetrics.tenants) >= maxTenantLabels {
+		tenant = OtherTenantLabel
+		if m, ok := allTenantMetrics.tenants[tenant]; ok {
+			return m
+		}
+	}
+	m = &tenantMetrics{}
+	allTenantMetrics.tenants[tenant] = m
+	return m
+}
+
+// countTenantDecision counts d under the request's tenant, when tenants
+// are configured.
+func (r *requestState) countTenantDecision(d decision) {
+	if !r.tenantsConfigured {
+		return
+	}
+	tenant := r.tenant
+	if tenant == "" {
+		tenant = DefaultTenantLabel
+	}
+	m := metricsFor(tenant)
+	if d.allowed {
+		m.allowed.Add(1)
+	} else {
+		m.rejected.Add(1)
+	}
+	v, _ := m.reasons.LoadOrStore(d.reason, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+	m.latency.add(time.Since(r.started))
+}
+
+// allTenantReports returns the counters of every tenant seen.
+func allTenantReports() map[string]tenantMetricsReport {
+	allTenantMetrics.Lock()
+	defer allTenantMetrics.Unlock()
+	reports := make(map[string]tenantMetricsReport, len(allTenantMetrics.tenants))
+	for name, m := range allTenantMetrics.tenants {
+		report := tenantMetricsReport{Allowed: m.allowed.Load(), Rejected: m.rejected.Load(), Decisions: make(map[string]int64), Latency: m.latency.stats()}
+		m.reasons.Range(func(k, v interface{}) bool {
+			report.Decisions[string(k.(Reason))] = v.(*atomic.Int64).Load()
+			return true
+		})
+		reports[name] = report
+	}
+	return reports
+}
+
+func handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, allTenantReports())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Threat Level ---
+// A single incident-response switch. When any configured source reports an
+// elevated level, the plugin tightens its behavior: tokens must be younger
+// than elevated_max_token_age_seconds, and features that trade strictness for
+// latency or availability are bypassed: every token goes to the provider
+// (no verification cache, failure cache, idempotent retries or verifications
+// of earlier plugin instances, see cacheStage), provider failures and 429s
+// fail closed whatever failure_mode and rate_limited_policy say, good IP
+// reputation or bot verdicts no longer skip the challenge, and neither do
+// sessions, passes, receipts, flow tokens or edge assertions (elevatedSkipped).
+// Sources are OR-ed. Forcing every request to the provider costs verify_quota
+// and provider budget, so the header is only taken from peers in
+// threat_level_header_cidrs, the direct connection as kong.client.get_ip
+// reports it; clients elsewhere cannot elevate the level.
+
+// threatFileInterval bounds how often the control file is re-read.
+const threatFileInterval = 5 * time.Second
+
+// isElevatedLevel interprets a threat level value: 'elevated', 'high',
+// 'critical' or any number above zero mean elevated.
+func isElevatedLevel(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "elevated", "high", "critical":
+		return true
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0
+}
+
+type threatFileState struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	elevated  bool
+}
+
+var threatFiles sync.Map // map[string]*threatFileState
+
+// threatFileElevated reads the control file at most every threatFileInterval.
+// A missing file means normal.
+func threatFileElevated(path string) bool {
+	v, _ := threatFiles.LoadOrStore(path, &threatFileState{})
+	state := v.(*threatFileState)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if now := clock.Now(); now.Sub(state.checkedAt) >= threatFileInterval {
+		content, err := os.ReadFile(path)
+		state.elevated = err == nil && isElevatedLevel(string(content))
+		state.checkedAt = now
+	}
+	return state.elevated
+}
+
+// elevatedSkipped are the bypass stages an elevated threat level skips.
+var elevatedSkipped = map[string]bool{
+	"edge_assertion": true,
+	"flow_token":     true,
+	"pass":           true,
+	"receipt":        true,
+	"session":        true,
+}
+
+// threatElevated reports whether any configured threat level source is
+// elevated, looking once per request.
+func (r *requestState) threatElevated() bool {
+	if !r.threatChecked {
+		r.threatValue, r.threatChecked = r.readThreatLevel(), true
+	}
+	return r.threatValue
+}
+
+func (r *requestState) readThreatLevel() bool {
+	settings := r.settings
+	if settings.threatLevelEnv != "" && isElevatedLevel(os.Getenv(settings.threatLevelEnv)) {
+		return true
+	}
+	if settings.threatLevelFile != "" && threatFileElevated(settings.threatLevelFile) {
+		return true
+	}
+	if settings.threatLevelHeader == "" {
+		return false
+	}
+	value, err := r.kong.Request.GetHeader(settings.threatLevelHeader)
+	if err != nil || !isElevatedLevel(value) {
+		return false
+	}
+	peer, err := r.kong.Client.GetIp()
+	return err == nil && ipInPrefixes(peer, settings.threatHeaderCIDRs)
+}
+
+// --- Interactive Challenge Hint ---
+// Interactive challenges take users far longer to solve than managed or
+// invisible ones, so their tokens reach us older and the elevated freshness
+// window rejects legitimate users. Frontends can flag such solves in
+// interactive_hint_header (e.g. from the widget's 'before-interactive-callback');
+// hinted requests get interactive_max_token_age_seconds instead of
+// elevated_max_token_age_seconds. The hint is client-controlled: it only
+// ever widens the window to the configured bound, and the token itself is
+// verified as usual.
+
+// interactiveHinted reports whether the request flags an interactive solve.
+func (r *requestState) interactiveHinted() bool {
+	if r.settings.interactiveHintHeader == "" {
+		return false
+	}
+	value, err := r.kong.Request.GetHeader(r.settings.interactiveHintHeader)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "interactive":
+		return true
+	}
+	return false
+}
+
+// --- Token Age ---
+// The provider accepts a token for tokenValidity (5 minutes) after the
+// challenge was solved. Where that is too long a replay window,
+// max_token_age_seconds rejects older tokens, judged by challenge_ts, with
+// reason expired at all times; while the threat level is elevated, the
+// elevated window applies unless max_token_age_seconds is tighter. A token
+// whose age is unknown (challenge_ts missing, unreadable or in the future)
+// is rejected whenever a window applies.
+
+// maxTokenAge is the freshness window applied to the request's tokens and
+// what imposes it; ok is false when token age is not checked.
+func (r *requestState) maxTokenAge() (maxAge time.Duration, cause string, ok bool) {
+	settings := r.settings
+	if r.threatElevated() {
+		maxAge = settings.elevatedMaxTokenAge
+		if r.interactiveHinted() && settings.interactiveMaxAge > maxAge {
+			maxAge = settings.interactiveMaxAge
+		}
+		if settings.maxTokenAge == 0 || settings.maxTokenAge > maxAge {
+			return maxAge, "under elevated threat level", true
+		}
+	}
+	return settings.maxTokenAge, "by max_token_age_seconds", settings.maxTokenAge > 0
+}
+
+// checkTokenAge rejects resp when it is older than the request's freshness
+// window or its age is unknown. label names the token in log lines.
+func (r *requestState) checkTokenAge(p *provider, resp *VerificationResult, label string) bool {
+	maxAge, cause, bounded := r.maxTokenAge()
+	if !bounded {
+		return true
+	}
+	age, ok := tokenAge(resp, clock.Now())
+	if ok && age <= maxAge {
+		return true
+	}
+	p.stats.Rejected.Add(1)
+	if ok {
+		r.log.Warn(fmt.Sprintf("Turnstile %s rejected %s: challenge_ts '%s' older than %s", label, cause, r.exportedField("challenge_ts", resp.challengeTs()), maxAge))
+	} else {
+		r.log.Warn(fmt.Sprintf("Turnstile %s rejected %s: challenge_ts missing, unreadable or in the future, token age unknown", label, cause))
+	}
+	r.reject(decision{status: http.StatusForbidden, reason: ReasonExpired, provider: p, response: resp}, "Verification failed")
+	return false
+}
+
+// tokenAge returns how long ago the challenge behind resp was solved.
+func tokenAge(resp *VerificationResult, now time.Time) (time.Duration, bool) {
+	if resp.IssuedAt.IsZero() {
+		return 0, false
+	}
+	return now.Sub(resp.IssuedAt), true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+// elevatedRequest carries token and, when elevated, a threat level header.
+func elevatedRequest(token string, elevated bool) test.Request {
+	headers := http.Header{DefaultTokenHeader: {token}}
+	if elevated {
+		headers.Set("X-Threat-Level", "critical")
+	}
+	return test.Request{Method: "GET", Url: "http://example.com/login", Headers: headers}
+}
+
+func TestElevatedThreatLevelBypassesVerifyCache(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.ThreatLevelHeader = "X-Threat-Level"
+	conf.ThreatLevelHeaderCIDRs = []string{"10.10.10.0/24"}
+	conf.VerifyCacheTTLSeconds = 60
+	token := "token-" + t.Name()
+
+	turnstiletest.RunAccess(t, conf, elevatedRequest(token, false))
+	if env := turnstiletest.RunAccess(t, conf, elevatedRequest(token, false)); decisionReason(t, env) != string(ReasonCacheHit) {
+		t.Fatalf("resent token not served from the cache: %s", decisionReason(t, env))
+	}
+	env := turnstiletest.RunAccess(t, conf, elevatedRequest(token, true))
+	if got := decisionReason(t, env); got != string(ReasonVerified) {
+		t.Errorf("reason under elevated threat level = %q, want %q", got, ReasonVerified)
+	}
+	if calls := len(srv.Calls()); calls != 2 {
+		t.Errorf("siteverify called %d times, want 2", calls)
+	}
+}
+
+func TestElevatedThreatLevelFailsClosed(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       func(c *Config)
+		reply      turnstiletest.Reply
+		wantStatus int
+		wantReason Reason
+	}{
+		{"failure_mode open", func(c *Config) { c.FailureMode = "open" },
+			turnstiletest.ServerError(http.StatusInternalServerError), http.StatusBadGateway, ReasonProviderError},
+		{"rate_limited_policy fail_open", func(c *Config) { c.RateLimitedPolicy = "fail_open" },
+			turnstiletest.Reply{Status: http.StatusTooManyRequests, Body: "{}"}, http.StatusServiceUnavailable, ReasonProviderRateLimited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, elevated := range []bool{false, true} {
+				srv := turnstiletest.NewServer(t)
+				srv.SetDefault(tt.reply)
+				conf := New().(*Config)
+				conf.TurnstileSecretKey = "secret"
+				conf.TurnstileVerifyURL = srv.URL()
+				conf.ThreatLevelHeader = "X-Threat-Level"
+				conf.ThreatLevelHeaderCIDRs = []string{"10.10.10.0/24"}
+				tt.conf(conf)
+
+				env := turnstiletest.RunAccess(t, conf, elevatedRequest("token-"+t.Name(), elevated))
+				if !elevated {
+					if got := decisionReason(t, env); got != string(ReasonFailOpen) {
+						t.Fatalf("reason at normal threat level = %q, want %q", got, ReasonFailOpen)
+					}
+					continue
+				}
+				if env.ClientRes.Status != tt.wantStatus {
+					t.Errorf("status under elevated threat level = %d, want %d", env.ClientRes.Status, tt.wantStatus)
+				}
+				if got := decisionReason(t, env); got != string(tt.wantReason) {
+					t.Errorf("reason under elevated threat level = %q, want %q", got, tt.wantReason)
+				}
+			}
+		})
+	}
+}
+
+func TestThreatLevelHeaderOnlyFromTrustedPeers(t *testing.T) {
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.ThreatLevelHeader = "X-Threat-Level"
+	if conf.settings().err == nil {
+		t.Error("threat_level_header accepted without threat_level_header_cidrs")
+	}
+
+	srv := turnstiletest.NewServer(t)
+	conf = New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.ThreatLevelHeader = "X-Threat-Level"
+	conf.ThreatLevelHeaderCIDRs = []string{"192.0.2.0/24"} // The test peer is 10.10.10.1
+	conf.VerifyCacheTTLSeconds = 60
+	token := "token-" + t.Name()
+
+	turnstiletest.RunAccess(t, conf, elevatedRequest(token, false))
+	env := turnstiletest.RunAccess(t, conf, elevatedRequest(token, true))
+	if got := decisionReason(t, env); got != string(ReasonCacheHit) {
+		t.Errorf("reason with the header from an untrusted peer = %q, want %q", got, ReasonCacheHit)
+	}
+}
+
+func TestElevatedThreatLevelIgnoresPasses(t *testing.T) {
+	srv := turnstiletest.NewServer(t)
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL()
+	conf.PassSecret = "pass-secret"
+	conf.ThreatLevelHeader = "X-Threat-Level"
+	conf.ThreatLevelHeaderCIDRs = []string{"10.10.10.0/24"}
+
+	for _, elevated := range []bool{false, true} {
+		payload, _ := json.Marshal(passPayload{Type: passType, ID: newUUID(), Expires: time.Now().Add(time.Minute).Unix()})
+		req := elevatedRequest("", elevated)
+		req.Headers.Del(DefaultTokenHeader)
+		req.Headers.Set("X-Turnstile-Pass", conf.settings().passKeys.sign(payload))
+
+		env := turnstiletest.RunAccess(t, conf, req)
+
+		want := string(ReasonPass)
+		if elevated {
+			want = string(ReasonMissingToken)
+		}
+		if got := decisionReason(t, env); got != want {
+			t.Errorf("elevated %v: reason = %q, want %q", elevated, got, want)
+		}
+	}
+}
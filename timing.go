@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Stage Timings ---
+// Every stage of the policy chain (see chain.go) is timed, so a slow
+// request shows whether the time went to reading the body (extraction),
+// cache lookups or the provider (verification). Stages run inside another
+// stage, the token stages of the preverify endpoint, are named
+// "preverify/extraction" and so on. The timings of a request up to its
+// decision are published with the decision as "timings_ms" (and so reach
+// analytics_url), logged at debug level with the trace correlation fields,
+// and sent in a Server-Timing header to clients allowed by
+// debug_passthrough_cidrs. Support bundles aggregate them per stage.
+
+// stageTiming is the duration of one stage of a request.
+type stageTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// durationStats aggregates durations, e.g. of one stage.
+type durationStats struct {
+	Count   int64   `json:"count"`
+	TotalMs float64 `json:"total_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// durationCounter aggregates durations concurrently.
+type durationCounter struct {
+	count atomic.Int64
+	total atomic.Int64 // Nanoseconds
+	max   atomic.Int64
+}
+
+func (c *durationCounter) add(d time.Duration) {
+	c.count.Add(1)
+	c.total.Add(int64(d))
+	for {
+		longest := c.max.Load()
+		if int64(d) <= longest || c.max.CompareAndSwap(longest, int64(d)) {
+			break
+		}
+	}
+}
+
+func (c *durationCounter) stats() durationStats {
+	return durationStats{Count: c.count.Load(), TotalMs: durationMs(time.Duration(c.total.Load())), MaxMs: durationMs(time.Duration(c.max.Load()))}
+}
+
+var allStageCounters sync.Map // map[string]*durationCounter
+
+// startStage makes name the running stage, returning the one it interrupts.
+func (r *requestState) startStage(name string) (outer stageTiming, outerStarted time.Time) {
+	outer, outerStarted = r.currentStage, r.stageStarted
+	if outer.name != "" {
+		name = outer.name + "/" + name
+	}
+	r.currentStage, r.stageStarted = stageTiming{name: name}, time.Now()
+	return outer, outerStarted
+}
+
+// endStage records the running stage and resumes outer.
+func (r *requestState) endStage(outer stageTiming, outerStarted time.Time) {
+	stage := r.currentStage
+	stage.duration = time.Since(r.stageStarted)
+	r.timings = append(r.timings, stage)
+	r.currentStage, r.stageStarted = outer, outerStarted
+
+	v, _ := allStageCounters.LoadOrStore(stage.name, &durationCounter{})
+	v.(*durationCounter).add(stage.duration)
+}
+
+// timingsSoFar returns the finished stages of the request and the running
+// one up to now.
+func (r *requestState) timingsSoFar() []stageTiming {
+	timings := append([]stageTiming(nil), r.timings...)
+	if r.currentStage.name != "" {
+		timings = append(timings, stageTiming{name: r.currentStage.name, duration: time.Since(r.stageStarted)})
+	}
+	return timings
+}
+
+// publishTimings adds the request's timings to a decision being published.
+func (r *requestState) publishTimings(value map[string]interface{}) {
+	timings := r.timingsSoFar()
+	if len(timings) == 0 {
+		return
+	}
+	ms := make(map[string]interface{}, len(timings))
+	parts := make([]string, len(timings))
+	for i, t := range timings {
+		ms[t.name] = durationMs(t.duration)
+		parts[i] = fmt.Sprintf("%s=%.3fms", t.name, durationMs(t.duration))
+	}
+	value["timings_ms"] = ms
+	r.log.Debug("Turnstile stage timings: " + strings.Join(parts, " "))
+}
+
+// serverTiming renders the request's timings as a Server-Timing header.
+func (r *requestState) serverTiming() string {
+	timings := r.timingsSoFar()
+	parts := make([]string, len(timings))
+	for i, t := range timings {
+		parts[i] = fmt.Sprintf("turnstile-%s;dur=%.3f", strings.ReplaceAll(t.name, "/", "-"), durationMs(t.duration))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// addServerTiming sends the request's timings to debug clients, in headers
+// of a response the plugin sends or on the proxied response.
+func (r *requestState) addServerTiming(headers map[string][]string) {
+	if len(r.timingsSoFar()) == 0 || !r.debugPassthroughAllowed() {
+		return
+	}
+	timing := r.serverTiming()
+	if headers != nil {
+		headers["Server-Timing"] = append(headers["Server-Timing"], timing)
+		return
+	}
+	if err := r.kong.Response.AddHeader("Server-Timing", timing); err != nil {
+		r.log.Warn(fmt.Sprintf("Could not add Server-Timing to the response: %v", err))
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// allStageTimings returns the aggregated timings of every stage.
+func allStageTimings() map[string]durationStats {
+	stats := make(map[string]durationStats)
+	allStageCounters.Range(func(k, v interface{}) bool {
+		stats[k.(string)] = v.(*durationCounter).stats()
+		return true
+	})
+	return stats
+}
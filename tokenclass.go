@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// --- Token Rejection Classes ---
+// A rejected token points at very different client problems: no token means
+// the widget never ran or the integration puts it in the wrong place, a
+// malformed one means the client mangles it (truncation, double encoding,
+// a placeholder value), and one the provider calls expired means users
+// solve the challenge and then wait too long or resubmit. Each class has its
+// own reason, so it is counted separately in the decision counts of support
+// bundles, analytics and failure counters, and its own optional status:
+//
+//	missing_token    challenge_status        Default: 400
+//	malformed_token  malformed_token_status  Default: 400
+//	invalid_token    invalid_token_status    Default: 403
+//	expired          expired_token_status    Default: 403
+//
+// Malformed tokens are caught before the provider is asked: tokens longer
+// than max_token_length or containing whitespace, control or non-ASCII
+// characters. The provider reports a token as expired (or already redeemed)
+// with 'timeout-or-duplicate'; any other error code keeps invalid_token.
+
+// ProviderExpiredCode is the error code with which providers report expired
+// or already redeemed tokens.
+const ProviderExpiredCode = "timeout-or-duplicate"
+
+// maxTokenLength returns the longest token accepted for p.
+func (r *requestState) maxTokenLength(p *provider) int {
+	if r.settings.maxTokenLength > 0 {
+		return r.settings.maxTokenLength
+	}
+	return p.kind.maxTokenLength() // reCAPTCHA and hCaptcha tokens run longer
+}
+
+// malformedToken describes why token cannot be a token of p, or returns ""
+// when it may be one.
+func (r *requestState) malformedToken(p *provider, token string) string {
+	if limit := r.maxTokenLength(p); len(token) > limit {
+		return fmt.Sprintf("%d characters, longer than %d", len(token), limit)
+	}
+	for i := 0; i < len(token); i++ {
+		if c := token[i]; c <= ' ' || c > '~' {
+			return fmt.Sprintf("unexpected byte 0x%02x at offset %d", c, i)
+		}
+	}
+	return ""
+}
+
+// providerRejection returns the reason for a token the provider answered
+// with success=false.
+func providerRejection(resp *VerificationResult) Reason {
+	if len(resp.ErrorCodes) > 0 && !slices.ContainsFunc(resp.ErrorCodes, func(code string) bool { return code != ProviderExpiredCode }) {
+		return ReasonExpired
+	}
+	return ReasonInvalidToken
+}
+
+// compileTokenStatuses maps the rejection classes to their configured
+// statuses.
+func compileTokenStatuses(conf *Config) (map[Reason]int, error) {
+	statuses := make(map[Reason]int)
+	for _, s := range []struct {
+		name   string
+		reason Reason
+		status int
+	}{
+		{"challenge_status", ReasonMissingToken, conf.ChallengeStatus},
+		{"malformed_token_status", ReasonMalformedToken, conf.MalformedTokenStatus},
+		{"invalid_token_status", ReasonInvalidToken, conf.InvalidTokenStatus},
+		{"expired_token_status", ReasonExpired, conf.ExpiredTokenStatus},
+	} {
+		if s.status == 0 {
+			continue
+		}
+		if s.status < 400 || s.status > 499 {
+			return nil, fmt.Errorf("invalid %s configured: %d. Use a 4xx status", s.name, s.status)
+		}
+		statuses[s.reason] = s.status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Kong/go-pdk"
+)
+
+// --- Trace Correlation ---
+// When the request carries a W3C trace context, every plugin log line and
+// published decision includes its trace_id and span_id, so logs, traces and
+// decisions can be joined in the observability stack.
+
+// traceContext holds the identifiers of an incoming traceparent header.
+type traceContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool // The caller records the trace, see tracing.go
+}
+
+func (t traceContext) valid() bool { return t.TraceID != "" }
+
+// isLowerHex reports whether s consists of n lowercase hex digits that are not all zero.
+func isLowerHex(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent parses "version-traceid-spanid-flags"; anything malformed
+// yields the zero traceContext.
+func parseTraceparent(header string) traceContext {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceContext{}
+	}
+	if !isLowerHex(parts[1], 32) || !isLowerHex(parts[2], 16) {
+		return traceContext{}
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 {
+		return traceContext{}
+	}
+	return traceContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags&1 == 1}
+}
+
+// requestLog wraps kong.Log, appending trace correlation fields to every line.
+type requestLog struct {
+	kong   *pdk.PDK
+	fields string // " trace_id=... span_id=..." or empty
+}
+
+func newRequestLog(kong *pdk.PDK, trace traceContext) requestLog {
+	l := requestLog{kong: kong}
+	if trace.valid() {
+		l.fields = fmt.Sprintf(" trace_id=%s span_id=%s", trace.TraceID, trace.SpanID)
+	}
+	return l
+}
+
+func (l requestLog) Err(msg string)   { l.kong.Log.Err(msg + l.fields) }
+func (l requestLog) Warn(msg string)  { l.kong.Log.Warn(msg + l.fields) }
+func (l requestLog) Info(msg string)  { l.kong.Log.Info(msg + l.fields) }
+func (l requestLog) Debug(msg string) { l.kong.Log.Debug(msg + l.fields) }
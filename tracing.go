@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Verification Tracing ---
+// With otlp_traces_url set, every siteverify call becomes an OpenTelemetry
+// span, exported as OTLP/HTTP JSON to a collector, e.g.
+// 'http://otel-collector:4318/v1/traces', so verification latency shows up
+// inside the distributed traces it belongs to. When the request carries a
+// W3C traceparent (see trace.go), the span is a child of its span and is
+// exported only if the caller sampled the trace; requests without one start
+// a new trace for otlp_sample_percent of them (default none). The span,
+// named "turnstile siteverify" with kind client, covers the call itself,
+// without the wait for a verification worker, and carries:
+//
+//	turnstile.provider, turnstile.token_hash   provider name and SHA-256 of the token
+//	server.address, http.request.method        the verification endpoint
+//	turnstile.success                          the provider's verdict
+//	turnstile.hostname, turnstile.action,      only while exported_response_fields lists them
+//	turnstile.error_codes
+//
+// Failed calls have status ERROR with the error message. The trace context
+// is not forwarded to the provider. Spans are queued in memory (see
+// sinkqueue.go) and sent in batches by one exporter per URL; batches the
+// collector does not accept are dropped.
+
+const (
+	DefaultOTLPServiceName = "kong-turnstile-plugin"
+	otlpQueueSize          = 10000
+	otlpBatchSize          = 512
+	otlpFlushInterval      = 5 * time.Second
+	otlpSpanKindClient     = 3
+	otlpStatusOK           = 1
+	otlpStatusError        = 2
+)
+
+// verifySpan is a siteverify call being traced. The worker running the call
+// sets start and end.
+type verifySpan struct {
+	traceID, spanID, parentSpanID string
+	start, end                    time.Time
+}
+
+// spanExporter batches spans for one collector.
+type spanExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *httpClient
+	queue   *sinkQueue[otlpSpan]
+}
+
+// spanExporters holds one exporter per collector URL and service name.
+var spanExporters sync.Map // map[string]*spanExporter
+
+// otlpSpan is a span in OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string    `json:"stringValue,omitempty"`
+	BoolValue   *bool      `json:"boolValue,omitempty"`
+	ArrayValue  *otlpArray `json:"arrayValue,omitempty"`
+}
+
+type otlpArray struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func compileTracing(conf *Config, clients map[string]*httpClient) (*spanExporter, error) {
+	if _, err := url.ParseRequestURI(conf.OTLPTracesURL); err != nil {
+		return nil, fmt.Errorf("invalid otlp_traces_url configured: %v", err)
+	}
+	client, err := resolveHTTPClient(clients, "otlp_http_client", conf.OTLPHTTPClient,
+		defaultHTTPClient("otlp", 10*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	e := &spanExporter{url: conf.OTLPTracesURL, headers: conf.OTLPHeaders, service: conf.OTLPServiceName, client: client}
+	if e.service == "" {
+		e.service = DefaultOTLPServiceName
+	}
+	e.queue = newSinkQueue[otlpSpan]("otlp:"+e.url, otlpQueueSize, nil)
+	actual, loaded := spanExporters.LoadOrStore(e.url+"\x00"+e.service, e)
+	if !loaded {
+		e.queue.register()
+		go e.loop()
+	}
+	return actual.(*spanExporter), nil
+}
+
+// newVerifySpan starts tracing a siteverify call of the request, or returns
+// nil when the request is not traced.
+func (r *requestState) newVerifySpan() *verifySpan {
+	settings := r.settings
+	if settings.tracing == nil {
+		return nil
+	}
+	if !r.spanTraceDecided {
+		r.spanTraceDecided = true
+		switch {
+		case r.trace.valid() && r.trace.Sampled:
+			r.spanTrace = r.trace
+		case !r.trace.valid() && settings.otlpSamplePercent > 0 && rand.Float64()*100 < settings.otlpSamplePercent:
+			r.spanTrace = traceContext{TraceID: randomID()}
+		}
+	}
+	if !r.spanTrace.valid() {
+		return nil
+	}
+	return &verifySpan{traceID: r.spanTrace.TraceID, spanID: randomID()[:16], parentSpanID: r.spanTrace.SpanID}
+}
+
+// endVerifySpan exports span with the outcome of its call.
+func (r *requestState) endVerifySpan(span *verifySpan, p *provider, token string, resp *VerificationResult, verr *verifyError) {
+	if span == nil || span.start.IsZero() { // Never reached a worker
+		return
+	}
+	server := p.verifyURL
+	if u, err := url.Parse(p.verifyURL); err == nil {
+		server = u.Hostname()
+	}
+	s := otlpSpan{
+		TraceID:           span.traceID,
+		SpanID:            span.spanID,
+		ParentSpanID:      span.parentSpanID,
+		Name:              "turnstile siteverify",
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("turnstile.provider", p.name),
+			stringAttribute("turnstile.token_hash", tokenHash(token)),
+			stringAttribute("server.address", server),
+			stringAttribute("http.request.method", http.MethodPost),
+		},
+		Status: otlpStatus{Code: otlpStatusOK},
+	}
+	if verr != nil {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: verr.msg}
+	}
+	if resp != nil {
+		fields := r.settings.exportedFields
+		success := resp.Success
+		s.Attributes = append(s.Attributes, otlpAttribute{Key: "turnstile.success", Value: otlpValue{BoolValue: &success}})
+		if fields["hostname"] {
+			s.Attributes = append(s.Attributes, stringAttribute("turnstile.hostname", resp.Hostname))
+		}
+		if fields["action"] {
+			s.Attributes = append(s.Attributes, stringAttribute("turnstile.action", resp.Action))
+		}
+		if fields["error_codes"] && len(resp.ErrorCodes) > 0 {
+			codes := &otlpArray{}
+			for _, code := range resp.ErrorCodes {
+				codes.Values = append(codes.Values, otlpValue{StringValue: &code})
+			}
+			s.Attributes = append(s.Attributes, otlpAttribute{Key: "turnstile.error_codes", Value: otlpValue{ArrayValue: codes}})
+		}
+	}
+	r.settings.tracing.queue.put(s, r.settings.sinkOverflow)
+}
+
+// verifyCall runs one siteverify call on the worker pool and traces it.
+func (r *requestState) verifyCall(p *provider, token, clientIP string) (*VerificationResult, *verifyError) {
+	span := r.newVerifySpan()
+	result := <-verifyWorkers.startTraced(r.settings, p, token, clientIP, span)
+	r.endVerifySpan(span, p, token, result.resp, result.err)
+	return result.resp, result.err
+}
+
+func (e *spanExporter) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("turnstile: exporting %d spans to %s failed: %v", len(batch), e.url, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.queue.items:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send posts one batch as an OTLP ExportTraceServiceRequest.
+func (e *spanExporter) send(spans []otlpSpan) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttribute{stringAttribute("service.name", e.service)}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": DefaultOTLPServiceName, "version": PluginVersion},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range e.headers {
+			req.Header.Set(name, value)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, snippet)
+	}
+	return nil
+}
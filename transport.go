@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// --- Strict Transport ---
+// A token sent over plain HTTP can be read on the way and replayed before
+// the client redeems it, and a token submitted from a foreign page was
+// likely lifted from the site's widget. Both checks are opt-in and apply to
+// requests carrying a token, before it is verified:
+//
+//   - require_https rejects tokens that reached Kong (or, through Kong's
+//     trusted_ips, the load balancer in front of it) over plain HTTP, with
+//     reason insecure_transport.
+//   - allowed_origins rejects tokens from requests whose origin is missing
+//     or not listed, with reason origin_not_allowed. Entries are origins as
+//     browsers send them ("https://shop.example.com"); a leading "*." in the
+//     host allows its subdomains ("https://*.example.com").
+//
+// The origin is taken from the Origin header, or, as browsers leave it out
+// of same-origin GET requests, from the Referer. siteverify's hostname only
+// tells where the widget ran; a token lifted from the site's page verifies
+// fine when submitted from anywhere, so the origin is checked even though
+// the token would verify. Batch requests are checked once for all items.
+//
+// Neither is a client failure (see isClientFailure): solving the challenge
+// again does not fix them, so they are rejected in enforcement_mode
+// 'advise' as well.
+
+// normalizeOrigin reduces an origin to lowercase scheme://host[:port],
+// dropping default ports. It returns "" for anything that is not an origin,
+// including the opaque origin "null".
+func normalizeOrigin(origin string) string {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return u.Scheme + "://" + host
+}
+
+// compileOrigins normalizes allowed_origins.
+func compileOrigins(origins []string) ([]string, error) {
+	compiled := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		// The wildcard is swapped for a label while parsing
+		placeholder := strings.Replace(origin, "://*.", "://x--wildcard--x.", 1)
+		u, err := url.Parse(placeholder)
+		normalized := normalizeOrigin(placeholder)
+		if err != nil || normalized == "" || strings.Contains(normalized, "*") || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid allowed_origins entry '%s'. Use e.g. 'https://example.com' or 'https://*.example.com'", origin)
+		}
+		compiled = append(compiled, strings.Replace(normalized, "://x--wildcard--x.", "://*.", 1))
+	}
+	return compiled, nil
+}
+
+// originAllowed reports whether the normalized origin matches an entry of
+// allowed.
+func originAllowed(origin string, allowed []string) bool {
+	for _, entry := range allowed {
+		if prefix, suffix, wildcard := strings.Cut(entry, "*"); wildcard {
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				!strings.Contains(strings.TrimSuffix(strings.TrimPrefix(origin, prefix), suffix), "/") {
+				return true
+			}
+			continue
+		}
+		if origin == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the normalized origin of the request, and where it
+// came from for log lines.
+func (r *requestState) requestOrigin() (origin, source string) {
+	if header, err := r.kong.Request.GetHeader("Origin"); err == nil && header != "" {
+		return normalizeOrigin(header), fmt.Sprintf("Origin '%s'", header) // "null" stays unusable, no fallback
+	}
+	if referer, err := r.kong.Request.GetHeader("Referer"); err == nil && referer != "" {
+		origin = normalizeOrigin(referer)
+		return origin, fmt.Sprintf("Referer origin '%s'", origin)
+	}
+	return "", "no Origin or Referer"
+}
+
+// transportStage applies require_https and allowed_origins.
+func (r *requestState) transportStage(v *verification) bool {
+	settings := r.settings
+	if settings.requireHTTPS {
+		if scheme, err := r.kong.Request.GetForwardedScheme(); err != nil || !strings.EqualFold(scheme, "https") {
+			r.log.Warn(fmt.Sprintf("Turnstile token rejected: submitted over '%s', require_https is set", scheme))
+			r.reject(decision{status: http.StatusForbidden, reason: ReasonInsecureTransport, provider: v.provider}, "Turnstile token must be submitted over HTTPS")
+			return false
+		}
+	}
+	if len(settings.allowedOrigins) > 0 {
+		origin, source := r.requestOrigin()
+		if origin == "" || !originAllowed(origin, settings.allowedOrigins) {
+			r.log.Warn(fmt.Sprintf("Turnstile token rejected: %s not in allowed_origins", source))
+			r.reject(decision{status: http.StatusForbidden, reason: ReasonOriginNotAllowed, provider: v.provider}, "Origin not allowed")
+			return false
+		}
+	}
+	return true
+}
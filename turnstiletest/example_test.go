@@ -0,0 +1,65 @@
+package turnstiletest_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+// answer is the part of a siteverify answer the examples print.
+type answer struct {
+	Success     bool     `json:"success"`
+	ChallengeTs string   `json:"challenge_ts"`
+	ErrorCodes  []string `json:"error-codes"`
+}
+
+func siteverify(srv *turnstiletest.Server, token string) answer {
+	resp, err := http.PostForm(srv.URL(), url.Values{"secret": {"secret"}, "response": {token}})
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	var a answer
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func ExampleServer() {
+	srv := turnstiletest.StartServer()
+	defer srv.Close()
+	srv.Enqueue(turnstiletest.Failure("timeout-or-duplicate"))
+
+	first := siteverify(srv, "token-1")
+	second := siteverify(srv, "token-2") // The script is exhausted: Success
+
+	fmt.Println(first.Success, first.ErrorCodes)
+	fmt.Println(second.Success, second.ErrorCodes)
+	for _, call := range srv.Calls() {
+		fmt.Println(call.Secret, call.Response)
+	}
+	// Output:
+	// false [timeout-or-duplicate]
+	// true []
+	// secret token-1
+	// secret token-2
+}
+
+func ExampleClock() {
+	clk := turnstiletest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	srv := turnstiletest.StartServer()
+	defer srv.Close()
+	srv.UseClock(clk)
+
+	fmt.Println(siteverify(srv, "token").ChallengeTs)
+	clk.Advance(time.Hour)
+	fmt.Println(siteverify(srv, "token").ChallengeTs)
+	// Output:
+	// 2025-01-01T00:00:00Z
+	// 2025-01-01T01:00:00Z
+}
@@ -0,0 +1,306 @@
+// Package turnstiletest helps writing regression tests for Turnstile plugin
+// configurations without Cloudflare: Server is a scriptable stand-in for the
+// siteverify API, and RunAccess runs the plugin's Access phase on the go-pdk
+// test framework.
+//
+// A typical test in the plugin package looks like:
+//
+//	srv := turnstiletest.NewServer(t)
+//	srv.Enqueue(turnstiletest.Failure("timeout-or-duplicate"))
+//
+//	conf := New().(*Config)
+//	conf.TurnstileSecretKey = "secret"
+//	conf.TurnstileVerifyURL = srv.URL()
+//
+//	env := turnstiletest.RunAccess(t, conf, test.Request{
+//		Method:  "GET",
+//		Url:     "http://example.com/login",
+//		Headers: http.Header{"Cf-Turnstile-Response": {"token"}},
+//	})
+//	if env.ClientRes.Status != http.StatusForbidden { ... }
+//
+// Expiry behavior is tested with a Clock instead of sleeps. Server stamps
+// challenge_ts from a Clock once UseClock is called:
+//
+//	clk := turnstiletest.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+//	srv.UseClock(clk)
+//	...
+//	clk.Advance(time.Hour) // Tokens now look an hour old
+//
+// A Clock satisfies the plugin's Clock interface (see clock.go), so tests in
+// the plugin package can also have the plugin read the time from it and see
+// cached verifications, passes and sessions expire. Outside of tests, e.g.
+// in a harness of its own, StartServer runs a Server without a testing.TB.
+package turnstiletest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+// Reply scripts one answer of the mock siteverify API.
+type Reply struct {
+	Status      int           // HTTP status. Default: 200
+	Delay       time.Duration // Wait before answering, e.g. to trigger timeouts
+	Body        string        // Raw body, replacing the JSON built from the fields below
+	RetryAfter  string        // Retry-After header, if any
+	Success     bool
+	ErrorCodes  []string
+	Hostname    string
+	Action      string
+	CData       string
+	ChallengeTs string // Default: the time of the call
+}
+
+// Success is a successful verification for hostname "example.com".
+func Success() Reply {
+	return Reply{Success: true, Hostname: "example.com"}
+}
+
+// Failure is a failed verification with the given error codes.
+func Failure(codes ...string) Reply {
+	return Reply{ErrorCodes: codes}
+}
+
+// ServerError is a non-200 answer with an HTML body, like a failing proxy would send.
+func ServerError(status int) Reply {
+	return Reply{Status: status, Body: "<html><body>upstream error</body></html>"}
+}
+
+// RateLimited is a 429 answer with the given Retry-After header value.
+func RateLimited(retryAfter string) Reply {
+	return Reply{Status: http.StatusTooManyRequests, Body: `{"success":false,"error-codes":["rate-limited"]}`, RetryAfter: retryAfter}
+}
+
+// Call records one request received by the mock.
+type Call struct {
+	Secret   string
+	Response string // The token
+	RemoteIP string
+}
+
+// Server is a mock siteverify API. Scripted replies are consumed in order;
+// once exhausted, the default reply (Success unless changed) is used.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	script   []Reply
+	fallback Reply
+	calls    []Call
+	clock    *Clock
+}
+
+// NewServer starts a mock siteverify API that is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	s := StartServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// StartServer starts a mock siteverify API; the caller closes it.
+func StartServer() *Server {
+	s := &Server{fallback: Success()}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL returns the verification endpoint, suitable for turnstile_verify_url.
+func (s *Server) URL() string {
+	return s.Server.URL + "/turnstile/v0/siteverify"
+}
+
+// Enqueue appends replies to the script.
+func (s *Server) Enqueue(replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, replies...)
+}
+
+// SetDefault sets the reply used once the script is exhausted.
+func (s *Server) SetDefault(r Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = r
+}
+
+// UseClock makes default challenge_ts values come from c rather than the
+// system clock.
+func (s *Server) UseClock(c *Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
+// Calls returns the requests received so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+func (s *Server) next(call Call) Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+	if len(s.script) == 0 {
+		return s.fallback
+	}
+	r := s.script[0]
+	s.script = s.script[1:]
+	return r
+}
+
+func (s *Server) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		// Connection warm-up probes neither consume the script nor count as calls
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	now := time.Now()
+	if s.clock != nil {
+		now = s.clock.Now()
+	}
+	s.mu.Unlock()
+	r := s.next(Call{
+		Secret:   req.PostForm.Get("secret"),
+		Response: req.PostForm.Get("response"),
+		RemoteIP: req.PostForm.Get("remoteip"),
+	})
+
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	body := []byte(r.Body)
+	if r.Body == "" {
+		if r.ChallengeTs == "" {
+			r.ChallengeTs = now.UTC().Format(time.RFC3339)
+		}
+		errorCodes := r.ErrorCodes
+		if errorCodes == nil {
+			errorCodes = []string{}
+		}
+		body, _ = json.Marshal(map[string]interface{}{
+			"success":      r.Success,
+			"challenge_ts": r.ChallengeTs,
+			"hostname":     r.Hostname,
+			"error-codes":  errorCodes,
+			"action":       r.Action,
+			"cdata":        r.CData,
+		})
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if r.RetryAfter != "" {
+		w.Header().Set("Retry-After", r.RetryAfter)
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	w.WriteHeader(r.Status)
+	_, _ = w.Write(body)
+}
+
+// Clock is a clock that only moves when told to. It satisfies the plugin's
+// Clock interface.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock standing at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// RunAccess runs the Access phase of plugin (the configured value returned
+// by the plugin's New) for req and returns the test environment, whose
+// ClientRes holds the response when the plugin ended the request and whose
+// ServiceReq holds the request as it would be proxied otherwise. The go-pdk
+// test framework records upstream body rewrites (e.g. by strip_token) in
+// ServiceRes.Body rather than ServiceReq.Body.
+func RunAccess(t *testing.T, plugin interface{}, req test.Request) *test.TestEnv {
+	t.Helper()
+	if req.Headers == nil {
+		req.Headers = make(http.Header)
+	}
+	env, err := test.New(t, req)
+	if err != nil {
+		t.Fatalf("turnstiletest: invalid request: %v", err)
+	}
+	env.DoAccess(plugin)
+	return env
+}
+
+// Rejected reports whether the plugin ended the request instead of letting
+// it through to the service.
+func Rejected(env *test.TestEnv) bool {
+	return !env.IsRunning()
+}
+
+// Compress encodes s as a compressing proxy in front of siteverify would:
+// encoding is 'gzip', 'zlib' (Content-Encoding deflate as specified) or
+// 'flate' (raw deflate, as sent by some servers for deflate).
+func Compress(t testing.TB, encoding, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		t.Fatalf("turnstiletest: unknown encoding %q", encoding)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// --- Upstream Header Templates ---
+// score_header, verified_identity_header and fail_open_header each pass one
+// fixed value upstream. upstream_headers maps any number of header names to
+// Go text/templates rendered per allowed request with upstreamHeaderData:
+//
+//	upstream_headers:
+//	  X-Verified: '{{.Hostname}}/{{.Action}}'
+//	  X-Turnstile-Via: '{{.Provider}} {{.Reason}}'
+//
+// siteverify fields are only filled in while exported_response_fields lists
+// them, and are empty for requests let through without a verification (e.g.
+// reason pass or session). Headers rendering empty are not set. Client values
+// of every listed header are removed, and line breaks in rendered values are
+// replaced by spaces.
+
+// upstreamHeaderData is what upstream_headers templates can use.
+type upstreamHeaderData struct {
+	Reason      string // Decision reason, e.g. 'verified' or 'cache_hit'
+	Provider    string // Provider name, if one verified the token
+	Tenant      string // Selected tenant, if any
+	Hostname    string // Hostname the challenge was solved on
+	Action      string // Widget action
+	CData       string // Customer data passed to the widget
+	ChallengeTs string // When the challenge was solved, RFC 3339
+	Score       string // Enterprise score, e.g. '0.9'
+	TraceID     string // From the request's traceparent header, if any
+}
+
+// upstreamHeader is one compiled upstream_headers entry.
+type upstreamHeader struct {
+	name  string
+	value *template.Template
+}
+
+// compileUpstreamHeaders validates and compiles upstream_headers, sorted by name.
+func compileUpstreamHeaders(headers map[string]string) ([]upstreamHeader, error) {
+	compiled := make([]upstreamHeader, 0, len(headers))
+	for name, text := range headers {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " :\r\n") {
+			return nil, fmt.Errorf("invalid upstream_headers entry '%s': not a header name", name)
+		}
+		value, err := template.New(name).Parse(text)
+		if err == nil {
+			err = value.Execute(io.Discard, upstreamHeaderData{}) // Catches unknown fields now
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_headers.%s: %v", name, err)
+		}
+		compiled = append(compiled, upstreamHeader{name: name, value: value})
+	}
+	slices.SortFunc(compiled, func(a, b upstreamHeader) int { return strings.Compare(a.name, b.name) })
+	return compiled, nil
+}
+
+// clearUpstreamHeaders drops client-supplied upstream_headers.
+func (r *requestState) clearUpstreamHeaders() {
+	for _, header := range r.settings.upstreamHeaders {
+		if err := r.kong.ServiceRequest.ClearHeader(header.name); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header.name, err))
+		}
+	}
+}
+
+// setUpstreamHeaders renders upstream_headers for an allowed decision.
+func (r *requestState) setUpstreamHeaders(d decision) {
+	headers := r.settings.upstreamHeaders
+	if len(headers) == 0 || !d.allowed {
+		return
+	}
+	data := upstreamHeaderData{Reason: string(d.reason), Tenant: r.tenant, TraceID: r.trace.TraceID}
+	if d.provider != nil {
+		data.Provider = d.provider.name
+	}
+	if resp, fields := d.response, r.settings.exportedFields; resp != nil {
+		if fields["hostname"] {
+			data.Hostname = resp.Hostname
+		}
+		if fields["action"] {
+			data.Action = resp.Action
+		}
+		if fields["cdata"] {
+			data.CData = resp.CData
+		}
+		if fields["challenge_ts"] {
+			data.ChallengeTs = resp.challengeTs()
+		}
+		if fields["score"] && resp.Score != nil {
+			data.Score = formatScore(*resp.Score)
+		}
+	}
+	for _, header := range headers {
+		var rendered bytes.Buffer
+		if err := header.value.Execute(&rendered, data); err != nil {
+			r.log.Warn(fmt.Sprintf("Turnstile upstream header %s failed, not set: %v", header.name, err))
+			continue
+		}
+		value := strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(rendered.String())
+		if value == "" {
+			continue
+		}
+		if err := r.kong.ServiceRequest.SetHeader(header.name, value); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not set %s on the upstream request: %v", header.name, err))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// --- Verification Headers ---
+// Backends that record challenge metadata would otherwise have to verify the
+// token again. With verification_headers set, requests let through on a
+// successful verification (including cache hits and edge assertions) carry:
+//
+//	X-Turnstile-Verified       'true'
+//	X-Turnstile-Hostname       hostname the challenge was solved on
+//	X-Turnstile-Action         widget action
+//	X-Turnstile-Challenge-Ts   when the challenge was solved, RFC 3339
+//	X-Turnstile-Cdata          customer data passed to the widget
+//
+// verification_header_names renames single headers, keyed by 'verified',
+// 'hostname', 'action', 'challenge_ts' and 'cdata'; an empty name disables
+// one. The siteverify fields are only sent while exported_response_fields
+// lists them, and empty values are not sent. Client values of every enabled
+// header are removed, whether or not the request is verified. For free-form
+// headers, see upstream_headers.
+
+// verificationHeaderFields are the fields in header order, with their default names.
+var verificationHeaderFields = []struct{ field, name string }{
+	{"verified", "X-Turnstile-Verified"},
+	{"hostname", "X-Turnstile-Hostname"},
+	{"action", "X-Turnstile-Action"},
+	{"challenge_ts", "X-Turnstile-Challenge-Ts"},
+	{"cdata", "X-Turnstile-Cdata"},
+}
+
+// verificationHeader is one enabled verification header.
+type verificationHeader struct {
+	field, name string
+}
+
+// compileVerificationHeaders resolves the enabled headers, nil when
+// verification_headers is off.
+func compileVerificationHeaders(enabled bool, names map[string]string) ([]verificationHeader, error) {
+	for field := range names {
+		if !isVerificationHeaderField(field) {
+			return nil, fmt.Errorf("invalid verification_header_names entry '%s'. Use 'verified', 'hostname', 'action', 'challenge_ts' or 'cdata'", field)
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+	headers := make([]verificationHeader, 0, len(verificationHeaderFields))
+	for _, f := range verificationHeaderFields {
+		name, renamed := names[f.field]
+		if !renamed {
+			name = f.name
+		}
+		if name == "" {
+			continue
+		}
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " :\r\n") {
+			return nil, fmt.Errorf("invalid verification_header_names.%s '%s': not a header name", f.field, name)
+		}
+		headers = append(headers, verificationHeader{field: f.field, name: name})
+	}
+	return headers, nil
+}
+
+func isVerificationHeaderField(field string) bool {
+	for _, f := range verificationHeaderFields {
+		if f.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// clearVerificationHeaders drops client-supplied verification headers.
+func (r *requestState) clearVerificationHeaders() {
+	for _, header := range r.settings.verificationHeaders {
+		if err := r.kong.ServiceRequest.ClearHeader(header.name); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not clear %s from the upstream request: %v", header.name, err))
+		}
+	}
+}
+
+// setVerificationHeaders passes the metadata of a successful verification upstream.
+func (r *requestState) setVerificationHeaders(d decision) {
+	headers := r.settings.verificationHeaders
+	if len(headers) == 0 || !d.allowed || d.response == nil || !d.response.Success {
+		return
+	}
+	resp, fields := d.response, r.settings.exportedFields
+	for _, header := range headers {
+		var value string
+		switch header.field {
+		case "verified":
+			value = "true"
+		case "hostname":
+			value = resp.Hostname
+		case "action":
+			value = resp.Action
+		case "challenge_ts":
+			value = resp.challengeTs()
+		case "cdata":
+			value = resp.CData
+		}
+		if header.field != "verified" && !fields[header.field] {
+			continue
+		}
+		value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+		if value == "" {
+			continue
+		}
+		if err := r.kong.ServiceRequest.SetHeader(header.name, value); err != nil {
+			r.log.Warn(fmt.Sprintf("Could not set %s on the upstream request: %v", header.name, err))
+		}
+	}
+}
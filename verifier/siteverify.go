@@ -0,0 +1,239 @@
+package verifier
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Siteverify Wire Format ---
+// The request form and answer JSON of the siteverify endpoints, shared by
+// Verifier and the Kong plugin so both speak to providers alike. Turnstile,
+// hCaptcha and reCAPTCHA take the same core form parameters (secret,
+// response, remoteip) and answer with the same core JSON fields; a Kind adds
+// its own parameters and reads its own fields on top.
+
+// Verify URLs of the supported kinds.
+const (
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	RecaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// RecaptchaV3MinScore is the score threshold Google suggests for reCAPTCHA v3.
+const RecaptchaV3MinScore = 0.5
+
+// Kind is the siteverify dialect of a provider.
+type Kind int
+
+const (
+	Turnstile   Kind = iota // Cloudflare Turnstile, the default
+	HCaptcha                // hCaptcha
+	RecaptchaV2             // Google reCAPTCHA v2, checkbox and invisible
+	RecaptchaV3             // Google reCAPTCHA v3, which scores every request
+)
+
+// VerifyURL is the kind's siteverify endpoint.
+func (k Kind) VerifyURL() string {
+	switch k {
+	case HCaptcha:
+		return HCaptchaVerifyURL
+	case RecaptchaV2, RecaptchaV3:
+		return RecaptchaVerifyURL
+	default:
+		return TurnstileVerifyURL
+	}
+}
+
+// DefaultMinScore is the score below which the kind's tokens are rejected
+// unless another threshold is set; zero when the kind does not score by default.
+func (k Kind) DefaultMinScore() float64 {
+	if k == RecaptchaV3 {
+		return RecaptchaV3MinScore
+	}
+	return 0
+}
+
+// Scores reports whether every successful answer of the kind carries a
+// score; one without is not a verification of that kind, e.g. a reCAPTCHA
+// v2 secret answering for a v3 site.
+func (k Kind) Scores() bool {
+	return k == RecaptchaV3
+}
+
+// Request holds the parameters of one siteverify call.
+type Request struct {
+	Secret, Token, RemoteIP string
+	SiteKey                 string // hCaptcha only; lets it reject tokens solved for other sites
+	IdempotencyKey          string // Turnstile only; makes a retried call answer like the first
+}
+
+// AppendForm writes the form parameters of req, as k takes them, to buf in
+// application/x-www-form-urlencoded encoding.
+func (k Kind) AppendForm(buf *bytes.Buffer, req Request) {
+	appendFormField(buf, "secret", req.Secret)
+	appendFormField(buf, "response", req.Token)
+	if req.RemoteIP != "" {
+		appendFormField(buf, "remoteip", req.RemoteIP)
+	}
+	switch {
+	case k == Turnstile && req.IdempotencyKey != "":
+		appendFormField(buf, "idempotency_key", req.IdempotencyKey)
+	case k == HCaptcha && req.SiteKey != "":
+		appendFormField(buf, "sitekey", req.SiteKey)
+	}
+}
+
+// appendFormField appends key=value to buf, without the intermediate maps
+// and strings of url.Values.
+func appendFormField(buf *bytes.Buffer, key, value string) {
+	if buf.Len() > 0 {
+		buf.WriteByte('&')
+	}
+	buf.WriteString(url.QueryEscape(key))
+	buf.WriteByte('=')
+	buf.WriteString(url.QueryEscape(value))
+}
+
+// Answer is the union of the JSON fields siteverify endpoints send.
+type Answer struct {
+	Success        bool      `json:"success"`
+	ChallengeTs    Timestamp `json:"challenge_ts"`
+	Hostname       string    `json:"hostname"`
+	APKPackageName string    `json:"apk_package_name"` // reCAPTCHA on Android, instead of hostname
+	ErrorCodes     []string  `json:"error-codes"`
+	Action         string    `json:"action"`
+	CData          string    `json:"cdata"`
+	Score          *float64  `json:"score"`
+	ScoreReason    []string  `json:"score_reason"`
+}
+
+// Result normalizes answer as k reads it. Scores are turned into 0.0
+// (likely automated) to 1.0 (likely human) for every kind.
+func (k Kind) Result(answer *Answer) Result {
+	res := Result{
+		Success:     answer.Success,
+		Hostname:    answer.Hostname,
+		ErrorCodes:  answer.ErrorCodes,
+		Action:      answer.Action,
+		Score:       answer.Score,
+		ScoreReason: answer.ScoreReason,
+	}
+	if issued, ok := ParseTimestamp(answer.ChallengeTs); ok {
+		res.ChallengeTs = issued
+	}
+	switch k {
+	case Turnstile:
+		res.CData = answer.CData
+	case HCaptcha:
+		if answer.Score != nil {
+			human := 1 - *answer.Score // hCaptcha reports risk, 0.0 being safe
+			res.Score = &human
+		}
+	case RecaptchaV2, RecaptchaV3:
+		if res.Hostname == "" {
+			res.Hostname = answer.APKPackageName
+		}
+	}
+	return res
+}
+
+// Timestamp is challenge_ts as sent, a string or a number.
+type Timestamp string
+
+func (ts *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*ts = Timestamp(s)
+		return nil
+	}
+	if string(data) != "null" {
+		*ts = Timestamp(data) // Numbers verbatim, anything else fails to parse later
+	}
+	return nil
+}
+
+// timestampLayouts are tried in order; layouts without zone mean UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// ParseTimestamp reads a challenge_ts. Providers agree on ISO 8601 but not
+// on its details, and custom providers send Unix timestamps, so RFC 3339
+// with or without fractional seconds or zone, with a space instead of the
+// T, and Unix seconds or milliseconds are all accepted.
+func ParseTimestamp(ts Timestamp) (time.Time, bool) {
+	s := strings.TrimSpace(string(ts))
+	if s == "" {
+		return time.Time{}, false
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil && n > 0 {
+		if n >= 1e12 {
+			return time.UnixMilli(int64(n)), true
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	for _, layout := range timestampLayouts {
+		if issued, err := time.Parse(layout, s); err == nil {
+			return issued, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// DecodeBody undoes the Content-Encoding of a siteverify answer. Proxies in
+// between may compress answers, some without declaring it, so gzip is also
+// recognized by its magic bytes. Decoded bodies are held to limit as well.
+func DecodeBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var decoder io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		decoder = zr
+	case "deflate":
+		// Meant to be zlib-wrapped, but raw deflate is common in practice
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			decoder = zr
+		} else {
+			decoder = flate.NewReader(bytes.NewReader(body))
+		}
+	case "", "identity":
+		if !bytes.HasPrefix(body, gzipMagic) {
+			return body, nil
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, nil // Not gzip after all; left to the JSON parser
+		}
+		decoder = zr
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%s'", encoding)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(decoder, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", limit)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,357 @@
+// Package verifier is the siteverify call of the Turnstile plugin as a
+// library, for Go services that verify tokens outside Kong:
+//
+//	v := verifier.New(secretKey,
+//		verifier.WithTimeout(2*time.Second),
+//		verifier.WithCache(time.Minute))
+//
+//	res, err := v.Verify(ctx, token, clientIP)
+//	if err != nil { ... } // No usable answer from the provider
+//	if !res.Success { ... } // Token rejected, see res.ErrorCodes
+//
+// Code depending on the TokenVerifier interface instead of *Verifier can be
+// tested with a stub. hCaptcha and reCAPTCHA are verified through WithKind,
+// any other siteverify-compatible provider through WithProvider. The
+// request and answer handling (see siteverify.go) is the plugin's own.
+package verifier
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout   = 5 * time.Second
+	maxResponseBytes = 64 * 1024
+	tokenValidity    = 300 * time.Second // Tokens are accepted this long after challenge_ts
+	maxCacheEntries  = 100000
+	retryBackoff     = 100 * time.Millisecond // Before the first retry, doubling for each further one
+)
+
+// Error codes Verify adds to Result.ErrorCodes.
+const (
+	// InternalErrorCode is the provider's code for failures inside
+	// siteverify, retried under WithRetries.
+	InternalErrorCode = "internal-error"
+
+	// LowScoreCode marks answers rejected for scoring below the threshold,
+	// see WithMinScore.
+	LowScoreCode = "low-score"
+
+	// MissingScoreCode marks answers of kinds that always score (see
+	// Kind.Scores) rejected for carrying no score.
+	MissingScoreCode = "missing-score"
+)
+
+// Result is the provider's answer to one verification.
+type Result struct {
+	Success     bool
+	ChallengeTs time.Time // Zero when the provider did not send one
+	Hostname    string    // Or Android package name, for reCAPTCHA
+	ErrorCodes  []string
+	Action      string
+	CData       string   // Turnstile only
+	Score       *float64 // 0.0 (likely automated) to 1.0 (likely human), when the provider scores
+	ScoreReason []string
+	Cached      bool // Answer served from the WithCache cache
+}
+
+// TokenVerifier is implemented by *Verifier.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token, remoteIP string) (Result, error)
+}
+
+// Verifier verifies tokens against one provider. It is safe for concurrent use.
+type Verifier struct {
+	secretKey string
+	siteKey   string
+	kind      Kind
+	provider  string
+	verifyURL string
+	client    *http.Client
+	timeout   time.Duration
+	retries   int
+	minScore  *float64 // nil for the kind's default
+	cache     *resultCache
+}
+
+// Option configures a Verifier.
+type Option func(*Verifier)
+
+// WithTimeout bounds each siteverify call. Default: 5s, or the deadline of
+// the context passed to Verify if that is earlier.
+func WithTimeout(d time.Duration) Option {
+	return func(v *Verifier) { v.timeout = d }
+}
+
+// WithCache serves tokens verified successfully within ttl from memory, so a
+// client resending a token is not answered 'timeout-or-duplicate'. Entries
+// never outlive the token itself and are only reused for the same client IP.
+func WithCache(ttl time.Duration) Option {
+	return func(v *Verifier) {
+		if ttl > 0 {
+			v.cache = &resultCache{ttl: ttl, entries: make(map[string]*list.Element), order: list.New()}
+		} else {
+			v.cache = nil
+		}
+	}
+}
+
+// WithKind verifies tokens of another kind of provider, at its verify URL
+// unless WithProvider sets one. Default: Turnstile.
+func WithKind(kind Kind) Option {
+	return func(v *Verifier) { v.kind = kind }
+}
+
+// WithSiteKey sends the site key to kinds that check it (hCaptcha), so
+// tokens solved for other sites are rejected.
+func WithSiteKey(siteKey string) Option {
+	return func(v *Verifier) { v.siteKey = siteKey }
+}
+
+// WithProvider verifies against another siteverify-compatible endpoint; name
+// appears in error messages. Default: the verify URL of the kind.
+func WithProvider(name, verifyURL string) Option {
+	return func(v *Verifier) { v.provider, v.verifyURL = name, verifyURL }
+}
+
+// WithRetries repeats calls up to n times after connection errors, 5xx
+// statuses and 'internal-error' answers, pausing 100ms before the first
+// retry and doubling that for each further one. Turnstile calls then carry
+// an idempotency key, so a retry is not answered 'timeout-or-duplicate'.
+// Default: 0.
+func WithRetries(n int) Option {
+	return func(v *Verifier) { v.retries = max(n, 0) }
+}
+
+// WithMinScore rejects tokens scoring below min with LowScoreCode; answers
+// without a score are not affected, except for RecaptchaV3, whose answers
+// always score and are rejected with MissingScoreCode otherwise. Default: RecaptchaV3MinScore for
+// RecaptchaV3, none for the other kinds. Zero disables the threshold.
+func WithMinScore(min float64) Option {
+	return func(v *Verifier) { v.minScore = &min }
+}
+
+// WithHTTPClient sends calls through client, e.g. for proxies or custom TLS
+// settings. Its own Timeout still applies on top of WithTimeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *Verifier) { v.client = client }
+}
+
+// New returns a Verifier using secretKey.
+func New(secretKey string, opts ...Option) *Verifier {
+	v := &Verifier{
+		secretKey: secretKey,
+		provider:  "turnstile",
+		client:    http.DefaultClient,
+		timeout:   defaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if v.verifyURL == "" {
+		v.verifyURL = v.kind.VerifyURL()
+	}
+	return v
+}
+
+// Verify sends token to the provider. A nil error means the provider
+// answered; whether it accepted the token is Result.Success. Errors report
+// calls without a usable answer: connection failures, non-200 statuses
+// (including rate limiting), undecodable bodies and 'internal-error'
+// answers that persisted through WithRetries.
+func (v *Verifier) Verify(ctx context.Context, token, remoteIP string) (Result, error) {
+	if token == "" {
+		return Result{ErrorCodes: []string{"missing-input-response"}}, nil
+	}
+	now := time.Now()
+	if res, ok := v.cache.get(token, remoteIP, now); ok {
+		return res, nil
+	}
+
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+	req := Request{Secret: v.secretKey, Token: token, RemoteIP: remoteIP, SiteKey: v.siteKey}
+	if v.retries > 0 {
+		req.IdempotencyKey = newIdempotencyKey()
+	}
+	var res Result
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		res, retryable, err = v.call(ctx, req)
+		if !retryable {
+			break
+		}
+		if attempt >= v.retries {
+			if err == nil {
+				err = fmt.Errorf("%s answered '%s' %d times", v.provider, InternalErrorCode, attempt+1)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return Result{}, fmt.Errorf("calling %s verification API: %w", v.provider, ctx.Err())
+		case <-time.After(retryBackoff << attempt):
+		}
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	v.checkScore(&res)
+	if res.Success {
+		v.cache.put(token, remoteIP, res, now)
+	}
+	return res, nil
+}
+
+// call makes one siteverify call, reporting whether it is worth repeating.
+func (v *Verifier) call(ctx context.Context, r Request) (Result, bool, error) {
+	var form bytes.Buffer
+	v.kind.AppendForm(&form, r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL, &form)
+	if err != nil {
+		return Result{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return Result{}, ctx.Err() == nil, fmt.Errorf("calling %s verification API: %w", v.provider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return Result{}, false, fmt.Errorf("reading %s response body: %w", v.provider, err)
+	}
+	if len(body) > maxResponseBytes {
+		return Result{}, false, fmt.Errorf("%s response exceeded %d bytes, status: %d", v.provider, maxResponseBytes, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, resp.StatusCode >= 500, fmt.Errorf("%s API returned non-200 status: %d", v.provider, resp.StatusCode)
+	}
+	body, err = DecodeBody(resp.Header.Get("Content-Encoding"), body, maxResponseBytes)
+	if err != nil {
+		return Result{}, false, fmt.Errorf("decoding %s response body: %w", v.provider, err)
+	}
+
+	var answer Answer
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return Result{}, false, fmt.Errorf("parsing %s JSON response: %w", v.provider, err)
+	}
+	res := v.kind.Result(&answer)
+	return res, !res.Success && slices.Contains(res.ErrorCodes, InternalErrorCode), nil
+}
+
+// checkScore rejects a successful answer scoring below the threshold, or
+// without the score its kind always sends.
+func (v *Verifier) checkScore(res *Result) {
+	if !res.Success {
+		return
+	}
+	threshold := v.kind.DefaultMinScore()
+	if v.minScore != nil {
+		threshold = *v.minScore
+	}
+	switch {
+	case res.Score == nil && v.kind.Scores():
+		res.Success = false
+		res.ErrorCodes = append(slices.Clip(res.ErrorCodes), MissingScoreCode)
+	case res.Score != nil && *res.Score < threshold:
+		res.Success = false
+		res.ErrorCodes = append(slices.Clip(res.ErrorCodes), LowScoreCode)
+	}
+}
+
+// newIdempotencyKey returns a random UUID (version 4).
+func newIdempotencyKey() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// --- Result Cache ---
+
+type cacheEntry struct {
+	key     string
+	ip      string
+	result  Result
+	expires time.Time
+}
+
+// resultCache holds entries in a map for lookups and a list in insertion
+// order, oldest first, for eviction.
+type resultCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element // By token hash, of *cacheEntry
+	order   *list.List
+}
+
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *resultCache) get(token, ip string, now time.Time) (Result, bool) {
+	if c == nil {
+		return Result{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[cacheKey(token)]
+	if !ok {
+		return Result{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.ip != ip || now.After(entry.expires) {
+		return Result{}, false
+	}
+	res := entry.result
+	res.Cached = true
+	return res, true
+}
+
+// put caches res for the cache TTL, capped to the token's remaining
+// validity. A full cache drops its oldest entries first.
+func (c *resultCache) put(token, ip string, res Result, now time.Time) {
+	if c == nil || res.ChallengeTs.IsZero() {
+		return // Without challenge_ts the token's validity is unknown
+	}
+	ttl := min(c.ttl, tokenValidity-now.Sub(res.ChallengeTs))
+	if ttl <= 0 {
+		return
+	}
+	key := cacheKey(token)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+	for oldest := c.order.Front(); oldest != nil; oldest = c.order.Front() {
+		entry := oldest.Value.(*cacheEntry)
+		if len(c.entries) < maxCacheEntries && !now.After(entry.expires) {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+	}
+	c.entries[key] = c.order.PushBack(&cacheEntry{key: key, ip: ip, result: res, expires: now.Add(ttl)})
+}
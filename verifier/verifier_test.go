@@ -0,0 +1,205 @@
+package verifier
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kong-turnstile-plugin/turnstiletest"
+)
+
+const answer = `{"success":true,"hostname":"example.com","error-codes":[]}`
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		limit    int64
+		want     string
+		wantErr  bool
+	}{
+		{"identity", "", []byte(answer), 1024, answer, false},
+		{"explicit identity", "identity", []byte(answer), 1024, answer, false},
+		{"gzip", "gzip", turnstiletest.Compress(t, "gzip", answer), 1024, answer, false},
+		{"x-gzip", "x-gzip", turnstiletest.Compress(t, "gzip", answer), 1024, answer, false},
+		{"gzip in upper case", " GZIP ", turnstiletest.Compress(t, "gzip", answer), 1024, answer, false},
+		{"undeclared gzip", "", turnstiletest.Compress(t, "gzip", answer), 1024, answer, false},
+		{"zlib deflate", "deflate", turnstiletest.Compress(t, "zlib", answer), 1024, answer, false},
+		{"raw deflate", "deflate", turnstiletest.Compress(t, "flate", answer), 1024, answer, false},
+		{"gzip magic without gzip", "", []byte{0x1f, 0x8b, 'x'}, 1024, "\x1f\x8bx", false},
+		{"corrupt gzip", "gzip", []byte("not gzip"), 1024, "", true},
+		{"unsupported", "br", []byte(answer), 1024, "", true},
+		{"decoded over limit", "gzip", turnstiletest.Compress(t, "gzip", strings.Repeat(" ", 2048)), 1024, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeBody(tt.encoding, tt.body, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("DecodeBody() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKindResult(t *testing.T) {
+	score := 0.25
+	tests := []struct {
+		name   string
+		kind   Kind
+		answer Answer
+		check  func(Result) error
+	}{
+		{"turnstile keeps cdata", Turnstile, Answer{Success: true, CData: "session"}, func(res Result) error {
+			if res.CData != "session" {
+				return fmt.Errorf("cdata = %q", res.CData)
+			}
+			return nil
+		}},
+		{"hcaptcha inverts risk", HCaptcha, Answer{Success: true, Score: &score}, func(res Result) error {
+			if res.Score == nil || *res.Score != 0.75 {
+				return fmt.Errorf("score = %v, want 0.75", res.Score)
+			}
+			return nil
+		}},
+		{"recaptcha android package", RecaptchaV3, Answer{Success: true, APKPackageName: "com.example"}, func(res Result) error {
+			if res.Hostname != "com.example" {
+				return fmt.Errorf("hostname = %q", res.Hostname)
+			}
+			return nil
+		}},
+		{"unix timestamp", Turnstile, Answer{ChallengeTs: "1735689600"}, func(res Result) error {
+			if !res.ChallengeTs.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				return fmt.Errorf("challenge_ts = %v", res.ChallengeTs)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.check(tt.kind.Result(&tt.answer)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// siteverify answers with the queued bodies, then with answer, and records
+// the forms it was sent.
+type siteverify struct {
+	mu      sync.Mutex
+	replies []string
+	forms   []url.Values
+}
+
+func (s *siteverify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forms = append(s.forms, r.PostForm)
+	reply := answer
+	if len(s.replies) > 0 {
+		reply, s.replies = s.replies[0], s.replies[1:]
+	}
+	if strings.HasPrefix(reply, "status ") {
+		var status int
+		fmt.Sscanf(reply, "status %d", &status)
+		w.WriteHeader(status)
+		return
+	}
+	_, _ = io.WriteString(w, reply)
+}
+
+func TestVerifyRetriesWithIdempotencyKey(t *testing.T) {
+	sv := &siteverify{replies: []string{"status 502", `{"success":false,"error-codes":["internal-error"]}`}}
+	srv := httptest.NewServer(sv)
+	defer srv.Close()
+
+	v := New("secret", WithProvider("turnstile", srv.URL), WithRetries(2))
+	res, err := v.Verify(context.Background(), "token", "192.0.2.1")
+	if err != nil || !res.Success {
+		t.Fatalf("Verify() = %+v, %v, want success", res, err)
+	}
+	if len(sv.forms) != 3 {
+		t.Fatalf("%d calls, want 3", len(sv.forms))
+	}
+	key := sv.forms[0].Get("idempotency_key")
+	for i, form := range sv.forms {
+		if key == "" || form.Get("idempotency_key") != key {
+			t.Errorf("call %d idempotency_key = %q, want %q on every call", i, form.Get("idempotency_key"), key)
+		}
+	}
+}
+
+func TestVerifyGivesUpOnPersistentInternalError(t *testing.T) {
+	sv := &siteverify{replies: []string{`{"success":false,"error-codes":["internal-error"]}`, `{"success":false,"error-codes":["internal-error"]}`}}
+	srv := httptest.NewServer(sv)
+	defer srv.Close()
+
+	v := New("secret", WithProvider("turnstile", srv.URL), WithRetries(1))
+	if _, err := v.Verify(context.Background(), "token", ""); err == nil {
+		t.Fatal("Verify() succeeded, want an error")
+	}
+}
+
+func TestVerifyMinScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		score   string
+		success bool
+	}{
+		{"v3 default threshold", []Option{WithKind(RecaptchaV3)}, "0.3", false},
+		{"v3 above threshold", []Option{WithKind(RecaptchaV3)}, "0.7", true},
+		{"threshold disabled", []Option{WithKind(RecaptchaV3), WithMinScore(0)}, "0.3", true},
+		{"turnstile unscored by default", nil, "0.1", true},
+		{"turnstile threshold", []Option{WithMinScore(0.5)}, "0.1", false},
+		{"v3 without score", []Option{WithKind(RecaptchaV3), WithMinScore(0)}, "null", false},
+		{"turnstile without score", []Option{WithMinScore(0.5)}, "null", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sv := &siteverify{replies: []string{`{"success":true,"score":` + tt.score + `}`}}
+			srv := httptest.NewServer(sv)
+			defer srv.Close()
+
+			v := New("secret", append(tt.opts, WithProvider("test", srv.URL))...)
+			res, err := v.Verify(context.Background(), "token", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Success != tt.success {
+				t.Errorf("success = %v, want %v (error codes %v)", res.Success, tt.success, res.ErrorCodes)
+			}
+		})
+	}
+}
+
+func TestResultCacheEvictsOldest(t *testing.T) {
+	c := &resultCache{ttl: time.Minute, entries: make(map[string]*list.Element), order: list.New()}
+	now := time.Now()
+	res := Result{Success: true, ChallengeTs: now}
+	for i := 0; i < maxCacheEntries+1; i++ {
+		c.put(fmt.Sprint(i), "", res, now)
+	}
+	if len(c.entries) != maxCacheEntries || c.order.Len() != maxCacheEntries {
+		t.Fatalf("%d entries (%d listed), want %d", len(c.entries), c.order.Len(), maxCacheEntries)
+	}
+	if _, ok := c.get("0", "", now); ok {
+		t.Error("the oldest entry should have been evicted")
+	}
+	if _, ok := c.get(fmt.Sprint(maxCacheEntries), "", now); !ok {
+		t.Error("the newest entry should be cached")
+	}
+}
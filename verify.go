@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kong-turnstile-plugin/verifier"
+)
+
+// --- Verification Results ---
+// Every provider's answer is normalized into a VerificationResult, so
+// caching, headers, logging and policies treat all providers alike. The
+// provider's kind decides how its JSON maps in, see providers.go.
+
+// VerificationResult is a provider's answer to one verification.
+type VerificationResult struct {
+	Success    bool
+	Hostname   string    // Hostname (or Android package) the challenge was solved on
+	Action     string    // Widget action, if any
+	IssuedAt   time.Time // When the challenge was solved; zero when not reported
+	ErrorCodes []string
+	CData      string // Customer data passed to the widget, Turnstile only
+
+	Score       *float64 // Enterprise score, 0.0 (automated) to 1.0 (human), see score.go
+	ScoreReason []string // Why the score was given
+
+	raw []byte // Undecoded answer, only kept when debug passthrough is configured
+}
+
+// challengeTs formats IssuedAt like the providers' challenge_ts, "" when unknown.
+func (res *VerificationResult) challengeTs() string {
+	if res.IssuedAt.IsZero() {
+		return ""
+	}
+	return res.IssuedAt.UTC().Format(time.RFC3339)
+}
+
+// normalize maps answer into a VerificationResult as kind reads it.
+func normalize(kind siteVerifier, answer *verifier.Answer) *VerificationResult {
+	res := kind.dialect().Result(answer)
+	return &VerificationResult{
+		Success:     res.Success,
+		Hostname:    res.Hostname,
+		Action:      res.Action,
+		IssuedAt:    res.ChallengeTs,
+		ErrorCodes:  res.ErrorCodes,
+		CData:       res.CData,
+		Score:       res.Score,
+		ScoreReason: res.ScoreReason,
+	}
+}
+
+// --- Providers ---
+// provider is a siteverify-compatible endpoint. Turnstile, hCaptcha and
+// reCAPTCHA all take the same core form parameters (secret, response,
+// remoteip) and answer with the same core JSON fields, so they only differ
+// in where the token comes from, where it is verified and in what their
+// kind adds to the request and normalizes in the answer.
+type provider struct {
+	name      string
+	verifyURL string
+	secretKey string
+	siteKey   string // Sent to kinds that check it, see verifier.Request
+	tokenName string
+	schema    string       // See providerSchemas
+	kind      siteVerifier // Of schema
+	minScore  float64      // See score.go
+	secretID  string       // See rotation.go
+	stats     *providerStats
+}
+
+// providerStats counts outcomes per provider, so operators running two
+// providers side by side can tell when the old one stops receiving traffic.
+type providerStats struct {
+	Verified atomic.Int64 // Successful verifications
+	Rejected atomic.Int64 // Verifications the provider answered with success=false
+	Errors   atomic.Int64 // Calls that produced no usable answer
+
+	RateLimited atomic.Int64 // Calls answered with 429 or held back after one, see ratelimit.go
+
+	BreakerFailures atomic.Int64 // Failed calls counted by the circuit breaker, see breaker.go
+	BreakerOpen     atomic.Int64 // Calls short-circuited by the open breaker
+
+	LowScore atomic.Int64               // Verifications rejected under min_score
+	Scores   [scoreBuckets]atomic.Int64 // Scores seen, by tenth
+
+	BadTimestamps    atomic.Int64 // Answers with a challenge_ts that could not be read, see challengets.go
+	SkewedTimestamps atomic.Int64 // Answers with a challenge_ts beyond max_clock_skew_seconds in the future
+
+	InternalErrors       atomic.Int64 // Answers with 'internal-error', see internalerror.go
+	InternalErrorRetries atomic.Int64 // Calls repeated after one
+
+	lastTimestampWarning atomic.Int64 // Unix nanoseconds, see warnTimestamp
+}
+
+// allProviderStats holds the counters of every provider seen by this plugin
+// server, keyed by provider name, so they survive config changes.
+var allProviderStats sync.Map // map[string]*providerStats
+
+func statsForProvider(name string) *providerStats {
+	stats, _ := allProviderStats.LoadOrStore(name, &providerStats{})
+	return stats.(*providerStats)
+}
+
+// --- SiteVerify Call ---
+
+// verifyError is a siteverify call that did not produce a usable answer,
+// along with how the client should be answered.
+type verifyError struct {
+	status int    // Status code returned to the client
+	body   string // Client-facing body
+	msg    string // Detailed message for the Kong log
+
+	retryAfter time.Duration // Set when the provider is rate limiting us
+	answered   bool          // The provider answered 429, as opposed to the call being held back
+
+	breakerOpen bool // Not sent, the circuit breaker is open, see breaker.go
+}
+
+func (e *verifyError) Error() string { return e.msg }
+
+// siteVerify posts token to the provider's verification endpoint and decodes the answer.
+func siteVerify(settings *compiledConfig, p *provider, token, remoteIP string) (*VerificationResult, *verifyError) {
+	seedHoldBack(p.verifyURL, clock.Now())
+	if wait := rateLimitRemaining(p.verifyURL, clock.Now()); wait > 0 {
+		return nil, rateLimitedError(p, wait, false)
+	}
+	if wait := breakerRemaining(settings, p, clock.Now()); wait > 0 {
+		p.stats.BreakerOpen.Add(1)
+		return nil, breakerOpenError(p, wait)
+	}
+	if wait := verifyQuotaWait(settings, p); wait > 0 {
+		return nil, quotaExceededError(p, wait)
+	}
+	started := time.Now()
+	resp, verr := callSiteVerify(settings, p, token, remoteIP)
+	observeSiteVerify(p, time.Since(started), resp)
+	recordBreaker(settings, p, verr)
+	return resp, verr
+}
+
+// callSiteVerify makes the siteverify call of siteVerify.
+func callSiteVerify(settings *compiledConfig, p *provider, token, remoteIP string) (*VerificationResult, *verifyError) {
+	if settings.chaos != nil {
+		if resp, verr, injected := settings.chaos.inject(p); injected {
+			return resp, verr
+		}
+	}
+
+	// Tokens are single-use: a retried call carries an idempotency key so the
+	// provider answers it like the first attempt instead of as a duplicate
+	var idempotencyKey string
+	if settings.verifyClient.retries > 0 {
+		idempotencyKey = newUUID()
+	}
+
+	// Retries stop at request_timeout_ms, which bounds the wait of the request
+	resp, err := settings.verifyClient.doUntil(time.Now().Add(settings.timeout), func() (*http.Request, error) {
+		// Prepare form data (encoded into a pooled buffer)
+		reqBody := newVerifyBody(p.kind, verifier.Request{Secret: p.secretKey, Token: token, RemoteIP: remoteIP,
+			SiteKey: p.siteKey, IdempotencyKey: idempotencyKey})
+		req, err := http.NewRequest("POST", p.verifyURL, reqBody)
+		if err != nil {
+			reqBody.Close()
+			return nil, err
+		}
+		req.ContentLength = int64(reqBody.Len()) // Not inferred for custom body types
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if settings.verifyClient.compress {
+			req.Header.Set("Accept-Encoding", "gzip, deflate") // Decoded by verifier.DecodeBody
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (connection error)",
+			msg: fmt.Sprintf("Failed to call %s verification API: %v", p.name, err)}
+	}
+	defer resp.Body.Close()
+
+	// Read at most maxResponseBytes (plus one to detect overflow) into a pooled buffer
+	respBuf := getBuffer()
+	defer putBuffer(respBuf)
+	_, err = respBuf.ReadFrom(io.LimitReader(resp.Body, settings.maxResponseBytes+1))
+	bodyBytes := respBuf.Bytes()
+	if err != nil {
+		return nil, &verifyError{status: http.StatusInternalServerError, body: "Turnstile verification failed (read error)",
+			msg: fmt.Sprintf("Failed to read %s response body: %v", p.name, err)}
+	}
+	if int64(len(bodyBytes)) > settings.maxResponseBytes {
+		// Most likely an HTML error page from a proxy in between; treat it like a connection failure
+		return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (connection error)",
+			msg: fmt.Sprintf("%s response exceeded max_response_bytes (%d), status: %d", p.name, settings.maxResponseBytes, resp.StatusCode)}
+	}
+
+	bodyBytes, err = verifier.DecodeBody(resp.Header.Get("Content-Encoding"), bodyBytes, settings.maxResponseBytes)
+	if err != nil {
+		return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (API error)",
+			msg: fmt.Sprintf("Failed to decode %s response body: %v, status: %d", p.name, err, resp.StatusCode)}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := parseRetryAfter(resp.Header.Get("Retry-After"), clock.Now())
+		holdBackProvider(p.verifyURL, wait)
+		shareHoldBack(p.verifyURL, wait)
+		return nil, rateLimitedError(p, wait, true)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &verifyError{status: http.StatusBadGateway, body: "Turnstile verification failed (API error)",
+			msg: fmt.Sprintf("%s API returned non-200 status: %d - Body: %s", p.name, resp.StatusCode, string(bodyBytes))}
+	}
+
+	// --- Parse Response ---
+	var answer verifier.Answer
+	if err := json.Unmarshal(bodyBytes, &answer); err != nil {
+		diagnosis := diagnoseParseError(resp.Header.Get("Content-Type"), bodyBytes, err)
+		countParseError(p, diagnosis)
+		return nil, &verifyError{status: http.StatusInternalServerError, body: "Turnstile verification failed (parse error)",
+			msg: fmt.Sprintf("Failed to parse %s JSON response: %v (%s)", p.name, err, diagnosis)}
+	}
+	verifyResponse := normalize(p.kind, &answer)
+	checkIssuedAt(settings, p, verifyResponse, answer.ChallengeTs, clock.Now())
+	if len(settings.debugPassthroughCIDRs) > 0 {
+		verifyResponse.raw = append([]byte(nil), bodyBytes...) // bodyBytes goes back to the pool
+	}
+	return verifyResponse, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"kong-turnstile-plugin/turnstiletest"
+
+	"github.com/Kong/go-pdk/test"
+)
+
+const successAnswer = `{"success":true,"hostname":"example.com","error-codes":[]}`
+
+func TestCompressedSiteverifyAnswer(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", ""} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			var acceptEncoding atomic.Value
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost {
+					return // Connection warm-up probe
+				}
+				acceptEncoding.Store(req.Header.Get("Accept-Encoding"))
+				w.Header().Set("Content-Type", "application/json")
+				switch encoding {
+				case "gzip":
+					w.Header().Set("Content-Encoding", "gzip")
+					_, _ = w.Write(turnstiletest.Compress(t, "gzip", successAnswer))
+				case "deflate":
+					w.Header().Set("Content-Encoding", "deflate")
+					_, _ = w.Write(turnstiletest.Compress(t, "zlib", successAnswer))
+				default:
+					_, _ = w.Write(turnstiletest.Compress(t, "gzip", successAnswer)) // A proxy compressing without saying so
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			conf := New().(*Config)
+			conf.TurnstileSecretKey = "secret"
+			conf.TurnstileVerifyURL = srv.URL
+			env := turnstiletest.RunAccess(t, conf, test.Request{
+				Method:  "GET",
+				Url:     "http://example.com/login",
+				Headers: http.Header{DefaultTokenHeader: {"token-" + t.Name()}}, // Not in the result cache
+			})
+
+			if turnstiletest.Rejected(env) {
+				t.Fatalf("rejected with %d: %s", env.ClientRes.Status, env.ClientRes.Body)
+			}
+			if got, _ := acceptEncoding.Load().(string); !strings.Contains(got, "gzip") {
+				t.Errorf("Accept-Encoding = %q, want gzip requested", got)
+			}
+		})
+	}
+}
+
+func TestDisableCompressionOmitsAcceptEncoding(t *testing.T) {
+	var acceptEncoding atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			return // Connection warm-up probe
+		}
+		acceptEncoding.Store(req.Header.Get("Accept-Encoding"))
+		_, _ = io.WriteString(w, successAnswer)
+	}))
+	t.Cleanup(srv.Close)
+
+	conf := New().(*Config)
+	conf.TurnstileSecretKey = "secret"
+	conf.TurnstileVerifyURL = srv.URL
+	conf.HTTPClients = map[string]HTTPClientConfig{"plain": {DisableCompression: true}}
+	conf.VerifyHTTPClient = "plain"
+	env := accessWithToken(t, conf, "token-"+t.Name())
+
+	if turnstiletest.Rejected(env) {
+		t.Fatalf("rejected with %d: %s", env.ClientRes.Status, env.ClientRes.Body)
+	}
+	if got, _ := acceptEncoding.Load().(string); got != "" {
+		t.Errorf("Accept-Encoding = %q, want none under disable_compression", got)
+	}
+}
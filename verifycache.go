@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"time"
+)
+
+// --- Verification Cache ---
+// Provider tokens are single-use: asked twice, siteverify answers the second
+// call with 'timeout-or-duplicate'. Clients that legitimately resend a token,
+// e.g. a retried request, are served from this cache for
+// verify_cache_ttl_seconds instead. An entry never outlives the token itself,
+// which the provider accepts for tokenValidity after challenge_ts, and is only
+// reused for the provider, secret (see rotation.go) and client IP it was
+// verified for. Batch
+// verifications are not cached.
+//
+// With verify_cache_failure_ttl_seconds set, tokens the provider rejected as
+// invalid or already redeemed are remembered as well, and a resent one gets
+// the same rejection without another siteverify call. Only these two answers
+// are cached: they judge the token, whereas e.g. 'internal-error' or a secret
+// error says nothing about it. A rejection holds for the provider and secret
+// whatever client resends the token. Each cache holds at most
+// verify_cache_max_entries per plugin server; as the caches are shared by
+// all instances, the largest value any valid configuration sets applies,
+// and TURNSTILE_VERIFY_CACHE_ENTRIES (default 100000) until one does. A full
+// cache drops expired entries and otherwise the entry closest to
+// expiry, which an expiry-ordered heap finds without scanning the cache.
+
+const (
+	VerifyCacheEntriesEnv     = "TURNSTILE_VERIFY_CACHE_ENTRIES"
+	ProviderInvalidTokenCode  = "invalid-input-response"
+	tokenValidity             = 300 * time.Second
+	defaultVerifyCacheEntries = 100000
+	maxVerifyCacheEntries     = 10000000
+)
+
+type verifyCacheEntry struct {
+	provider string
+	secretID string
+	ip       string
+	response *VerificationResult
+	expires  time.Time
+	key      string
+	index    int // Position in verifyCache.byExpiry
+}
+
+// expiryHeap orders cache entries by expiry, the soonest first.
+type expiryHeap []*verifyCacheEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*verifyCacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// verifyCache remembers verifications by token hash.
+type verifyCache struct {
+	mu        sync.Mutex
+	entries   map[string]*verifyCacheEntry
+	byExpiry  expiryHeap
+	limit     int
+	limitSet  bool // limit comes from verify_cache_max_entries
+	bindIP    bool // Entries are only reused for the client IP they were verified for
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+var (
+	verifiedTokens = newVerifyCache("verified_tokens", true)
+	rejectedTokens = newVerifyCache("rejected_tokens", false)
+)
+
+func newVerifyCache(name string, bindIP bool) *verifyCache {
+	c := &verifyCache{entries: make(map[string]*verifyCacheEntry), limit: envInt(VerifyCacheEntriesEnv, defaultVerifyCacheEntries), bindIP: bindIP}
+	registerCache(name, c)
+	return c
+}
+
+// applyVerifyCacheLimit applies the verify_cache_max_entries of a newly
+// compiled configuration to both caches, unless another one set a larger
+// value. A lowered limit is reached as entries are stored.
+func applyVerifyCacheLimit(cc *compiledConfig) {
+	if cc.err != nil || cc.verifyCacheMaxEntries == 0 {
+		return
+	}
+	for _, c := range []*verifyCache{verifiedTokens, rejectedTokens} {
+		c.mu.Lock()
+		if !c.limitSet || cc.verifyCacheMaxEntries > c.limit {
+			c.limit, c.limitSet = cc.verifyCacheMaxEntries, true
+		}
+		c.mu.Unlock()
+	}
+}
+
+// cacheableRejection reports whether resp rejects the token itself, as
+// invalid or already redeemed, and nothing else.
+func cacheableRejection(resp *VerificationResult) bool {
+	if resp.Success || len(resp.ErrorCodes) == 0 {
+		return false
+	}
+	return !slices.ContainsFunc(resp.ErrorCodes, func(code string) bool {
+		return code != ProviderInvalidTokenCode && code != ProviderExpiredCode
+	})
+}
+
+// tokenHash is the cache key of token, also used to purge it via the admin endpoint.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *verifyCache) get(p *provider, token, ip string, now time.Time) (*VerificationResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[tokenHash(token)]
+	if !ok || now.After(entry.expires) || entry.provider != p.name || entry.secretID != p.secretID || (c.bindIP && entry.ip != ip) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.response, true
+}
+
+// put caches resp for ttl, capped to the remaining validity of the token.
+func (c *verifyCache) put(p *provider, token, ip string, resp *VerificationResult, ttl time.Duration, now time.Time) {
+	age, ok := tokenAge(resp, now)
+	if !ok {
+		return // Without challenge_ts the token's validity is unknown
+	}
+	c.store(tokenHash(token), &verifyCacheEntry{provider: p.name, secretID: p.secretID, ip: ip, response: resp}, min(ttl, tokenValidity-age), now)
+}
+
+// putRejection caches the provider's rejection of token for ttl, at most
+// for tokenValidity: the provider does not accept the token any longer anyway.
+func (c *verifyCache) putRejection(p *provider, token, ip string, resp *VerificationResult, ttl time.Duration, now time.Time) {
+	c.store(tokenHash(token), &verifyCacheEntry{provider: p.name, secretID: p.secretID, ip: ip, response: resp}, min(ttl, tokenValidity), now)
+}
+
+func (c *verifyCache) store(key string, entry *verifyCacheEntry, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limit <= 0 {
+		return
+	}
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	for len(c.byExpiry) > 0 && now.After(c.byExpiry[0].expires) {
+		c.remove(c.byExpiry[0])
+		c.evictions++
+	}
+	for len(c.entries) >= c.limit {
+		c.remove(c.byExpiry[0]) // The entry closest to expiry
+		c.evictions++
+	}
+	entry.key = key
+	entry.expires = now.Add(ttl)
+	c.entries[key] = entry
+	heap.Push(&c.byExpiry, entry)
+}
+
+// remove drops entry from the cache; c.mu must be held.
+func (c *verifyCache) remove(entry *verifyCacheEntry) {
+	delete(c.entries, entry.key)
+	heap.Remove(&c.byExpiry, entry.index)
+}
+
+func (c *verifyCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// Purge removes all entries, or those matching a token hash or client IP.
+func (c *verifyCache) Purge(filter cacheFilter) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for key, entry := range c.entries {
+		if (filter.TokenHash == "" || filter.TokenHash == key) && (filter.IP == "" || filter.IP == entry.ip) {
+			c.remove(entry)
+			removed++
+		}
+	}
+	return removed, true
+}
+
+// purgeSecrets removes entries verified under the given secret IDs.
+func (c *verifyCache) purgeSecrets(ids map[string]bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, entry := range c.entries {
+		if ids[entry.secretID] {
+			c.remove(entry)
+			removed++
+		}
+	}
+	return removed
+}
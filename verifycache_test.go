@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerifyCacheEvictsEntryClosestToExpiry(t *testing.T) {
+	c := &verifyCache{entries: make(map[string]*verifyCacheEntry), limit: 3, bindIP: true}
+	p := &provider{name: "turnstile", secretID: "secret"}
+	now := clockStart
+	resp := &VerificationResult{Success: true, IssuedAt: now}
+	ttls := []time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute}
+	for i, ttl := range ttls {
+		c.put(p, fmt.Sprintf("token-%d", i), "192.0.2.1", resp, ttl, now)
+	}
+
+	c.put(p, "token-3", "192.0.2.1", resp, 4*time.Minute, now)
+
+	if _, ok := c.get(p, "token-1", "192.0.2.1", now); ok {
+		t.Error("token-1, closest to expiry, should have been evicted")
+	}
+	for _, token := range []string{"token-0", "token-2", "token-3"} {
+		if _, ok := c.get(p, token, "192.0.2.1", now); !ok {
+			t.Errorf("%s should still be cached", token)
+		}
+	}
+	if stats := c.Stats(); stats.Entries != 3 || stats.Evictions != 1 {
+		t.Errorf("stats = %+v, want 3 entries and 1 eviction", stats)
+	}
+}
+
+func TestVerifyCacheDropsExpiredEntriesFirst(t *testing.T) {
+	c := &verifyCache{entries: make(map[string]*verifyCacheEntry), limit: 2}
+	p := &provider{name: "turnstile", secretID: "secret"}
+	now := clockStart
+	resp := &VerificationResult{ErrorCodes: []string{ProviderInvalidTokenCode}}
+	c.putRejection(p, "short", "", resp, time.Second, now)
+	c.putRejection(p, "long", "", resp, time.Minute, now)
+	c.putRejection(p, "short", "", resp, 2*time.Second, now) // Replaces the first entry
+
+	later := now.Add(3 * time.Second)
+	c.putRejection(p, "new", "", resp, time.Minute, later)
+
+	if _, ok := c.get(p, "long", "", later); !ok {
+		t.Error("long should still be cached")
+	}
+	if _, ok := c.get(p, "new", "", later); !ok {
+		t.Error("new should be cached")
+	}
+	if removed, _ := c.Purge(cacheFilter{TokenHash: tokenHash("long")}); removed != 1 {
+		t.Errorf("Purge removed %d entries, want 1", removed)
+	}
+	if len(c.byExpiry) != len(c.entries) {
+		t.Errorf("heap holds %d entries, map %d", len(c.byExpiry), len(c.entries))
+	}
+}
+
+func TestVerifyCacheMaxEntries(t *testing.T) {
+	for _, c := range []*verifyCache{verifiedTokens, rejectedTokens} {
+		c.mu.Lock()
+		limit, limitSet := c.limit, c.limitSet
+		c.limitSet = false
+		c.mu.Unlock()
+		t.Cleanup(func() {
+			c.mu.Lock()
+			c.limit, c.limitSet = limit, limitSet
+			c.mu.Unlock()
+		})
+	}
+
+	for _, entries := range []int{-1, maxVerifyCacheEntries + 1} {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = "secret"
+		conf.VerifyCacheMaxEntries = entries
+		if conf.settings().err == nil {
+			t.Errorf("verify_cache_max_entries %d accepted", entries)
+		}
+	}
+
+	for _, step := range []struct{ configured, want int }{{500, 500}, {300, 500}, {800, 800}, {0, 800}} {
+		conf := New().(*Config)
+		conf.TurnstileSecretKey = "secret"
+		conf.VerifyCacheMaxEntries = step.configured
+		if err := conf.settings().err; err != nil {
+			t.Fatalf("verify_cache_max_entries %d: %v", step.configured, err)
+		}
+		for _, c := range []*verifyCache{verifiedTokens, rejectedTokens} {
+			c.mu.Lock()
+			limit := c.limit
+			c.mu.Unlock()
+			if limit != step.want {
+				t.Errorf("after verify_cache_max_entries %d, limit = %d, want %d", step.configured, limit, step.want)
+			}
+		}
+	}
+}
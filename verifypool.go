@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Verification Worker Pool ---
+// Every siteverify call runs on a fixed set of workers fed through a bounded
+// queue, instead of on the goroutine of whichever request needs it. This caps
+// concurrent outbound calls and connections no matter how many requests or
+// batch items arrive at once; when the queue is full, requests are shed with
+// 503 instead of piling up. Verification endpoints are warmed with a HEAD
+// request per idle connection slot when a configuration is compiled, so the
+// first verifications after a deploy do not pay for TCP and TLS setup.
+//
+// Like the admin endpoint, the pool is sized for the whole process:
+//
+//	TURNSTILE_VERIFY_WORKERS  concurrent siteverify calls (default 32)
+//	TURNSTILE_VERIFY_QUEUE    verifications waiting for a worker (default 512)
+//
+// Queue depth and wait times are reported by the admin endpoint under
+// GET /verify-pool.
+const (
+	VerifyWorkersEnv     = "TURNSTILE_VERIFY_WORKERS"
+	VerifyQueueEnv       = "TURNSTILE_VERIFY_QUEUE"
+	defaultVerifyWorkers = 32
+	defaultVerifyQueue   = 512
+	warmConnections      = 4 // Connections opened per verification endpoint
+)
+
+// errVerifyQueueFull is the result of verifications shed by a full queue.
+var errVerifyQueueFull = &verifyError{status: http.StatusServiceUnavailable, body: "Turnstile verification temporarily unavailable",
+	msg: "Verification queue full, shedding request"}
+
+// verifyErrorReason is the decision reason for a failed verification call.
+func verifyErrorReason(err *verifyError) Reason {
+	if err == errVerifyQueueFull {
+		return ReasonOverloaded
+	}
+	return ReasonProviderError
+}
+
+type verifyResult struct {
+	resp *VerificationResult
+	err  *verifyError
+}
+
+type verifyJob struct {
+	settings        *compiledConfig
+	provider        *provider
+	token, remoteIP string
+	enqueued        time.Time
+	result          chan verifyResult
+	span            *verifySpan // nil when the call is not traced, see tracing.go
+}
+
+// verifyPool runs siteverify calls on a fixed set of workers.
+type verifyPool struct {
+	startOnce sync.Once
+	workers   int
+	jobs      chan *verifyJob
+
+	busy      atomic.Int64
+	completed atomic.Int64
+	shed      atomic.Int64
+	waitTotal atomic.Int64 // Nanoseconds spent queued, summed over completed jobs
+	waitMax   atomic.Int64 // Nanoseconds
+
+	warmed sync.Map // map[warmKey]bool
+}
+
+type warmKey struct {
+	client *http.Client
+	url    string
+}
+
+var verifyWorkers = newVerifyPool(envInt(VerifyWorkersEnv, defaultVerifyWorkers), envInt(VerifyQueueEnv, defaultVerifyQueue))
+
+func init() {
+	adminMux.HandleFunc("/verify-pool", handleVerifyPoolStats)
+}
+
+// envInt reads a positive integer from the environment.
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+func newVerifyPool(workers, queue int) *verifyPool {
+	return &verifyPool{workers: workers, jobs: make(chan *verifyJob, queue)}
+}
+
+func (p *verifyPool) work() {
+	for job := range p.jobs {
+		wait := time.Since(job.enqueued).Nanoseconds()
+		p.waitTotal.Add(wait)
+		for {
+			max := p.waitMax.Load()
+			if wait <= max || p.waitMax.CompareAndSwap(max, wait) {
+				break
+			}
+		}
+		p.busy.Add(1)
+		var started time.Time
+		if job.span != nil {
+			started = time.Now()
+		}
+		resp, err := siteVerify(job.settings, job.provider, job.token, job.remoteIP)
+		if job.span != nil {
+			job.span.start, job.span.end = started, time.Now()
+		}
+		p.busy.Add(-1)
+		p.completed.Add(1)
+		job.result <- verifyResult{resp, err}
+	}
+}
+
+// start queues a verification and returns where its result will arrive.
+// A full queue yields an immediate 503 result.
+func (p *verifyPool) start(settings *compiledConfig, pr *provider, token, remoteIP string) <-chan verifyResult {
+	return p.startTraced(settings, pr, token, remoteIP, nil)
+}
+
+// startTraced is start, recording the call in span if it is not nil.
+func (p *verifyPool) startTraced(settings *compiledConfig, pr *provider, token, remoteIP string, span *verifySpan) <-chan verifyResult {
+	p.startOnce.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+	job := &verifyJob{settings: settings, provider: pr, token: token, remoteIP: remoteIP,
+		enqueued: time.Now(), result: make(chan verifyResult, 1), span: span}
+	select {
+	case p.jobs <- job:
+	default:
+		p.shed.Add(1)
+		job.result <- verifyResult{err: errVerifyQueueFull}
+	}
+	return job.result
+}
+
+// verify queues a verification and waits for its result.
+func (p *verifyPool) verify(settings *compiledConfig, pr *provider, token, remoteIP string) (*VerificationResult, *verifyError) {
+	result := <-p.start(settings, pr, token, remoteIP)
+	return result.resp, result.err
+}
+
+// warm opens connections to url through client in the background, once per
+// client and url.
+func (p *verifyPool) warm(client *httpClient, url string) {
+	if url == "" {
+		return
+	}
+	if _, done := p.warmed.LoadOrStore(warmKey{client.client, url}, true); done {
+		return
+	}
+	for i := 0; i < warmConnections; i++ {
+		go func() {
+			req, err := http.NewRequest(http.MethodHead, url, nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.client.Do(req)
+			if err != nil {
+				return // The first real verification reports connection problems
+			}
+			resp.Body.Close()
+		}()
+	}
+}
+
+// verifyPoolStats is a point-in-time view of the pool.
+type verifyPoolStats struct {
+	Workers       int     `json:"workers"`
+	Busy          int64   `json:"busy"`
+	QueueDepth    int     `json:"queue_depth"`
+	QueueCapacity int     `json:"queue_capacity"`
+	Completed     int64   `json:"completed"`
+	Shed          int64   `json:"shed"`
+	WaitAvgMs     float64 `json:"wait_avg_ms"`
+	WaitMaxMs     float64 `json:"wait_max_ms"`
+}
+
+func (p *verifyPool) stats() verifyPoolStats {
+	s := verifyPoolStats{
+		Workers:       p.workers,
+		Busy:          p.busy.Load(),
+		QueueDepth:    len(p.jobs),
+		QueueCapacity: cap(p.jobs),
+		Completed:     p.completed.Load(),
+		Shed:          p.shed.Load(),
+		WaitMaxMs:     float64(p.waitMax.Load()) / float64(time.Millisecond),
+	}
+	if s.Completed > 0 {
+		s.WaitAvgMs = float64(p.waitTotal.Load()) / float64(s.Completed) / float64(time.Millisecond)
+	}
+	return s
+}
+
+func handleVerifyPoolStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, verifyWorkers.stats())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+)
+
+// --- Version and Capabilities ---
+// Fleet tooling needs to know what each data plane's plugin binary can do
+// before rolling out configuration that relies on it. GET /version on the
+// admin endpoint answers with versionInfo: the plugin version, how the binary
+// was built (commit, build time, build tags, from the Go build info) and its
+// capabilities, among them every configuration field it accepts. The same
+// summary is logged once at startup:
+//
+//	turnstile: kong-turnstile-plugin 0.1.0 (commit 1a2b3c4, go1.24.2, tags none) providers=turnstile,recaptcha,hcaptcha config_fields=123
+
+// versionInfo is the document served by GET /version.
+type versionInfo struct {
+	Version      string       `json:"version"`
+	Priority     int          `json:"priority"`
+	Build        buildDetails `json:"build"`
+	Capabilities capabilities `json:"capabilities"`
+}
+
+// buildDetails describes how the binary was built.
+type buildDetails struct {
+	GoVersion string   `json:"go_version"`
+	Module    string   `json:"module"`
+	Commit    string   `json:"commit,omitempty"`   // VCS revision, if built from a checkout
+	Time      string   `json:"time,omitempty"`     // VCS commit time
+	Modified  bool     `json:"modified,omitempty"` // Built with uncommitted changes
+	Tags      []string `json:"tags"`               // Build tags
+	GOOS      string   `json:"goos"`
+	GOARCH    string   `json:"goarch"`
+}
+
+// capabilities lists what the binary supports.
+type capabilities struct {
+	Providers        []string `json:"providers"`         // Provider schemas, see ProviderConfig.Schema
+	TokenLocations   []string `json:"token_locations"`   // Extraction step locations
+	RejectionReasons []Reason `json:"rejection_reasons"` // Reasons response_policies can name
+	ConfigFields     []string `json:"config_fields"`     // Top-level configuration fields, sorted
+	Subcommands      []string `json:"subcommands"`
+}
+
+func init() {
+	adminMux.HandleFunc("/version", handleVersion)
+}
+
+func collectVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:  PluginVersion,
+		Priority: PluginPriority,
+		Build:    buildDetails{GoVersion: runtime.Version(), Tags: []string{}, GOOS: runtime.GOOS, GOARCH: runtime.GOARCH},
+		Capabilities: capabilities{
+			Providers:        providerSchemas,
+			TokenLocations:   tokenLocations,
+			RejectionReasons: rejectionReasons,
+			ConfigFields:     configFields(),
+			Subcommands:      []string{"lint-config", "support-bundle"},
+		},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Build.Module = bi.Main.Path
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Build.Commit = s.Value
+			case "vcs.time":
+				info.Build.Time = s.Value
+			case "vcs.modified":
+				info.Build.Modified = s.Value == "true"
+			case "-tags":
+				info.Build.Tags = strings.Split(s.Value, ",")
+			}
+		}
+	}
+	return info
+}
+
+// configFields returns the JSON names of the top-level Config fields.
+func configFields() []string {
+	t := reflect.TypeOf(Config{})
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// logVersion logs the startup summary of versionInfo.
+func logVersion() {
+	info := collectVersionInfo()
+	commit, tags := "unknown", "none"
+	if info.Build.Commit != "" {
+		commit = info.Build.Commit[:min(len(info.Build.Commit), 7)]
+		if info.Build.Modified {
+			commit += "+dirty"
+		}
+	}
+	if len(info.Build.Tags) > 0 {
+		tags = strings.Join(info.Build.Tags, ",")
+	}
+	log.Printf("turnstile: kong-turnstile-plugin %s (commit %s, %s, tags %s) providers=%s config_fields=%d",
+		info.Version, commit, info.Build.GoVersion, tags, strings.Join(info.Capabilities.Providers, ","), len(info.Capabilities.ConfigFields))
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, collectVersionInfo())
+}
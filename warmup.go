@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// --- Verification Cache Warmup ---
+// After a rolling deploy every client that resends a token finds the
+// verification cache empty, and the new plugin servers ask the provider
+// again, which answers 'timeout-or-duplicate' for tokens already redeemed.
+// With TURNSTILE_WARMUP_ENTRIES set next to TURNSTILE_STATE_DIR, the most
+// recent entries of the verification cache are saved with the other caches
+// (see persist.go), and a starting plugin server loads up to that many that
+// have not expired yet before it serves traffic. For this to help a rolling
+// deploy, the state directory must be shared with, or handed over from, the
+// replaced instance, e.g. a persistent volume. Entries stay bound to their
+// provider, secret and client IP, so nothing is accepted that the previous
+// instance would not have accepted.
+
+const (
+	WarmupEntriesEnv = "TURNSTILE_WARMUP_ENTRIES"
+	warmupFile       = "verified_tokens.warm.json"
+)
+
+// warmEntry is the on-disk form of one verification cache entry.
+type warmEntry struct {
+	TokenHash string              `json:"token_hash"`
+	Provider  string              `json:"provider"`
+	SecretID  string              `json:"secret_id"`
+	IP        string              `json:"ip"`
+	Response  *VerificationResult `json:"response"`
+	Expires   int64               `json:"expires"` // Unix nanoseconds
+}
+
+// warmState is the on-disk form of the warmup entries.
+type warmState struct {
+	Version int         `json:"version"`
+	SavedAt int64       `json:"saved_at"`
+	Entries []warmEntry `json:"entries"`
+}
+
+// warmSnapshot returns up to limit unexpired entries, latest expiry first.
+func (c *verifyCache) warmSnapshot(limit int, now time.Time) []warmEntry {
+	c.mu.Lock()
+	entries := make([]warmEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if now.Before(entry.expires) {
+			entries = append(entries, warmEntry{TokenHash: key, Provider: entry.provider, SecretID: entry.secretID, IP: entry.ip,
+				Response: entry.response, Expires: entry.expires.UnixNano()})
+		}
+	}
+	c.mu.Unlock()
+	slices.SortFunc(entries, func(a, b warmEntry) int { return cmp.Compare(b.Expires, a.Expires) })
+	return entries[:min(len(entries), limit)]
+}
+
+// warm loads up to limit unexpired entries, keeping entries already cached.
+func (c *verifyCache) warm(entries []warmEntry, limit int, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loaded := 0
+	for _, e := range entries {
+		if loaded >= limit || len(c.entries) >= c.limit {
+			break
+		}
+		expires := time.Unix(0, e.Expires)
+		if e.Response == nil || !now.Before(expires) {
+			continue
+		}
+		if _, ok := c.entries[e.TokenHash]; ok {
+			continue
+		}
+		entry := &verifyCacheEntry{provider: e.Provider, secretID: e.SecretID, ip: e.IP, response: e.Response, expires: expires, key: e.TokenHash}
+		c.entries[e.TokenHash] = entry
+		heap.Push(&c.byExpiry, entry)
+		loaded++
+	}
+	return loaded
+}
+
+// warmupLimit is the number of entries kept for warmup, 0 when disabled.
+func warmupLimit() int {
+	return envInt(WarmupEntriesEnv, 0)
+}
+
+func loadWarmup(dir string, now time.Time) {
+	limit := warmupLimit()
+	if limit == 0 {
+		return
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, warmupFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	var state warmState
+	if err == nil {
+		err = json.Unmarshal(raw, &state)
+	}
+	if err == nil && state.Version != stateVersion {
+		err = fmt.Errorf("unsupported version %d", state.Version)
+	}
+	if err != nil {
+		log.Printf("turnstile: ignoring saved warmup entries: %v", err)
+		return
+	}
+	loaded := verifiedTokens.warm(state.Entries, limit, now)
+	log.Printf("turnstile: warmed verification cache with %d of %d saved entries", loaded, len(state.Entries))
+}
+
+func saveWarmup(dir string, now time.Time) error {
+	limit := warmupLimit()
+	if limit == 0 {
+		return nil
+	}
+	return writeState(dir, warmupFile, warmState{Version: stateVersion, SavedAt: now.Unix(), Entries: verifiedTokens.warmSnapshot(limit, now)})
+}
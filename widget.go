@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/Kong/go-pdk"
+)
+
+// --- Widget Injection ---
+// Legacy server-rendered apps can adopt Turnstile without template changes:
+// for widget_inject_paths, the Response phase adds the Turnstile script to
+// <head> and a hidden widget container before </body> of HTML pages. GET and
+// HEAD requests to those paths serve the page carrying the widget, so they
+// pass Access without a token.
+//
+// Note that Kong buffers the upstream response of every route the plugin is
+// attached to once it implements the Response phase. Pages are only rewritten
+// when they are uncompressed HTML no larger than widget_max_body_bytes;
+// anything else is passed through unchanged.
+
+const (
+	turnstileScriptURL = "https://challenges.cloudflare.com/turnstile/v0/api.js"
+	widgetContainerID  = "turnstile-widget"
+)
+
+// hasPathPrefix reports whether path starts with one of prefixes.
+func hasPathPrefix(prefixes []string, path string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWidgetPageRequest reports whether the request fetches a page the widget
+// is injected into.
+func (r *requestState) isWidgetPageRequest() bool {
+	if len(r.settings.widgetPaths) == 0 {
+		return false
+	}
+	method, err := r.kong.Request.GetMethod()
+	if err != nil || (method != http.MethodGet && method != http.MethodHead) {
+		return false
+	}
+	path, err := r.kong.Request.GetPath()
+	return err == nil && hasPathPrefix(r.settings.widgetPaths, path)
+}
+
+// Response phase: injects the widget into HTML pages on widget_inject_paths.
+func (conf *Config) Response(kong *pdk.PDK) {
+	settings := conf.requestSettings(kong)
+	if settings.err != nil || len(settings.widgetPaths) == 0 {
+		return
+	}
+	r := newRequestState(kong, settings)
+	r.selectTenant()
+	if !r.isWidgetPageRequest() {
+		return
+	}
+	r.injectWidget()
+}
+
+// injectWidget rewrites the upstream response, if it is an eligible page.
+func (r *requestState) injectWidget() {
+	settings, kong := r.settings, r.kong
+	status, err := kong.ServiceResponse.GetStatus()
+	if err != nil || status < 200 || status > 299 {
+		return
+	}
+	contentType, _ := kong.ServiceResponse.GetHeader("Content-Type")
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "text/html") {
+		return
+	}
+	if encoding, _ := kong.ServiceResponse.GetHeader("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		r.log.Debug(fmt.Sprintf("Turnstile: not injecting widget into %s-encoded page", encoding))
+		return
+	}
+	page, err := kong.ServiceResponse.GetRawBody()
+	if err != nil {
+		r.log.Warn(fmt.Sprintf("Could not read upstream page for widget injection: %v", err))
+		return
+	}
+	if int64(len(page)) > settings.widgetMaxBodyBytes {
+		r.log.Debug(fmt.Sprintf("Turnstile: page of %d bytes exceeds widget_max_body_bytes (%d), not injecting", len(page), settings.widgetMaxBodyBytes))
+		return
+	}
+	if bytes.Contains(page, []byte(turnstileScriptURL)) {
+		return // The page already embeds Turnstile
+	}
+
+	headers, err := kong.Response.GetHeaders(-1)
+	if err != nil {
+		r.log.Warn(fmt.Sprintf("Could not read response headers for widget injection: %v", err))
+		return
+	}
+	delete(headers, "Content-Length") // Recomputed for the rewritten page
+	delete(headers, "content-length")
+	kong.Response.Exit(status, injectWidgetMarkup(page, settings.widgetSiteKey), headers)
+}
+
+// injectWidgetMarkup adds the script before </head> and the container before
+// </body>, falling back to the start and end of the page.
+func injectWidgetMarkup(page []byte, siteKey string) []byte {
+	script := fmt.Sprintf(`<script src="%s" async defer></script>`, turnstileScriptURL)
+	container := fmt.Sprintf(`<div id="%s" class="cf-turnstile" data-sitekey="%s" data-appearance="interaction-only" hidden></div>`,
+		widgetContainerID, html.EscapeString(siteKey))
+
+	out := make([]byte, 0, len(page)+len(script)+len(container))
+	lower := bytes.ToLower(page) // Tags are matched case-insensitively; offsets carry over for ASCII
+	head := bytes.Index(lower, []byte("</head>"))
+	body := bytes.LastIndex(lower, []byte("</body>"))
+	if len(lower) != len(page) || head < 0 {
+		head = 0
+	}
+	if len(lower) != len(page) || body < head {
+		body = len(page)
+	}
+	out = append(out, page[:head]...)
+	out = append(out, script...)
+	out = append(out, page[head:body]...)
+	out = append(out, container...)
+	out = append(out, page[body:]...)
+	return out
+}